@@ -0,0 +1,116 @@
+package accounts
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/internal/apitoken"
+)
+
+type Controller struct {
+	Route        string
+	Method       string
+	Active       bool
+	Handler      func(c echo.Context) error
+	RequiredAuth bool
+	Scope        string
+	Permission   string
+}
+
+func GetAccountsController() []*Controller {
+	return []*Controller{
+		{
+			Route:        "/api/accounts",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      listView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/accounts",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      createView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/accounts/discover",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      discoverView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/accounts/:id",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      getView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/accounts/:id",
+			Method:       http.MethodPut,
+			Active:       true,
+			Handler:      updateView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/accounts/:id",
+			Method:       http.MethodDelete,
+			Active:       true,
+			Handler:      deleteView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/accounts/:id/test",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      testView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/accounts/:id/verification",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      verificationView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/accounts/:id/select",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      selectView,
+			RequiredAuth: true,
+		},
+		{
+			Route:        "/api/accounts/:id/oauth",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      authorizeView,
+			RequiredAuth: true,
+		},
+		{
+			Route:        "/api/accounts/:id/oauth",
+			Method:       http.MethodDelete,
+			Active:       true,
+			Handler:      revokeView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/oauth/callback",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      callbackView,
+			RequiredAuth: true,
+		},
+	}
+}
@@ -0,0 +1,43 @@
+package accounts
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/internal/autodiscover"
+)
+
+// DiscoverRequest represents the request structure for finding the servers of an address
+type DiscoverRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// discoverer finds the servers of the addresses of new accounts
+var discoverer = autodiscover.New()
+
+// discoverView handles the request to find the IMAP and SMTP settings of an
+// email address, before adding it as a mail account
+func discoverView(c echo.Context) error {
+	req := new(DiscoverRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid request: %v", err),
+		})
+	}
+
+	if err := c.Validate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: %v", err),
+		})
+	}
+
+	report, err := discoverer.Discover(c.Request().Context(), req.Email)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
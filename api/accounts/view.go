@@ -0,0 +1,408 @@
+package accounts
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/account"
+	"github.com/lyneq/mailapi/internal/oauth"
+	"github.com/lyneq/mailapi/internal/session"
+	"github.com/lyneq/mailapi/internal/verification"
+)
+
+// AccountRequest represents the request structure for adding or updating a
+// mail account. Usernames default to the email address and the SMTP password
+// to the IMAP one. Passwords left empty on update keep the stored ones, and
+// are not used by accounts authenticating with OAuth.
+type AccountRequest struct {
+	Name         string `json:"name" validate:"max=255"`
+	Email        string `json:"email" validate:"required,email"`
+	IMAPHost     string `json:"imap_host" validate:"required,hostname_rfc1123"`
+	IMAPPort     int    `json:"imap_port" validate:"required,min=1,max=65535"`
+	IMAPTLSMode  string `json:"imap_tls_mode" validate:"omitempty,oneof=implicit starttls none"`
+	IMAPUsername string `json:"imap_username"`
+	IMAPPassword string `json:"imap_password"`
+	SMTPHost     string `json:"smtp_host" validate:"required,hostname_rfc1123"`
+	SMTPPort     int    `json:"smtp_port" validate:"required,min=1,max=65535"`
+	SMTPTLSMode  string `json:"smtp_tls_mode" validate:"omitempty,oneof=implicit starttls none"`
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword string `json:"smtp_password"`
+	// SaveSent copies sent messages to the Sent folder, true when omitted
+	SaveSent  *bool `json:"save_sent"`
+	IsDefault bool  `json:"is_default"`
+	// AuthMethod is "password", the default, or "oauth2" with the name of an
+	// [OAuth <provider>] section of the configuration
+	AuthMethod    string `json:"auth_method" validate:"omitempty,oneof=password oauth2"`
+	OAuthProvider string `json:"oauth_provider" validate:"required_if=AuthMethod oauth2"`
+}
+
+// ProbeResult reports whether the server of an account accepted the credentials
+type ProbeResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// listView handles the request to list the user's mail accounts, the default one first
+func listView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	accounts, err := account.List(userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"accounts": accounts,
+		"selected": session.GetAccountID(c.Request().Context()),
+	})
+}
+
+// createView handles the request to add a mail account
+func createView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	return save(c, &db.MailAccount{UserID: userID}, http.StatusCreated)
+}
+
+// getView handles the request to get a mail account
+func getView(c echo.Context) error {
+	return withAccount(c, func(found *db.MailAccount) error {
+		return c.JSON(http.StatusOK, found)
+	})
+}
+
+// updateView handles the request to replace the settings of a mail account
+func updateView(c echo.Context) error {
+	return withAccount(c, func(found *db.MailAccount) error {
+		return save(c, found, http.StatusOK)
+	})
+}
+
+// deleteView handles the request to remove a mail account
+func deleteView(c echo.Context) error {
+	return withAccount(c, func(found *db.MailAccount) error {
+		if err := account.Delete(found); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": fmt.Sprintf("Failed to delete mail account: %v", err),
+			})
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "Mail account deleted",
+		})
+	})
+}
+
+// testView handles the request to check that the IMAP and SMTP servers of a
+// mail account accept its credentials
+func testView(c echo.Context) error {
+	return withAccount(c, func(found *db.MailAccount) error {
+		results := map[string]ProbeResult{}
+
+		imapClient, err := account.IMAPClient(found)
+		if err != nil {
+			return accountErrorResponse(c, "Failed to read credentials", err)
+		}
+		if err := imapClient.Connect(); err != nil {
+			results["imap"] = ProbeResult{Error: err.Error()}
+		} else {
+			imapClient.Disconnect()
+			results["imap"] = ProbeResult{OK: true}
+		}
+
+		smtpClient, err := account.SMTPClient(found)
+		if err != nil {
+			return accountErrorResponse(c, "Failed to read credentials", err)
+		}
+		if err := smtpClient.Connect(); err != nil {
+			results["smtp"] = ProbeResult{Error: err.Error()}
+		} else {
+			smtpClient.Close()
+			results["smtp"] = ProbeResult{OK: true}
+		}
+
+		status := http.StatusOK
+		if !results["imap"].OK || !results["smtp"].OK {
+			status = http.StatusBadGateway
+		}
+		return c.JSON(status, results)
+	})
+}
+
+// verificationView handles the request to mail a link confirming the address
+// of a mail account to it
+func verificationView(c echo.Context) error {
+	return withAccount(c, func(found *db.MailAccount) error {
+		err := account.RequestVerification(found)
+		switch {
+		case errors.Is(err, account.ErrVerified):
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": err.Error(),
+			})
+		case errors.Is(err, verification.ErrTooSoon):
+			return c.JSON(http.StatusTooManyRequests, map[string]string{
+				"error": "An email was sent less than a minute ago, please wait before asking again",
+			})
+		case err != nil:
+			return c.JSON(http.StatusBadGateway, map[string]string{
+				"error": fmt.Sprintf("Failed to send the verification email: %v", err),
+			})
+		}
+
+		return c.JSON(http.StatusAccepted, map[string]string{
+			"email":   found.Email,
+			"message": "A verification link has been sent to the address",
+		})
+	})
+}
+
+// selectView handles the request to use a mail account for the rest of the session
+func selectView(c echo.Context) error {
+	return withAccount(c, func(found *db.MailAccount) error {
+		session.SetAccountID(c.Request().Context(), found.ID)
+		return c.JSON(http.StatusOK, found)
+	})
+}
+
+// authorizeView handles the request to grant the application access to a
+// mail account authenticating with OAuth. The user is sent to the returned
+// URL, from which the provider redirects to /api/oauth/callback.
+func authorizeView(c echo.Context) error {
+	return withAccount(c, func(found *db.MailAccount) error {
+		if !account.UsesOAuth(found) {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": "The mail account does not authenticate with OAuth",
+			})
+		}
+
+		provider, err := oauth.Get(found.OAuthProvider)
+		if err != nil {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{
+				"error": fmt.Sprintf("OAuth provider %q is not configured", found.OAuthProvider),
+			})
+		}
+
+		state, verifier := oauth.NewVerifier(), oauth.NewVerifier()
+		session.SetOAuthFlow(c.Request().Context(), found.ID, state, verifier)
+
+		return c.JSON(http.StatusOK, map[string]string{
+			"url": provider.AuthCodeURL(state, verifier, found.IMAPUsername),
+		})
+	})
+}
+
+// callbackView handles the redirection of the OAuth provider once the user
+// granted or denied access, and stores the tokens of the mail account
+func callbackView(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID, err := session.GetUserID(ctx)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	accountID, state, verifier := session.PopOAuthFlow(ctx)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.QueryParam("state"))) != 1 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid or expired OAuth state, start again with POST /api/accounts/:id/oauth",
+		})
+	}
+	if reason := c.QueryParam("error"); reason != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Access was not granted: %s", reason),
+		})
+	}
+
+	found, err := account.Get(userID, accountID)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Mail account not found",
+		})
+	}
+	provider, err := oauth.Get(found.OAuthProvider)
+	if err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": fmt.Sprintf("OAuth provider %q is not configured", found.OAuthProvider),
+		})
+	}
+
+	token, err := provider.Exchange(c.QueryParam("code"), verifier)
+	if err != nil {
+		return c.JSON(http.StatusBadGateway, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	if token.RefreshToken == "" {
+		return c.JSON(http.StatusBadGateway, map[string]string{
+			"error": "The OAuth provider issued no refresh token, check the offline access scope",
+		})
+	}
+	if err := account.SaveTokens(found, token); err != nil {
+		return accountErrorResponse(c, "Failed to save tokens", err)
+	}
+
+	return c.JSON(http.StatusOK, found)
+}
+
+// revokeView handles the request to forget the OAuth tokens of a mail account
+func revokeView(c echo.Context) error {
+	return withAccount(c, func(found *db.MailAccount) error {
+		if err := account.ClearTokens(found); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": fmt.Sprintf("Failed to forget tokens: %v", err),
+			})
+		}
+		return c.JSON(http.StatusOK, found)
+	})
+}
+
+// save fills a mail account from the request and stores it
+func save(c echo.Context, target *db.MailAccount, status int) error {
+	req := new(AccountRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid request: %v", err),
+		})
+	}
+
+	if err := c.Validate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: %v", err),
+		})
+	}
+
+	if req.IMAPUsername == "" {
+		req.IMAPUsername = req.Email
+	}
+	if req.SMTPUsername == "" {
+		req.SMTPUsername = req.IMAPUsername
+	}
+	useOAuth := req.AuthMethod == account.AuthOAuth2
+	if useOAuth {
+		if _, err := oauth.Get(req.OAuthProvider); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("Validation error: oauth_provider %q is not configured", req.OAuthProvider),
+			})
+		}
+	} else {
+		req.AuthMethod = account.AuthPassword
+		req.OAuthProvider = ""
+		if req.SMTPPassword == "" && target.SMTPPassword == "" {
+			req.SMTPPassword = req.IMAPPassword
+		}
+		// Stored passwords are never sent to another server than the one they were given for
+		if req.IMAPPassword == "" && (target.IMAPPassword == "" || !strings.EqualFold(req.IMAPHost, target.IMAPHost)) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Validation error: imap_password is required",
+			})
+		}
+		if req.SMTPPassword == "" && target.ID != 0 && !strings.EqualFold(req.SMTPHost, target.SMTPHost) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Validation error: smtp_password is required when smtp_host changes",
+			})
+		}
+	}
+
+	// Neither are tokens, which must be granted again
+	if !useOAuth || !strings.EqualFold(req.OAuthProvider, target.OAuthProvider) ||
+		!strings.EqualFold(req.IMAPHost, target.IMAPHost) || !strings.EqualFold(req.SMTPHost, target.SMTPHost) {
+		target.OAuthAccessToken = ""
+		target.OAuthRefreshToken = ""
+		target.OAuthExpiry = nil
+		target.OAuthAuthorizedAt = nil
+	}
+
+	// A new address is mailed a verification link
+	changed := target.ID == 0 || !strings.EqualFold(strings.TrimSpace(req.Email), target.Email)
+	target.Name = req.Name
+	target.Email = req.Email
+	target.IMAPHost = req.IMAPHost
+	target.IMAPPort = req.IMAPPort
+	target.IMAPTLSMode = req.IMAPTLSMode
+	target.IMAPUsername = req.IMAPUsername
+	target.SMTPHost = req.SMTPHost
+	target.SMTPPort = req.SMTPPort
+	target.SMTPTLSMode = req.SMTPTLSMode
+	target.SMTPUsername = req.SMTPUsername
+	target.SaveSent = req.SaveSent == nil || *req.SaveSent
+	target.IsDefault = req.IsDefault
+	target.AuthMethod = req.AuthMethod
+	target.OAuthProvider = req.OAuthProvider
+
+	err := account.Save(target, account.Credentials{IMAPPassword: req.IMAPPassword, SMTPPassword: req.SMTPPassword})
+	if err != nil {
+		return accountErrorResponse(c, "Failed to save mail account", err)
+	}
+
+	// Identities and sender checks only rely on the address once it is
+	// confirmed; the link can be requested again when the email is lost
+	if changed && !target.EmailVerified {
+		if err := account.RequestVerification(target); err != nil && !errors.Is(err, verification.ErrTooSoon) {
+			_ = fmt.Errorf("mail account verification email error: %v", err)
+		}
+	}
+
+	return c.JSON(status, target)
+}
+
+// withAccount runs fn with the mail account of the request owned by the current user
+func withAccount(c echo.Context, fn func(found *db.MailAccount) error) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid mail account ID",
+		})
+	}
+
+	found, err := account.Get(userID, uint(id))
+	if errors.Is(err, account.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Mail account not found",
+		})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to get mail account: %v", err),
+		})
+	}
+
+	return fn(found)
+}
+
+// accountErrorResponse reports a failure to store or use account credentials
+func accountErrorResponse(c echo.Context, message string, err error) error {
+	if errors.Is(err, account.ErrNoKey) {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": "Mail accounts are not available: no encryption key is configured",
+		})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error": fmt.Sprintf("%s: %v", message, err),
+	})
+}
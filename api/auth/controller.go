@@ -2,6 +2,7 @@ package auth
 
 import (
 	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/internal/apitoken"
 	"net/http"
 )
 
@@ -11,6 +12,8 @@ type Controller struct {
 	Active       bool
 	Handler      func(c echo.Context) error
 	RequiredAuth bool
+	Scope        string
+	Permission   string
 }
 
 func GetAuthController() []*Controller {
@@ -28,12 +31,105 @@ func GetAuthController() []*Controller {
 			Active:       true,
 			Handler:      signInView,
 			RequiredAuth: false,
+		}, {
+			Route:        "/api/signin/2fa",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      twoFactorSignInView,
+			RequiredAuth: false,
+		}, {
+			Route:        "/api/verify-email",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      verifyEmailView,
+			RequiredAuth: false,
+		}, {
+			Route:        "/api/verify-identity",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      verifyIdentityView,
+			RequiredAuth: false,
+		}, {
+			Route:        "/api/password/forgot",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      forgotPasswordView,
+			RequiredAuth: false,
+		}, {
+			Route:        "/api/password/reset",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      resetPasswordView,
+			RequiredAuth: false,
 		}, {
 			Route:        "/api/me",
 			Method:       http.MethodGet,
 			Active:       true,
 			Handler:      me,
 			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		}, {
+			Route:        "/api/me/settings",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      settingsView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		}, {
+			Route:        "/api/me/settings",
+			Method:       http.MethodPut,
+			Active:       true,
+			Handler:      updateSettingsView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		}, {
+			Route:        "/api/me/email",
+			Method:       http.MethodPut,
+			Active:       true,
+			Handler:      changeEmailView,
+			RequiredAuth: true,
+		}, {
+			Route:        "/api/me/email/verify",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      resendVerificationView,
+			RequiredAuth: true,
+		}, {
+			Route:        "/api/me/2fa",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      twoFactorStatusView,
+			RequiredAuth: true,
+		}, {
+			Route:        "/api/me/2fa/setup",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      twoFactorSetupView,
+			RequiredAuth: true,
+		}, {
+			Route:        "/api/me/2fa/enable",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      twoFactorEnableView,
+			RequiredAuth: true,
+		}, {
+			Route:        "/api/me/2fa/disable",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      twoFactorDisableView,
+			RequiredAuth: true,
+		}, {
+			Route:        "/api/me/2fa/reset",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      twoFactorResetView,
+			RequiredAuth: true,
+		}, {
+			Route:        "/api/me/2fa/recovery-codes",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      recoveryCodesView,
+			RequiredAuth: true,
 		}, {
 			Route:        "/api/signout",
 			Method:       http.MethodGet,
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/internal/lockout"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared with the passwords given for unknown usernames, so
+// that they take as long to refuse as wrong passwords
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not the password of any user"), bcrypt.DefaultCost)
+	if err != nil {
+		_ = fmt.Errorf("bcrypt error: %v", err)
+	}
+	return hash
+})
+
+// lockAttempts serialises the sign-ins of username and of the IP address of
+// the request until the returned function is called, once the outcome of the
+// attempt is recorded
+func lockAttempts(c echo.Context, username string) func() {
+	return lockout.Lock(username, c.RealIP())
+}
+
+// checkAttempts answers 429 Too Many Requests when the username or the IP
+// address of the request must wait before signing in again. It returns
+// false when the sign-in may proceed.
+func checkAttempts(c echo.Context, username string) (bool, error) {
+	wait, err := lockout.Check(username, c.RealIP())
+	if err != nil {
+		_ = fmt.Errorf("lockout error: %v", err)
+		return true, c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "An unexpected error occurred, please try again later.",
+		})
+	}
+	if wait <= 0 {
+		return false, nil
+	}
+
+	seconds := int((wait + time.Second - 1) / time.Second)
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return true, c.JSON(http.StatusTooManyRequests, map[string]interface{}{
+		"message":     fmt.Sprintf("Too many failed sign-in attempts, please try again in %d seconds.", seconds),
+		"retry_after": seconds,
+	})
+}
+
+// failAttempt counts a failed sign-in of username from the IP address of the request
+func failAttempt(c echo.Context, username string) {
+	if err := lockout.Fail(username, c.RealIP()); err != nil {
+		_ = fmt.Errorf("lockout error: %v", err)
+	}
+}
+
+// resetAttempts forgets the failed sign-ins of username once they signed in
+func resetAttempts(username string) {
+	if err := lockout.Reset(username); err != nil {
+		_ = fmt.Errorf("lockout error: %v", err)
+	}
+}
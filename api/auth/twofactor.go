@@ -0,0 +1,322 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/session"
+	"github.com/lyneq/mailapi/internal/twofactor"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type TwoFactorSignInRequest struct {
+	Code         string `json:"code" validate:"required_without=RecoveryCode,max=16"`
+	RecoveryCode string `json:"recovery_code" validate:"max=32"`
+	CallbackURL  string `json:"callbackURL"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" validate:"required,max=16"`
+}
+
+// PasswordConfirmRequest re-confirms the password before changing two-factor authentication
+type PasswordConfirmRequest struct {
+	Password string `json:"password" validate:"required,max=64"`
+}
+
+// twoFactorSignInView completes the sign-in of a pending session with a TOTP or recovery code.
+func twoFactorSignInView(c echo.Context) error {
+	var req TwoFactorSignInRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "An error occurred while processing your request.",
+		})
+	}
+
+	queryCallbackURL := c.QueryParam("callbackURL")
+	if queryCallbackURL != "" {
+		req.CallbackURL = queryCallbackURL
+	}
+
+	if err := c.Validate(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "Enter a code or a recovery code.",
+		})
+	}
+
+	ctx := c.Request().Context()
+	userID, ok := session.GetPendingUser(ctx)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"message": "Your sign-in expired, please enter your password again.",
+		})
+	}
+
+	var user db.User
+	if err := db.DB.First(&user, userID).Error; err != nil || user.Disabled {
+		session.ClearPendingUser(ctx)
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"message": "Your sign-in expired, please enter your password again.",
+		})
+	}
+
+	var err error
+	if req.RecoveryCode != "" {
+		err = twofactor.Recover(&user, req.RecoveryCode)
+	} else {
+		err = twofactor.Verify(&user, req.Code)
+	}
+	if err != nil {
+		if !errors.Is(err, twofactor.ErrInvalidCode) && !errors.Is(err, twofactor.ErrNotEnabled) {
+			_ = fmt.Errorf("two-factor verification error: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "An unexpected error occurred, please try again later.",
+			})
+		}
+		failAttempt(c, user.Username)
+		left := session.FailPendingAttempt(ctx)
+		if left == 0 {
+			return c.JSON(http.StatusUnauthorized, map[string]string{
+				"message": "Too many invalid codes, please enter your password again.",
+			})
+		}
+		return c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"message":       "Invalid code.",
+			"attempts_left": left,
+		})
+	}
+
+	session.ClearPendingUser(ctx)
+	if err := session.Manager.RenewToken(ctx); err != nil {
+		_ = fmt.Errorf("session error: %v", err)
+	}
+	resetAttempts(user.Username)
+	session.SetSessionCookie(c, user.ID)
+
+	if req.CallbackURL != "" {
+		if isAllowedDomain(req.CallbackURL) {
+			return c.Redirect(http.StatusSeeOther, req.CallbackURL)
+		}
+		_ = fmt.Errorf("redirection to unauthorized domain attempted: %s", req.CallbackURL)
+	}
+
+	response := map[string]interface{}{
+		"id":       user.ID,
+		"username": user.Username,
+		"role":     user.Role,
+		"message":  "Login successful. Session cookie has been set.",
+	}
+	if req.RecoveryCode != "" {
+		remaining, _ := twofactor.RemainingRecoveryCodes(user.ID)
+		response["recovery_codes_remaining"] = remaining
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// twoFactorStatusView tells whether two-factor authentication is enabled for the current user.
+func twoFactorStatusView(c echo.Context) error {
+	user, err := session.GetCurrentUser(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"message": "Not authenticated. Please sign in first.",
+		})
+	}
+
+	remaining, err := twofactor.RemainingRecoveryCodes(user.ID)
+	if err != nil {
+		_ = fmt.Errorf("database error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "An unexpected error occurred, please try again later.",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"enabled":                  user.TOTPEnabled,
+		"setup_pending":            user.TOTPPendingSecret != "",
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// twoFactorSetupView generates the secret of an authenticator app for a user without two-factor authentication.
+func twoFactorSetupView(c echo.Context) error {
+	user, err := session.GetCurrentUser(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"message": "Not authenticated. Please sign in first.",
+		})
+	}
+
+	if user.TOTPEnabled {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"message": "Two-factor authentication is already enabled, reset it to change your authenticator app.",
+		})
+	}
+
+	return setupResponse(c, user)
+}
+
+// twoFactorEnableView confirms the authenticator app being set up with one of its codes.
+func twoFactorEnableView(c echo.Context) error {
+	user, err := session.GetCurrentUser(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"message": "Not authenticated. Please sign in first.",
+		})
+	}
+
+	var req TwoFactorCodeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "An error occurred while processing your request.",
+		})
+	}
+	if err := c.Validate(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "Enter the code of your authenticator app.",
+		})
+	}
+
+	codes, err := twofactor.Enable(user, req.Code)
+	switch {
+	case errors.Is(err, twofactor.ErrNoPendingSetup):
+		return c.JSON(http.StatusConflict, map[string]string{
+			"message": "Set up an authenticator app first.",
+		})
+	case errors.Is(err, twofactor.ErrInvalidCode):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "Invalid code.",
+		})
+	case err != nil:
+		_ = fmt.Errorf("two-factor error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "An unexpected error occurred, please try again later.",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":        "Two-factor authentication enabled. Keep the recovery codes somewhere safe, they are shown once.",
+		"recovery_codes": codes,
+	})
+}
+
+// twoFactorDisableView turns two-factor authentication off after re-confirming the password.
+func twoFactorDisableView(c echo.Context) error {
+	user, ok, err := confirmPassword(c)
+	if !ok {
+		return err
+	}
+
+	if !user.TOTPEnabled && user.TOTPPendingSecret == "" {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"message": "Two-factor authentication is not enabled.",
+		})
+	}
+
+	if err := twofactor.Disable(user); err != nil {
+		_ = fmt.Errorf("database error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "An unexpected error occurred, please try again later.",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Two-factor authentication disabled.",
+	})
+}
+
+// twoFactorResetView starts replacing the authenticator app after re-confirming the password.
+// The current app keeps working until a code of the new one is confirmed.
+func twoFactorResetView(c echo.Context) error {
+	user, ok, err := confirmPassword(c)
+	if !ok {
+		return err
+	}
+
+	if !user.TOTPEnabled {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"message": "Two-factor authentication is not enabled.",
+		})
+	}
+
+	return setupResponse(c, user)
+}
+
+// recoveryCodesView replaces the recovery codes after re-confirming the password.
+func recoveryCodesView(c echo.Context) error {
+	user, ok, err := confirmPassword(c)
+	if !ok {
+		return err
+	}
+
+	codes, err := twofactor.RegenerateRecoveryCodes(user)
+	if errors.Is(err, twofactor.ErrNotEnabled) {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"message": "Two-factor authentication is not enabled.",
+		})
+	} else if err != nil {
+		_ = fmt.Errorf("two-factor error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "An unexpected error occurred, please try again later.",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":        "New recovery codes generated, the previous ones no longer work.",
+		"recovery_codes": codes,
+	})
+}
+
+// setupResponse generates the secret of a new authenticator app and returns its provisioning URI
+func setupResponse(c echo.Context, user *db.User) error {
+	secret, uri, err := twofactor.Setup(user)
+	if err != nil {
+		_ = fmt.Errorf("two-factor error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "An unexpected error occurred, please try again later.",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"secret":  secret,
+		"uri":     uri,
+		"message": "Scan the QR code of the URI with your authenticator app, then confirm one of its codes.",
+	})
+}
+
+// confirmPassword reads the current user and checks the password of the request. When it
+// returns false, the error response has been written.
+func confirmPassword(c echo.Context) (*db.User, bool, error) {
+	user, err := session.GetCurrentUser(c.Request().Context())
+	if err != nil {
+		return nil, false, c.JSON(http.StatusUnauthorized, map[string]string{
+			"message": "Not authenticated. Please sign in first.",
+		})
+	}
+
+	var req PasswordConfirmRequest
+	if err := c.Bind(&req); err != nil {
+		return nil, false, c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "An error occurred while processing your request.",
+		})
+	}
+	if err := c.Validate(&req); err != nil {
+		return nil, false, c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "Enter your password to confirm.",
+		})
+	}
+
+	if !passwordMatches(user, req.Password) {
+		return nil, false, c.JSON(http.StatusUnauthorized, map[string]string{
+			"message": "Invalid password.",
+		})
+	}
+	return user, true, nil
+}
+
+// passwordMatches checks a password against the hash of the user
+func passwordMatches(user *db.User, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil
+}
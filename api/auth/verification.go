@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/identity"
+	"github.com/lyneq/mailapi/internal/session"
+	"github.com/lyneq/mailapi/internal/verification"
+)
+
+type TokenRequest struct {
+	Token string `json:"token" validate:"required,max=128"`
+}
+
+type EmailChangeRequest struct {
+	Email    string `json:"email" validate:"required,email,max=254"`
+	Password string `json:"password" validate:"required,max=64"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email,max=254"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required,max=128"`
+	Password string `json:"password" validate:"required,min=3,max=64"`
+}
+
+// verifyEmailView verifies the email address a token was sent to.
+func verifyEmailView(c echo.Context) error {
+	var req TokenRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "An error occurred while processing your request.",
+		})
+	}
+	if err := c.Validate(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "Could not validate your information.",
+		})
+	}
+
+	user, err := verification.VerifyEmail(req.Token)
+	if errors.Is(err, verification.ErrInvalidToken) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "This link is invalid or expired, please request a new one.",
+		})
+	} else if err != nil {
+		_ = fmt.Errorf("verification error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "An unexpected error occurred, please try again later.",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"email":   user.Email,
+		"message": "Your email address is verified.",
+	})
+}
+
+// verifyIdentityView confirms the sender identity or mail account whose address a token was sent to.
+func verifyIdentityView(c echo.Context) error {
+	var req TokenRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "An error occurred while processing your request.",
+		})
+	}
+	if err := c.Validate(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "Could not validate your information.",
+		})
+	}
+
+	address, err := identity.Verify(req.Token)
+	if errors.Is(err, verification.ErrInvalidToken) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "This link is invalid or expired, please request a new one.",
+		})
+	} else if errors.Is(err, identity.ErrAddressTaken) {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"message": "This address belongs to another user.",
+		})
+	} else if err != nil {
+		_ = fmt.Errorf("identity verification error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "An unexpected error occurred, please try again later.",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"address": address,
+		"message": "The sender address is confirmed.",
+	})
+}
+
+// resendVerificationView mails a new verification token to the current user.
+func resendVerificationView(c echo.Context) error {
+	user, err := session.GetCurrentUser(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"message": "Not authenticated. Please sign in first.",
+		})
+	}
+
+	if user.IsVerified {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"message": "Your email address is already verified.",
+		})
+	}
+
+	return sendVerification(c, user)
+}
+
+// changeEmailView sets the email address of the current user after re-confirming the password,
+// and mails it a verification token.
+func changeEmailView(c echo.Context) error {
+	user, err := session.GetCurrentUser(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"message": "Not authenticated. Please sign in first.",
+		})
+	}
+
+	var req EmailChangeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "An error occurred while processing your request.",
+		})
+	}
+	req.Email = verification.NormalizeEmail(req.Email)
+	if err := c.Validate(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "Could not validate your information.",
+		})
+	}
+
+	if !passwordMatches(user, req.Password) {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"message": "Invalid password.",
+		})
+	}
+
+	email := req.Email
+	if email == user.Email {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"message": "This is already your email address.",
+		})
+	}
+	taken, err := verification.EmailTaken(email, user.ID)
+	if err != nil {
+		_ = fmt.Errorf("database error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "An unexpected error occurred, please try again later.",
+		})
+	}
+	if taken {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "Email address unavailable. Please try another one.",
+		})
+	}
+
+	err = db.DB.Model(user).Updates(map[string]interface{}{"email": email, "is_verified": false}).Error
+	if err != nil {
+		_ = fmt.Errorf("database error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "An unexpected error occurred, please try again later.",
+		})
+	}
+	user.Email, user.IsVerified = email, false
+
+	return sendVerification(c, user)
+}
+
+// forgotPasswordView mails a password reset token to a verified email address. The answer is
+// the same whether or not the address belongs to a user.
+func forgotPasswordView(c echo.Context) error {
+	var req ForgotPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "An error occurred while processing your request.",
+		})
+	}
+	req.Email = verification.NormalizeEmail(req.Email)
+	if err := c.Validate(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "Could not validate your information.",
+		})
+	}
+
+	if err := verification.RequestPasswordReset(req.Email); err != nil {
+		_ = fmt.Errorf("password reset error: %v", err)
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"message": "If this address belongs to a verified account, a link to reset the password has been sent.",
+	})
+}
+
+// resetPasswordView sets a new password with a reset token.
+func resetPasswordView(c echo.Context) error {
+	var req ResetPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "An error occurred while processing your request.",
+		})
+	}
+	if err := c.Validate(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "Could not validate your information.",
+		})
+	}
+
+	if _, err := verification.ResetPassword(req.Token, req.Password); errors.Is(err, verification.ErrInvalidToken) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "This link is invalid or expired, please request a new one.",
+		})
+	} else if err != nil {
+		_ = fmt.Errorf("password reset error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "An unexpected error occurred, please try again later.",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Your password has been changed, you can sign in with it.",
+	})
+}
+
+// sendVerification mails a verification token to the user and writes the response
+func sendVerification(c echo.Context, user *db.User) error {
+	err := verification.SendVerification(user)
+	switch {
+	case errors.Is(err, verification.ErrNoEmail):
+		return c.JSON(http.StatusConflict, map[string]string{
+			"message": "Set an email address first.",
+		})
+	case errors.Is(err, verification.ErrTooSoon):
+		return c.JSON(http.StatusTooManyRequests, map[string]string{
+			"message": "An email was sent less than a minute ago, please wait before asking again.",
+		})
+	case err != nil:
+		_ = fmt.Errorf("verification email error: %v", err)
+		return c.JSON(http.StatusBadGateway, map[string]string{
+			"message": "The verification email could not be sent, please try again later.",
+		})
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"email":   user.Email,
+		"message": "A verification link has been sent to your email address.",
+	})
+}
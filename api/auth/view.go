@@ -11,7 +11,9 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/lyneq/mailapi/config"
 	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/rbac"
 	"github.com/lyneq/mailapi/internal/session"
+	"github.com/lyneq/mailapi/internal/verification"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 	_ "gorm.io/gorm"
@@ -43,6 +45,7 @@ func isAllowedDomain(urlStr string) bool {
 type SignUpRequest struct {
 	Username    string `json:"username" validate:"required,min=3,max=64"`
 	Password    string `json:"password" validate:"required,min=3,max=64"`
+	Email       string `json:"email" validate:"omitempty,email,max=254"`
 	CallbackURL string `json:"callbackURL"`
 }
 
@@ -66,6 +69,7 @@ func signUpView(c echo.Context) error {
 	}
 
 	// Validate request data
+	req.Email = verification.NormalizeEmail(req.Email)
 	if err := c.Validate(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{
 			"message": "Could not validate your information.",
@@ -87,6 +91,22 @@ func signUpView(c echo.Context) error {
 		})
 	}
 
+	// Check if the email address already belongs to a user
+	if req.Email != "" {
+		taken, err := verification.EmailTaken(req.Email, 0)
+		if err != nil {
+			_ = fmt.Errorf("database error: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "An unexpected error occurred, please try again later.",
+			})
+		}
+		if taken {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "Email address unavailable. Please try another one.",
+			})
+		}
+	}
+
 	// Hash the password before store it in the database
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -100,6 +120,7 @@ func signUpView(c echo.Context) error {
 	user := &db.User{
 		Username: req.Username,
 		Password: string(hashedPassword),
+		Email:    req.Email,
 	}
 	if result := db.DB.Create(user); result.Error != nil {
 		_ = fmt.Errorf("database error: %v", result.Error)
@@ -108,6 +129,13 @@ func signUpView(c echo.Context) error {
 		})
 	}
 
+	// The account works without the email, which can be sent again from /api/me/email/verify
+	if user.Email != "" {
+		if err := verification.SendVerification(user); err != nil {
+			_ = fmt.Errorf("verification email error: %v", err)
+		}
+	}
+
 	// Check if there's a callback URL and if it's allowed
 	if req.CallbackURL != "" {
 		if isAllowedDomain(req.CallbackURL) {
@@ -149,11 +177,21 @@ func signInView(c echo.Context) error {
 		})
 	}
 
+	// Usernames and IP addresses guessing passwords must wait between
+	// attempts, which are not checked before the previous one is counted
+	defer lockAttempts(c, req.Username)()
+	if refused, err := checkAttempts(c, req.Username); refused {
+		return err
+	}
+
 	var user db.User
 	result := db.DB.Where("username = ?", req.Username).First(&user)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			_ = fmt.Errorf("user not found: %v", req.Username)
+			// Take as long as a wrong password, so that the answer does not tell that the username is unknown
+			_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(req.Password))
+			failAttempt(c, req.Username)
 			return c.JSON(http.StatusUnauthorized, map[string]string{
 				"message": "Invalid username or password.",
 			})
@@ -167,11 +205,29 @@ func signInView(c echo.Context) error {
 	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
 	if err != nil {
 		_ = fmt.Errorf("invalid password for user: %v", req.Username)
+		failAttempt(c, req.Username)
 		return c.JSON(http.StatusUnauthorized, map[string]string{
 			"message": "Invalid username or password.",
 		})
 	}
 
+	if user.Disabled {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"message": "This account is disabled.",
+		})
+	}
+
+	// Users of two-factor authentication get a pending session until they
+	// enter a code; their failed attempts are forgotten once they do
+	if user.TOTPEnabled {
+		session.SetPendingUser(c, user.ID)
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"two_factor_required": true,
+			"message":             "Enter the code of your authenticator app, or a recovery code, to finish signing in.",
+		})
+	}
+
+	resetAttempts(user.Username)
 	session.SetSessionCookie(c, user.ID)
 
 	// Check if there's a callback URL and if it's allowed
@@ -210,8 +266,62 @@ func me(c echo.Context) error {
 	}
 
 	return c.JSON(http.StatusOK, map[string]interface{}{
-		"message": "authenticated!",
-		"user":    user,
+		"message":     "authenticated!",
+		"user":        user,
+		"permissions": rbac.Permissions(user.Role),
+	})
+}
+
+type SettingsRequest struct {
+	// UndoSendDelay is 0 to send immediately, or between 5 and 30 seconds
+	UndoSendDelay int `json:"undo_send_delay" validate:"eq=0|min=5,max=30"`
+}
+
+// settingsView returns the settings of the current user.
+func settingsView(c echo.Context) error {
+	user, err := session.GetCurrentUser(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"message": "Not authenticated. Please sign in first.",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"undo_send_delay": user.UndoSendDelay,
+	})
+}
+
+// updateSettingsView updates the settings of the current user.
+func updateSettingsView(c echo.Context) error {
+	user, err := session.GetCurrentUser(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"message": "Not authenticated. Please sign in first.",
+		})
+	}
+
+	req := SettingsRequest{UndoSendDelay: user.UndoSendDelay}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "An error occurred while processing your request.",
+		})
+	}
+
+	if err := c.Validate(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "undo_send_delay must be 0 or between 5 and 30 seconds.",
+		})
+	}
+
+	if err := db.DB.Model(user).Update("undo_send_delay", req.UndoSendDelay).Error; err != nil {
+		_ = fmt.Errorf("database error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "An unexpected error occurred, please try again later.",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"undo_send_delay": req.UndoSendDelay,
 	})
 }
 
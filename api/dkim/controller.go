@@ -0,0 +1,39 @@
+package dkim
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/internal/apitoken"
+)
+
+type Controller struct {
+	Route        string
+	Method       string
+	Active       bool
+	Handler      func(c echo.Context) error
+	RequiredAuth bool
+	Scope        string
+	Permission   string
+}
+
+func GetDKIMController() []*Controller {
+	return []*Controller{
+		{
+			Route:        "/api/dkim",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      listView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/dkim/:domain",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      recordView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+	}
+}
@@ -0,0 +1,90 @@
+package dkim
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// maxTXTString is the longest character-string of a DNS TXT record, longer
+// values (such as 2048-bit RSA keys) are split into several strings
+const maxTXTString = 255
+
+// RecordResponse represents the DNS TXT record publishing the DKIM key of a domain
+type RecordResponse struct {
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	// ZoneFile is the record in zone file syntax, its value split into 255 character strings
+	ZoneFile string `json:"zone_file"`
+}
+
+// listView handles the request to list the TXT records of every DKIM domain
+func listView(c echo.Context) error {
+	records := []RecordResponse{}
+	for _, key := range smtpclient.DKIMKeys() {
+		record, err := dnsRecord(key)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": fmt.Sprintf("Failed to build DKIM record of %s: %v", key.Domain, err),
+			})
+		}
+		records = append(records, record)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"records": records,
+	})
+}
+
+// recordView handles the request to get the TXT record to publish for a domain
+func recordView(c echo.Context) error {
+	domain := strings.ToLower(c.Param("domain"))
+
+	for _, key := range smtpclient.DKIMKeys() {
+		if key.Domain != domain {
+			continue
+		}
+
+		record, err := dnsRecord(key)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": fmt.Sprintf("Failed to build DKIM record: %v", err),
+			})
+		}
+		return c.JSON(http.StatusOK, record)
+	}
+
+	return c.JSON(http.StatusNotFound, map[string]string{
+		"error": fmt.Sprintf("No DKIM key configured for %s", domain),
+	})
+}
+
+// dnsRecord describes the TXT record of a DKIM key
+func dnsRecord(key *smtpclient.DKIMKey) (RecordResponse, error) {
+	name, value, err := key.DNSRecord()
+	if err != nil {
+		return RecordResponse{}, err
+	}
+
+	var chunks []string
+	for rest := value; rest != ""; {
+		n := min(len(rest), maxTXTString)
+		chunks = append(chunks, `"`+rest[:n]+`"`)
+		rest = rest[n:]
+	}
+
+	return RecordResponse{
+		Domain:   key.Domain,
+		Selector: key.Selector,
+		Name:     name,
+		Type:     "TXT",
+		Value:    value,
+		ZoneFile: fmt.Sprintf("%s. IN TXT ( %s )", name, strings.Join(chunks, " ")),
+	}, nil
+}
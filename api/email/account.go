@@ -0,0 +1,85 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/account"
+	"github.com/lyneq/mailapi/internal/session"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// errUnauthenticated is returned by mailAccount for requests without a session user
+var errUnauthenticated = errors.New("authentication required")
+
+// mailAccount returns the mail account of the request: the one given by the
+// account query parameter, else the one the session works with, nil for the
+// shared account
+func mailAccount(c echo.Context) (*db.MailAccount, error) {
+	ctx := c.Request().Context()
+	userID, err := session.GetUserID(ctx)
+	if err != nil {
+		return nil, errUnauthenticated
+	}
+
+	if param := c.QueryParam("account"); param != "" {
+		id, err := strconv.ParseUint(param, 10, 32)
+		if err != nil {
+			return nil, account.ErrNotFound
+		}
+		return account.Get(userID, uint(id))
+	}
+	return account.Current(userID, session.GetAccountID(ctx))
+}
+
+// connectIMAP opens an IMAP session on the mail account of the session
+func connectIMAP(c echo.Context) (*smtpclient.IMAPClient, error) {
+	found, err := mailAccount(c)
+	if err != nil {
+		return nil, err
+	}
+
+	imapClient, err := account.IMAPClient(found)
+	if err != nil {
+		return nil, err
+	}
+	if err := imapClient.Connect(); err != nil {
+		return nil, err
+	}
+	return imapClient, nil
+}
+
+// accountErrorResponse reports a mail account that cannot be used, or the
+// failure to connect to it
+func accountErrorResponse(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, errUnauthenticated):
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	case errors.Is(err, account.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Mail account not found",
+		})
+	case errors.Is(err, account.ErrNoAccount):
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": "No mail account configured, add one with POST /api/accounts",
+		})
+	case errors.Is(err, account.ErrNotAuthorized):
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": "The mail account must be authorized again with POST /api/accounts/:id/oauth",
+		})
+	case errors.Is(err, account.ErrNoKey):
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": "Mail accounts are not available: no encryption key is configured",
+		})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to connect to mail server: %v", err),
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package email
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// AttachmentUpload represents a base64 encoded attachment in a JSON send request
+type AttachmentUpload struct {
+	Filename  string `json:"filename" validate:"required"`
+	Content   string `json:"content" validate:"required,base64"`
+	MimeType  string `json:"mime_type"`
+	ContentID string `json:"content_id"`
+	Inline    bool   `json:"inline"`
+}
+
+// attachmentError is a rejected attachment, reported to the client with its HTTP status
+type attachmentError struct {
+	status  int
+	message string
+}
+
+func (e *attachmentError) Error() string {
+	return e.message
+}
+
+// sniffLength is the number of bytes used to detect the content type of a file
+const sniffLength = 512
+
+// collectAttachments gathers the attachments of a send request, either from
+// the multipart form ("attachments" and "inline" files) or from the base64
+// JSON variant, and enforces the configured count, size and type limits.
+// Contents are opened lazily so large files are streamed when the message is composed.
+func collectAttachments(c echo.Context, uploads []AttachmentUpload) ([]smtpclient.Attachment, error) {
+	var attachments []smtpclient.Attachment
+
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		form, err := c.MultipartForm()
+		if err != nil {
+			return nil, &attachmentError{http.StatusBadRequest, fmt.Sprintf("Invalid upload: %v", err)}
+		}
+
+		for _, field := range []string{"attachments", "inline"} {
+			for _, fh := range form.File[field] {
+				attachment, err := formAttachment(fh, field == "inline")
+				if err != nil {
+					return nil, err
+				}
+				attachments = append(attachments, attachment)
+			}
+		}
+	}
+
+	for _, upload := range uploads {
+		attachment, err := base64Attachment(upload)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	if err := checkAttachmentLimits(attachments); err != nil {
+		return nil, err
+	}
+
+	return attachments, nil
+}
+
+// formAttachment builds an attachment from an uploaded multipart file.
+// Inline files get their file name as Content-ID.
+func formAttachment(fh *multipart.FileHeader, inline bool) (smtpclient.Attachment, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return smtpclient.Attachment{}, &attachmentError{http.StatusBadRequest, fmt.Sprintf("Failed to read %s: %v", fh.Filename, err)}
+	}
+	head := make([]byte, sniffLength)
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+
+	attachment := smtpclient.Attachment{
+		Filename: filepath.Base(fh.Filename),
+		MimeType: detectMimeType(fh.Filename, head[:n]),
+		Size:     fh.Size,
+		Inline:   inline,
+		Open: func() (io.ReadCloser, error) {
+			return fh.Open()
+		},
+	}
+	if inline {
+		attachment.ContentID = attachment.Filename
+	}
+
+	return attachment, nil
+}
+
+// base64Attachment builds an attachment from the JSON variant, decoding the content while streaming it
+func base64Attachment(upload AttachmentUpload) (smtpclient.Attachment, error) {
+	content := strings.TrimSpace(upload.Content)
+
+	padding := len(content) - len(strings.TrimRight(content, "="))
+	size := int64(len(content)/4*3 - padding)
+
+	prefix := content
+	if len(prefix) > sniffLength*4/3 {
+		prefix = prefix[:sniffLength*4/3]
+	}
+	head, _ := base64.StdEncoding.DecodeString(prefix)
+
+	mimeType := upload.MimeType
+	if mimeType == "" {
+		mimeType = detectMimeType(upload.Filename, head)
+	}
+
+	return smtpclient.Attachment{
+		Filename:  filepath.Base(upload.Filename),
+		MimeType:  mimeType,
+		ContentID: upload.ContentID,
+		Inline:    upload.Inline || upload.ContentID != "",
+		Size:      size,
+		Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(base64.NewDecoder(base64.StdEncoding, strings.NewReader(content))), nil
+		},
+	}, nil
+}
+
+// detectMimeType sniffs the content type of a file, falling back to its
+// extension when the content is not recognised
+func detectMimeType(filename string, head []byte) string {
+	detected := http.DetectContentType(head)
+	mediaType, _, _ := mime.ParseMediaType(detected)
+
+	if mediaType == "application/octet-stream" || mediaType == "text/plain" {
+		if byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))); byExt != "" {
+			return byExt
+		}
+	}
+
+	return detected
+}
+
+// checkAttachmentLimits enforces the [Attachments] configuration
+func checkAttachmentLimits(attachments []smtpclient.Attachment) error {
+	limits := config.GetAttachmentsConfig()
+
+	if limits.MaxCount > 0 && len(attachments) > limits.MaxCount {
+		return &attachmentError{http.StatusBadRequest, fmt.Sprintf("Too many attachments: at most %d are allowed", limits.MaxCount)}
+	}
+
+	var total int64
+	for _, attachment := range attachments {
+		ext := strings.ToLower(filepath.Ext(attachment.Filename))
+		for _, blocked := range limits.BlockedExtensions {
+			if ext == strings.ToLower(blocked) {
+				return &attachmentError{http.StatusUnsupportedMediaType, fmt.Sprintf("Attachment %s: %s files are not allowed", attachment.Filename, ext)}
+			}
+		}
+
+		if !typeAllowed(attachment.MimeType, limits.AllowedTypes) {
+			return &attachmentError{http.StatusUnsupportedMediaType, fmt.Sprintf("Attachment %s: type %s is not allowed", attachment.Filename, attachment.MimeType)}
+		}
+
+		if limits.MaxFileSize > 0 && attachment.Size > limits.MaxFileSize {
+			return &attachmentError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Attachment %s is larger than %d bytes", attachment.Filename, limits.MaxFileSize)}
+		}
+
+		total += attachment.Size
+	}
+
+	if limits.MaxTotalSize > 0 && total > limits.MaxTotalSize {
+		return &attachmentError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Attachments are larger than %d bytes in total", limits.MaxTotalSize)}
+	}
+
+	return nil
+}
+
+// typeAllowed reports whether a MIME type matches the allow list
+func typeAllowed(mimeType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		mediaType = mimeType
+	}
+
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if pattern == mediaType || (strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
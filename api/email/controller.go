@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/internal/apitoken"
 )
 
 type Controller struct {
@@ -12,6 +13,8 @@ type Controller struct {
 	Active       bool
 	Handler      func(c echo.Context) error
 	RequiredAuth bool
+	Scope        string
+	Permission   string
 }
 
 func GetEmailController() []*Controller {
@@ -22,6 +25,15 @@ func GetEmailController() []*Controller {
 			Active:       true,
 			Handler:      getInboxView,
 			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/email/unified",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      unifiedInboxView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
 		},
 		{
 			Route:        "/api/email/folder",
@@ -29,6 +41,7 @@ func GetEmailController() []*Controller {
 			Active:       true,
 			Handler:      getFolderView,
 			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
 		},
 		{
 			Route:        "/api/email/:id",
@@ -36,6 +49,39 @@ func GetEmailController() []*Controller {
 			Active:       true,
 			Handler:      getEmailView,
 			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/email/:id/rsvp",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      rsvpView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailSend,
+		},
+		{
+			Route:        "/api/email/:id/reply",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      replyView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailSend,
+		},
+		{
+			Route:        "/api/email/:id/reply-all",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      replyAllView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailSend,
+		},
+		{
+			Route:        "/api/email/:id/forward",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      forwardView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailSend,
 		},
 		{
 			Route:        "/api/email/send",
@@ -43,6 +89,39 @@ func GetEmailController() []*Controller {
 			Active:       true,
 			Handler:      sendEmailView,
 			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailSend,
+		},
+		{
+			Route:        "/api/email/send/:token/cancel",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      cancelSendView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailSend,
+		},
+		{
+			Route:        "/api/email/export",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      exportView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/email/import",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      importView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/email/jobs/:id",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      jobView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
 		},
 		{
 			Route:        "/api/email",
@@ -50,6 +129,7 @@ func GetEmailController() []*Controller {
 			Active:       true,
 			Handler:      getFoldersView,
 			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
 		},
 	}
 }
@@ -0,0 +1,51 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/identity"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// applyIdentity sends msg from the identity and adds its reply-to address,
+// unless the request set one. Without identity, deliver sends msg from the
+// address of the mail account.
+func applyIdentity(msg *smtpclient.OutgoingMessage, found *db.Identity) {
+	if found == nil {
+		return
+	}
+	msg.From = identity.From(found)
+	if msg.ReplyTo == "" {
+		msg.ReplyTo = found.ReplyTo
+	}
+}
+
+// identityErrorResponse reports an identity that cannot be used to send
+func identityErrorResponse(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, identity.ErrNotFound):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Validation error: unknown identity",
+		})
+	case errors.Is(err, identity.ErrSenderNotAllowed):
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "Sending from this identity is not allowed",
+		})
+	case errors.Is(err, identity.ErrUnverified):
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "Confirm the address of this identity before sending from it",
+		})
+	case errors.Is(err, identity.ErrAddressTaken):
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "The address of this identity belongs to another user",
+		})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to get identity: %v", err),
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package email
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/account"
+	"github.com/lyneq/mailapi/internal/identity"
+	"github.com/lyneq/mailapi/internal/session"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// ReplyRequest represents the request structure for replying to an email.
+// Recipients are taken from the original email, Cc and Bcc are added to them.
+type ReplyRequest struct {
+	Body        string             `json:"body" form:"body" validate:"required"`
+	HTMLBody    bool               `json:"html_body" form:"html_body"`
+	Cc          []string           `json:"cc" form:"cc" validate:"dive,mailbox"`
+	Bcc         []string           `json:"bcc" form:"bcc" validate:"dive,mailbox"`
+	Attachments []AttachmentUpload `json:"attachments" form:"-" validate:"dive"`
+	// IdentityID chooses the identity to reply from. When 0, the identity the
+	// original email was sent to is used, else the default identity.
+	IdentityID uint `json:"identity_id" form:"identity_id"`
+	Scheduling
+}
+
+// ForwardRequest represents the request structure for forwarding an email
+type ForwardRequest struct {
+	To       []string `json:"to" form:"to" validate:"required,min=1,dive,mailbox"`
+	Cc       []string `json:"cc" form:"cc" validate:"dive,mailbox"`
+	Bcc      []string `json:"bcc" form:"bcc" validate:"dive,mailbox"`
+	Body     string   `json:"body" form:"body"`
+	HTMLBody bool     `json:"html_body" form:"html_body"`
+	// AsAttachment forwards the original as a message/rfc822 attachment instead of inline
+	AsAttachment bool               `json:"as_attachment" form:"as_attachment"`
+	Attachments  []AttachmentUpload `json:"attachments" form:"-" validate:"dive"`
+	// IdentityID chooses the identity to forward from, the default identity when 0
+	IdentityID uint `json:"identity_id" form:"identity_id"`
+	Scheduling
+}
+
+// replyView handles the request to reply to the author of an email
+func replyView(c echo.Context) error {
+	return reply(c, false)
+}
+
+// replyAllView handles the request to reply to the author and every recipient of an email
+func replyAllView(c echo.Context) error {
+	return reply(c, true)
+}
+
+func reply(c echo.Context, all bool) error {
+	req := new(ReplyRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid request: %v", err),
+		})
+	}
+
+	if err := c.Validate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: %v", err),
+		})
+	}
+
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	found, err := mailAccount(c)
+	if err != nil {
+		return accountErrorResponse(c, err)
+	}
+
+	original, err := getOriginal(c, found)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to get email: %v", err),
+		})
+	}
+
+	from, err := replyIdentity(userID, req.IdentityID, original)
+	if err != nil {
+		return identityErrorResponse(c, err)
+	}
+
+	own, err := ownAddresses(userID, found)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	to, cc := smtpclient.ReplyRecipients(original, all, own)
+	if len(to) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "The email has no recipient to reply to",
+		})
+	}
+
+	attachments, err := collectAttachments(c, req.Attachments)
+	if err != nil {
+		return attachmentErrorResponse(c, err)
+	}
+
+	msg := &smtpclient.OutgoingMessage{
+		To:          to,
+		Cc:          append(cc, req.Cc...),
+		Bcc:         req.Bcc,
+		Subject:     smtpclient.ReplySubject(original.Subject),
+		InReplyTo:   original.MessageID,
+		References:  smtpclient.ThreadReferences(original),
+		Attachments: attachments,
+	}
+	applyIdentity(msg, from)
+
+	// The reply keeps the format it was written in, signed above the quote
+	body := identity.Sign(from, req.Body, req.HTMLBody)
+	if req.HTMLBody {
+		msg.Body = smtpclient.QuoteHTML(body, original)
+	} else {
+		msg.TextBody = smtpclient.QuoteText(body, original)
+	}
+
+	return deliver(c, msg, req.Scheduling, "Reply sent successfully")
+}
+
+// forwardView handles the request to forward an email with its attachments
+func forwardView(c echo.Context) error {
+	req := new(ForwardRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid request: %v", err),
+		})
+	}
+
+	if err := c.Validate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: %v", err),
+		})
+	}
+
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	from, err := identity.Resolve(userID, req.IdentityID)
+	if err != nil {
+		return identityErrorResponse(c, err)
+	}
+
+	found, err := mailAccount(c)
+	if err != nil {
+		return accountErrorResponse(c, err)
+	}
+
+	original, err := getOriginal(c, found)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to get email: %v", err),
+		})
+	}
+
+	attachments, err := collectAttachments(c, req.Attachments)
+	if err != nil {
+		return attachmentErrorResponse(c, err)
+	}
+
+	msg := &smtpclient.OutgoingMessage{
+		To:      req.To,
+		Cc:      req.Cc,
+		Bcc:     req.Bcc,
+		Subject: smtpclient.ForwardSubject(original.Subject),
+	}
+	applyIdentity(msg, from)
+
+	// The signature goes under the user's note, above the forwarded email
+	body := identity.Sign(from, req.Body, req.HTMLBody)
+
+	switch {
+	case req.AsAttachment:
+		msg.Attachments = append(attachments, smtpclient.Attachment{
+			Filename: forwardFilename(original.Subject),
+			Content:  original.Raw,
+			MimeType: "message/rfc822",
+		})
+		if req.HTMLBody {
+			msg.Body = body
+		} else {
+			msg.TextBody = body
+		}
+	case req.HTMLBody:
+		msg.Body = smtpclient.ForwardHTML(body, original)
+		msg.Attachments = append(original.Attachments, attachments...)
+	default:
+		msg.TextBody = smtpclient.ForwardText(body, original)
+		msg.Attachments = append(original.Attachments, attachments...)
+	}
+
+	return deliver(c, msg, req.Scheduling, "Email forwarded successfully")
+}
+
+// getOriginal loads the email answered or forwarded by the request from the mail account
+func getOriginal(c echo.Context, found *db.MailAccount) (*smtpclient.Message, error) {
+	imapClient, err := account.IMAPClient(found)
+	if err != nil {
+		return nil, err
+	}
+	if err := imapClient.Connect(); err != nil {
+		return nil, err
+	}
+	defer imapClient.Disconnect()
+
+	return imapClient.GetEmailByID(c.Param("id"), c.QueryParam("folder"))
+}
+
+// replyIdentity returns the identity a reply is sent from: the requested one,
+// else the identity the original email was addressed to, else the default one
+func replyIdentity(userID, requested uint, original *smtpclient.Message) (*db.Identity, error) {
+	if requested == 0 {
+		found, err := identity.Match(userID, append(append([]string(nil), original.To...), original.Cc...))
+		if err != nil || found != nil {
+			return found, err
+		}
+	}
+	return identity.Resolve(userID, requested)
+}
+
+// ownAddresses returns the addresses of the user, account and identities,
+// left out of reply-all recipients
+func ownAddresses(userID uint, found *db.MailAccount) ([]string, error) {
+	addresses, err := identity.Addresses(userID)
+	if err != nil {
+		return nil, err
+	}
+	return append(addresses, account.Addresses(found)...), nil
+}
+
+// forwardFilename names the message/rfc822 attachment of a forwarded email
+func forwardFilename(subject string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(subject))
+
+	if name == "" {
+		name = "message"
+	}
+	return name + ".eml"
+}
@@ -0,0 +1,194 @@
+package email
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/internal/account"
+	"github.com/lyneq/mailapi/internal/mailbox"
+	"github.com/lyneq/mailapi/internal/session"
+)
+
+// exportView streams a folder, or the whole account when no folder is given,
+// as an mbox file or a zipped Maildir. The job ID is returned in the X-Job-ID
+// header so progress can be followed on /api/email/jobs/:id.
+func exportView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = mailbox.FormatMbox
+	}
+	if format != mailbox.FormatMbox && format != mailbox.FormatMaildir {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Format must be mbox or maildir",
+		})
+	}
+
+	imapClient, err := connectIMAP(c)
+	if err != nil {
+		return accountErrorResponse(c, err)
+	}
+	defer imapClient.Disconnect()
+
+	var folders []string
+	if folder := c.QueryParam("folder"); folder != "" {
+		folders = []string{folder}
+	} else {
+		folders, err = imapClient.GetSelectableFolders()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": fmt.Sprintf("Failed to get folders: %v", err),
+			})
+		}
+	}
+
+	job := mailbox.NewJob(userID, "export")
+	contentType, filename := mailbox.ExportFileInfo(format, folders)
+
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	c.Response().Header().Set("X-Job-ID", job.ID())
+	c.Response().WriteHeader(http.StatusOK)
+
+	// The status line is already sent, so a failure can only be reported through the job
+	err = mailbox.Export(imapClient, folders, format, c.Response(), job)
+	job.Finish(err)
+	if err != nil {
+		fmt.Printf("Export job %s failed: %v\n", job.ID(), err)
+	}
+
+	return nil
+}
+
+// importView accepts uploaded mbox files, zipped Maildirs or .eml files and
+// appends their messages to the IMAP account in a background job
+func importView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	format := c.FormValue("format")
+	if format != "" && format != mailbox.FormatMbox && format != mailbox.FormatMaildir && format != mailbox.FormatEML {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Format must be mbox, maildir or eml",
+		})
+	}
+
+	found, err := mailAccount(c)
+	if err != nil {
+		return accountErrorResponse(c, err)
+	}
+	// Decrypt the credentials now, the job outlives the request
+	imapClient, err := account.IMAPClient(found)
+	if err != nil {
+		return accountErrorResponse(c, err)
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid upload: %v", err),
+		})
+	}
+
+	files := append(form.File["file"], form.File["files"]...)
+	if len(files) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "At least one file is required",
+		})
+	}
+
+	// Uploads are removed once the request ends, so keep our own copies for the job
+	var sources []mailbox.Source
+	for _, fh := range files {
+		path, err := saveUpload(fh)
+		if err != nil {
+			removeSources(sources)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": fmt.Sprintf("Failed to store upload: %v", err),
+			})
+		}
+		sources = append(sources, mailbox.Source{Path: path, Filename: fh.Filename, Format: format})
+	}
+
+	target := c.FormValue("folder")
+	job := mailbox.NewJob(userID, "import")
+
+	go func() {
+		defer removeSources(sources)
+
+		if err := imapClient.Connect(); err != nil {
+			job.Finish(fmt.Errorf("failed to connect to IMAP server: %w", err))
+			return
+		}
+		defer imapClient.Disconnect()
+
+		job.Finish(mailbox.Import(imapClient, sources, target, job))
+	}()
+
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
+		"message": "Import started",
+		"job":     job.Status(),
+	})
+}
+
+// jobView returns the progress of an export or import job
+func jobView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	job, ok := mailbox.GetJob(c.Param("id"), userID)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Job not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, job.Status())
+}
+
+// saveUpload copies an uploaded file to a temporary file and returns its path
+func saveUpload(fh *multipart.FileHeader) (string, error) {
+	src, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp("", "mailapi-import-*")
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+
+	return dst.Name(), nil
+}
+
+// removeSources deletes the temporary copies of uploaded archives
+func removeSources(sources []mailbox.Source) {
+	for _, src := range sources {
+		os.Remove(src.Path)
+	}
+}
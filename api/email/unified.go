@@ -0,0 +1,146 @@
+package email
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/account"
+	"github.com/lyneq/mailapi/internal/pagination"
+	"github.com/lyneq/mailapi/internal/session"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// UnifiedEmailResponse is an email of the unified inbox, tagged with its mail
+// account. Pass account_id as the account query parameter to open it.
+type UnifiedEmailResponse struct {
+	EmailResponse
+	UID       uint32 `json:"uid"`
+	Received  string `json:"received"`
+	AccountID uint   `json:"account_id"`
+	Account   string `json:"account"`
+}
+
+// AccountError reports a mail account whose inbox could not be read
+type AccountError struct {
+	AccountID uint   `json:"account_id"`
+	Error     string `json:"error"`
+}
+
+// unifiedInboxView handles the request to list the newest emails of every
+// mail account of the user, merged by received date. The next_cursor of a
+// response fetches the following page, unaffected by emails received since.
+func unifiedInboxView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	limit := pagination.DefaultPageSize
+	if parsed, err := strconv.Atoi(c.QueryParam("limit")); err == nil && parsed > 0 {
+		limit = min(parsed, pagination.MaxPageSize)
+	}
+
+	var after *account.Cursor
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		after = new(account.Cursor)
+		if err := pagination.DecodeCursor(cursor, after); err != nil || after.Last.Received.IsZero() {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid cursor",
+			})
+		}
+	}
+
+	accounts, err := account.List(userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	var sources []account.InboxSource
+	for i := range accounts {
+		sources = append(sources, inboxSource(&accounts[i]))
+	}
+	if len(sources) == 0 {
+		shared, err := account.Current(userID, 0)
+		if err != nil {
+			return accountErrorResponse(c, err)
+		}
+		sources = append(sources, inboxSource(shared))
+	}
+
+	messages, failed := account.UnifiedInbox(sources, after, limit)
+	if len(failed) == len(sources) {
+		return c.JSON(http.StatusBadGateway, map[string]interface{}{
+			"error":  "Failed to read the inbox of every mail account",
+			"errors": accountErrors(failed),
+		})
+	}
+
+	emails := []UnifiedEmailResponse{}
+	for _, msg := range messages {
+		emails = append(emails, UnifiedEmailResponse{
+			EmailResponse: EmailResponse{
+				ID:      msg.ID,
+				From:    msg.From,
+				To:      msg.To,
+				Subject: msg.Subject,
+				Date:    msg.Date.Format("2006-01-02 15:04:05"),
+				Labels:  msg.Flags,
+			},
+			UID:       msg.UID,
+			Received:  msg.Received.Format(time.RFC3339),
+			AccountID: msg.AccountID,
+			Account:   msg.Account,
+		})
+	}
+
+	response := map[string]interface{}{
+		"emails": emails,
+	}
+	if len(messages) == limit {
+		response["next_cursor"] = pagination.EncodeCursor(account.NextCursor(after, messages))
+	}
+	if len(failed) > 0 {
+		response["errors"] = accountErrors(failed)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// inboxSource reads the INBOX of a mail account, the shared account when found is nil
+func inboxSource(found *db.MailAccount) account.InboxSource {
+	source := account.InboxSource{Address: account.Address(found)}
+	if found != nil {
+		source.AccountID = found.ID
+	}
+
+	source.Fetch = func(limit int, keep func(msg *smtpclient.Message) bool) ([]smtpclient.Message, error) {
+		imapClient, err := account.IMAPClient(found)
+		if err != nil {
+			return nil, err
+		}
+		if err := imapClient.Connect(); err != nil {
+			return nil, err
+		}
+		defer imapClient.Disconnect()
+
+		return imapClient.GetLatestInbox(limit, keep)
+	}
+	return source
+}
+
+// accountErrors lists the failures of UnifiedInbox by account ID
+func accountErrors(failed map[uint]error) []AccountError {
+	errs := make([]AccountError, 0, len(failed))
+	for id, err := range failed {
+		errs = append(errs, AccountError{AccountID: id, Error: err.Error()})
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].AccountID < errs[j].AccountID })
+	return errs
+}
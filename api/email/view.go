@@ -1,29 +1,47 @@
 package email
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"net/http"
+	"net/textproto"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
-	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/account"
+	"github.com/lyneq/mailapi/internal/calendar"
+	"github.com/lyneq/mailapi/internal/identity"
+	"github.com/lyneq/mailapi/internal/mailauth"
+	"github.com/lyneq/mailapi/internal/outbox"
 	"github.com/lyneq/mailapi/internal/pagination"
+	"github.com/lyneq/mailapi/internal/session"
 	"github.com/lyneq/mailapi/internal/smtpClient"
 	"github.com/lyneq/mailapi/internal/utils"
 )
 
+// securityTimeout bounds the DNS lookups checking the sender of an email
+const securityTimeout = 2 * time.Second
+
 // EmailResponse represents the response structure for email data
 type EmailResponse struct {
-	ID          string       `json:"id"`
-	From        string       `json:"from"`
-	To          []string     `json:"to"`
-	Subject     string       `json:"subject"`
-	Date        string       `json:"date"`
-	Body        string       `json:"body,omitempty"`
-	Labels      []string     `json:"labels"`
-	Attachments []Attachment `json:"attachments,omitempty"`
+	ID          string               `json:"id"`
+	From        string               `json:"from"`
+	To          []string             `json:"to"`
+	Subject     string               `json:"subject"`
+	Date        string               `json:"date"`
+	Body        string               `json:"body,omitempty"`
+	Labels      []string             `json:"labels"`
+	Attachments []Attachment         `json:"attachments,omitempty"`
+	Invitation  *calendar.Invitation `json:"invitation,omitempty"`
+	ReplyTo     string               `json:"reply_to,omitempty"`
+	Security    *mailauth.Report     `json:"security,omitempty"`
 }
 
 // Attachment represents an email attachment in the response
@@ -44,22 +62,69 @@ type Response struct {
 	Emails  []EmailResponse `json:"inbox"`
 }
 
-// SendEmailRequest represents the request structure for sending an email
+// SendEmailRequest represents the request structure for sending an email.
+// It is accepted as JSON (attachments base64 encoded) or as multipart/form-data
+// with "attachments" and "inline" files, and custom headers as a JSON object
+// "headers" field or as "headers[Name]" fields.
+// Addresses may carry a display name, e.g. "Alice" <alice@example.com>.
 type SendEmailRequest struct {
-	To       []string `json:"to" validate:"required,min=1,dive,email"`
-	Subject  string   `json:"subject" validate:"required"`
-	Body     string   `json:"body" validate:"required"`
-	HTMLBody bool     `json:"html_body"`
+	To       []string `json:"to" form:"to" validate:"required,min=1,dive,mailbox"`
+	Cc       []string `json:"cc" form:"cc" validate:"dive,mailbox"`
+	Bcc      []string `json:"bcc" form:"bcc" validate:"dive,mailbox"`
+	ReplyTo  string   `json:"reply_to" form:"reply_to" validate:"omitempty,mailbox"`
+	Subject  string   `json:"subject" form:"subject" validate:"required"`
+	Body     string   `json:"body" form:"body" validate:"required"`
+	HTMLBody bool     `json:"html_body" form:"html_body"`
+	Priority string   `json:"priority" form:"priority" validate:"omitempty,oneof=high normal low"`
+	// Headers holds custom X- header fields, limited to the SMTP allowed_headers setting
+	Headers     map[string]string  `json:"headers" form:"-" validate:"dive,keys,custom_header,endkeys,max=998"`
+	Attachments []AttachmentUpload `json:"attachments" form:"-" validate:"dive"`
+	// IdentityID chooses the identity to send from, the default identity when 0
+	IdentityID uint `json:"identity_id" form:"identity_id"`
+	Scheduling
+}
+
+// Scheduling holds the optional delivery time of a send request. SendAt is an
+// RFC 3339 timestamp, or a local time when Timezone (IANA name) is given.
+type Scheduling struct {
+	SendAt   string `json:"send_at" form:"send_at"`
+	Timezone string `json:"timezone" form:"timezone" validate:"omitempty,timezone"`
+}
+
+// outgoingMessage builds the message to compose from the request, sent from
+// the identity with its signature appended
+func (req *SendEmailRequest) outgoingMessage(from *db.Identity, attachments []smtpclient.Attachment) *smtpclient.OutgoingMessage {
+	headers := make(map[string]string, len(req.Headers))
+	for name, value := range req.Headers {
+		headers[textproto.CanonicalMIMEHeaderKey(name)] = value
+	}
+
+	msg := &smtpclient.OutgoingMessage{
+		To:          req.To,
+		Cc:          req.Cc,
+		Bcc:         req.Bcc,
+		ReplyTo:     req.ReplyTo,
+		Subject:     req.Subject,
+		Priority:    req.Priority,
+		Headers:     headers,
+		Attachments: attachments,
+	}
+	applyIdentity(msg, from)
+
+	if req.HTMLBody {
+		msg.Body = identity.Sign(from, req.Body, true)
+	} else {
+		msg.TextBody = identity.Sign(from, req.Body, false)
+	}
+
+	return msg
 }
 
 // getInboxView handles the request to get the user's inbox with pagination
 func getInboxView(c echo.Context) error {
-	imapClient := smtpclient.NewIMAPClientFromConfig()
-
-	if err := imapClient.Connect(); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": fmt.Sprintf("Failed to connect to IMAP server: %v", err),
-		})
+	imapClient, err := connectIMAP(c)
+	if err != nil {
+		return accountErrorResponse(c, err)
 	}
 	defer imapClient.Disconnect()
 
@@ -115,12 +180,9 @@ func getInboxView(c echo.Context) error {
 
 // getFolderView handles the request to get messages from a specific folder with pagination
 func getFolderView(c echo.Context) error {
-	imapClient := smtpclient.NewIMAPClientFromConfig()
-
-	if err := imapClient.Connect(); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": fmt.Sprintf("Failed to connect to IMAP server: %v", err),
-		})
+	imapClient, err := connectIMAP(c)
+	if err != nil {
+		return accountErrorResponse(c, err)
 	}
 	defer imapClient.Disconnect()
 
@@ -179,12 +241,9 @@ func getEmailView(c echo.Context) error {
 		})
 	}
 
-	imapClient := smtpclient.NewIMAPClientFromConfig()
-
-	if err := imapClient.Connect(); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": fmt.Sprintf("Failed to connect to IMAP server: %v", err),
-		})
+	imapClient, err := connectIMAP(c)
+	if err != nil {
+		return accountErrorResponse(c, err)
 	}
 	defer imapClient.Disconnect()
 
@@ -253,18 +312,48 @@ func getEmailView(c echo.Context) error {
 	}
 
 	response.Body = emailBody
+	response.Invitation = findInvitation(message)
+	response.ReplyTo = message.ReplyTo
+	if len(message.Raw) > 0 {
+		// DKIM and DMARC need DNS lookups, which must not hold the response
+		ctx, cancel := context.WithTimeout(c.Request().Context(), securityTimeout)
+		response.Security = mailauth.AnalyzeCached(ctx, message.Raw)
+		cancel()
+	}
 
 	return c.JSON(http.StatusOK, response)
 }
 
+// findInvitation returns the meeting invitation carried by a message, either as
+// an inline text/calendar part or as an .ics attachment
+func findInvitation(message *smtpclient.Message) *calendar.Invitation {
+	candidates := []string{message.Calendar}
+	for _, att := range message.Attachments {
+		if att.MimeType == "text/calendar" || att.MimeType == "application/ics" {
+			candidates = append(candidates, string(att.Content))
+		}
+	}
+
+	for _, data := range candidates {
+		if data == "" {
+			continue
+		}
+		invitation, err := calendar.ParseInvitation(data)
+		if err != nil {
+			fmt.Printf("Failed to parse calendar data: %v\n", err)
+			continue
+		}
+		return invitation
+	}
+
+	return nil
+}
+
 // getFoldersView handles the request to get all mail folders
 func getFoldersView(c echo.Context) error {
-	imapClient := smtpclient.NewIMAPClientFromConfig()
-
-	if err := imapClient.Connect(); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": fmt.Sprintf("Failed to connect to IMAP server: %v", err),
-		})
+	imapClient, err := connectIMAP(c)
+	if err != nil {
+		return accountErrorResponse(c, err)
 	}
 	defer imapClient.Disconnect()
 
@@ -326,6 +415,13 @@ func sendEmailView(c echo.Context) error {
 			"error": fmt.Sprintf("Invalid request: %v", err),
 		})
 	}
+	if headers, err := formHeaders(c); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid request: %v", err),
+		})
+	} else if headers != nil {
+		req.Headers = headers
+	}
 
 	if err := c.Validate(req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{
@@ -333,30 +429,316 @@ func sendEmailView(c echo.Context) error {
 		})
 	}
 
-	smtpClient := smtpclient.NewSMTPClientFromConfig()
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	from, err := identity.Resolve(userID, req.IdentityID)
+	if err != nil {
+		return identityErrorResponse(c, err)
+	}
+
+	attachments, err := collectAttachments(c, req.Attachments)
+	if err != nil {
+		return attachmentErrorResponse(c, err)
+	}
+
+	return deliver(c, req.outgoingMessage(from, attachments), req.Scheduling, "Email sent successfully")
+}
+
+// formHeaders reads the custom header fields of a form request: a "headers"
+// field holding a JSON object, and "headers[Name]" fields, which take
+// precedence. It returns nil for other requests.
+func formHeaders(c echo.Context) (map[string]string, error) {
+	contentType := c.Request().Header.Get(echo.HeaderContentType)
+	if !strings.HasPrefix(contentType, echo.MIMEMultipartForm) && !strings.HasPrefix(contentType, echo.MIMEApplicationForm) {
+		return nil, nil
+	}
+	form, err := c.FormParams()
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]string{}
+	for _, value := range form["headers"] {
+		var fields map[string]string
+		if err := json.Unmarshal([]byte(value), &fields); err != nil {
+			return nil, errors.New("headers must be a JSON object of header names and values")
+		}
+		for name, value := range fields {
+			headers[name] = value
+		}
+	}
+	for key, values := range form {
+		if name, ok := strings.CutPrefix(key, "headers["); ok && strings.HasSuffix(name, "]") && len(values) > 0 {
+			headers[strings.TrimSuffix(name, "]")] = values[len(values)-1]
+		}
+	}
+
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	return headers, nil
+}
+
+// attachmentErrorResponse reports a collectAttachments failure with its status code
+func attachmentErrorResponse(c echo.Context, err error) error {
+	var attErr *attachmentError
+	if errors.As(err, &attErr) {
+		return c.JSON(attErr.status, map[string]string{
+			"error": attErr.message,
+		})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error": fmt.Sprintf("Failed to read attachments: %v", err),
+	})
+}
+
+// deliver composes msg, stores it in the outbox and makes a first delivery
+// attempt. Messages that could not be delivered yet stay queued for retries,
+// scheduled messages wait for their time.
+func deliver(c echo.Context, msg *smtpclient.OutgoingMessage, schedule Scheduling, successMessage string) error {
+	user, err := session.GetCurrentUser(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	var sendAt time.Time
+	if schedule.SendAt != "" {
+		if sendAt, err = outbox.ParseSendAt(schedule.SendAt, schedule.Timezone, time.Now()); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("Validation error: %v", err),
+			})
+		}
+	}
 
-	if err := smtpClient.Connect(); err != nil {
+	found, err := mailAccount(c)
+	if err != nil {
+		return accountErrorResponse(c, err)
+	}
+	if msg.From == "" {
+		msg.From = account.Address(found)
+	}
+
+	client, err := account.SMTPClient(found)
+	if err != nil {
+		return accountErrorResponse(c, err)
+	}
+	// Attachments are streamed to a spool file, never held whole in memory
+	spool, err := outbox.NewSpool()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to compose email: %v", err),
+		})
+	}
+	if err := client.ComposeTo(msg, spool); err != nil {
+		spool.Remove()
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to compose email: %v", err),
+		})
+	}
+	spool.Close()
+	// Signed once, so that the Sent copy is the message delivered
+	size, err := client.SignSpool(msg.Sender(), spool.Path())
+	if err != nil {
+		spool.Remove()
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to compose email: %v", err),
+		})
+	}
+
+	queued := &db.OutboxMessage{
+		UserID:     user.ID,
+		AccountID:  account.ID(found),
+		From:       msg.Sender(),
+		Recipients: msg.Recipients(),
+		Subject:    msg.Subject,
+		SpoolPath:  spool.Path(),
+		Size:       size,
+		SaveSent:   account.SaveSent(found),
+	}
+
+	if !sendAt.IsZero() {
+		if err := outbox.Schedule(queued, sendAt, schedule.Timezone); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": fmt.Sprintf("Failed to schedule email: %v", err),
+			})
+		}
+		return c.JSON(http.StatusAccepted, map[string]interface{}{
+			"message": "Email scheduled for " + sendAt.Format(time.RFC3339),
+			"outbox":  queued,
+		})
+	}
+
+	if user.UndoSendDelay > 0 {
+		if err := outbox.Hold(queued, time.Duration(user.UndoSendDelay)*time.Second); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": fmt.Sprintf("Failed to queue email: %v", err),
+			})
+		}
+		return c.JSON(http.StatusAccepted, map[string]interface{}{
+			"message":      fmt.Sprintf("Email will be sent in %d seconds", user.UndoSendDelay),
+			"cancel_token": queued.CancelToken,
+			"outbox":       queued,
+		})
+	}
+
+	if err := outbox.Enqueue(queued); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": fmt.Sprintf("Failed to connect to SMTP server: %v", err),
+			"error": fmt.Sprintf("Failed to queue email: %v", err),
 		})
 	}
 
-	sender := config.GetIMAPConfig().Username
+	sent, err := outbox.Deliver(queued.ID)
+	if err != nil {
+		// The worker will pick the message up
+		return c.JSON(http.StatusAccepted, map[string]interface{}{
+			"message": "Email queued for delivery",
+			"outbox":  queued,
+		})
+	}
 
-	err := smtpClient.SendMessage(
-		sender,
-		req.To,
-		req.Subject,
-		req.Body,
-		nil,
-	)
+	switch sent.Status {
+	case db.OutboxSent:
+		response := map[string]interface{}{
+			"message": successMessage,
+			"outbox":  sent,
+		}
+		if sent.Warning != "" {
+			response["warning"] = sent.Warning
+		}
+		return c.JSON(http.StatusOK, response)
+	case db.OutboxFailed:
+		return c.JSON(http.StatusBadGateway, map[string]interface{}{
+			"error":  fmt.Sprintf("Failed to send email: %s", sent.LastError),
+			"outbox": sent,
+		})
+	default:
+		return c.JSON(http.StatusAccepted, map[string]interface{}{
+			"message": "Email could not be sent yet and will be retried",
+			"outbox":  sent,
+		})
+	}
+}
+
+// cancelSendView handles the request to abort an email during its undo-send delay
+func cancelSendView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
 	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	msg, err := outbox.CancelHeld(userID, c.Param("token"))
+	switch {
+	case errors.Is(err, outbox.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Unknown cancel token",
+		})
+	case errors.Is(err, outbox.ErrInvalidState):
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": "The email has already been sent",
+		})
+	case err != nil:
 		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": fmt.Sprintf("Failed to send email: %v", err),
+			"error": fmt.Sprintf("Failed to cancel email: %v", err),
 		})
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{
-		"message": "Email sent successfully",
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message": "Email cancelled",
+		"outbox":  msg,
 	})
 }
+
+// RSVPRequest represents the request structure for answering a meeting invitation
+type RSVPRequest struct {
+	Response string `json:"response" validate:"required,oneof=accepted declined tentative"`
+	Comment  string `json:"comment"`
+}
+
+// rsvpSubjectPrefixes maps each response to the subject prefix used by common calendar clients
+var rsvpSubjectPrefixes = map[string]string{
+	calendar.PartStatAccepted:  "Accepted",
+	calendar.PartStatDeclined:  "Declined",
+	calendar.PartStatTentative: "Tentative",
+}
+
+// rsvpView handles the request to answer a meeting invitation with an iMIP REPLY sent to the organizer
+func rsvpView(c echo.Context) error {
+	id := c.Param("id")
+
+	req := new(RSVPRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid request: %v", err),
+		})
+	}
+
+	if err := c.Validate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: %v", err),
+		})
+	}
+
+	imapClient, err := connectIMAP(c)
+	if err != nil {
+		return accountErrorResponse(c, err)
+	}
+	defer imapClient.Disconnect()
+
+	message, err := imapClient.GetEmailByID(id, c.QueryParam("folder"))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to get email: %v", err),
+		})
+	}
+
+	invitation := findInvitation(message)
+	if invitation == nil || invitation.Method != "REQUEST" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "This email does not contain a meeting invitation",
+		})
+	}
+	if invitation.Organizer == nil || invitation.Organizer.Email == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "The invitation has no organizer to reply to",
+		})
+	}
+
+	found, err := mailAccount(c)
+	if err != nil {
+		return accountErrorResponse(c, err)
+	}
+	sender := account.Address(found)
+	partStat := strings.ToUpper(req.Response)
+
+	var name string
+	if attendee := invitation.FindAttendee(sender); attendee != nil {
+		name = attendee.Name
+	}
+
+	reply := invitation.Reply(sender, name, partStat, req.Comment, time.Now())
+	subject := rsvpSubjectPrefixes[partStat] + ": " + invitation.Summary
+
+	body := fmt.Sprintf("<p>%s has %s this invitation.</p>", html.EscapeString(sender), strings.ToLower(rsvpSubjectPrefixes[partStat]))
+	if req.Comment != "" {
+		body += "<p>" + html.EscapeString(req.Comment) + "</p>"
+	}
+
+	return deliver(c, &smtpclient.OutgoingMessage{
+		From:    sender,
+		To:      []string{invitation.Organizer.Email},
+		Subject: subject,
+		Body:    body,
+		Alternatives: []smtpclient.Alternative{
+			{ContentType: "text/calendar; method=REPLY", Body: reply},
+		},
+	}, Scheduling{}, "Reply sent to "+invitation.Organizer.Email)
+}
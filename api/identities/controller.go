@@ -0,0 +1,71 @@
+package identities
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/internal/apitoken"
+)
+
+type Controller struct {
+	Route        string
+	Method       string
+	Active       bool
+	Handler      func(c echo.Context) error
+	RequiredAuth bool
+	Scope        string
+	Permission   string
+}
+
+func GetIdentitiesController() []*Controller {
+	return []*Controller{
+		{
+			Route:        "/api/identities",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      listView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/identities",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      createView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/identities/:id",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      getView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/identities/:id",
+			Method:       http.MethodPut,
+			Active:       true,
+			Handler:      updateView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/identities/:id/verification",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      verificationView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/identities/:id",
+			Method:       http.MethodDelete,
+			Active:       true,
+			Handler:      deleteView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+	}
+}
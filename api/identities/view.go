@@ -0,0 +1,197 @@
+package identities
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/identity"
+	"github.com/lyneq/mailapi/internal/session"
+	"github.com/lyneq/mailapi/internal/verification"
+)
+
+// IdentityRequest represents the request structure for creating or updating a sender identity
+type IdentityRequest struct {
+	Address       string `json:"address" validate:"required,email"`
+	Name          string `json:"name" validate:"max=255"`
+	ReplyTo       string `json:"reply_to" validate:"omitempty,mailbox"`
+	HTMLSignature string `json:"html_signature"`
+	TextSignature string `json:"text_signature"`
+	IsDefault     bool   `json:"is_default"`
+}
+
+// listView handles the request to list the user's identities, the default one first
+func listView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	var identities []db.Identity
+	err = db.DB.Where("user_id = ?", userID).Order("is_default DESC, address").Find(&identities).Error
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to list identities: %v", err),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"identities": identities,
+	})
+}
+
+// createView handles the request to add a sender identity
+func createView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	return save(c, &db.Identity{UserID: userID}, http.StatusCreated)
+}
+
+// getView handles the request to get a sender identity
+func getView(c echo.Context) error {
+	return withIdentity(c, func(found *db.Identity) error {
+		return c.JSON(http.StatusOK, found)
+	})
+}
+
+// updateView handles the request to replace a sender identity
+func updateView(c echo.Context) error {
+	return withIdentity(c, func(found *db.Identity) error {
+		return save(c, found, http.StatusOK)
+	})
+}
+
+// deleteView handles the request to delete a sender identity
+func deleteView(c echo.Context) error {
+	return withIdentity(c, func(found *db.Identity) error {
+		if err := db.DB.Delete(found).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": fmt.Sprintf("Failed to delete identity: %v", err),
+			})
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "Identity deleted",
+		})
+	})
+}
+
+// verificationView handles the request to mail a new verification link to
+// the address of an identity
+func verificationView(c echo.Context) error {
+	return withIdentity(c, func(found *db.Identity) error {
+		err := identity.RequestVerification(found)
+		switch {
+		case errors.Is(err, identity.ErrVerified):
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": err.Error(),
+			})
+		case errors.Is(err, verification.ErrTooSoon):
+			return c.JSON(http.StatusTooManyRequests, map[string]string{
+				"error": "An email was sent less than a minute ago, please wait before asking again",
+			})
+		case err != nil:
+			return c.JSON(http.StatusBadGateway, map[string]string{
+				"error": fmt.Sprintf("Failed to send the verification email: %v", err),
+			})
+		}
+
+		return c.JSON(http.StatusAccepted, map[string]string{
+			"address": found.Address,
+			"message": "A verification link has been sent to the address",
+		})
+	})
+}
+
+// save fills an identity from the request and stores it
+func save(c echo.Context, target *db.Identity, status int) error {
+	req := new(IdentityRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid request: %v", err),
+		})
+	}
+
+	if err := c.Validate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: %v", err),
+		})
+	}
+
+	// A new address is mailed a verification link
+	changed := target.ID == 0 || !strings.EqualFold(strings.TrimSpace(req.Address), target.Address)
+	target.Address = req.Address
+	target.Name = req.Name
+	target.ReplyTo = req.ReplyTo
+	target.HTMLSignature = req.HTMLSignature
+	target.TextSignature = req.TextSignature
+	target.IsDefault = req.IsDefault
+
+	err := identity.Save(target)
+	switch {
+	case errors.Is(err, identity.ErrSenderNotAllowed):
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": fmt.Sprintf("Sending from %s is not allowed", target.Address),
+		})
+	case errors.Is(err, identity.ErrDuplicate), errors.Is(err, identity.ErrAddressTaken):
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": err.Error(),
+		})
+	case err != nil:
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to save identity: %v", err),
+		})
+	}
+
+	// The identity is usable once its address confirms it; the link can be
+	// requested again when the email is lost
+	if changed && !target.Verified {
+		if err := identity.RequestVerification(target); err != nil && !errors.Is(err, verification.ErrTooSoon) {
+			_ = fmt.Errorf("identity verification email error: %v", err)
+		}
+	}
+
+	return c.JSON(status, target)
+}
+
+// withIdentity runs fn with the identity of the request owned by the current user
+func withIdentity(c echo.Context, fn func(found *db.Identity) error) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid identity ID",
+		})
+	}
+
+	found, err := identity.Get(userID, uint(id))
+	if errors.Is(err, identity.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Identity not found",
+		})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to get identity: %v", err),
+		})
+	}
+
+	return fn(found)
+}
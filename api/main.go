@@ -5,11 +5,19 @@ import (
 	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
 	echomiddleware "github.com/labstack/echo/v4/middleware"
+	"github.com/lyneq/mailapi/api/accounts"
 	"github.com/lyneq/mailapi/api/auth"
+	"github.com/lyneq/mailapi/api/dkim"
 	"github.com/lyneq/mailapi/api/email"
+	"github.com/lyneq/mailapi/api/identities"
+	"github.com/lyneq/mailapi/api/outbox"
+	"github.com/lyneq/mailapi/api/templates"
+	"github.com/lyneq/mailapi/api/tokens"
+	"github.com/lyneq/mailapi/api/users"
 	"github.com/lyneq/mailapi/config"
 	"github.com/lyneq/mailapi/internal/middleware"
 	"github.com/lyneq/mailapi/internal/session"
+	"github.com/lyneq/mailapi/internal/utils"
 	"net/http"
 )
 
@@ -25,6 +33,10 @@ func Init() {
 
 	allowedDomains := config.GetAllowedDomains()
 	e := echo.New()
+	// The client address limiting sign-in attempts is read from X-Forwarded-For
+	// only behind a proxy on a loopback or private address, so that clients
+	// cannot choose it
+	e.IPExtractor = echo.ExtractIPFromXFFHeader()
 
 	var allowedHosts []string
 
@@ -47,7 +59,11 @@ func Init() {
 		return c.String(http.StatusOK, "Hello, World!")
 	})
 
-	e.Validator = &CustomValidator{validator: validator.New()}
+	v := validator.New()
+	if err := utils.RegisterValidations(v); err != nil {
+		e.Logger.Fatal(err)
+	}
+	e.Validator = &CustomValidator{validator: v}
 
 	registerRoutes(e)
 
@@ -62,73 +78,86 @@ func Init() {
 
 // registerRoutes registers all the routes for the API
 func registerRoutes(e *echo.Echo) {
-	var routes []*auth.Controller
-	routes = auth.GetAuthController()
+	for _, route := range auth.GetAuthController() {
+		if route.Active {
+			registerRoute(e, route.Method, route.Route, route.Handler, route.RequiredAuth, route.Scope, route.Permission)
+		}
+	}
+
+	for _, route := range email.GetEmailController() {
+		if route.Active {
+			registerRoute(e, route.Method, route.Route, route.Handler, route.RequiredAuth, route.Scope, route.Permission, middleware.RequireVerified())
+		}
+	}
+
+	for _, route := range accounts.GetAccountsController() {
+		if route.Active {
+			registerRoute(e, route.Method, route.Route, route.Handler, route.RequiredAuth, route.Scope, route.Permission, middleware.RequireVerified())
+		}
+	}
+
+	for _, route := range identities.GetIdentitiesController() {
+		if route.Active {
+			registerRoute(e, route.Method, route.Route, route.Handler, route.RequiredAuth, route.Scope, route.Permission, middleware.RequireVerified())
+		}
+	}
+
+	for _, route := range outbox.GetOutboxController() {
+		if route.Active {
+			registerRoute(e, route.Method, route.Route, route.Handler, route.RequiredAuth, route.Scope, route.Permission, middleware.RequireVerified())
+		}
+	}
 
-	emailRoutes := email.GetEmailController()
-	for _, route := range emailRoutes {
+	for _, route := range templates.GetTemplatesController() {
 		if route.Active {
-			switch route.Method {
-			case http.MethodGet:
-				if route.RequiredAuth {
-					e.GET(route.Route, route.Handler, middleware.RequireAuth)
-				} else {
-					e.GET(route.Route, route.Handler)
-				}
-			case http.MethodPost:
-				if route.RequiredAuth {
-					e.POST(route.Route, route.Handler, middleware.RequireAuth)
-				} else {
-					e.POST(route.Route, route.Handler)
-				}
-			case http.MethodPut:
-				if route.RequiredAuth {
-					e.PUT(route.Route, route.Handler, middleware.RequireAuth)
-				} else {
-					e.PUT(route.Route, route.Handler)
-				}
-			case http.MethodDelete:
-				if route.RequiredAuth {
-					e.DELETE(route.Route, route.Handler, middleware.RequireAuth)
-				} else {
-					e.DELETE(route.Route, route.Handler)
-				}
-			default:
-				fmt.Printf("Méthode non supportée ou introuvable pour %v", route.Route)
-			}
+			registerRoute(e, route.Method, route.Route, route.Handler, route.RequiredAuth, route.Scope, route.Permission, middleware.RequireVerified())
 		}
 	}
 
-	for _, route := range routes {
+	for _, route := range dkim.GetDKIMController() {
 		if route.Active {
-			switch route.Method {
-			case http.MethodGet:
-				if route.RequiredAuth {
-					e.GET(route.Route, route.Handler, middleware.RequireAuth)
-				} else {
-					e.GET(route.Route, route.Handler)
-				}
-			case http.MethodPost:
-				if route.RequiredAuth {
-					e.POST(route.Route, route.Handler, middleware.RequireAuth)
-				} else {
-					e.POST(route.Route, route.Handler)
-				}
-			case http.MethodPut:
-				if route.RequiredAuth {
-					e.PUT(route.Route, route.Handler, middleware.RequireAuth)
-				} else {
-					e.PUT(route.Route, route.Handler)
-				}
-			case http.MethodDelete:
-				if route.RequiredAuth {
-					e.DELETE(route.Route, route.Handler, middleware.RequireAuth)
-				} else {
-					e.DELETE(route.Route, route.Handler)
-				}
-			default:
-				fmt.Printf("Méthode non supportée ou introuvable pour %v", route.Route)
-			}
+			registerRoute(e, route.Method, route.Route, route.Handler, route.RequiredAuth, route.Scope, route.Permission)
 		}
 	}
+
+	for _, route := range tokens.GetTokensController() {
+		if route.Active {
+			registerRoute(e, route.Method, route.Route, route.Handler, route.RequiredAuth, route.Scope, route.Permission)
+		}
+	}
+
+	for _, route := range users.GetUsersController() {
+		if route.Active {
+			registerRoute(e, route.Method, route.Route, route.Handler, route.RequiredAuth, route.Scope, route.Permission)
+		}
+	}
+}
+
+// registerRoute registers a single route, behind RequireAuth when requiredAuth
+// is set. Sessions may always call it, API tokens only when they grant scope:
+// an empty scope refuses every Bearer token. The role of the user must grant
+// permission, when set. The checks of authenticated users follow
+// authentication.
+func registerRoute(e *echo.Echo, method, path string, handler echo.HandlerFunc, requiredAuth bool, scope, permission string, checks ...echo.MiddlewareFunc) {
+	var middlewares []echo.MiddlewareFunc
+	if requiredAuth {
+		middlewares = append(middlewares, middleware.RequireAuth(scope))
+		if permission != "" {
+			middlewares = append(middlewares, middleware.RequirePermission(permission))
+		}
+		middlewares = append(middlewares, checks...)
+	}
+
+	switch method {
+	case http.MethodGet:
+		e.GET(path, handler, middlewares...)
+	case http.MethodPost:
+		e.POST(path, handler, middlewares...)
+	case http.MethodPut:
+		e.PUT(path, handler, middlewares...)
+	case http.MethodDelete:
+		e.DELETE(path, handler, middlewares...)
+	default:
+		fmt.Printf("Méthode non supportée ou introuvable pour %v", path)
+	}
 }
@@ -0,0 +1,63 @@
+package outbox
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/internal/apitoken"
+)
+
+type Controller struct {
+	Route        string
+	Method       string
+	Active       bool
+	Handler      func(c echo.Context) error
+	RequiredAuth bool
+	Scope        string
+	Permission   string
+}
+
+func GetOutboxController() []*Controller {
+	return []*Controller{
+		{
+			Route:        "/api/outbox",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      listView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/outbox/:id",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      getView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/outbox/:id/retry",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      retryView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailSend,
+		},
+		{
+			Route:        "/api/outbox/:id/reschedule",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      rescheduleView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailSend,
+		},
+		{
+			Route:        "/api/outbox/:id/cancel",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      cancelView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailSend,
+		},
+	}
+}
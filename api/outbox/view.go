@@ -0,0 +1,155 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/outbox"
+	"github.com/lyneq/mailapi/internal/pagination"
+	"github.com/lyneq/mailapi/internal/session"
+)
+
+// outboxStatuses lists the statuses accepted by the status filter
+var outboxStatuses = map[string]bool{
+	db.OutboxScheduled: true,
+	db.OutboxPending:   true,
+	db.OutboxSending:   true,
+	db.OutboxSent:      true,
+	db.OutboxFailed:    true,
+	db.OutboxCancelled: true,
+}
+
+// listView handles the request to list the user's queued and delivered emails, newest first
+func listView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	query := db.DB.Model(&db.OutboxMessage{}).Where("user_id = ?", userID)
+
+	if status := c.QueryParam("status"); status != "" {
+		if !outboxStatuses[status] {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("Unknown status %q", status),
+			})
+		}
+		query = query.Where("status = ?", status)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to list outbox: %v", err),
+		})
+	}
+
+	params := pagination.GetParamsFromContext(c)
+
+	var messages []db.OutboxMessage
+	err = query.Omit("raw").
+		Order("created_at DESC").
+		Offset(params.Offset).
+		Limit(params.PageSize).
+		Find(&messages).Error
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to list outbox: %v", err),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"messages":   messages,
+		"pagination": pagination.CreateResponse(params, int(total)),
+	})
+}
+
+// getView handles the request to get the delivery status of an email
+func getView(c echo.Context) error {
+	return action(c, outbox.Get)
+}
+
+// retryView handles the request to retry a failed email immediately
+func retryView(c echo.Context) error {
+	return action(c, outbox.Retry)
+}
+
+// cancelView handles the request to stop the delivery of a pending or scheduled email
+func cancelView(c echo.Context) error {
+	return action(c, outbox.Cancel)
+}
+
+// RescheduleRequest represents the request structure for moving a scheduled email
+type RescheduleRequest struct {
+	SendAt   string `json:"send_at" validate:"required"`
+	Timezone string `json:"timezone" validate:"omitempty,timezone"`
+}
+
+// rescheduleView handles the request to change the time a scheduled email is sent at
+func rescheduleView(c echo.Context) error {
+	req := new(RescheduleRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid request: %v", err),
+		})
+	}
+
+	if err := c.Validate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: %v", err),
+		})
+	}
+
+	sendAt, err := outbox.ParseSendAt(req.SendAt, req.Timezone, time.Now())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: %v", err),
+		})
+	}
+
+	return action(c, func(userID, id uint) (*db.OutboxMessage, error) {
+		return outbox.Reschedule(userID, id, sendAt, req.Timezone)
+	})
+}
+
+// action runs fn on the outbox message of the request and responds with the result
+func action(c echo.Context, fn func(userID, id uint) (*db.OutboxMessage, error)) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid outbox message ID",
+		})
+	}
+
+	msg, err := fn(userID, uint(id))
+	switch {
+	case errors.Is(err, outbox.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": err.Error(),
+		})
+	case errors.Is(err, outbox.ErrInvalidState):
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": err.Error(),
+		})
+	case err != nil:
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to update outbox message: %v", err),
+		})
+	}
+
+	return c.JSON(http.StatusOK, msg)
+}
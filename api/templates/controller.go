@@ -0,0 +1,95 @@
+package templates
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/internal/apitoken"
+)
+
+type Controller struct {
+	Route        string
+	Method       string
+	Active       bool
+	Handler      func(c echo.Context) error
+	RequiredAuth bool
+	Scope        string
+	Permission   string
+}
+
+func GetTemplatesController() []*Controller {
+	return []*Controller{
+		{
+			Route:        "/api/templates",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      listView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/templates",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      createView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/templates/:id",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      getView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/templates/:id",
+			Method:       http.MethodPut,
+			Active:       true,
+			Handler:      updateView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/templates/:id",
+			Method:       http.MethodDelete,
+			Active:       true,
+			Handler:      deleteView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeAdmin,
+		},
+		{
+			Route:        "/api/templates/:id/preview",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      previewView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/templates/:id/merge",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      mergeView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailSend,
+		},
+		{
+			Route:        "/api/merges/:id",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      mergeStatusView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailRead,
+		},
+		{
+			Route:        "/api/merges/:id/cancel",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      cancelMergeView,
+			RequiredAuth: true,
+			Scope:        apitoken.ScopeMailSend,
+		},
+	}
+}
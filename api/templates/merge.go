@@ -0,0 +1,338 @@
+package templates
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/account"
+	"github.com/lyneq/mailapi/internal/mailtemplate"
+	"github.com/lyneq/mailapi/internal/outbox"
+	"github.com/lyneq/mailapi/internal/pagination"
+	"github.com/lyneq/mailapi/internal/session"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+	"gorm.io/gorm"
+)
+
+// MergeRequest represents the request structure for a mail-merge send. Each
+// recipient is a set of template variables and must have an "email" one.
+// Recipients can also be uploaded as a CSV or JSON "recipients" file, or sent
+// as a text/csv body with the rate as query parameter.
+type MergeRequest struct {
+	Recipients []map[string]interface{} `json:"recipients" form:"-"`
+	// Rate is the number of emails sent per minute, at most the configured rate
+	Rate int `json:"rate" form:"rate" query:"rate" validate:"omitempty,min=1"`
+}
+
+// RecipientError reports a recipient whose email could not be prepared
+type RecipientError struct {
+	Row   int    `json:"row"`
+	Email string `json:"email,omitempty"`
+	Error string `json:"error"`
+}
+
+// mergeView handles the request to send a template to a list of recipients,
+// each email personalised with the recipient's variables. Nothing is queued
+// unless every email can be rendered.
+func mergeView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	tpl, err := findTemplate(c, userID)
+	if err != nil {
+		return templateErrorResponse(c, err)
+	}
+
+	req := new(MergeRequest)
+	if err := bindMerge(c, req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	limits := config.GetMergeConfig()
+	switch {
+	case len(req.Recipients) == 0:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Validation error: at least one recipient is required",
+		})
+	case len(req.Recipients) > limits.MaxRecipients:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: at most %d recipients are allowed", limits.MaxRecipients),
+		})
+	case req.Rate > limits.Rate:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: rate must be at most %d emails per minute", limits.Rate),
+		})
+	}
+	if req.Rate == 0 {
+		req.Rate = limits.Rate
+	}
+
+	found, err := account.Current(userID, session.GetAccountID(c.Request().Context()))
+	if err != nil {
+		return accountErrorResponse(c, err)
+	}
+	client, err := account.SMTPClient(found)
+	if err != nil {
+		return accountErrorResponse(c, err)
+	}
+
+	var messages []*db.OutboxMessage
+	var failures []RecipientError
+	for i, vars := range req.Recipients {
+		msg, err := personalise(client, tpl, found, vars)
+		if err != nil {
+			email, _ := vars["email"].(string)
+			failures = append(failures, RecipientError{Row: i + 1, Email: email, Error: err.Error()})
+			continue
+		}
+		msg.UserID = userID
+		messages = append(messages, msg)
+	}
+
+	if len(failures) > 0 {
+		outbox.Discard(messages...)
+		return c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":      fmt.Sprintf("%d of %d emails could not be prepared", len(failures), len(req.Recipients)),
+			"recipients": failures,
+		})
+	}
+
+	merge := &db.Merge{UserID: userID, TemplateID: tpl.ID, Rate: req.Rate}
+	if err := outbox.EnqueueMerge(merge, messages); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to queue emails: %v", err),
+		})
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
+		"message": fmt.Sprintf("%d emails queued, sending %d per minute", merge.Total, merge.Rate),
+		"merge":   merge,
+	})
+}
+
+// personalise renders the template for one recipient and composes the email
+// sent from the mail account
+func personalise(client *smtpclient.Client, tpl *db.Template, found *db.MailAccount, vars map[string]interface{}) (*db.OutboxMessage, error) {
+	recipient, err := mailtemplate.Recipient(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered, err := mailtemplate.Render(tpl, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &smtpclient.OutgoingMessage{
+		From:     account.Address(found),
+		To:       []string{recipient},
+		Subject:  rendered.Subject,
+		Body:     rendered.HTMLBody,
+		TextBody: rendered.TextBody,
+	}
+
+	spool, err := outbox.NewSpool()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compose email: %w", err)
+	}
+	if err := client.ComposeTo(msg, spool); err != nil {
+		spool.Remove()
+		return nil, fmt.Errorf("failed to compose email: %w", err)
+	}
+	spool.Close()
+	size, err := client.SignSpool(msg.Sender(), spool.Path())
+	if err != nil {
+		spool.Remove()
+		return nil, fmt.Errorf("failed to compose email: %w", err)
+	}
+
+	return &db.OutboxMessage{
+		AccountID:  account.ID(found),
+		From:       msg.Sender(),
+		Recipients: msg.Recipients(),
+		Subject:    msg.Subject,
+		SpoolPath:  spool.Path(),
+		Size:       size,
+		SaveSent:   account.SaveSent(found),
+	}, nil
+}
+
+// accountErrorResponse reports a mail account the session cannot send with
+func accountErrorResponse(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, account.ErrNoAccount):
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": "No mail account configured, add one with POST /api/accounts",
+		})
+	case errors.Is(err, account.ErrNoKey):
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": "Mail accounts are not available: no encryption key is configured",
+		})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to get mail account: %v", err),
+		})
+	}
+}
+
+// bindMerge reads a mail-merge request from a JSON body, a text/csv body or a
+// multipart form with a "recipients" file
+func bindMerge(c echo.Context, req *MergeRequest) error {
+	contentType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+
+	if contentType == "text/csv" {
+		recipients, err := mailtemplate.ParseCSV(c.Request().Body)
+		if err != nil {
+			return fmt.Errorf("Invalid recipients: %v", err)
+		}
+		req.Recipients = recipients
+
+		if rate := c.QueryParam("rate"); rate != "" {
+			if req.Rate, err = strconv.Atoi(rate); err != nil {
+				return fmt.Errorf("Invalid request: invalid rate %q", rate)
+			}
+		}
+	} else if err := c.Bind(req); err != nil {
+		return fmt.Errorf("Invalid request: %v", err)
+	}
+
+	if contentType == echo.MIMEMultipartForm {
+		fh, err := c.FormFile("recipients")
+		if err != nil {
+			return fmt.Errorf("Invalid request: missing recipients file")
+		}
+		file, err := fh.Open()
+		if err != nil {
+			return fmt.Errorf("Invalid recipients: %v", err)
+		}
+		defer file.Close()
+
+		if req.Recipients, err = parseRecipientsFile(fh.Filename, file); err != nil {
+			return fmt.Errorf("Invalid recipients: %v", err)
+		}
+	}
+
+	if err := c.Validate(req); err != nil {
+		return fmt.Errorf("Validation error: %v", err)
+	}
+	return nil
+}
+
+// parseRecipientsFile parses an uploaded recipients file, JSON when its name
+// ends in .json and CSV otherwise
+func parseRecipientsFile(filename string, r io.Reader) ([]map[string]interface{}, error) {
+	if !strings.EqualFold(filepath.Ext(filename), ".json") {
+		return mailtemplate.ParseCSV(r)
+	}
+
+	var recipients []map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&recipients); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	return recipients, nil
+}
+
+// mergeStatusView handles the request to follow a mail-merge: the number of
+// emails per delivery status and the status of each recipient
+func mergeStatusView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	var merge db.Merge
+	err = db.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&merge).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Mail-merge not found",
+		})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to get mail-merge: %v", err),
+		})
+	}
+
+	query := db.DB.Model(&db.OutboxMessage{}).Where("merge_id = ?", merge.ID)
+
+	var counts []struct {
+		Status string
+		Count  int
+	}
+	if err := query.Session(&gorm.Session{}).Select("status, count(*) AS count").Group("status").Scan(&counts).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to get mail-merge: %v", err),
+		})
+	}
+	statuses := make(map[string]int, len(counts))
+	for _, count := range counts {
+		statuses[count.Status] = count.Count
+	}
+
+	params := pagination.GetParamsFromContext(c)
+
+	var messages []db.OutboxMessage
+	err = query.Omit("raw").
+		Order("id").
+		Offset(params.Offset).
+		Limit(params.PageSize).
+		Find(&messages).Error
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to get mail-merge: %v", err),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"merge":      merge,
+		"statuses":   statuses,
+		"recipients": messages,
+		"pagination": pagination.CreateResponse(params, merge.Total),
+	})
+}
+
+// cancelMergeView handles the request to stop a mail-merge, cancelling the emails not sent yet
+func cancelMergeView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid mail-merge ID",
+		})
+	}
+
+	cancelled, err := outbox.CancelMerge(userID, uint(id))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to cancel mail-merge: %v", err),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":   fmt.Sprintf("%d emails cancelled", cancelled),
+		"cancelled": cancelled,
+	})
+}
@@ -0,0 +1,249 @@
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/mailtemplate"
+	"github.com/lyneq/mailapi/internal/pagination"
+	"github.com/lyneq/mailapi/internal/session"
+	"gorm.io/gorm"
+)
+
+// TemplateRequest represents the request structure for creating or updating a template
+type TemplateRequest struct {
+	Name     string `json:"name" validate:"required,max=255"`
+	Subject  string `json:"subject" validate:"required,max=998"`
+	HTMLBody string `json:"html_body" validate:"required_without=TextBody"`
+	TextBody string `json:"text_body" validate:"required_without=HTMLBody"`
+}
+
+// PreviewRequest represents the request structure for rendering a template
+type PreviewRequest struct {
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// errTemplateNotFound is returned when the template does not exist or belongs to another user
+var errTemplateNotFound = errors.New("Template not found")
+
+// listView handles the request to list the user's templates, sorted by name
+func listView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	query := db.DB.Model(&db.Template{}).Where("user_id = ?", userID)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to list templates: %v", err),
+		})
+	}
+
+	params := pagination.GetParamsFromContext(c)
+
+	var templates []db.Template
+	err = query.Order("name").
+		Offset(params.Offset).
+		Limit(params.PageSize).
+		Find(&templates).Error
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to list templates: %v", err),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"templates":  templates,
+		"pagination": pagination.CreateResponse(params, int(total)),
+	})
+}
+
+// createView handles the request to store a new template
+func createView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	tpl := &db.Template{UserID: userID}
+	if err := bindTemplate(c, tpl); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	if err := db.DB.Create(tpl).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to create template: %v", err),
+		})
+	}
+
+	return c.JSON(http.StatusCreated, tpl)
+}
+
+// getView handles the request to get a template
+func getView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	tpl, err := findTemplate(c, userID)
+	if err != nil {
+		return templateErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, tpl)
+}
+
+// updateView handles the request to replace the content of a template
+func updateView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	tpl, err := findTemplate(c, userID)
+	if err != nil {
+		return templateErrorResponse(c, err)
+	}
+
+	if err := bindTemplate(c, tpl); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	if err := db.DB.Save(tpl).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to update template: %v", err),
+		})
+	}
+
+	return c.JSON(http.StatusOK, tpl)
+}
+
+// deleteView handles the request to delete a template
+func deleteView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	tpl, err := findTemplate(c, userID)
+	if err != nil {
+		return templateErrorResponse(c, err)
+	}
+
+	if err := db.DB.Delete(tpl).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to delete template: %v", err),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Template deleted",
+	})
+}
+
+// previewView handles the request to render a template with sample variables
+func previewView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	tpl, err := findTemplate(c, userID)
+	if err != nil {
+		return templateErrorResponse(c, err)
+	}
+
+	req := new(PreviewRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid request: %v", err),
+		})
+	}
+
+	rendered, err := mailtemplate.Render(tpl, req.Variables)
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{
+			"error": fmt.Sprintf("Failed to render template: %v", err),
+		})
+	}
+
+	return c.JSON(http.StatusOK, rendered)
+}
+
+// bindTemplate fills tpl from the request and checks its template syntax
+func bindTemplate(c echo.Context, tpl *db.Template) error {
+	req := new(TemplateRequest)
+	if err := c.Bind(req); err != nil {
+		return fmt.Errorf("Invalid request: %v", err)
+	}
+
+	if err := c.Validate(req); err != nil {
+		return fmt.Errorf("Validation error: %v", err)
+	}
+
+	tpl.Name = req.Name
+	tpl.Subject = req.Subject
+	tpl.HTMLBody = req.HTMLBody
+	tpl.TextBody = req.TextBody
+
+	if err := mailtemplate.Check(tpl); err != nil {
+		return fmt.Errorf("Invalid template: %v", err)
+	}
+	return nil
+}
+
+// findTemplate loads the template of the request owned by the user
+func findTemplate(c echo.Context, userID uint) (*db.Template, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return nil, errTemplateNotFound
+	}
+
+	var tpl db.Template
+	err = db.DB.Where("id = ? AND user_id = ?", id, userID).First(&tpl).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errTemplateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tpl, nil
+}
+
+// templateErrorResponse responds to a failed findTemplate
+func templateErrorResponse(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, errTemplateNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": err.Error(),
+		})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to get template: %v", err),
+		})
+	}
+}
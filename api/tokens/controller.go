@@ -0,0 +1,45 @@
+package tokens
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type Controller struct {
+	Route        string
+	Method       string
+	Active       bool
+	Handler      func(c echo.Context) error
+	RequiredAuth bool
+	Scope        string
+	Permission   string
+}
+
+// GetTokensController returns the routes managing API tokens, reserved to
+// sessions so that a token cannot issue other tokens
+func GetTokensController() []*Controller {
+	return []*Controller{
+		{
+			Route:        "/api/tokens",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      listView,
+			RequiredAuth: true,
+		},
+		{
+			Route:        "/api/tokens",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      createView,
+			RequiredAuth: true,
+		},
+		{
+			Route:        "/api/tokens/:id",
+			Method:       http.MethodDelete,
+			Active:       true,
+			Handler:      revokeView,
+			RequiredAuth: true,
+		},
+	}
+}
@@ -0,0 +1,124 @@
+package tokens
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/apitoken"
+	"github.com/lyneq/mailapi/internal/session"
+)
+
+// defaultLifetime is the lifetime of tokens created without expires_in_days
+const defaultLifetime = 90 * 24 * time.Hour
+
+// TokenRequest represents the request structure for creating an API token
+type TokenRequest struct {
+	Name   string   `json:"name" validate:"required,max=100"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=mail:read mail:send admin"`
+	// ExpiresInDays is the lifetime of the token, 90 days when omitted
+	ExpiresInDays int `json:"expires_in_days" validate:"omitempty,min=1,max=365"`
+}
+
+// TokenResponse is a created API token, the only response holding the token itself
+type TokenResponse struct {
+	db.APIToken
+	Token string `json:"token"`
+}
+
+// listView handles the request to list the API tokens of the user
+func listView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	tokens, err := apitoken.List(userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"tokens": tokens,
+	})
+}
+
+// createView handles the request to issue an API token
+func createView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	req := new(TokenRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid request: %v", err),
+		})
+	}
+
+	if err := c.Validate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: %v", err),
+		})
+	}
+
+	lifetime := defaultLifetime
+	if req.ExpiresInDays > 0 {
+		lifetime = time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	}
+	slices.Sort(req.Scopes)
+
+	plaintext, token, err := apitoken.Create(userID, req.Name, slices.Compact(req.Scopes), lifetime)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusCreated, TokenResponse{APIToken: *token, Token: plaintext})
+}
+
+// revokeView handles the request to revoke an API token
+func revokeView(c echo.Context) error {
+	userID, err := session.GetUserID(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid token ID",
+		})
+	}
+
+	err = apitoken.Revoke(userID, uint(id))
+	if errors.Is(err, apitoken.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "API token not found",
+		})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to revoke token: %v", err),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "API token revoked",
+	})
+}
@@ -0,0 +1,121 @@
+package users
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/internal/rbac"
+)
+
+type Controller struct {
+	Route        string
+	Method       string
+	Active       bool
+	Handler      func(c echo.Context) error
+	RequiredAuth bool
+	Scope        string
+	Permission   string
+}
+
+// GetUsersController returns the routes of the user administration, reserved
+// to sessions of users whose role grants the users permissions
+func GetUsersController() []*Controller {
+	return []*Controller{
+		{
+			Route:        "/api/admin/users",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      listView,
+			RequiredAuth: true,
+			Permission:   rbac.PermissionUsersRead,
+		},
+		{
+			Route:        "/api/admin/users",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      createView,
+			RequiredAuth: true,
+			Permission:   rbac.PermissionUsersManage,
+		},
+		{
+			Route:        "/api/admin/users/:id",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      getView,
+			RequiredAuth: true,
+			Permission:   rbac.PermissionUsersRead,
+		},
+		{
+			Route:        "/api/admin/users/:id",
+			Method:       http.MethodDelete,
+			Active:       true,
+			Handler:      deleteView,
+			RequiredAuth: true,
+			Permission:   rbac.PermissionUsersManage,
+		},
+		{
+			Route:        "/api/admin/users/:id/disable",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      disableView,
+			RequiredAuth: true,
+			Permission:   rbac.PermissionUsersManage,
+		},
+		{
+			Route:        "/api/admin/users/:id/enable",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      enableView,
+			RequiredAuth: true,
+			Permission:   rbac.PermissionUsersManage,
+		},
+		{
+			Route:        "/api/admin/users/:id/role",
+			Method:       http.MethodPut,
+			Active:       true,
+			Handler:      roleView,
+			RequiredAuth: true,
+			Permission:   rbac.PermissionUsersManage,
+		},
+		{
+			Route:        "/api/admin/users/:id/logout",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      logoutView,
+			RequiredAuth: true,
+			Permission:   rbac.PermissionUsersManage,
+		},
+		{
+			Route:        "/api/admin/users/:id/unlock",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      unlockView,
+			RequiredAuth: true,
+			Permission:   rbac.PermissionUsersManage,
+		},
+		{
+			Route:        "/api/admin/users/:id/identities",
+			Method:       http.MethodPost,
+			Active:       true,
+			Handler:      assignIdentityView,
+			RequiredAuth: true,
+			Permission:   rbac.PermissionUsersManage,
+		},
+		{
+			Route:        "/api/admin/lockouts",
+			Method:       http.MethodGet,
+			Active:       true,
+			Handler:      lockoutsView,
+			RequiredAuth: true,
+			Permission:   rbac.PermissionUsersRead,
+		},
+		{
+			Route:        "/api/admin/lockouts/:id",
+			Method:       http.MethodDelete,
+			Active:       true,
+			Handler:      deleteLockoutView,
+			RequiredAuth: true,
+			Permission:   rbac.PermissionUsersManage,
+		},
+	}
+}
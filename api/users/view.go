@@ -0,0 +1,313 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/identity"
+	"github.com/lyneq/mailapi/internal/lockout"
+	"github.com/lyneq/mailapi/internal/pagination"
+	"github.com/lyneq/mailapi/internal/session"
+	"github.com/lyneq/mailapi/internal/users"
+	"github.com/lyneq/mailapi/internal/verification"
+)
+
+// CreateUserRequest describes a user created by an administrator
+type CreateUserRequest struct {
+	Username string `json:"username" validate:"required,min=3,max=64"`
+	Password string `json:"password" validate:"required,min=3,max=64"`
+	Email    string `json:"email" validate:"omitempty,email,max=254"`
+	Role     string `json:"role" validate:"omitempty,oneof=User Admin"`
+}
+
+// AssignIdentityRequest describes an address an administrator lets a user send from
+type AssignIdentityRequest struct {
+	Address   string `json:"address" validate:"required,email"`
+	Name      string `json:"name" validate:"max=255"`
+	ReplyTo   string `json:"reply_to" validate:"omitempty,mailbox"`
+	IsDefault bool   `json:"is_default"`
+}
+
+// RoleRequest promotes or demotes a user
+type RoleRequest struct {
+	Role string `json:"role" validate:"required,oneof=User Admin"`
+}
+
+// listView handles the request to list or search users
+func listView(c echo.Context) error {
+	filter := users.Filter{
+		Query: c.QueryParam("q"),
+		Role:  c.QueryParam("role"),
+	}
+	if value := c.QueryParam("disabled"); value != "" {
+		disabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "disabled must be true or false",
+			})
+		}
+		filter.Disabled = &disabled
+	}
+
+	params := pagination.GetParamsFromContext(c)
+	list, total, err := users.Search(filter, params.Offset, params.PageSize)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"users":      list,
+		"pagination": pagination.CreateResponse(params, int(total)),
+	})
+}
+
+// getView handles the request to read a user
+func getView(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	user, err := users.Get(id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+// createView handles the request to create a user
+func createView(c echo.Context) error {
+	req := new(CreateUserRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid request: %v", err),
+		})
+	}
+	req.Email = verification.NormalizeEmail(req.Email)
+	if err := c.Validate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: %v", err),
+		})
+	}
+
+	user, err := users.Create(req.Username, req.Password, req.Email, req.Role)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusCreated, user)
+}
+
+// disableView handles the request to disable a user and end their sessions
+func disableView(c echo.Context) error {
+	return setDisabled(c, true)
+}
+
+// enableView handles the request to enable a disabled user
+func enableView(c echo.Context) error {
+	return setDisabled(c, false)
+}
+
+// roleView handles the request to promote or demote a user
+func roleView(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	req := new(RoleRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid request: %v", err),
+		})
+	}
+	if err := c.Validate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: %v", err),
+		})
+	}
+
+	actorID, _ := session.GetUserID(c.Request().Context())
+	user, err := users.SetRole(actorID, id, req.Role)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+// logoutView handles the request to end the sessions of a user
+func logoutView(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	if _, err := users.RevokeSessions(id); err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "The sessions of the user have ended",
+	})
+}
+
+// unlockView handles the request to forget the failed sign-ins of a user
+func unlockView(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	user, err := users.Get(id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	if err := lockout.Reset(user.Username); err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "The user can sign in again",
+	})
+}
+
+// lockoutsView handles the request to list the usernames and IP addresses
+// with failed sign-ins
+func lockoutsView(c echo.Context) error {
+	list, err := lockout.List()
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"lockouts": list,
+	})
+}
+
+// deleteLockoutView handles the request to unlock a username or an IP address
+func deleteLockoutView(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid lockout ID",
+		})
+	}
+
+	if err := lockout.Unlock(uint(id)); errors.Is(err, lockout.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Lockout not found"})
+	} else if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Unlocked",
+	})
+}
+
+// assignIdentityView handles the request to give a user a verified sender identity
+func assignIdentityView(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	req := new(AssignIdentityRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid request: %v", err),
+		})
+	}
+	if err := c.Validate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Validation error: %v", err),
+		})
+	}
+
+	user, err := users.Get(id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	actorID, _ := session.GetUserID(c.Request().Context())
+	assigned := &db.Identity{UserID: user.ID, Address: req.Address, Name: req.Name, ReplyTo: req.ReplyTo, IsDefault: req.IsDefault}
+	err = identity.Assign(actorID, assigned)
+	switch {
+	case errors.Is(err, identity.ErrSenderNotAllowed):
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": fmt.Sprintf("The user may not send from %s", assigned.Address),
+		})
+	case errors.Is(err, identity.ErrDuplicate), errors.Is(err, identity.ErrAddressTaken):
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": err.Error(),
+		})
+	case err != nil:
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusCreated, assigned)
+}
+
+// deleteView handles the request to delete a user and their data
+func deleteView(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	actorID, _ := session.GetUserID(c.Request().Context())
+	if err := users.Delete(actorID, id); err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "User deleted",
+	})
+}
+
+// setDisabled disables or enables the user of the route
+func setDisabled(c echo.Context, disabled bool) error {
+	id, err := userID(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid user ID",
+		})
+	}
+
+	actorID, _ := session.GetUserID(c.Request().Context())
+	user, err := users.SetDisabled(actorID, id, disabled)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+// userID parses the user ID of the route
+func userID(c echo.Context) (uint, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	return uint(id), err
+}
+
+// errorResponse maps the errors of the users package to HTTP responses
+func errorResponse(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, users.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	case errors.Is(err, users.ErrUsernameTaken), errors.Is(err, users.ErrEmailTaken), errors.Is(err, users.ErrInvalidRole):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, users.ErrSelf), errors.Is(err, users.ErrLastAdmin):
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Config holds all configuration values
@@ -14,6 +16,16 @@ type Config struct {
 	Api            ApiConfig
 	SMTP           SMTPConfig
 	IMAP           IMAPConfig
+	Attachments    AttachmentsConfig
+	Outbox         OutboxConfig
+	Merge          MergeConfig
+	Accounts       AccountsConfig
+	Users          UsersConfig
+	SignIn         SignInConfig
+	// DKIM holds the signing settings by lower-cased sending domain
+	DKIM map[string]DKIMConfig
+	// OAuth holds the OAuth 2.0 providers of mail accounts by lower-cased name
+	OAuth map[string]OAuthConfig
 }
 
 // DatabaseConfig holds database configuration values
@@ -32,6 +44,17 @@ type SMTPConfig struct {
 	Port     string
 	Username string
 	Password string
+	// SaveSent controls whether sent messages are copied to the IMAP Sent folder.
+	// Disable it for providers that already do this (Gmail, Proton Bridge).
+	SaveSent bool
+	// AllowedHeaders lists the custom X- header fields clients may set on sent emails
+	AllowedHeaders []string
+	// SenderDomains lists the domains identities may send from, the domain of
+	// Username when empty
+	SenderDomains []string
+	// IdleTimeout is how long the connection to the server is kept open between messages
+	IdleTimeout time.Duration
+	TLS         TLSConfig
 }
 
 // IMAPConfig holds IMAP configuration values
@@ -40,6 +63,125 @@ type IMAPConfig struct {
 	Port     string
 	Username string
 	Password string
+	TLS      TLSConfig
+}
+
+// TLSConfig holds the transport security settings of a mail server connection,
+// read from the tls_* keys of the SMTP and IMAP sections
+type TLSConfig struct {
+	// Mode is "implicit" (TLS from the start), "starttls" (required upgrade) or
+	// "none". When empty it is implicit on ports 465 and 993, starttls otherwise.
+	Mode string
+	// SkipVerify disables the verification of the server certificate
+	SkipVerify bool
+	// CAFile is a PEM bundle of certificate authorities trusted in addition to the system ones
+	CAFile string
+	// PinnedCert is the SHA-256 fingerprint of the expected server certificate,
+	// or the path of a PEM file holding it. It replaces the chain verification.
+	PinnedCert string
+	// ClientCert and ClientKey are the PEM files of a client certificate
+	ClientCert string
+	ClientKey  string
+	// MinVersion is the minimum TLS version: 1.0, 1.1, 1.2 (default) or 1.3
+	MinVersion string
+}
+
+// AttachmentsConfig holds the limits applied to attachments of sent emails
+type AttachmentsConfig struct {
+	MaxCount     int
+	MaxFileSize  int64
+	MaxTotalSize int64
+	// AllowedTypes lists accepted MIME types, "image/*" style wildcards included. Empty allows every type.
+	AllowedTypes      []string
+	BlockedExtensions []string
+}
+
+// OutboxConfig holds the retry policy of the outbound queue
+type OutboxConfig struct {
+	// MaxAttempts is the number of delivery attempts before a message is marked as failed
+	MaxAttempts int
+	// RetryDelay is the delay before the first retry, doubled after each attempt
+	RetryDelay time.Duration
+	// PollInterval is how often the queue is checked for messages due for delivery
+	PollInterval time.Duration
+	// SpoolDir is the directory of the composed messages waiting for
+	// delivery, spool next to the database when empty
+	SpoolDir string
+}
+
+// DKIMConfig holds the DKIM signing settings of a sending domain, read from a
+// [DKIM example.com] section
+type DKIMConfig struct {
+	Selector string
+	// PrivateKey is the path of the PEM encoded RSA or Ed25519 private key
+	PrivateKey string
+	// Headers lists the header fields to sign, a recommended set when empty
+	Headers []string
+}
+
+// MergeConfig holds the limits of mail-merge bulk sends
+type MergeConfig struct {
+	// MaxRecipients is the largest number of recipients accepted by one mail-merge
+	MaxRecipients int
+	// Rate is the default and maximum number of mail-merge emails sent per minute
+	Rate int
+}
+
+// AccountsConfig holds the settings of the per-user mail accounts
+type AccountsConfig struct {
+	// EncryptionKey is the base64 encoded 32 bytes AES key encrypting account
+	// credentials, overridden by the MAILAPI_ENCRYPTION_KEY environment variable
+	EncryptionKey string
+	// SharedAccount lets users without a mail account use the [IMAP] and [SMTP] account
+	SharedAccount bool
+}
+
+// UsersConfig holds the settings of user sign-ups and the emails sent to users
+type UsersConfig struct {
+	// From is the sender of verification and password reset emails, the
+	// username of the [SMTP] section when empty
+	From string
+	// VerifyURL is the page of the client verifying email addresses, linked
+	// with a token query parameter
+	VerifyURL string
+	// ResetURL is the page of the client resetting passwords, linked with a
+	// token query parameter
+	ResetURL string
+	// IdentityVerifyURL is the page of the client confirming sender
+	// identities, linked with a token query parameter
+	IdentityVerifyURL string
+	// RequireVerified denies the mail endpoints to users without a verified email address
+	RequireVerified bool
+}
+
+// SignInConfig holds the limits slowing down password guessing
+type SignInConfig struct {
+	// MaxAttempts is the number of failed sign-ins of a username before it is locked out
+	MaxAttempts int
+	// IPMaxAttempts is the number of failed sign-ins from an IP address, for
+	// any username, before it is locked out
+	IPMaxAttempts int
+	// Delay is the wait after the second failed sign-in of a username,
+	// doubled after each further failure
+	Delay time.Duration
+	// Lockout is how long a username or an IP address stays locked out, and
+	// how long failures are remembered
+	Lockout time.Duration
+}
+
+// OAuthConfig holds an OAuth 2.0 provider issuing access tokens to mail
+// accounts, read from an [OAuth google] section
+type OAuthConfig struct {
+	ClientID     string
+	ClientSecret string
+	// AuthURL is the authorization endpoint users are sent to
+	AuthURL string
+	// TokenURL is the endpoint exchanging authorization codes and refresh tokens
+	TokenURL string
+	// RedirectURL is the public URL of /api/oauth/callback, registered with the provider
+	RedirectURL string
+	// Scopes lists the requested scopes, e.g. https://mail.google.com/
+	Scopes []string
 }
 
 var (
@@ -59,6 +201,32 @@ func LoadConfig() error {
 	}
 	defer file.Close()
 
+	// Defaults for values that are enabled unless explicitly turned off
+	AppConfig.SMTP.SaveSent = true
+	AppConfig.Attachments = AttachmentsConfig{
+		MaxCount:          10,
+		MaxFileSize:       10 << 20,
+		MaxTotalSize:      25 << 20,
+		BlockedExtensions: []string{".exe", ".bat", ".cmd", ".com", ".scr", ".pif", ".vbs", ".js", ".jar", ".msi"},
+	}
+	AppConfig.Outbox = OutboxConfig{
+		MaxAttempts:  8,
+		RetryDelay:   time.Minute,
+		PollInterval: 15 * time.Second,
+	}
+	AppConfig.Merge = MergeConfig{
+		MaxRecipients: 1000,
+		Rate:          60,
+	}
+	AppConfig.SignIn = SignInConfig{
+		MaxAttempts:   5,
+		IPMaxAttempts: 20,
+		Delay:         time.Second,
+		Lockout:       15 * time.Minute,
+	}
+	AppConfig.DKIM = make(map[string]DKIMConfig)
+	AppConfig.OAuth = make(map[string]OAuthConfig)
+
 	var currentSection string
 	scanner := bufio.NewScanner(file)
 
@@ -116,6 +284,134 @@ func LoadConfig() error {
 				AppConfig.SMTP.Username = value
 			case "password":
 				AppConfig.SMTP.Password = value
+			case "save_sent":
+				AppConfig.SMTP.SaveSent = parseBool(value, true)
+			case "allowed_headers":
+				AppConfig.SMTP.AllowedHeaders = splitList(value)
+			case "sender_domains":
+				AppConfig.SMTP.SenderDomains = splitList(value)
+			case "idle_timeout":
+				if d, err := time.ParseDuration(value); err == nil && d > 0 {
+					AppConfig.SMTP.IdleTimeout = d
+				}
+			default:
+				parseTLSKey(&AppConfig.SMTP.TLS, key, value)
+			}
+		} else if currentSection == "Outbox" {
+			switch key {
+			case "max_attempts":
+				if n, err := strconv.Atoi(value); err == nil && n > 0 {
+					AppConfig.Outbox.MaxAttempts = n
+				}
+			case "retry_delay":
+				if d, err := time.ParseDuration(value); err == nil && d > 0 {
+					AppConfig.Outbox.RetryDelay = d
+				}
+			case "poll_interval":
+				if d, err := time.ParseDuration(value); err == nil && d > 0 {
+					AppConfig.Outbox.PollInterval = d
+				}
+			case "spool_dir":
+				AppConfig.Outbox.SpoolDir = value
+			}
+		} else if strings.HasPrefix(currentSection, "DKIM ") {
+			domain := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(currentSection, "DKIM ")))
+			dkim := AppConfig.DKIM[domain]
+			switch key {
+			case "selector":
+				dkim.Selector = value
+			case "private_key":
+				dkim.PrivateKey = value
+			case "headers":
+				dkim.Headers = splitList(value)
+			}
+			AppConfig.DKIM[domain] = dkim
+		} else if strings.HasPrefix(currentSection, "OAuth ") {
+			name := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(currentSection, "OAuth ")))
+			provider := AppConfig.OAuth[name]
+			switch key {
+			case "client_id":
+				provider.ClientID = value
+			case "client_secret":
+				provider.ClientSecret = value
+			case "auth_url":
+				provider.AuthURL = value
+			case "token_url":
+				provider.TokenURL = value
+			case "redirect_url":
+				provider.RedirectURL = value
+			case "scopes":
+				provider.Scopes = splitList(value)
+			}
+			AppConfig.OAuth[name] = provider
+		} else if currentSection == "Merge" {
+			switch key {
+			case "max_recipients":
+				if n, err := strconv.Atoi(value); err == nil && n > 0 {
+					AppConfig.Merge.MaxRecipients = n
+				}
+			case "rate":
+				if n, err := strconv.Atoi(value); err == nil && n > 0 {
+					AppConfig.Merge.Rate = n
+				}
+			}
+		} else if currentSection == "Accounts" {
+			switch key {
+			case "encryption_key":
+				AppConfig.Accounts.EncryptionKey = value
+			case "shared_account":
+				AppConfig.Accounts.SharedAccount = parseBool(value, false)
+			}
+		} else if currentSection == "Users" {
+			switch key {
+			case "from":
+				AppConfig.Users.From = value
+			case "verify_url":
+				AppConfig.Users.VerifyURL = value
+			case "reset_url":
+				AppConfig.Users.ResetURL = value
+			case "identity_verify_url":
+				AppConfig.Users.IdentityVerifyURL = value
+			case "require_verified":
+				AppConfig.Users.RequireVerified = parseBool(value, false)
+			}
+		} else if currentSection == "SignIn" {
+			switch key {
+			case "max_attempts":
+				if n, err := strconv.Atoi(value); err == nil && n > 0 {
+					AppConfig.SignIn.MaxAttempts = n
+				}
+			case "ip_max_attempts":
+				if n, err := strconv.Atoi(value); err == nil && n > 0 {
+					AppConfig.SignIn.IPMaxAttempts = n
+				}
+			case "delay":
+				if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+					AppConfig.SignIn.Delay = d
+				}
+			case "lockout":
+				if d, err := time.ParseDuration(value); err == nil && d > 0 {
+					AppConfig.SignIn.Lockout = d
+				}
+			}
+		} else if currentSection == "Attachments" {
+			switch key {
+			case "max_count":
+				if n, err := strconv.Atoi(value); err == nil {
+					AppConfig.Attachments.MaxCount = n
+				}
+			case "max_file_size":
+				if n, err := parseSize(value); err == nil {
+					AppConfig.Attachments.MaxFileSize = n
+				}
+			case "max_total_size":
+				if n, err := parseSize(value); err == nil {
+					AppConfig.Attachments.MaxTotalSize = n
+				}
+			case "allowed_types":
+				AppConfig.Attachments.AllowedTypes = splitList(value)
+			case "blocked_extensions":
+				AppConfig.Attachments.BlockedExtensions = splitList(value)
 			}
 		} else if currentSection == "IMAP" {
 			switch key {
@@ -127,6 +423,8 @@ func LoadConfig() error {
 				AppConfig.IMAP.Username = value
 			case "password":
 				AppConfig.IMAP.Password = value
+			default:
+				parseTLSKey(&AppConfig.IMAP.TLS, key, value)
 			}
 		}
 	}
@@ -135,10 +433,73 @@ func LoadConfig() error {
 		return fmt.Errorf("error reading config file: %w", err)
 	}
 
+	// Keep the key out of the configuration file when the environment provides it
+	if key := os.Getenv("MAILAPI_ENCRYPTION_KEY"); key != "" {
+		AppConfig.Accounts.EncryptionKey = key
+	}
+
 	fmt.Printf("[App] Configuration loaded from file %v\n", file.Name())
 	return nil
 }
 
+// parseTLSKey reads a tls_* key of a server section into tlsConfig
+func parseTLSKey(tlsConfig *TLSConfig, key, value string) {
+	switch key {
+	case "tls_mode":
+		tlsConfig.Mode = strings.ToLower(value)
+	case "tls_verify":
+		tlsConfig.SkipVerify = !parseBool(value, true)
+	case "tls_ca_file":
+		tlsConfig.CAFile = value
+	case "tls_pinned_cert":
+		tlsConfig.PinnedCert = value
+	case "tls_client_cert":
+		tlsConfig.ClientCert = value
+	case "tls_client_key":
+		tlsConfig.ClientKey = value
+	case "tls_min_version":
+		tlsConfig.MinVersion = value
+	}
+}
+
+// parseBool parses a boolean configuration value, falling back to def when it is invalid
+func parseBool(value string, def bool) bool {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// parseSize parses a size such as 512, 512KB, 10MB or 1GB into bytes
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(value, suffix) {
+			multiplier = m
+			value = strings.TrimSpace(strings.TrimSuffix(value, suffix))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(value, "B"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", value, err)
+	}
+	return n * multiplier, nil
+}
+
+// splitList splits a comma-separated value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // GetAllowedDomains returns the list of allowed domains
 func GetAllowedDomains() []string {
 	return AppConfig.AllowedDomains
@@ -167,3 +528,44 @@ func GetSMTPConfig() SMTPConfig {
 func GetIMAPConfig() IMAPConfig {
 	return AppConfig.IMAP
 }
+
+// GetAttachmentsConfig returns the attachment limits
+func GetAttachmentsConfig() AttachmentsConfig {
+	return AppConfig.Attachments
+}
+
+// GetOutboxConfig returns the retry policy of the outbound queue
+func GetOutboxConfig() OutboxConfig {
+	return AppConfig.Outbox
+}
+
+// GetMergeConfig returns the mail-merge limits
+func GetMergeConfig() MergeConfig {
+	return AppConfig.Merge
+}
+
+// GetAccountsConfig returns the settings of the per-user mail accounts
+func GetAccountsConfig() AccountsConfig {
+	return AppConfig.Accounts
+}
+
+// GetUsersConfig returns the settings of sign-ups and user emails
+func GetUsersConfig() UsersConfig {
+	return AppConfig.Users
+}
+
+// GetSignInConfig returns the limits of failed sign-ins
+func GetSignInConfig() SignInConfig {
+	return AppConfig.SignIn
+}
+
+// GetDKIMConfig returns the DKIM signing settings by sending domain
+func GetDKIMConfig() map[string]DKIMConfig {
+	return AppConfig.DKIM
+}
+
+// GetOAuthConfig returns the OAuth 2.0 provider of the given name
+func GetOAuthConfig(name string) (OAuthConfig, bool) {
+	provider, ok := AppConfig.OAuth[strings.ToLower(name)]
+	return provider, ok
+}
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MailAccount is an IMAP/SMTP account of a user. Passwords and OAuth tokens
+// are encrypted with the key of the [Accounts] section and never serialised.
+// The default account is used by sessions that did not select another one.
+type MailAccount struct {
+	gorm.Model
+	UserID       uint   `json:"user_id" gorm:"index;not null"`
+	Name         string `json:"name"`
+	Email        string `json:"email" gorm:"not null"`
+	IMAPHost     string `json:"imap_host" gorm:"not null"`
+	IMAPPort     int    `json:"imap_port" gorm:"not null"`
+	IMAPTLSMode  string `json:"imap_tls_mode"`
+	IMAPUsername string `json:"imap_username" gorm:"not null"`
+	IMAPPassword string `json:"-" gorm:"not null"`
+	SMTPHost     string `json:"smtp_host" gorm:"not null"`
+	SMTPPort     int    `json:"smtp_port" gorm:"not null"`
+	SMTPTLSMode  string `json:"smtp_tls_mode"`
+	SMTPUsername string `json:"smtp_username" gorm:"not null"`
+	SMTPPassword string `json:"-" gorm:"not null"`
+	// EmailVerified is set once the user opened a link mailed to Email. The
+	// servers are chosen by the user, so logging in proves nothing about it.
+	EmailVerified bool `json:"email_verified" gorm:"not null;default:false"`
+	// SaveSent controls whether sent messages are copied to the IMAP Sent folder
+	SaveSent  bool `json:"save_sent" gorm:"not null"`
+	IsDefault bool `json:"is_default" gorm:"not null;default:false"`
+	// AuthMethod is "password", the default, or "oauth2" to authenticate both
+	// servers with the access tokens of OAuthProvider
+	AuthMethod    string `json:"auth_method" gorm:"not null;default:password"`
+	OAuthProvider string `json:"oauth_provider,omitempty" gorm:"column:oauth_provider"`
+	// OAuthAuthorizedAt is when the user last granted access, nil until then
+	OAuthAuthorizedAt *time.Time `json:"oauth_authorized_at,omitempty" gorm:"column:oauth_authorized_at"`
+	OAuthRefreshToken string     `json:"-" gorm:"column:oauth_refresh_token"`
+	OAuthAccessToken  string     `json:"-" gorm:"column:oauth_access_token"`
+	OAuthExpiry       *time.Time `json:"-" gorm:"column:oauth_expiry"`
+}
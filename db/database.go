@@ -6,6 +6,7 @@ import (
 	"github.com/lyneq/mailapi/config"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"time"
 )
 
 var DB *gorm.DB
@@ -16,6 +17,22 @@ type User struct {
 	Password   string `json:"-" gorm:"not null"`
 	Role       string `json:"role" gorm:"not null;default:User"`
 	IsVerified bool   `json:"is_verified" gorm:"default:false"`
+	// Email is the address verification and password reset emails are sent to, verified when IsVerified is set
+	Email string `json:"email" gorm:"index"`
+	// UndoSendDelay is the number of seconds sent emails are held before delivery, 0 to send immediately
+	UndoSendDelay int `json:"undo_send_delay" gorm:"not null;default:0"`
+	// TOTPEnabled is set once an authenticator app is confirmed, the sign-in then requiring a code
+	TOTPEnabled bool `json:"totp_enabled" gorm:"column:totp_enabled;not null;default:false"`
+	// TOTPSecret is the base32 secret shared with the authenticator app
+	TOTPSecret string `json:"-" gorm:"column:totp_secret"`
+	// TOTPPendingSecret is the secret of an authenticator app being set up, until a code confirms it
+	TOTPPendingSecret string `json:"-" gorm:"column:totp_pending_secret"`
+	// TOTPLastStep is the time step of the last accepted code, so that a code is used once
+	TOTPLastStep int64 `json:"-" gorm:"column:totp_last_step;not null;default:0"`
+	// Disabled users can neither sign in nor use their sessions and API tokens
+	Disabled bool `json:"disabled" gorm:"not null;default:false"`
+	// SessionsRevokedAt ends the sessions signed in before it
+	SessionsRevokedAt *time.Time `json:"-"`
 }
 
 func Init() {
@@ -34,7 +51,7 @@ func Init() {
 	DB = db
 
 	// Migrate the schema
-	err = db.AutoMigrate(&User{})
+	err = db.AutoMigrate(&User{}, &OutboxMessage{}, &Template{}, &Merge{}, &Identity{}, &MailAccount{}, &APIToken{}, &RecoveryCode{}, &UserToken{}, &SignInThrottle{})
 	if err != nil {
 		_ = fmt.Errorf("failed to migrate database: %v\n", err)
 		return
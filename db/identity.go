@@ -0,0 +1,22 @@
+package db
+
+import "gorm.io/gorm"
+
+// Identity is an address a user sends from, with its display name, reply-to
+// address and signature. The default identity is used when a send request
+// does not choose one. Identities are only used once the user opened a link
+// mailed to the address, for the identity or one of their mail accounts, or
+// an administrator assigned it.
+type Identity struct {
+	gorm.Model
+	UserID        uint   `json:"user_id" gorm:"index;not null"`
+	Address       string `json:"address" gorm:"not null"`
+	Name          string `json:"name"`
+	ReplyTo       string `json:"reply_to"`
+	HTMLSignature string `json:"html_signature"`
+	TextSignature string `json:"text_signature"`
+	IsDefault     bool   `json:"is_default" gorm:"not null;default:false"`
+	Verified      bool   `json:"verified" gorm:"not null;default:false"`
+	// AssignedBy is the administrator who assigned the address to the user
+	AssignedBy *uint `json:"assigned_by,omitempty"`
+}
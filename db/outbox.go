@@ -0,0 +1,49 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Outbox message statuses
+const (
+	OutboxScheduled = "scheduled"
+	OutboxPending   = "pending"
+	OutboxSending   = "sending"
+	OutboxSent      = "sent"
+	OutboxFailed    = "failed"
+	OutboxCancelled = "cancelled"
+)
+
+// OutboxMessage is a composed email waiting for, or done with, SMTP delivery.
+// Messages are written to the outbox before the first attempt so that none is
+// lost when the server is unreachable or the application restarts.
+type OutboxMessage struct {
+	gorm.Model
+	UserID uint `json:"user_id" gorm:"index;not null"`
+	// AccountID is the mail account sending the message, the shared account when nil
+	AccountID  *uint    `json:"account_id,omitempty" gorm:"index"`
+	From       string   `json:"from" gorm:"not null"`
+	Recipients []string `json:"recipients" gorm:"serializer:json;not null"`
+	Subject    string   `json:"subject"`
+	// SpoolPath is the file of the composed MIME message, deleted once the
+	// message is sent or cancelled
+	SpoolPath string `json:"-"`
+	Size      int    `json:"size"`
+	SaveSent  bool   `json:"-"`
+	Status    string `json:"status" gorm:"index;not null;default:pending"`
+	// ScheduledAt is the time a scheduled message is released for delivery
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+	// Timezone is the IANA timezone ScheduledAt was expressed in
+	Timezone string `json:"timezone,omitempty"`
+	// CancelToken lets the user abort the message during the undo-send delay
+	CancelToken string `json:"cancel_token,omitempty" gorm:"index"`
+	// MergeID is the mail-merge the message was personalised for
+	MergeID       *uint      `json:"merge_id,omitempty" gorm:"index"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" gorm:"index"`
+	LastError     string     `json:"last_error,omitempty"`
+	Warning       string     `json:"warning,omitempty"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+}
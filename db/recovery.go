@@ -0,0 +1,16 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RecoveryCode is a one-time code signing in a user who lost their
+// authenticator app. Only the SHA-256 hash of the code is stored.
+type RecoveryCode struct {
+	gorm.Model
+	UserID uint       `json:"user_id" gorm:"index;not null"`
+	Hash   string     `json:"-" gorm:"uniqueIndex;not null"`
+	UsedAt *time.Time `json:"used_at"`
+}
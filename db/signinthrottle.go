@@ -0,0 +1,25 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Kinds of sign-in throttles
+const (
+	ThrottleUsername = "username"
+	ThrottleIP       = "ip"
+)
+
+// SignInThrottle counts the failed sign-ins of a username or an IP address,
+// so that the delays and lockouts they cause survive restarts
+type SignInThrottle struct {
+	gorm.Model
+	Kind  string `json:"kind" gorm:"uniqueIndex:idx_sign_in_throttle;not null"`
+	Value string `json:"value" gorm:"uniqueIndex:idx_sign_in_throttle;not null"`
+	// Failures is the number of failed sign-ins since the last success or lockout window
+	Failures      int        `json:"failures" gorm:"not null;default:0"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
@@ -0,0 +1,33 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Template is a stored email whose subject and bodies use Go template syntax,
+// e.g. "Hello {{.name}}". The HTML body is rendered with html/template so
+// that variables are escaped, the subject and text body with text/template.
+type Template struct {
+	gorm.Model
+	UserID   uint   `json:"user_id" gorm:"index;not null"`
+	Name     string `json:"name" gorm:"not null"`
+	Subject  string `json:"subject"`
+	HTMLBody string `json:"html_body"`
+	TextBody string `json:"text_body"`
+}
+
+// Merge is a mail-merge bulk send: one personalised email per recipient,
+// each queued in the outbox with MergeID set
+type Merge struct {
+	gorm.Model
+	UserID     uint `json:"user_id" gorm:"index;not null"`
+	TemplateID uint `json:"template_id"`
+	// Total is the number of recipients
+	Total int `json:"total"`
+	// Rate is the number of emails sent per minute
+	Rate int `json:"rate"`
+	// NextSendAt is the earliest time the next email of the merge may be sent
+	NextSendAt time.Time `json:"next_send_at"`
+}
@@ -0,0 +1,20 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APIToken is a personal access token of a user. Only the SHA-256 hash of
+// the token is stored, with its first characters as a hint to recognise it.
+type APIToken struct {
+	gorm.Model
+	UserID     uint       `json:"user_id" gorm:"index;not null"`
+	Name       string     `json:"name"`
+	Hint       string     `json:"hint" gorm:"not null"`
+	Hash       string     `json:"-" gorm:"uniqueIndex;not null"`
+	Scopes     []string   `json:"scopes" gorm:"serializer:json"`
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"not null"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
@@ -0,0 +1,21 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UserToken is a single-use token mailed to a user, verifying their email
+// address or a sender identity, or resetting their password. Only its
+// SHA-256 hash is stored.
+type UserToken struct {
+	gorm.Model
+	UserID  uint   `json:"user_id" gorm:"index;not null"`
+	Purpose string `json:"purpose" gorm:"index;not null"`
+	// Email is the address the token was sent to
+	Email     string     `json:"email"`
+	Hash      string     `json:"-" gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null"`
+	UsedAt    *time.Time `json:"used_at"`
+}
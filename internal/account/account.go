@@ -0,0 +1,285 @@
+// Package account manages the IMAP/SMTP accounts of users. Passwords and
+// OAuth tokens are encrypted at rest with AES-GCM, and every mail operation
+// connects with the account selected by the session, or the user's default
+// account.
+package account
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+	"github.com/lyneq/mailapi/internal/verification"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrNotFound is returned when the account does not exist or belongs to another user
+	ErrNotFound = errors.New("mail account not found")
+	// ErrNoAccount is returned when the user has no mail account and the shared
+	// account is disabled
+	ErrNoAccount = errors.New("no mail account configured")
+	// ErrNoKey is returned when credentials are used without an encryption key
+	ErrNoKey = errors.New("mail account encryption key not configured")
+	// ErrVerified is returned when verification is requested for a verified address
+	ErrVerified = errors.New("the address of this mail account is already verified")
+)
+
+// Credentials holds the plaintext passwords of an account. Empty passwords
+// keep the stored ones when an account is updated.
+type Credentials struct {
+	IMAPPassword string
+	SMTPPassword string
+}
+
+// List returns the accounts of the user, the default one first
+func List(userID uint) ([]db.MailAccount, error) {
+	var accounts []db.MailAccount
+	err := db.DB.Where("user_id = ?", userID).Order("is_default DESC, id").Find(&accounts).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mail accounts: %w", err)
+	}
+	return accounts, nil
+}
+
+// Get returns an account of the user
+func Get(userID, id uint) (*db.MailAccount, error) {
+	var account db.MailAccount
+	err := db.DB.Where("id = ? AND user_id = ?", id, userID).First(&account).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// Current returns the account a session works with: the selected one when it
+// still exists, else the default account of the user. It returns nil without
+// error for users without account when the shared account is enabled.
+func Current(userID, selected uint) (*db.MailAccount, error) {
+	if selected != 0 {
+		account, err := Get(userID, selected)
+		if !errors.Is(err, ErrNotFound) {
+			return account, err
+		}
+	}
+
+	var account db.MailAccount
+	err := db.DB.Where("user_id = ?", userID).Order("is_default DESC, id").First(&account).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if config.GetAccountsConfig().SharedAccount {
+			return nil, nil
+		}
+		return nil, ErrNoAccount
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// Save creates or updates an account, encrypting the given passwords. Making
+// it the default account, or creating the first account of the user, unsets
+// the previous default. New and changed addresses are unverified until
+// RequestVerification is confirmed.
+func Save(account *db.MailAccount, credentials Credentials) error {
+	account.Email = strings.ToLower(strings.TrimSpace(account.Email))
+	account.Name = strings.Join(strings.Fields(account.Name), " ")
+	account.IMAPHost = strings.TrimSpace(account.IMAPHost)
+	account.SMTPHost = strings.TrimSpace(account.SMTPHost)
+	account.IMAPTLSMode = strings.ToLower(account.IMAPTLSMode)
+	account.SMTPTLSMode = strings.ToLower(account.SMTPTLSMode)
+	if account.AuthMethod == "" {
+		account.AuthMethod = AuthPassword
+	}
+	account.OAuthProvider = strings.ToLower(account.OAuthProvider)
+
+	if credentials.IMAPPassword != "" {
+		sealed, err := Encrypt(credentials.IMAPPassword)
+		if err != nil {
+			return err
+		}
+		account.IMAPPassword = sealed
+	}
+	if credentials.SMTPPassword != "" {
+		sealed, err := Encrypt(credentials.SMTPPassword)
+		if err != nil {
+			return err
+		}
+		account.SMTPPassword = sealed
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if account.ID == 0 {
+			account.EmailVerified = false
+		} else {
+			var previous db.MailAccount
+			if err := tx.Select("email").First(&previous, account.ID).Error; err != nil {
+				return err
+			}
+			if previous.Email != account.Email {
+				account.EmailVerified = false
+			}
+		}
+
+		if !account.IsDefault {
+			var count int64
+			err := tx.Model(&db.MailAccount{}).
+				Where("user_id = ? AND id <> ?", account.UserID, account.ID).
+				Count(&count).Error
+			if err != nil {
+				return err
+			}
+			account.IsDefault = count == 0
+		}
+
+		if account.IsDefault {
+			err := tx.Model(&db.MailAccount{}).
+				Where("user_id = ? AND id <> ?", account.UserID, account.ID).
+				Update("is_default", false).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Save(account).Error
+	})
+	if err == nil {
+		// The next message is sent with the new settings
+		smtpclient.CloseAccount(account.ID)
+	}
+	return err
+}
+
+// RequestVerification mails a link confirming the address of an account to
+// it, used through the identity confirmation of the verification package
+func RequestVerification(account *db.MailAccount) error {
+	if account.EmailVerified {
+		return ErrVerified
+	}
+	var user db.User
+	if err := db.DB.First(&user, account.UserID).Error; err != nil {
+		return fmt.Errorf("failed to find user: %w", err)
+	}
+	return verification.SendIdentityVerification(&user, account.Email)
+}
+
+// Delete removes an account. When it was the default account, the oldest
+// remaining account becomes the default.
+func Delete(account *db.MailAccount) error {
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(account).Error; err != nil {
+			return err
+		}
+		if !account.IsDefault {
+			return nil
+		}
+
+		var next db.MailAccount
+		err := tx.Where("user_id = ?", account.UserID).Order("id").First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&next).Update("is_default", true).Error
+	})
+	if err == nil {
+		smtpclient.CloseAccount(account.ID)
+	}
+	return err
+}
+
+// Address returns the address emails are sent from when the user has no
+// identity: the account's, or the shared account username when account is nil
+func Address(account *db.MailAccount) string {
+	if account == nil {
+		return config.GetIMAPConfig().Username
+	}
+	return account.Email
+}
+
+// Addresses returns the addresses of the account, used to recognise the
+// user's own address among recipients
+func Addresses(account *db.MailAccount) []string {
+	if account == nil {
+		return []string{config.GetIMAPConfig().Username, config.GetSMTPConfig().Username}
+	}
+	return []string{account.Email, account.IMAPUsername, account.SMTPUsername}
+}
+
+// SaveSent reports whether messages sent with the account are copied to its Sent folder
+func SaveSent(account *db.MailAccount) bool {
+	if account == nil {
+		return config.GetSMTPConfig().SaveSent
+	}
+	return account.SaveSent
+}
+
+// ID returns the ID of the account stored with outbox messages, nil for the shared account
+func ID(account *db.MailAccount) *uint {
+	if account == nil {
+		return nil
+	}
+	id := account.ID
+	return &id
+}
+
+// IMAPClient returns a client for the IMAP server of the account, the shared
+// account when account is nil. The client is not connected yet.
+func IMAPClient(account *db.MailAccount) (*smtpclient.IMAPClient, error) {
+	if account == nil {
+		return smtpclient.NewIMAPClientFromConfig(), nil
+	}
+
+	server := smtpclient.IMAPConfig{
+		Host:     account.IMAPHost,
+		Port:     account.IMAPPort,
+		Username: account.IMAPUsername,
+		TLS:      config.TLSConfig{Mode: account.IMAPTLSMode},
+	}
+	if UsesOAuth(account) {
+		server.TokenSource = tokenSource(account.ID)
+		return smtpclient.NewIMAPClient(server), nil
+	}
+
+	password, err := Decrypt(account.IMAPPassword)
+	if err != nil {
+		return nil, err
+	}
+	server.Password = password
+	return smtpclient.NewIMAPClient(server), nil
+}
+
+// SMTPClient returns a client for the SMTP server of the account, the shared
+// account when account is nil
+func SMTPClient(account *db.MailAccount) (*smtpclient.Client, error) {
+	if account == nil {
+		return smtpclient.NewSMTPClientFromConfig(), nil
+	}
+
+	server := smtpclient.SMTPConfig{
+		Host:      account.SMTPHost,
+		Port:      account.SMTPPort,
+		Username:  account.SMTPUsername,
+		TLS:       config.TLSConfig{Mode: account.SMTPTLSMode},
+		AccountID: account.ID,
+	}
+	if UsesOAuth(account) {
+		server.TokenSource = tokenSource(account.ID)
+		return smtpclient.NewAccountSMTPClient(server), nil
+	}
+
+	password, err := Decrypt(account.SMTPPassword)
+	if err != nil {
+		return nil, err
+	}
+	server.Password = password
+	return smtpclient.NewAccountSMTPClient(server), nil
+}
@@ -0,0 +1,92 @@
+package account
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/lyneq/mailapi/config"
+)
+
+var (
+	keyMu sync.RWMutex
+	// aead seals the credentials, nil when no encryption key is configured
+	aead cipher.AEAD
+)
+
+// LoadKey reads the credential encryption key of the configuration. Without a
+// key the application starts, but mail accounts can neither be added nor used.
+func LoadKey() error {
+	var loaded cipher.AEAD
+
+	if encoded := config.GetAccountsConfig().EncryptionKey; encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return errors.New("encryption_key must be 32 bytes encoded in base64, e.g. the output of openssl rand -base64 32")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		if loaded, err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+	}
+
+	keyMu.Lock()
+	aead = loaded
+	keyMu.Unlock()
+	return nil
+}
+
+// loadedKey returns the AEAD sealing credentials, or ErrNoKey
+func loadedKey() (cipher.AEAD, error) {
+	keyMu.RLock()
+	defer keyMu.RUnlock()
+	if aead == nil {
+		return nil, ErrNoKey
+	}
+	return aead, nil
+}
+
+// Encrypt seals a credential with AES-256-GCM and returns the nonce followed
+// by the ciphertext, base64 encoded
+func Encrypt(plaintext string) (string, error) {
+	key, err := loadedKey()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, key.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key.Seal(nonce, nonce, []byte(plaintext), nil)), nil
+}
+
+// Decrypt opens a credential sealed by Encrypt. An empty credential is an
+// empty password, for servers without authentication.
+func Decrypt(sealed string) (string, error) {
+	if sealed == "" {
+		return "", nil
+	}
+
+	key, err := loadedKey()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < key.NonceSize() {
+		return "", errors.New("malformed encrypted credential")
+	}
+	plaintext, err := key.Open(nil, data[:key.NonceSize()], data[key.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt credential, was the encryption key changed?")
+	}
+	return string(plaintext), nil
+}
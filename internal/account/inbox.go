@@ -0,0 +1,129 @@
+package account
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// Position is the place of a message in the unified inbox, which lists the
+// newest received messages first, ties broken by account then UID
+type Position struct {
+	Received  time.Time `json:"t"`
+	AccountID uint      `json:"a"`
+	UID       uint32    `json:"u"`
+}
+
+// Before reports whether p is listed before q
+func (p Position) Before(q Position) bool {
+	if !p.Received.Equal(q.Received) {
+		return p.Received.After(q.Received)
+	}
+	if p.AccountID != q.AccountID {
+		return p.AccountID < q.AccountID
+	}
+	return p.UID > q.UID
+}
+
+// Cursor is the end of a page of the unified inbox. Each account resumes
+// after its last listed message; accounts none of whose messages were listed
+// yet resume after the last message of the page.
+type Cursor struct {
+	Accounts map[uint]Position `json:"a,omitempty"`
+	Last     Position          `json:"l"`
+}
+
+// after returns the position the messages of an account are listed after
+func (c *Cursor) after(accountID uint) Position {
+	if position, ok := c.Accounts[accountID]; ok {
+		return position
+	}
+	return c.Last
+}
+
+// NextCursor returns the cursor of the page following messages, listed after
+// the cursor position, nil for the first page
+func NextCursor(after *Cursor, messages []InboxMessage) Cursor {
+	next := Cursor{Accounts: map[uint]Position{}}
+	if after != nil {
+		for id, position := range after.Accounts {
+			next.Accounts[id] = position
+		}
+	}
+	for i := range messages {
+		next.Accounts[messages[i].AccountID] = messages[i].Position()
+		next.Last = messages[i].Position()
+	}
+	return next
+}
+
+// InboxSource reads the INBOX of one account of the unified inbox
+type InboxSource struct {
+	AccountID uint
+	Address   string
+	// Fetch returns up to limit messages for which keep returns true, the
+	// latest received first, in the order of Position
+	Fetch func(limit int, keep func(msg *smtpclient.Message) bool) ([]smtpclient.Message, error)
+}
+
+// InboxMessage is a message of the unified inbox, tagged with its account
+type InboxMessage struct {
+	smtpclient.Message
+	AccountID uint
+	Account   string
+}
+
+// Position returns the place of the message in the unified inbox
+func (m *InboxMessage) Position() Position {
+	return Position{Received: m.Received, AccountID: m.AccountID, UID: m.UID}
+}
+
+// UnifiedInbox reads the sources concurrently and merges their messages
+// listed after the cursor, nil for the first page, by received date into one
+// page of at most limit messages. Sources that fail are reported by account
+// ID and left out of the page.
+func UnifiedInbox(sources []InboxSource, after *Cursor, limit int) ([]InboxMessage, map[uint]error) {
+	pages := make([][]InboxMessage, len(sources))
+	errs := make([]error, len(sources))
+
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var from *Position
+			if after != nil {
+				position := after.after(source.AccountID)
+				from = &position
+			}
+			messages, err := source.Fetch(limit, func(msg *smtpclient.Message) bool {
+				return from == nil || from.Before(Position{Received: msg.Received, AccountID: source.AccountID, UID: msg.UID})
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for _, msg := range messages {
+				pages[i] = append(pages[i], InboxMessage{Message: msg, AccountID: source.AccountID, Account: source.Address})
+			}
+		}()
+	}
+	wg.Wait()
+
+	var merged []InboxMessage
+	failed := map[uint]error{}
+	for i := range sources {
+		if errs[i] != nil {
+			failed[sources[i].AccountID] = errs[i]
+		}
+		merged = append(merged, pages[i]...)
+	}
+
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Position().Before(merged[j].Position()) })
+	if len(merged) > limit {
+		merged = merged[:limit]
+	}
+	return merged, failed
+}
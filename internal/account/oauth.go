@@ -0,0 +1,137 @@
+package account
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/oauth"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+	"gorm.io/gorm"
+)
+
+const (
+	// AuthPassword authenticates with the stored passwords
+	AuthPassword = "password"
+	// AuthOAuth2 authenticates with OAuth 2.0 access tokens
+	AuthOAuth2 = "oauth2"
+)
+
+// ErrNotAuthorized is returned when an OAuth account has no valid refresh
+// token, before the user granted access or after they revoked it
+var ErrNotAuthorized = errors.New("mail account is not authorized, grant access with POST /api/accounts/:id/oauth")
+
+// refreshMargin is how long before their expiry access tokens are refreshed
+const refreshMargin = time.Minute
+
+// refreshLocks holds a mutex by account ID, so that concurrent connections
+// of an account wait for a single refresh
+var refreshLocks sync.Map
+
+// UsesOAuth reports whether the account authenticates with access tokens
+func UsesOAuth(account *db.MailAccount) bool {
+	return account != nil && account.AuthMethod == AuthOAuth2
+}
+
+// SaveTokens stores the tokens granted to an account, keeping the previous
+// refresh token when the provider did not issue a new one
+func SaveTokens(account *db.MailAccount, token *oauth.Token) error {
+	access, err := Encrypt(token.AccessToken)
+	if err != nil {
+		return err
+	}
+	account.OAuthAccessToken = access
+	if token.RefreshToken != "" {
+		if account.OAuthRefreshToken, err = Encrypt(token.RefreshToken); err != nil {
+			return err
+		}
+	}
+
+	expiry := token.Expiry
+	if expiry.IsZero() {
+		// Providers omitting expires_in usually issue one-hour tokens
+		expiry = time.Now().Add(time.Hour)
+	}
+	account.OAuthExpiry = &expiry
+	if account.OAuthAuthorizedAt == nil || token.RefreshToken != "" {
+		now := time.Now()
+		account.OAuthAuthorizedAt = &now
+	}
+
+	return db.DB.Model(account).
+		Select("OAuthAccessToken", "OAuthRefreshToken", "OAuthExpiry", "OAuthAuthorizedAt").
+		Updates(account).Error
+}
+
+// ClearTokens forgets the tokens of an account, which must be authorized again
+func ClearTokens(account *db.MailAccount) error {
+	account.OAuthAccessToken = ""
+	account.OAuthRefreshToken = ""
+	account.OAuthExpiry = nil
+	account.OAuthAuthorizedAt = nil
+	err := db.DB.Model(account).
+		Select("OAuthAccessToken", "OAuthRefreshToken", "OAuthExpiry", "OAuthAuthorizedAt").
+		Updates(account).Error
+	if err == nil {
+		// The session authenticated with the forgotten token ends
+		smtpclient.CloseAccount(account.ID)
+	}
+	return err
+}
+
+// AccessToken returns an access token of the account valid for at least a
+// minute, refreshing it with the provider when needed. A refresh token
+// rejected by the provider is forgotten and ErrNotAuthorized returned.
+func AccessToken(accountID uint) (string, error) {
+	lock, _ := refreshLocks.LoadOrStore(accountID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	// Read the tokens again, another connection may have refreshed them
+	var account db.MailAccount
+	err := db.DB.First(&account, accountID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if account.OAuthAccessToken != "" && account.OAuthExpiry != nil && time.Until(*account.OAuthExpiry) > refreshMargin {
+		return Decrypt(account.OAuthAccessToken)
+	}
+	if account.OAuthRefreshToken == "" {
+		return "", ErrNotAuthorized
+	}
+
+	provider, err := oauth.Get(account.OAuthProvider)
+	if err != nil {
+		return "", err
+	}
+	refreshToken, err := Decrypt(account.OAuthRefreshToken)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := provider.Refresh(refreshToken)
+	if oauth.IsRevoked(err) {
+		ClearTokens(&account)
+		return "", fmt.Errorf("%w: %v", ErrNotAuthorized, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := SaveTokens(&account, token); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// tokenSource returns the access tokens of an account to the mail clients
+func tokenSource(accountID uint) smtpclient.TokenSource {
+	return func() (string, error) {
+		return AccessToken(accountID)
+	}
+}
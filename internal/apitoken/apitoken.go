@@ -0,0 +1,124 @@
+// Package apitoken manages the personal access tokens scripts authenticate
+// with instead of a session cookie. Only the SHA-256 hash of a token is
+// stored; the token itself is shown once, when it is created.
+package apitoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lyneq/mailapi/db"
+	"gorm.io/gorm"
+)
+
+// Scopes granted to tokens, each route declaring the one it requires
+const (
+	// ScopeMailRead reads emails, folders, the outbox and the settings of the user
+	ScopeMailRead = "mail:read"
+	// ScopeMailSend sends, answers and schedules emails
+	ScopeMailSend = "mail:send"
+	// ScopeAdmin changes mail accounts, identities, templates and settings,
+	// and imports emails
+	ScopeAdmin = "admin"
+)
+
+// Scopes lists the valid scopes
+var Scopes = []string{ScopeMailRead, ScopeMailSend, ScopeAdmin}
+
+// prefix starts every token, so that leaked tokens are easy to recognise
+const prefix = "mapi_"
+
+var (
+	// ErrNotFound is returned when the token does not exist or belongs to another user
+	ErrNotFound = errors.New("API token not found")
+	// ErrInvalid is returned for an unknown, revoked or expired token
+	ErrInvalid = errors.New("invalid or expired API token")
+)
+
+// Create issues a token to the user and returns it with its stored record.
+// The token cannot be retrieved later.
+func Create(userID uint, name string, scopes []string, ttl time.Duration) (string, *db.APIToken, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	plaintext := prefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	expiresAt := time.Now().Add(ttl)
+	token := &db.APIToken{
+		UserID:    userID,
+		Name:      strings.Join(strings.Fields(name), " "),
+		Hint:      plaintext[:len(prefix)+4],
+		Hash:      hash(plaintext),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	if err := db.DB.Create(token).Error; err != nil {
+		return "", nil, fmt.Errorf("failed to store token: %w", err)
+	}
+	return plaintext, token, nil
+}
+
+// List returns the tokens of the user, the newest first
+func List(userID uint) ([]db.APIToken, error) {
+	var tokens []db.APIToken
+	if err := db.DB.Where("user_id = ?", userID).Order("id DESC").Find(&tokens).Error; err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+// Revoke deletes a token of the user
+func Revoke(userID, id uint) error {
+	result := db.DB.Where("id = ? AND user_id = ?", id, userID).Delete(&db.APIToken{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Authenticate returns the stored record of a token, recording its use
+func Authenticate(plaintext string) (*db.APIToken, error) {
+	if !strings.HasPrefix(plaintext, prefix) {
+		return nil, ErrInvalid
+	}
+
+	var token db.APIToken
+	err := db.DB.Where("hash = ?", hash(plaintext)).First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return nil, ErrInvalid
+	}
+
+	now := time.Now()
+	db.DB.Model(&token).UpdateColumn("last_used_at", now)
+	token.LastUsedAt = &now
+	return &token, nil
+}
+
+// HasScope reports whether the token grants the scope
+func HasScope(token *db.APIToken, scope string) bool {
+	return slices.Contains(token.Scopes, scope)
+}
+
+// hash returns the stored form of a token. Tokens carry 256 random bits, so
+// unlike passwords they need no slow, salted hash.
+func hash(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
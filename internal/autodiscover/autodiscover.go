@@ -0,0 +1,211 @@
+// Package autodiscover finds the IMAP and SMTP settings of an email address.
+// Candidate servers are gathered from Thunderbird autoconfig documents,
+// Microsoft autodiscover, the SRV records of RFC 6186 and common host names,
+// then probed and ranked, the working and most authoritative settings first.
+package autodiscover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProtocolIMAP = "imap"
+	ProtocolSMTP = "smtp"
+)
+
+// Sources of candidate servers, from the most to the least authoritative
+const (
+	SourceAutoconfig   = "autoconfig"
+	SourceAutodiscover = "autodiscover"
+	SourceSRV          = "srv"
+	SourceGuess        = "guess"
+)
+
+var sourceRank = map[string]int{
+	SourceAutoconfig:   0,
+	SourceAutodiscover: 1,
+	SourceSRV:          2,
+	SourceGuess:        3,
+}
+
+// ErrInvalidAddress is returned for an email address without domain
+var ErrInvalidAddress = errors.New("invalid email address")
+
+// Resolver looks up DNS records, implemented by *net.Resolver. The lookups
+// are interfaces so discovery can run offline in tests.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// HTTPClient fetches configuration documents, implemented by *http.Client
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Prober connects to a candidate server without logging in and returns the
+// SASL mechanisms it offers
+type Prober interface {
+	Probe(ctx context.Context, server Server) ([]string, error)
+}
+
+// Server is a candidate IMAP or SMTP endpoint
+type Server struct {
+	Protocol string `json:"protocol"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	// TLSMode is "implicit", "starttls" or "none"
+	TLSMode  string `json:"tls_mode"`
+	Username string `json:"username"`
+	Source   string `json:"source"`
+}
+
+// Result is a probed candidate server
+type Result struct {
+	Server
+	OK         bool     `json:"ok"`
+	Mechanisms []string `json:"mechanisms,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Report lists the candidate servers of an address, best first
+type Report struct {
+	Email string   `json:"email"`
+	IMAP  []Result `json:"imap"`
+	SMTP  []Result `json:"smtp"`
+}
+
+// Discoverer gathers and probes the servers of email addresses
+type Discoverer struct {
+	Resolver Resolver
+	HTTP     HTTPClient
+	Prober   Prober
+	// Timeout bounds the lookups of the sources, probes excepted
+	Timeout time.Duration
+	// ISPDB is the base URL of the Thunderbird database of providers
+	ISPDB string
+}
+
+// New returns a Discoverer using the network. Its HTTP requests and probes
+// refuse private and loopback addresses, since the hosts come from documents
+// and DNS records controlled by whoever owns the domain.
+func New() *Discoverer {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: publicOnly}
+	return &Discoverer{
+		Resolver: net.DefaultResolver,
+		HTTP: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+		},
+		Prober:  &NetProber{Dialer: dialer},
+		Timeout: 15 * time.Second,
+		ISPDB:   "https://autoconfig.thunderbird.net/v1.1/",
+	}
+}
+
+// Discover returns the ranked candidate servers of an email address
+func (d *Discoverer) Discover(ctx context.Context, email string) (*Report, error) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return nil, ErrInvalidAddress
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	if at < 0 || at == len(addr.Address)-1 {
+		return nil, ErrInvalidAddress
+	}
+	address := strings.ToLower(addr.Address)
+	domain := address[at+1:]
+
+	candidates := d.candidates(ctx, address, domain)
+
+	results := make([]Result, len(candidates))
+	var wg sync.WaitGroup
+	for i, server := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = Result{Server: server}
+			mechanisms, err := d.Prober.Probe(ctx, server)
+			if err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+			results[i].OK = true
+			results[i].Mechanisms = mechanisms
+		}()
+	}
+	wg.Wait()
+
+	rank(results)
+	report := &Report{Email: address, IMAP: []Result{}, SMTP: []Result{}}
+	for _, result := range results {
+		if result.Protocol == ProtocolIMAP {
+			report.IMAP = append(report.IMAP, result)
+		} else {
+			report.SMTP = append(report.SMTP, result)
+		}
+	}
+	return report, nil
+}
+
+// candidates queries every source concurrently and returns their servers
+// without duplicates, in the order of the sources
+func (d *Discoverer) candidates(ctx context.Context, address, domain string) []Server {
+	ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+	defer cancel()
+
+	lookups := []func() []Server{
+		func() []Server { return d.autoconfig(ctx, address, domain) },
+		func() []Server { return d.autodiscover(ctx, address, domain) },
+		func() []Server { return d.srv(ctx, address, domain) },
+		func() []Server { return guesses(address, domain) },
+	}
+	found := make([][]Server, len(lookups))
+	var wg sync.WaitGroup
+	for i, lookup := range lookups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found[i] = lookup()
+		}()
+	}
+	wg.Wait()
+
+	var servers []Server
+	seen := map[string]bool{}
+	for _, list := range found {
+		for _, server := range list {
+			key := fmt.Sprintf("%s|%s|%d|%s", server.Protocol, strings.ToLower(server.Host), server.Port, server.TLSMode)
+			if server.Host == "" || server.Port <= 0 || seen[key] {
+				continue
+			}
+			seen[key] = true
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// rank sorts working servers first, then encrypted ones, then by source,
+// keeping the order each source listed them in
+func rank(results []Result) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.OK != b.OK {
+			return a.OK
+		}
+		if secureA, secureB := a.TLSMode != "none", b.TLSMode != "none"; secureA != secureB {
+			return secureA
+		}
+		return sourceRank[a.Source] < sourceRank[b.Source]
+	})
+}
@@ -0,0 +1,44 @@
+package autodiscover
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/lyneq/mailapi/config"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// NetProber probes servers over the network with the mail clients, verifying
+// their certificates
+type NetProber struct {
+	Dialer *net.Dialer
+}
+
+func (p *NetProber) Probe(ctx context.Context, server Server) ([]string, error) {
+	dialer := *p.Dialer
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+
+	tlsConfig := config.TLSConfig{Mode: server.TLSMode}
+	if server.Protocol == ProtocolIMAP {
+		return smtpclient.ProbeIMAP(smtpclient.IMAPConfig{Host: server.Host, Port: server.Port, TLS: tlsConfig}, &dialer)
+	}
+	return smtpclient.ProbeSMTP(smtpclient.SMTPConfig{Host: server.Host, Port: server.Port, TLS: tlsConfig}, &dialer)
+}
+
+// publicOnly refuses connections to loopback, private and link-local addresses
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("refusing to connect to the non-public address %s", host)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package autodiscover
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxDocumentSize bounds the configuration documents read from the network
+const maxDocumentSize = 1 << 20
+
+// clientConfig is a Thunderbird autoconfig document
+type clientConfig struct {
+	Incoming []configServer `xml:"emailProvider>incomingServer"`
+	Outgoing []configServer `xml:"emailProvider>outgoingServer"`
+}
+
+type configServer struct {
+	Type       string `xml:"type,attr"`
+	Hostname   string `xml:"hostname"`
+	Port       int    `xml:"port"`
+	SocketType string `xml:"socketType"`
+	Username   string `xml:"username"`
+}
+
+// autoconfig reads the autoconfig document of the domain, published by the
+// domain itself or by the Thunderbird database. The database is also asked
+// for the domain of the MX hosts, which finds hosted domains such as Google
+// Workspace ones.
+func (d *Discoverer) autoconfig(ctx context.Context, address, domain string) []Server {
+	query := "?emailaddress=" + url.QueryEscape(address)
+	urls := []string{
+		"https://autoconfig." + domain + "/mail/config-v1.1.xml" + query,
+		"https://" + domain + "/.well-known/autoconfig/mail/config-v1.1.xml" + query,
+	}
+	if d.ISPDB != "" {
+		urls = append(urls, d.ISPDB+domain)
+		if mx := d.mxDomain(ctx, domain); mx != "" && mx != domain {
+			urls = append(urls, d.ISPDB+mx)
+		}
+	}
+
+	for _, u := range urls {
+		data, err := d.fetch(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			continue
+		}
+		var config clientConfig
+		if err := xml.Unmarshal(data, &config); err != nil {
+			continue
+		}
+
+		var servers []Server
+		for _, list := range [][]configServer{config.Incoming, config.Outgoing} {
+			for _, s := range list {
+				protocol := strings.ToLower(s.Type)
+				if protocol != ProtocolIMAP && protocol != ProtocolSMTP {
+					continue
+				}
+				mode := map[string]string{"SSL": "implicit", "STARTTLS": "starttls", "PLAIN": "none"}[strings.ToUpper(s.SocketType)]
+				if mode == "" {
+					continue
+				}
+				servers = append(servers, Server{
+					Protocol: protocol,
+					Host:     expand(s.Hostname, address, domain),
+					Port:     s.Port,
+					TLSMode:  mode,
+					Username: expand(s.Username, address, domain),
+					Source:   SourceAutoconfig,
+				})
+			}
+		}
+		if len(servers) > 0 {
+			return servers
+		}
+	}
+	return nil
+}
+
+// mxDomain returns the parent domain of the preferred MX host, e.g.
+// google.com for aspmx.l.google.com
+func (d *Discoverer) mxDomain(ctx context.Context, domain string) string {
+	records, err := d.Resolver.LookupMX(ctx, domain)
+	if err != nil || len(records) == 0 {
+		return ""
+	}
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(records[0].Host), "."), ".")
+	if len(labels) < 2 {
+		return ""
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// expand replaces the placeholders of autoconfig documents
+func expand(value, address, domain string) string {
+	return strings.NewReplacer(
+		"%EMAILADDRESS%", address,
+		"%EMAILLOCALPART%", strings.TrimSuffix(address, "@"+domain),
+		"%EMAILDOMAIN%", domain,
+	).Replace(strings.TrimSpace(value))
+}
+
+// autodiscoverResponse is a Microsoft autodiscover response of the Outlook schema
+type autodiscoverResponse struct {
+	Protocols []struct {
+		Type       string `xml:"Type"`
+		Server     string `xml:"Server"`
+		Port       int    `xml:"Port"`
+		LoginName  string `xml:"LoginName"`
+		SSL        string `xml:"SSL"`
+		Encryption string `xml:"Encryption"`
+	} `xml:"Response>Account>Protocol"`
+}
+
+const autodiscoverRequest = `<?xml version="1.0" encoding="utf-8"?>
+<Autodiscover xmlns="http://schemas.microsoft.com/exchange/autodiscover/outlook/requestschema/2006">
+  <Request>
+    <EMailAddress>%s</EMailAddress>
+    <AcceptableResponseSchema>http://schemas.microsoft.com/exchange/autodiscover/outlook/responseschema/2006a</AcceptableResponseSchema>
+  </Request>
+</Autodiscover>`
+
+// autodiscover posts a Microsoft autodiscover request to the domain
+func (d *Discoverer) autodiscover(ctx context.Context, address, domain string) []Server {
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(address))
+	body := fmt.Sprintf(autodiscoverRequest, escaped.String())
+
+	for _, u := range []string{
+		"https://autodiscover." + domain + "/autodiscover/autodiscover.xml",
+		"https://" + domain + "/autodiscover/autodiscover.xml",
+	} {
+		data, err := d.fetch(ctx, http.MethodPost, u, []byte(body))
+		if err != nil {
+			continue
+		}
+		var response autodiscoverResponse
+		if err := xml.Unmarshal(data, &response); err != nil {
+			continue
+		}
+
+		var servers []Server
+		for _, p := range response.Protocols {
+			protocol := strings.ToLower(p.Type)
+			if protocol != ProtocolIMAP && protocol != ProtocolSMTP {
+				continue
+			}
+			username := p.LoginName
+			if username == "" {
+				username = address
+			}
+			servers = append(servers, Server{
+				Protocol: protocol,
+				Host:     p.Server,
+				Port:     p.Port,
+				TLSMode:  autodiscoverMode(p.SSL, p.Encryption, p.Port),
+				Username: username,
+				Source:   SourceAutodiscover,
+			})
+		}
+		if len(servers) > 0 {
+			return servers
+		}
+	}
+	return nil
+}
+
+// autodiscoverMode maps the SSL and Encryption settings of autodiscover to a
+// TLS mode. Without Encryption, SSL means implicit TLS on the well-known ports.
+func autodiscoverMode(ssl, encryption string, port int) string {
+	switch strings.ToLower(encryption) {
+	case "ssl":
+		return "implicit"
+	case "tls":
+		return "starttls"
+	case "none":
+		return "none"
+	}
+	if strings.EqualFold(ssl, "off") {
+		return "none"
+	}
+	if port == 993 || port == 465 {
+		return "implicit"
+	}
+	return "starttls"
+}
+
+// srvServices maps the SRV services of RFC 6186 and RFC 8314 to their protocol and TLS mode
+var srvServices = []struct {
+	service  string
+	protocol string
+	mode     string
+}{
+	{"imaps", ProtocolIMAP, "implicit"},
+	{"imap", ProtocolIMAP, "starttls"},
+	{"submissions", ProtocolSMTP, "implicit"},
+	{"submission", ProtocolSMTP, "starttls"},
+}
+
+// srv looks up the SRV records of the domain, in the order of their priority
+func (d *Discoverer) srv(ctx context.Context, address, domain string) []Server {
+	var servers []Server
+	for _, s := range srvServices {
+		_, records, err := d.Resolver.LookupSRV(ctx, s.service, "tcp", domain)
+		if err != nil {
+			continue
+		}
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			// A target of "." declares that the service is not provided
+			if host == "" {
+				continue
+			}
+			servers = append(servers, Server{
+				Protocol: s.protocol,
+				Host:     host,
+				Port:     int(record.Port),
+				TLSMode:  s.mode,
+				Username: address,
+				Source:   SourceSRV,
+			})
+		}
+	}
+	return servers
+}
+
+// guesses returns the usual host names and ports of the domain
+func guesses(address, domain string) []Server {
+	var servers []Server
+	for _, candidate := range []struct {
+		protocol string
+		prefix   string
+		port     int
+		mode     string
+	}{
+		{ProtocolIMAP, "imap.", 993, "implicit"},
+		{ProtocolIMAP, "mail.", 993, "implicit"},
+		{ProtocolIMAP, "imap.", 143, "starttls"},
+		{ProtocolIMAP, "mail.", 143, "starttls"},
+		{ProtocolSMTP, "smtp.", 465, "implicit"},
+		{ProtocolSMTP, "mail.", 465, "implicit"},
+		{ProtocolSMTP, "smtp.", 587, "starttls"},
+		{ProtocolSMTP, "mail.", 587, "starttls"},
+	} {
+		servers = append(servers, Server{
+			Protocol: candidate.protocol,
+			Host:     candidate.prefix + domain,
+			Port:     candidate.port,
+			TLSMode:  candidate.mode,
+			Username: address,
+			Source:   SourceGuess,
+		})
+	}
+	return servers
+}
+
+// fetch sends a request and returns the body of a 200 OK response
+func (d *Discoverer) fetch(ctx context.Context, method, u string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	}
+
+	resp, err := d.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize))
+}
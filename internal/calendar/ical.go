@@ -0,0 +1,217 @@
+package calendar
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Property is a single iCalendar content line (RFC 5545 section 3.1)
+type Property struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// Component is an iCalendar component such as VCALENDAR or VEVENT
+type Component struct {
+	Name       string
+	Properties []Property
+	Children   []*Component
+}
+
+// Parse parses iCalendar data and returns its top-level component
+func Parse(data string) (*Component, error) {
+	var stack []*Component
+	var root *Component
+
+	for _, line := range unfold(data) {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		prop, err := parseContentLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch prop.Name {
+		case "BEGIN":
+			comp := &Component{Name: strings.ToUpper(prop.Value)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, comp)
+			} else if root == nil {
+				root = comp
+			}
+			stack = append(stack, comp)
+
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(prop.Value) {
+				return nil, fmt.Errorf("unexpected END:%s", prop.Value)
+			}
+			stack = stack[:len(stack)-1]
+
+		default:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("property %s outside of a component", prop.Name)
+			}
+			current := stack[len(stack)-1]
+			current.Properties = append(current.Properties, prop)
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("no calendar component found")
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("component %s is not terminated", stack[len(stack)-1].Name)
+	}
+
+	return root, nil
+}
+
+// Get returns the first property with the given name, or nil
+func (c *Component) Get(name string) *Property {
+	for i := range c.Properties {
+		if c.Properties[i].Name == name {
+			return &c.Properties[i]
+		}
+	}
+	return nil
+}
+
+// GetAll returns every property with the given name
+func (c *Component) GetAll(name string) []Property {
+	var props []Property
+	for _, p := range c.Properties {
+		if p.Name == name {
+			props = append(props, p)
+		}
+	}
+	return props
+}
+
+// Child returns the first sub-component with the given name, or nil
+func (c *Component) Child(name string) *Component {
+	for _, child := range c.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// unfold joins folded content lines (RFC 5545 section 3.1)
+func unfold(data string) []string {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+
+	var lines []string
+	for _, line := range strings.Split(data, "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, strings.TrimRight(line, "\r"))
+	}
+	return lines
+}
+
+// parseContentLine parses "NAME;PARAM=value;PARAM="quoted":value"
+func parseContentLine(line string) (Property, error) {
+	prop := Property{Params: make(map[string]string)}
+
+	i := strings.IndexAny(line, ";:")
+	if i < 0 {
+		return prop, fmt.Errorf("invalid content line: %q", line)
+	}
+	prop.Name = strings.ToUpper(line[:i])
+
+	for line[i] == ';' {
+		rest := line[i+1:]
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return prop, fmt.Errorf("invalid parameter in line: %q", line)
+		}
+		name := strings.ToUpper(rest[:eq])
+		rest = rest[eq+1:]
+		consumed := i + 1 + eq + 1
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return prop, fmt.Errorf("unterminated quoted parameter in line: %q", line)
+			}
+			value = rest[1 : end+1]
+			consumed += end + 2
+		} else {
+			end := strings.IndexAny(rest, ";:")
+			if end < 0 {
+				return prop, fmt.Errorf("invalid parameter in line: %q", line)
+			}
+			value = rest[:end]
+			consumed += end
+		}
+
+		prop.Params[name] = value
+		i = consumed
+		if i >= len(line) {
+			return prop, fmt.Errorf("missing value in line: %q", line)
+		}
+	}
+
+	prop.Value = line[i+1:]
+	return prop, nil
+}
+
+// String encodes the property as a folded content line terminated by CRLF
+func (p Property) String() string {
+	var b strings.Builder
+	b.WriteString(p.Name)
+
+	names := make([]string, 0, len(p.Params))
+	for name := range p.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := p.Params[name]
+		if strings.ContainsAny(value, ":;,") {
+			value = `"` + value + `"`
+		}
+		b.WriteString(";" + name + "=" + value)
+	}
+	b.WriteString(":" + p.Value)
+
+	return fold(b.String())
+}
+
+// fold splits a content line into chunks of at most 75 octets without breaking UTF-8 sequences
+func fold(line string) string {
+	var b strings.Builder
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+	return b.String()
+}
+
+// unescapeText decodes an iCalendar TEXT value
+func unescapeText(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+// escapeText encodes a string as an iCalendar TEXT value
+func escapeText(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
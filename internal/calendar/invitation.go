@@ -0,0 +1,250 @@
+package calendar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Participation statuses usable in a reply
+const (
+	PartStatAccepted  = "ACCEPTED"
+	PartStatDeclined  = "DECLINED"
+	PartStatTentative = "TENTATIVE"
+)
+
+// Invitation is a meeting request, cancellation or reply carried by an email (iMIP, RFC 6047)
+type Invitation struct {
+	Method      string     `json:"method"`
+	UID         string     `json:"uid"`
+	Sequence    int        `json:"sequence"`
+	Status      string     `json:"status,omitempty"`
+	Summary     string     `json:"summary"`
+	Description string     `json:"description,omitempty"`
+	Location    string     `json:"location,omitempty"`
+	Start       *time.Time `json:"start,omitempty"`
+	End         *time.Time `json:"end,omitempty"`
+	AllDay      bool       `json:"all_day"`
+	Organizer   *Attendee  `json:"organizer,omitempty"`
+	Attendees   []Attendee `json:"attendees,omitempty"`
+
+	event *Component
+}
+
+// Attendee is the organizer or a participant of an event
+type Attendee struct {
+	Email  string `json:"email"`
+	Name   string `json:"name,omitempty"`
+	Role   string `json:"role,omitempty"`
+	Status string `json:"status,omitempty"`
+	RSVP   bool   `json:"rsvp"`
+}
+
+// ParseInvitation extracts the first event of an iCalendar object
+func ParseInvitation(data string) (*Invitation, error) {
+	root, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if root.Name != "VCALENDAR" {
+		return nil, fmt.Errorf("expected VCALENDAR, got %s", root.Name)
+	}
+
+	event := root.Child("VEVENT")
+	if event == nil {
+		return nil, fmt.Errorf("no VEVENT found")
+	}
+
+	inv := &Invitation{
+		Method: "PUBLISH",
+		event:  event,
+	}
+
+	if p := root.Get("METHOD"); p != nil {
+		inv.Method = strings.ToUpper(p.Value)
+	}
+	if p := event.Get("UID"); p != nil {
+		inv.UID = p.Value
+	}
+	if p := event.Get("SEQUENCE"); p != nil {
+		inv.Sequence, _ = strconv.Atoi(p.Value)
+	}
+	if p := event.Get("STATUS"); p != nil {
+		inv.Status = strings.ToUpper(p.Value)
+	}
+	if p := event.Get("SUMMARY"); p != nil {
+		inv.Summary = unescapeText(p.Value)
+	}
+	if p := event.Get("DESCRIPTION"); p != nil {
+		inv.Description = unescapeText(p.Value)
+	}
+	if p := event.Get("LOCATION"); p != nil {
+		inv.Location = unescapeText(p.Value)
+	}
+
+	if p := event.Get("DTSTART"); p != nil {
+		start, allDay, err := parseDateTime(*p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DTSTART: %w", err)
+		}
+		inv.Start = &start
+		inv.AllDay = allDay
+	}
+	if p := event.Get("DTEND"); p != nil {
+		end, _, err := parseDateTime(*p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DTEND: %w", err)
+		}
+		inv.End = &end
+	} else if p := event.Get("DURATION"); p != nil && inv.Start != nil {
+		if d, err := parseDuration(p.Value); err == nil {
+			end := inv.Start.Add(d)
+			inv.End = &end
+		}
+	}
+
+	if p := event.Get("ORGANIZER"); p != nil {
+		organizer := parseAttendee(*p)
+		inv.Organizer = &organizer
+	}
+	for _, p := range event.GetAll("ATTENDEE") {
+		inv.Attendees = append(inv.Attendees, parseAttendee(p))
+	}
+
+	return inv, nil
+}
+
+// FindAttendee returns the attendee with the given address, or nil
+func (inv *Invitation) FindAttendee(email string) *Attendee {
+	for i := range inv.Attendees {
+		if strings.EqualFold(inv.Attendees[i].Email, email) {
+			return &inv.Attendees[i]
+		}
+	}
+	return nil
+}
+
+// Reply builds an iMIP METHOD:REPLY object answering the invitation on behalf of attendee
+func (inv *Invitation) Reply(email, name, partStat, comment string, now time.Time) string {
+	var b strings.Builder
+	b.WriteString("BEGIN:VCALENDAR\r\n")
+	b.WriteString(Property{Name: "PRODID", Value: "-//MailAPI//Calendar Reply//EN"}.String())
+	b.WriteString("VERSION:2.0\r\n")
+	b.WriteString("METHOD:REPLY\r\n")
+	b.WriteString("BEGIN:VEVENT\r\n")
+
+	// Identify the event exactly as the organizer sent it
+	for _, name := range []string{"UID", "RECURRENCE-ID", "SEQUENCE", "DTSTART", "DTEND", "DURATION", "ORGANIZER", "SUMMARY"} {
+		if p := inv.event.Get(name); p != nil {
+			b.WriteString(p.String())
+		}
+	}
+
+	b.WriteString(Property{Name: "DTSTAMP", Value: now.UTC().Format("20060102T150405Z")}.String())
+
+	attendee := Property{
+		Name:   "ATTENDEE",
+		Params: map[string]string{"PARTSTAT": partStat},
+		Value:  "mailto:" + email,
+	}
+	if name != "" {
+		attendee.Params["CN"] = name
+	}
+	b.WriteString(attendee.String())
+
+	if comment != "" {
+		b.WriteString(Property{Name: "COMMENT", Value: escapeText(comment)}.String())
+	}
+
+	b.WriteString("END:VEVENT\r\n")
+	b.WriteString("END:VCALENDAR\r\n")
+
+	return b.String()
+}
+
+// parseAttendee reads an ORGANIZER or ATTENDEE property
+func parseAttendee(p Property) Attendee {
+	value := p.Value
+	if len(value) >= 7 && strings.EqualFold(value[:7], "mailto:") {
+		value = value[7:]
+	}
+
+	return Attendee{
+		Email:  value,
+		Name:   p.Params["CN"],
+		Role:   p.Params["ROLE"],
+		Status: strings.ToUpper(p.Params["PARTSTAT"]),
+		RSVP:   strings.EqualFold(p.Params["RSVP"], "TRUE"),
+	}
+}
+
+// parseDateTime reads a DATE or DATE-TIME value, honouring the TZID parameter
+func parseDateTime(p Property) (time.Time, bool, error) {
+	if p.Params["VALUE"] == "DATE" || len(p.Value) == 8 {
+		t, err := time.ParseInLocation("20060102", p.Value, time.UTC)
+		return t, true, err
+	}
+
+	if strings.HasSuffix(p.Value, "Z") {
+		t, err := time.Parse("20060102T150405Z", p.Value)
+		return t, false, err
+	}
+
+	loc := time.UTC
+	if tzid := p.Params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+
+	t, err := time.ParseInLocation("20060102T150405", p.Value, loc)
+	return t, false, err
+}
+
+// parseDuration reads an iCalendar DURATION value such as PT1H30M or P1D
+func parseDuration(value string) (time.Duration, error) {
+	sign := time.Duration(1)
+	if strings.HasPrefix(value, "-") {
+		sign = -1
+	}
+	value = strings.TrimLeft(value, "+-")
+	if !strings.HasPrefix(value, "P") {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+
+	var d time.Duration
+	var num strings.Builder
+	for _, r := range value[1:] {
+		if r >= '0' && r <= '9' {
+			num.WriteRune(r)
+			continue
+		}
+		if r == 'T' {
+			continue
+		}
+
+		n, err := strconv.Atoi(num.String())
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", value)
+		}
+		num.Reset()
+
+		switch r {
+		case 'W':
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case 'D':
+			d += time.Duration(n) * 24 * time.Hour
+		case 'H':
+			d += time.Duration(n) * time.Hour
+		case 'M':
+			d += time.Duration(n) * time.Minute
+		case 'S':
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("invalid duration: %s", value)
+		}
+	}
+
+	return sign * d, nil
+}
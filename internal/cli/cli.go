@@ -0,0 +1,184 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/mailbox"
+	"github.com/lyneq/mailapi/internal/rbac"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+	"github.com/lyneq/mailapi/internal/users"
+)
+
+// usage describes the available sub-commands
+const usage = `Usage:
+  mailapi                                   start the API server
+  mailapi export [-folder NAME] [-format mbox|maildir] [-o FILE]
+  mailapi import [-folder NAME] [-format mbox|maildir|eml] FILE...
+  mailapi role USERNAME User|Admin          set the role of a user, e.g. the first administrator`
+
+// Run executes a command line sub-command against the configured mail account
+func Run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command\n%s", usage)
+	}
+
+	switch args[0] {
+	case "export":
+		return runExport(args[1:])
+	case "import":
+		return runImport(args[1:])
+	case "role":
+		return runRole(args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+// runExport writes a folder or the whole account to a file
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	folder := fs.String("folder", "", "folder to export (default: every folder)")
+	format := fs.String("format", mailbox.FormatMbox, "archive format: mbox or maildir")
+	output := fs.String("o", "", "output file (default: derived from the folder and format)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *format != mailbox.FormatMbox && *format != mailbox.FormatMaildir {
+		return fmt.Errorf("format must be mbox or maildir")
+	}
+
+	imapClient := smtpclient.NewIMAPClientFromConfig()
+	if err := imapClient.Connect(); err != nil {
+		return err
+	}
+	defer imapClient.Disconnect()
+
+	folders := []string{*folder}
+	if *folder == "" {
+		var err error
+		folders, err = imapClient.GetSelectableFolders()
+		if err != nil {
+			return err
+		}
+	}
+
+	if *output == "" {
+		_, *output = mailbox.ExportFileInfo(*format, folders)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", *output, err)
+	}
+	defer f.Close()
+
+	job := mailbox.NewJob(0, "export")
+	stop := reportProgress(job)
+	err = mailbox.Export(imapClient, folders, *format, f, job)
+	job.Finish(err)
+	stop()
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %d messages to %s\n", job.Status().Processed, *output)
+	return nil
+}
+
+// runImport appends the messages of archive files to the account
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	folder := fs.String("folder", "", "destination folder for messages without one (default: INBOX)")
+	format := fs.String("format", "", "archive format: mbox, maildir or eml (default: from the file extension)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("at least one file is required\n%s", usage)
+	}
+
+	var sources []mailbox.Source
+	for _, path := range fs.Args() {
+		sources = append(sources, mailbox.Source{Path: path, Filename: path, Format: *format})
+	}
+
+	imapClient := smtpclient.NewIMAPClientFromConfig()
+	if err := imapClient.Connect(); err != nil {
+		return err
+	}
+	defer imapClient.Disconnect()
+
+	job := mailbox.NewJob(0, "import")
+	stop := reportProgress(job)
+	err := mailbox.Import(imapClient, sources, *folder, job)
+	job.Finish(err)
+	stop()
+
+	if err != nil {
+		return err
+	}
+
+	status := job.Status()
+	fmt.Printf("Imported %d messages (%d failed)\n", status.Processed-status.Failed, status.Failed)
+	return nil
+}
+
+// runRole sets the role of a user
+func runRole(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("role takes a username and a role (%s)", strings.Join(rbac.Roles, " or "))
+	}
+	if !rbac.ValidRole(args[1]) {
+		return fmt.Errorf("unknown role %q, use %s", args[1], strings.Join(rbac.Roles, " or "))
+	}
+
+	db.Init()
+	user, err := users.GetByUsername(args[0])
+	if err != nil {
+		return err
+	}
+	if _, err := users.SetRole(0, user.ID, args[1]); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s is now %s\n", user.Username, args[1])
+	return nil
+}
+
+// reportProgress prints the job progress every second until the returned function is called
+func reportProgress(job *mailbox.Job) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				status := job.Status()
+				fmt.Fprintf(os.Stderr, "%s: %d/%d messages (%d%%)\n", status.Kind, status.Processed, status.Total, status.Percent)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,342 @@
+// Package identity manages the sender identities of users: the addresses they
+// send from, with their display names, reply-to addresses and signatures. An
+// identity is only used once its address is proven to be the user's: they
+// opened a link mailed to it, for the identity, one of their mail accounts or
+// their own email address, or an administrator assigned it to them.
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+	"github.com/lyneq/mailapi/internal/utils"
+	"github.com/lyneq/mailapi/internal/verification"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrNotFound is returned when the identity does not exist or belongs to another user
+	ErrNotFound = errors.New("identity not found")
+	// ErrSenderNotAllowed is returned when the address is outside the domains the user may send from
+	ErrSenderNotAllowed = errors.New("sending from this address is not allowed")
+	// ErrDuplicate is returned when the user already has an identity with the address
+	ErrDuplicate = errors.New("an identity with this address already exists")
+	// ErrAddressTaken is returned when the address belongs to another user
+	ErrAddressTaken = errors.New("this address belongs to another user")
+	// ErrUnverified is returned when the user has not proven they own the address yet
+	ErrUnverified = errors.New("this address is not verified yet")
+	// ErrVerified is returned when verification is requested for a verified identity
+	ErrVerified = errors.New("this identity is already verified")
+)
+
+// Get returns an identity of the user
+func Get(userID, id uint) (*db.Identity, error) {
+	var identity db.Identity
+	err := db.DB.Where("id = ? AND user_id = ?", id, userID).First(&identity).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// Resolve returns the identity a user sends from: the one with the given ID,
+// or the default identity when id is 0. It returns nil without error when the
+// user has no default identity, in which case the account address is used.
+func Resolve(userID, id uint) (*db.Identity, error) {
+	var identity *db.Identity
+	if id != 0 {
+		found, err := Get(userID, id)
+		if err != nil {
+			return nil, err
+		}
+		identity = found
+	} else {
+		var found db.Identity
+		err := db.DB.Where("user_id = ? AND is_default = ?", userID, true).First(&found).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		identity = &found
+	}
+
+	if err := usable(identity); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// Save creates or updates an identity. Making it the default identity, or
+// creating the first identity of the user, unsets the previous default. A new
+// address is verified right away when it is the user's own, else the identity
+// waits for RequestVerification and Verify.
+func Save(identity *db.Identity) error {
+	return save(identity, false)
+}
+
+// Assign creates or updates an identity on behalf of an administrator, verified
+// without mailing the address
+func Assign(actorID uint, identity *db.Identity) error {
+	identity.AssignedBy = &actorID
+	return save(identity, true)
+}
+
+// RequestVerification mails a verification link to the address of an identity
+func RequestVerification(identity *db.Identity) error {
+	if identity.Verified {
+		return ErrVerified
+	}
+	var user db.User
+	if err := db.DB.First(&user, identity.UserID).Error; err != nil {
+		return fmt.Errorf("failed to find user: %w", err)
+	}
+	return verification.SendIdentityVerification(&user, identity.Address)
+}
+
+// Verify uses a token mailed by RequestVerification, or by the verification
+// of a mail account, and marks the identity and the mail accounts of the
+// address as verified. It returns the confirmed address. The token is refused
+// once neither has the address anymore.
+func Verify(token string) (string, error) {
+	used, err := verification.VerifyIdentity(token)
+	if err != nil {
+		return "", err
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		var identities, accounts int64
+		err := tx.Model(&db.Identity{}).Where("user_id = ? AND address = ?", used.UserID, used.Email).Count(&identities).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&db.MailAccount{}).Where("user_id = ? AND email = ?", used.UserID, used.Email).Count(&accounts).Error
+		if err != nil {
+			return err
+		}
+		if identities+accounts == 0 {
+			return verification.ErrInvalidToken
+		}
+
+		if taken, err := addressTaken(tx, used.UserID, used.Email); err != nil {
+			return err
+		} else if taken {
+			return ErrAddressTaken
+		}
+		err = tx.Model(&db.Identity{}).Where("user_id = ? AND address = ?", used.UserID, used.Email).Update("verified", true).Error
+		if err != nil {
+			return fmt.Errorf("failed to verify identity: %w", err)
+		}
+		err = tx.Model(&db.MailAccount{}).Where("user_id = ? AND email = ?", used.UserID, used.Email).Update("email_verified", true).Error
+		if err != nil {
+			return fmt.Errorf("failed to verify mail account: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return used.Email, nil
+}
+
+// save stores an identity, verified when assigned by an administrator
+func save(identity *db.Identity, assigned bool) error {
+	identity.Address = strings.ToLower(strings.TrimSpace(identity.Address))
+	// Display names end up in a header field and must hold on a single line
+	identity.Name = strings.Join(strings.Fields(identity.Name), " ")
+
+	if !senderAllowed(identity.UserID, identity.Address) {
+		return ErrSenderNotAllowed
+	}
+
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&db.Identity{}).
+			Where("user_id = ? AND address = ? AND id <> ?", identity.UserID, identity.Address, identity.ID).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrDuplicate
+		}
+
+		if taken, err := addressTaken(tx, identity.UserID, identity.Address); err != nil {
+			return err
+		} else if taken {
+			return ErrAddressTaken
+		}
+
+		var previous db.Identity
+		if identity.ID != 0 {
+			if err := tx.Select("address").First(&previous, identity.ID).Error; err != nil {
+				return err
+			}
+		}
+		switch {
+		case assigned:
+			identity.Verified = true
+		case identity.ID == 0 || previous.Address != identity.Address:
+			// A changed address must be proven again
+			identity.AssignedBy = nil
+			identity.Verified, err = owned(tx, identity.UserID, identity.Address)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !identity.IsDefault {
+			err := tx.Model(&db.Identity{}).
+				Where("user_id = ? AND id <> ?", identity.UserID, identity.ID).
+				Count(&count).Error
+			if err != nil {
+				return err
+			}
+			identity.IsDefault = count == 0
+		}
+
+		if identity.IsDefault {
+			err := tx.Model(&db.Identity{}).
+				Where("user_id = ? AND id <> ?", identity.UserID, identity.ID).
+				Update("is_default", false).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Save(identity).Error
+	})
+}
+
+// Addresses returns the addresses of every identity of the user
+func Addresses(userID uint) ([]string, error) {
+	var addresses []string
+	err := db.DB.Model(&db.Identity{}).Where("user_id = ?", userID).Pluck("address", &addresses).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list identities: %w", err)
+	}
+	return addresses, nil
+}
+
+// From returns the From header value of an identity, with its display name
+func From(identity *db.Identity) string {
+	return (&mail.Address{Name: identity.Name, Address: identity.Address}).String()
+}
+
+// Sign appends the signature of an identity to an HTML or plain-text body
+func Sign(identity *db.Identity, body string, htmlBody bool) string {
+	if identity == nil {
+		return body
+	}
+	if htmlBody {
+		return smtpclient.SignHTML(body, identity.HTMLSignature, identity.TextSignature)
+	}
+	return smtpclient.SignText(body, identity.HTMLSignature, identity.TextSignature)
+}
+
+// Match returns the identity of the user whose address is one of the given
+// recipients, e.g. to answer an email from the address it was sent to. It
+// returns nil without error when none matches.
+func Match(userID uint, recipients []string) (*db.Identity, error) {
+	var identities []db.Identity
+	if err := db.DB.Where("user_id = ?", userID).Order("is_default DESC").Find(&identities).Error; err != nil {
+		return nil, err
+	}
+
+	for _, recipient := range recipients {
+		if addr, err := mail.ParseAddress(recipient); err == nil {
+			recipient = addr.Address
+		}
+		for i := range identities {
+			if strings.EqualFold(identities[i].Address, recipient) && usable(&identities[i]) == nil {
+				return &identities[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// usable checks that an identity may be used to send: its address is proven,
+// still the user's and, as the sender domains may have changed since it was
+// created, allowed
+func usable(identity *db.Identity) error {
+	if !senderAllowed(identity.UserID, identity.Address) {
+		return ErrSenderNotAllowed
+	}
+	if taken, err := addressTaken(db.DB, identity.UserID, identity.Address); err != nil {
+		return err
+	} else if taken {
+		return ErrAddressTaken
+	}
+	if !identity.Verified {
+		if owns, err := owned(db.DB, identity.UserID, identity.Address); err != nil {
+			return err
+		} else if !owns {
+			return ErrUnverified
+		}
+	}
+	return nil
+}
+
+// owned tells whether an address is already proven to be the user's: the
+// verified address of one of their mail accounts or their verified email
+func owned(tx *gorm.DB, userID uint, address string) (bool, error) {
+	var count int64
+	err := tx.Model(&db.MailAccount{}).Where("user_id = ? AND LOWER(email) = ? AND email_verified = ?", userID, address, true).Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	err = tx.Model(&db.User{}).Where("id = ? AND email = ? AND is_verified = ?", userID, address, true).Count(&count).Error
+	return count > 0, err
+}
+
+// addressTaken tells whether an address is proven to belong to another user:
+// the verified address of their mail account, their verified email or their
+// verified identity. Unproven claims never block the actual owner.
+func addressTaken(tx *gorm.DB, userID uint, address string) (bool, error) {
+	var count int64
+	err := tx.Model(&db.MailAccount{}).Where("user_id <> ? AND LOWER(email) = ? AND email_verified = ?", userID, address, true).Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	err = tx.Model(&db.User{}).Where("id <> ? AND email = ? AND is_verified = ?", userID, address, true).Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	err = tx.Model(&db.Identity{}).Where("user_id <> ? AND address = ? AND verified = ?", userID, address, true).Count(&count).Error
+	return count > 0, err
+}
+
+// senderAllowed reports whether the user may send from an address: its domain
+// is the domain of one of their verified mail account addresses or, for users
+// of the shared account, one of the SMTP sender_domains
+func senderAllowed(userID uint, address string) bool {
+	var accounts []db.MailAccount
+	if err := db.DB.Select("email", "email_verified").Where("user_id = ?", userID).Find(&accounts).Error; err != nil {
+		return false
+	}
+	if len(accounts) == 0 {
+		return config.GetAccountsConfig().SharedAccount && utils.SenderAllowed(address)
+	}
+
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return false
+	}
+	for _, account := range accounts {
+		i := strings.LastIndex(account.Email, "@")
+		if account.EmailVerified && i >= 0 && strings.EqualFold(account.Email[i+1:], address[at+1:]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+// Package lockout slows down password guessing. Failed sign-ins are counted
+// per username and per IP address in the database: after the second failure
+// of a username each attempt must wait twice as long as the previous one,
+// and a username or an IP address reaching its limit is locked out for a
+// while. Unknown usernames are counted like the others, so that lockouts do
+// not tell which usernames exist. The sign-ins of a username or an IP address
+// run one at a time, so that parallel requests cannot all pass the check
+// before their failures are counted.
+package lockout
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	"gorm.io/gorm"
+)
+
+// ErrNotFound is returned when the throttle to unlock does not exist
+var ErrNotFound = errors.New("lockout not found")
+
+// keyLock serialises the sign-ins of a username or an IP address
+type keyLock struct {
+	sync.Mutex
+	// users counts the sign-ins holding or waiting for the lock
+	users int
+}
+
+var (
+	locksMu sync.Mutex
+	locks   = make(map[string]*keyLock)
+)
+
+// Lock serialises the sign-ins of username and of ip, from Check to Fail or
+// Reset, so that parallel attempts are checked one after the other, each
+// seeing the failures of the previous ones. The returned function releases
+// them.
+func Lock(username, ip string) func() {
+	// Always in the same order, so that two sign-ins never wait for each other
+	releaseUsername := acquire(db.ThrottleUsername + ":" + username)
+	releaseIP := acquire(db.ThrottleIP + ":" + ip)
+	return func() {
+		releaseIP()
+		releaseUsername()
+	}
+}
+
+// acquire locks key, dropping its lock once nobody uses it
+func acquire(key string) func() {
+	locksMu.Lock()
+	lock := locks[key]
+	if lock == nil {
+		lock = &keyLock{}
+		locks[key] = lock
+	}
+	lock.users++
+	locksMu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		locksMu.Lock()
+		if lock.users--; lock.users == 0 {
+			delete(locks, key)
+		}
+		locksMu.Unlock()
+	}
+}
+
+// Check returns how long a sign-in of username from ip must wait, 0 when it
+// may proceed. The sign-in must hold Lock until its outcome is recorded.
+func Check(username, ip string) (time.Duration, error) {
+	now := time.Now()
+	limits := settings()
+
+	var throttles []db.SignInThrottle
+	err := db.DB.Where("(kind = ? AND value = ?) OR (kind = ? AND value = ?)",
+		db.ThrottleUsername, username, db.ThrottleIP, ip).Find(&throttles).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to check sign-in attempts: %w", err)
+	}
+
+	var wait time.Duration
+	for _, throttle := range throttles {
+		until := throttle.LastFailureAt
+		if throttle.LockedUntil != nil {
+			until = *throttle.LockedUntil
+		} else if throttle.Kind == db.ThrottleUsername && !stale(throttle, now, limits) {
+			until = throttle.LastFailureAt.Add(delay(throttle.Failures, limits))
+		}
+		if d := until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// Fail records a failed sign-in of username from ip, locking them out when
+// they reach their limit
+func Fail(username, ip string) error {
+	now := time.Now()
+	limits := settings()
+
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := record(tx, db.ThrottleUsername, username, limits.MaxAttempts, now, limits); err != nil {
+			return err
+		}
+		if err := record(tx, db.ThrottleIP, ip, limits.IPMaxAttempts, now, limits); err != nil {
+			return err
+		}
+		// Forget the failures nobody repeated, e.g. of mistyped usernames
+		return tx.Unscoped().
+			Where("last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)", now.Add(-limits.Lockout), now).
+			Delete(&db.SignInThrottle{}).Error
+	})
+}
+
+// Reset forgets the failed sign-ins of username, once they signed in or an
+// administrator unlocked them. Those of the IP addresses are kept, so that
+// signing in to one account does not reset the guessing of others.
+func Reset(username string) error {
+	err := db.DB.Unscoped().Where("kind = ? AND value = ?", db.ThrottleUsername, username).Delete(&db.SignInThrottle{}).Error
+	if err != nil {
+		return fmt.Errorf("failed to reset sign-in attempts: %w", err)
+	}
+	return nil
+}
+
+// List returns the usernames and IP addresses with failed sign-ins, locked
+// out first
+func List() ([]db.SignInThrottle, error) {
+	var throttles []db.SignInThrottle
+	err := db.DB.Where("locked_until > ? OR last_failure_at > ?", time.Now(), time.Now().Add(-settings().Lockout)).
+		Order("locked_until IS NULL, locked_until DESC, last_failure_at DESC").
+		Find(&throttles).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sign-in attempts: %w", err)
+	}
+	return throttles, nil
+}
+
+// Unlock forgets the failed sign-ins of a username or an IP address by ID
+func Unlock(id uint) error {
+	result := db.DB.Unscoped().Delete(&db.SignInThrottle{}, id)
+	if result.Error != nil {
+		return fmt.Errorf("failed to unlock: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// record counts a failure of the username or IP address value
+func record(tx *gorm.DB, kind, value string, max int, now time.Time, limits config.SignInConfig) error {
+	var throttle db.SignInThrottle
+	err := tx.Where("kind = ? AND value = ?", kind, value).First(&throttle).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		throttle = db.SignInThrottle{Kind: kind, Value: value}
+	} else if err != nil {
+		return fmt.Errorf("failed to read sign-in attempts: %w", err)
+	}
+
+	if stale(throttle, now, limits) {
+		throttle.Failures = 0
+		throttle.LockedUntil = nil
+	}
+	throttle.Failures++
+	throttle.LastFailureAt = now
+	if throttle.Failures >= max {
+		until := now.Add(limits.Lockout)
+		throttle.LockedUntil = &until
+	}
+
+	if err := tx.Save(&throttle).Error; err != nil {
+		return fmt.Errorf("failed to record sign-in attempt: %w", err)
+	}
+	return nil
+}
+
+// stale tells whether the failures of a throttle are old enough to be forgotten
+func stale(throttle db.SignInThrottle, now time.Time, limits config.SignInConfig) bool {
+	if throttle.LockedUntil != nil {
+		return !throttle.LockedUntil.After(now)
+	}
+	return throttle.LastFailureAt.Before(now.Add(-limits.Lockout))
+}
+
+// delay returns the wait after the failures of a username: none after the
+// first, so that a typo costs nothing, then Delay doubled at each failure
+func delay(failures int, limits config.SignInConfig) time.Duration {
+	if failures < 2 {
+		return 0
+	}
+	wait := limits.Delay
+	for i := 2; i < failures && wait < limits.Lockout; i++ {
+		wait *= 2
+	}
+	return min(wait, limits.Lockout)
+}
+
+// settings returns the [SignIn] limits, with the defaults of the values
+// missing when the configuration was not loaded
+func settings() config.SignInConfig {
+	limits := config.GetSignInConfig()
+	if limits.MaxAttempts <= 0 {
+		limits.MaxAttempts = 5
+	}
+	if limits.IPMaxAttempts <= 0 {
+		limits.IPMaxAttempts = 20
+	}
+	if limits.Lockout <= 0 {
+		limits.Lockout = 15 * time.Minute
+	}
+	return limits
+}
@@ -0,0 +1,78 @@
+package mailauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+const (
+	// cacheTTL is how long a report is reused; DNS records, e.g. rotated
+	// DKIM keys, may change meanwhile
+	cacheTTL = time.Hour
+	// cacheSize is the number of reports kept
+	cacheSize = 1000
+)
+
+type cachedReport struct {
+	report  *Report
+	expires time.Time
+}
+
+var (
+	cacheMu sync.Mutex
+	cache   = map[[sha256.Size]byte]cachedReport{}
+)
+
+// AnalyzeCached is AnalyzeContext with the default resolver, reusing the
+// report of a message analyzed less than an hour ago. Reports with temporary
+// errors are not kept, so that the next request tries again.
+func AnalyzeCached(ctx context.Context, raw []byte) *Report {
+	key := sha256.Sum256(raw)
+	now := time.Now()
+
+	cacheMu.Lock()
+	cached, ok := cache[key]
+	cacheMu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.report
+	}
+
+	report := AnalyzeContext(ctx, raw, nil)
+	if report.temporary() {
+		return report
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if len(cache) >= cacheSize {
+		for k, entry := range cache {
+			if !now.Before(entry.expires) {
+				delete(cache, k)
+			}
+		}
+		// Still full of fresh reports, drop an arbitrary one
+		for k := range cache {
+			if len(cache) < cacheSize {
+				break
+			}
+			delete(cache, k)
+		}
+	}
+	cache[key] = cachedReport{report: report, expires: now.Add(cacheTTL)}
+	return report
+}
+
+// temporary reports whether a verdict depends on a lookup that failed for now
+func (r *Report) temporary() bool {
+	if r.DKIM.Result == ResultTempError || r.DMARC.Result == ResultTempError {
+		return true
+	}
+	for _, sig := range r.Signatures {
+		if sig.Result == ResultTempError {
+			return true
+		}
+	}
+	return false
+}
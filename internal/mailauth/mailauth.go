@@ -0,0 +1,337 @@
+package mailauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Result values used in verdicts, as defined by RFC 8601
+const (
+	ResultPass      = "pass"
+	ResultFail      = "fail"
+	ResultSoftFail  = "softfail"
+	ResultNeutral   = "neutral"
+	ResultNone      = "none"
+	ResultTempError = "temperror"
+	ResultPermError = "permerror"
+)
+
+// Verdict sources
+const (
+	SourceHeader = "header" // reported by the receiving mail server
+	SourceLocal  = "local"  // computed by this API
+)
+
+// Resolver looks up DNS TXT records. It is an interface so verification can run offline in tests.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+// ContextResolver is a Resolver whose lookups can be cancelled
+type ContextResolver interface {
+	Resolver
+	LookupTXTContext(ctx context.Context, name string) ([]string, error)
+}
+
+// DNSResolver resolves TXT records with the system resolver
+type DNSResolver struct {
+	Timeout time.Duration
+}
+
+// LookupTXT implements Resolver
+func (r DNSResolver) LookupTXT(name string) ([]string, error) {
+	return r.LookupTXTContext(context.Background(), name)
+}
+
+// LookupTXTContext implements ContextResolver
+func (r DNSResolver) LookupTXTContext(ctx context.Context, name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+	return net.DefaultResolver.LookupTXT(ctx, name)
+}
+
+// boundResolver stops the lookups of a resolver once its context is done, so
+// that the verification of a message with many signatures ends in time
+type boundResolver struct {
+	ctx      context.Context
+	resolver Resolver
+}
+
+func (r boundResolver) LookupTXT(name string) ([]string, error) {
+	if err := r.ctx.Err(); err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name, IsTimeout: true, IsTemporary: true}
+	}
+	if resolver, ok := r.resolver.(ContextResolver); ok {
+		return resolver.LookupTXTContext(r.ctx, name)
+	}
+	return r.resolver.LookupTXT(name)
+}
+
+// DefaultResolver is used when Analyze is called without a resolver
+var DefaultResolver Resolver = DNSResolver{Timeout: 5 * time.Second}
+
+// Verdict is the outcome of one authentication mechanism
+type Verdict struct {
+	Result string `json:"result"`
+	Domain string `json:"domain,omitempty"`
+	Source string `json:"source,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Signature is the result of verifying one DKIM-Signature header locally
+type Signature struct {
+	Domain     string `json:"domain"`
+	Identifier string `json:"identifier,omitempty"`
+	Result     string `json:"result"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Report summarises how trustworthy the sender of a message is
+type Report struct {
+	SPF           Verdict     `json:"spf"`
+	DKIM          Verdict     `json:"dkim"`
+	DMARC         Verdict     `json:"dmarc"`
+	Signatures    []Signature `json:"dkim_signatures,omitempty"`
+	FromDomain    string      `json:"from_domain,omitempty"`
+	ReplyToDomain string      `json:"reply_to_domain,omitempty"`
+	Warnings      []string    `json:"warnings,omitempty"`
+}
+
+// Analyze inspects the Authentication-Results, Received-SPF and DKIM-Signature
+// headers of a raw message, verifies its DKIM signatures and evaluates DMARC
+// alignment when the receiving server did not report it.
+func Analyze(raw []byte, resolver Resolver) *Report {
+	return AnalyzeContext(context.Background(), raw, resolver)
+}
+
+// AnalyzeContext is Analyze with DNS lookups bound to ctx. Lookups not done
+// when ctx ends yield temperror verdicts.
+func AnalyzeContext(ctx context.Context, raw []byte, resolver Resolver) *Report {
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+	resolver = boundResolver{ctx: ctx, resolver: resolver}
+
+	report := &Report{
+		SPF:   Verdict{Result: ResultNone},
+		DKIM:  Verdict{Result: ResultNone},
+		DMARC: Verdict{Result: ResultNone},
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		report.Warnings = append(report.Warnings, "The message headers could not be parsed")
+		return report
+	}
+
+	report.FromDomain = addressDomain(msg.Header.Get("From"))
+	report.ReplyToDomain = addressDomain(msg.Header.Get("Reply-To"))
+
+	// Only the topmost headers were added by our own provider, anything below
+	// could have been forged by the sender
+	if values := msg.Header["Authentication-Results"]; len(values) > 0 {
+		applyAuthenticationResults(report, values[0])
+	}
+	if values := msg.Header["Received-Spf"]; len(values) > 0 && report.SPF.Source == "" {
+		report.SPF = parseReceivedSPF(values[0])
+	}
+
+	if len(msg.Header["Dkim-Signature"]) > 0 {
+		verifyDKIM(report, raw, resolver)
+	}
+
+	if report.DMARC.Source == "" && report.FromDomain != "" {
+		evaluateDMARC(report, resolver)
+	}
+
+	addWarnings(report)
+
+	return report
+}
+
+// applyAuthenticationResults copies the verdicts of an Authentication-Results header
+func applyAuthenticationResults(report *Report, value string) {
+	_, results, err := authres.Parse(value)
+	if err != nil {
+		return
+	}
+
+	for _, result := range results {
+		switch r := result.(type) {
+		case *authres.SPFResult:
+			report.SPF = Verdict{Result: string(r.Value), Domain: addressDomain(r.From), Source: SourceHeader, Reason: r.Reason}
+			if report.SPF.Domain == "" {
+				report.SPF.Domain = r.From
+			}
+		case *authres.DKIMResult:
+			// Keep the first passing signature if there are several
+			if report.DKIM.Source == "" || (report.DKIM.Result != ResultPass && string(r.Value) == ResultPass) {
+				report.DKIM = Verdict{Result: string(r.Value), Domain: r.Domain, Source: SourceHeader, Reason: r.Reason}
+			}
+		case *authres.DMARCResult:
+			report.DMARC = Verdict{Result: string(r.Value), Domain: r.From, Source: SourceHeader, Reason: r.Reason}
+		}
+	}
+}
+
+// parseReceivedSPF reads a Received-SPF header (RFC 7208 section 9.1)
+func parseReceivedSPF(value string) Verdict {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return Verdict{Result: ResultNone}
+	}
+
+	verdict := Verdict{Result: strings.ToLower(fields[0]), Source: SourceHeader}
+	for _, field := range fields[1:] {
+		field = strings.Trim(field, ";")
+		if strings.HasPrefix(strings.ToLower(field), "envelope-from=") {
+			verdict.Domain = addressDomain(strings.Trim(field[len("envelope-from="):], `"<>`))
+		}
+	}
+	return verdict
+}
+
+// verifyDKIM verifies every DKIM signature of the message. The local result
+// takes precedence over the one reported by the receiving server.
+func verifyDKIM(report *Report, raw []byte, resolver Resolver) {
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{
+		LookupTXT: resolver.LookupTXT,
+	})
+	if err != nil {
+		report.Warnings = append(report.Warnings, "DKIM signatures could not be verified: "+err.Error())
+		return
+	}
+
+	var local *Verdict
+	for _, v := range verifications {
+		sig := Signature{Domain: v.Domain, Identifier: v.Identifier, Result: ResultPass}
+		if v.Err != nil {
+			sig.Error = v.Err.Error()
+			switch {
+			case dkim.IsTempFail(v.Err):
+				sig.Result = ResultTempError
+			case dkim.IsPermFail(v.Err):
+				sig.Result = ResultPermError
+			default:
+				sig.Result = ResultFail
+			}
+		}
+		report.Signatures = append(report.Signatures, sig)
+
+		if local == nil || (local.Result != ResultPass && sig.Result == ResultPass) {
+			local = &Verdict{Result: sig.Result, Domain: sig.Domain, Source: SourceLocal, Reason: sig.Error}
+		}
+	}
+
+	if local != nil {
+		report.DKIM = *local
+	}
+}
+
+// evaluateDMARC checks the DMARC policy of the From domain against the SPF and DKIM verdicts
+func evaluateDMARC(report *Report, resolver Resolver) {
+	record, err := dmarc.LookupWithOptions(report.FromDomain, &dmarc.LookupOptions{
+		LookupTXT: resolver.LookupTXT,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, dmarc.ErrNoPolicy):
+			// Also look at the organizational domain policy for subdomains
+			orgDomain := organizationalDomain(report.FromDomain)
+			if orgDomain == report.FromDomain {
+				report.DMARC = Verdict{Result: ResultNone, Domain: report.FromDomain, Source: SourceLocal, Reason: "no DMARC policy published"}
+				return
+			}
+			record, err = dmarc.LookupWithOptions(orgDomain, &dmarc.LookupOptions{LookupTXT: resolver.LookupTXT})
+			if err != nil {
+				report.DMARC = Verdict{Result: ResultNone, Domain: report.FromDomain, Source: SourceLocal, Reason: "no DMARC policy published"}
+				return
+			}
+		case dmarc.IsTempFail(err):
+			report.DMARC = Verdict{Result: ResultTempError, Domain: report.FromDomain, Source: SourceLocal, Reason: err.Error()}
+			return
+		default:
+			report.DMARC = Verdict{Result: ResultPermError, Domain: report.FromDomain, Source: SourceLocal, Reason: err.Error()}
+			return
+		}
+	}
+
+	dkimAligned := report.DKIM.Result == ResultPass && aligned(report.DKIM.Domain, report.FromDomain, record.DKIMAlignment)
+	spfAligned := report.SPF.Result == ResultPass && aligned(report.SPF.Domain, report.FromDomain, record.SPFAlignment)
+
+	verdict := Verdict{Result: ResultFail, Domain: report.FromDomain, Source: SourceLocal, Reason: "policy=" + string(record.Policy)}
+	if dkimAligned || spfAligned {
+		verdict.Result = ResultPass
+	}
+	report.DMARC = verdict
+}
+
+// addWarnings flags the results a reader should be suspicious about
+func addWarnings(report *Report) {
+	if report.ReplyToDomain != "" && report.FromDomain != "" && report.ReplyToDomain != report.FromDomain {
+		report.Warnings = append(report.Warnings, "Replies will go to "+report.ReplyToDomain+", not to the sender domain "+report.FromDomain)
+	}
+
+	switch report.SPF.Result {
+	case ResultFail, ResultSoftFail:
+		report.Warnings = append(report.Warnings, "The sending server is not authorized to send mail for this domain (SPF "+report.SPF.Result+")")
+	}
+	if report.DKIM.Result == ResultFail || report.DKIM.Result == ResultPermError {
+		report.Warnings = append(report.Warnings, "The DKIM signature is invalid, the message may have been altered")
+	}
+	if report.DMARC.Result == ResultFail {
+		report.Warnings = append(report.Warnings, "The sender address could not be authenticated (DMARC fail), it may be spoofed")
+	}
+}
+
+// aligned reports whether an authenticated domain is aligned with the From domain
+func aligned(domain, fromDomain string, mode dmarc.AlignmentMode) bool {
+	domain = strings.ToLower(domain)
+	if domain == "" {
+		return false
+	}
+	if mode == dmarc.AlignmentStrict {
+		return domain == fromDomain
+	}
+	return organizationalDomain(domain) == organizationalDomain(fromDomain)
+}
+
+// organizationalDomain returns the registrable part of a domain, e.g. example.co.uk for mail.example.co.uk
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+// addressDomain returns the lower-cased domain of an address header value
+func addressDomain(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	address := value
+	if addr, err := mail.ParseAddress(value); err == nil {
+		address = addr.Address
+	}
+
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		if strings.Contains(address, ".") && !strings.ContainsAny(address, " <>") {
+			return strings.ToLower(address)
+		}
+		return ""
+	}
+	return strings.ToLower(strings.Trim(address[at+1:], "<> "))
+}
@@ -0,0 +1,75 @@
+package mailbox
+
+import (
+	"bytes"
+	"strings"
+)
+
+// normalizeLF converts CRLF line endings to LF
+func normalizeLF(raw []byte) []byte {
+	return bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+}
+
+// normalizeCRLF converts any line endings to CRLF, as required by IMAP APPEND
+func normalizeCRLF(raw []byte) []byte {
+	return bytes.ReplaceAll(normalizeLF(raw), []byte("\n"), []byte("\r\n"))
+}
+
+// splitHeader splits a raw message into its header block (including the line
+// ending of the last field) and its body. The blank separator line is dropped.
+func splitHeader(raw []byte) ([]byte, []byte) {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(raw, []byte(sep)); i >= 0 {
+			half := len(sep) / 2
+			return raw[:i+half], raw[i+len(sep):]
+		}
+	}
+	return raw, nil
+}
+
+// headerLines groups a header block into fields, keeping folded continuation lines together
+func headerLines(header []byte) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), "\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// headerField returns the unfolded value of the first header field with the given name
+func headerField(header []byte, name string) string {
+	prefix := strings.ToLower(name) + ":"
+	for _, field := range headerLines(header) {
+		if strings.HasPrefix(strings.ToLower(field), prefix) {
+			value := field[len(prefix):]
+			value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// removeHeaderFields drops every header field with one of the given names
+func removeHeaderFields(header []byte, names ...string) []byte {
+	var out bytes.Buffer
+	for _, field := range headerLines(header) {
+		drop := false
+		for _, name := range names {
+			if strings.HasPrefix(strings.ToLower(field), strings.ToLower(name)+":") {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			out.WriteString(field)
+		}
+	}
+	return out.Bytes()
+}
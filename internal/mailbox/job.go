@@ -0,0 +1,155 @@
+package mailbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Job statuses
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// jobRetention is how long finished jobs are kept for progress queries
+const jobRetention = 24 * time.Hour
+
+// Job tracks the progress of a long running export or import
+type Job struct {
+	mu         sync.Mutex
+	id         string
+	userID     uint
+	kind       string
+	status     string
+	total      int
+	processed  int
+	failed     int
+	err        string
+	startedAt  time.Time
+	finishedAt time.Time
+}
+
+// JobStatus is a point-in-time view of a job, suitable for API responses
+type JobStatus struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Status     string     `json:"status"`
+	Total      int        `json:"total"`
+	Processed  int        `json:"processed"`
+	Failed     int        `json:"failed"`
+	Percent    int        `json:"percent"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = make(map[string]*Job)
+)
+
+// NewJob creates and registers a new running job owned by the given user
+func NewJob(userID uint, kind string) *Job {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+
+	job := &Job{
+		id:        hex.EncodeToString(b),
+		userID:    userID,
+		kind:      kind,
+		status:    JobRunning,
+		startedAt: time.Now(),
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	for id, j := range jobs {
+		j.mu.Lock()
+		expired := !j.finishedAt.IsZero() && time.Since(j.finishedAt) > jobRetention
+		j.mu.Unlock()
+		if expired {
+			delete(jobs, id)
+		}
+	}
+	jobs[job.id] = job
+
+	return job
+}
+
+// GetJob returns the job with the given ID if it belongs to the user
+func GetJob(id string, userID uint) (*Job, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	job, ok := jobs[id]
+	if !ok || job.userID != userID {
+		return nil, false
+	}
+	return job, true
+}
+
+// ID returns the job identifier
+func (j *Job) ID() string {
+	return j.id
+}
+
+// SetTotal sets the number of messages the job is expected to process
+func (j *Job) SetTotal(total int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.total = total
+}
+
+// Advance records one processed message
+func (j *Job) Advance(failed bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.processed++
+	if failed {
+		j.failed++
+	}
+}
+
+// Finish marks the job as completed, or failed when err is not nil
+func (j *Job) Finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.status = JobCompleted
+	if err != nil {
+		j.status = JobFailed
+		j.err = err.Error()
+	}
+	j.finishedAt = time.Now()
+}
+
+// Status returns a snapshot of the job progress
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	status := JobStatus{
+		ID:        j.id,
+		Kind:      j.kind,
+		Status:    j.status,
+		Total:     j.total,
+		Processed: j.processed,
+		Failed:    j.failed,
+		Error:     j.err,
+		StartedAt: j.startedAt,
+	}
+
+	if j.total > 0 {
+		status.Percent = j.processed * 100 / j.total
+	}
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		status.FinishedAt = &finishedAt
+	}
+
+	return status
+}
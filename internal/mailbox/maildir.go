@@ -0,0 +1,179 @@
+package mailbox
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// maildirInfoSeparator separates the unique part of a Maildir file name from its flags
+const maildirInfoSeparator = ":2,"
+
+// MaildirWriter writes folders as Maildir directories inside a zip archive
+type MaildirWriter struct {
+	zw      *zip.Writer
+	folders map[string]bool
+	seq     int
+}
+
+// NewMaildirWriter creates a new zipped Maildir writer on top of w
+func NewMaildirWriter(w io.Writer) *MaildirWriter {
+	return &MaildirWriter{
+		zw:      zip.NewWriter(w),
+		folders: make(map[string]bool),
+	}
+}
+
+// AddFolder creates the cur, new and tmp directories of a folder
+func (mw *MaildirWriter) AddFolder(folder string) error {
+	dir := maildirPath(folder)
+	if mw.folders[dir] {
+		return nil
+	}
+	mw.folders[dir] = true
+
+	for _, sub := range []string{"cur/", "new/", "tmp/"} {
+		if _, err := mw.zw.Create(path.Join(dir, sub) + "/"); err != nil {
+			return fmt.Errorf("failed to create maildir folder %s: %w", folder, err)
+		}
+	}
+	return nil
+}
+
+// Write stores a message in the cur directory of the folder. Flags are
+// encoded in the file name and the internal date in the file modification time.
+func (mw *MaildirWriter) Write(folder string, msg Message) error {
+	if err := mw.AddFolder(folder); err != nil {
+		return err
+	}
+
+	date := msg.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	mw.seq++
+	name := fmt.Sprintf("%d.M%dQ%d.mailapi%s%s", date.Unix(), date.Nanosecond()/1000, mw.seq, maildirInfoSeparator, flagsToMaildir(msg.Flags))
+
+	w, err := mw.zw.CreateHeader(&zip.FileHeader{
+		Name:     path.Join(maildirPath(folder), "cur", name),
+		Method:   zip.Deflate,
+		Modified: date,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create maildir entry: %w", err)
+	}
+
+	if _, err := w.Write(normalizeLF(msg.Raw)); err != nil {
+		return fmt.Errorf("failed to write maildir entry: %w", err)
+	}
+	return nil
+}
+
+// Close finishes the zip archive
+func (mw *MaildirWriter) Close() error {
+	return mw.zw.Close()
+}
+
+// maildirPath turns an IMAP folder name into a safe relative directory
+func maildirPath(folder string) string {
+	var parts []string
+	for _, part := range strings.Split(folder, "/") {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return imap.InboxName
+	}
+	return strings.Join(parts, "/")
+}
+
+// parseMaildirEntry splits a zip entry path into its folder, subdirectory and file name.
+// ok is false when the entry is not a message inside a cur or new directory.
+func parseMaildirEntry(name string) (folder, sub, file string, ok bool) {
+	dir, file := path.Split(name)
+	if file == "" {
+		return "", "", "", false
+	}
+
+	dir = strings.TrimSuffix(dir, "/")
+	folder, sub = path.Split(dir)
+	if sub != "cur" && sub != "new" {
+		return "", "", "", false
+	}
+
+	return strings.TrimSuffix(folder, "/"), sub, file, true
+}
+
+// maildirDate recovers the internal date of a Maildir message from its
+// modification time, falling back to the timestamp prefix of its name
+func maildirDate(f *zip.File, file string) time.Time {
+	if !f.Modified.IsZero() {
+		return f.Modified
+	}
+	if dot := strings.Index(file, "."); dot > 0 {
+		if secs, err := strconv.ParseInt(file[:dot], 10, 64); err == nil {
+			return time.Unix(secs, 0)
+		}
+	}
+	return time.Time{}
+}
+
+// flagsToMaildir converts IMAP flags to the Maildir info letters, in ASCII order
+func flagsToMaildir(flags []string) string {
+	var letters []string
+	for _, flag := range flags {
+		switch flag {
+		case imap.DraftFlag:
+			letters = append(letters, "D")
+		case imap.FlaggedFlag:
+			letters = append(letters, "F")
+		case "$Forwarded":
+			letters = append(letters, "P")
+		case imap.AnsweredFlag:
+			letters = append(letters, "R")
+		case imap.SeenFlag:
+			letters = append(letters, "S")
+		case imap.DeletedFlag:
+			letters = append(letters, "T")
+		}
+	}
+	sort.Strings(letters)
+	return strings.Join(letters, "")
+}
+
+// maildirToFlags converts the info part of a Maildir file name to IMAP flags
+func maildirToFlags(file string) []string {
+	i := strings.LastIndex(file, maildirInfoSeparator)
+	if i < 0 {
+		return nil
+	}
+
+	var flags []string
+	for _, r := range file[i+len(maildirInfoSeparator):] {
+		switch r {
+		case 'D':
+			flags = append(flags, imap.DraftFlag)
+		case 'F':
+			flags = append(flags, imap.FlaggedFlag)
+		case 'P':
+			flags = append(flags, "$Forwarded")
+		case 'R':
+			flags = append(flags, imap.AnsweredFlag)
+		case 'S':
+			flags = append(flags, imap.SeenFlag)
+		case 'T':
+			flags = append(flags, imap.DeletedFlag)
+		}
+	}
+	return flags
+}
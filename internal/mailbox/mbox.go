@@ -0,0 +1,236 @@
+package mailbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Message is a single message read from or written to an archive
+type Message struct {
+	Raw   []byte
+	Flags []string
+	Date  time.Time
+}
+
+// mboxDateLayout is the asctime layout used on mbox "From " separator lines
+const mboxDateLayout = "Mon Jan _2 15:04:05 2006"
+
+// MboxWriter writes messages in the mboxrd format
+type MboxWriter struct {
+	w *bufio.Writer
+}
+
+// NewMboxWriter creates a new mbox writer on top of w
+func NewMboxWriter(w io.Writer) *MboxWriter {
+	return &MboxWriter{w: bufio.NewWriter(w)}
+}
+
+// Write appends a message to the mbox. Flags are stored in the Status and
+// X-Status headers so they survive a round trip.
+func (mw *MboxWriter) Write(msg Message) error {
+	date := msg.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	header, body := splitHeader(normalizeLF(msg.Raw))
+	header = removeHeaderFields(header, "Status", "X-Status")
+	if len(header) > 0 && !bytes.HasSuffix(header, []byte("\n")) {
+		header = append(header, '\n')
+	}
+
+	fmt.Fprintf(mw.w, "From %s %s\n", envelopeSender(header), date.UTC().Format(mboxDateLayout))
+
+	status, xStatus := flagsToStatus(msg.Flags)
+	mw.w.Write(header)
+	fmt.Fprintf(mw.w, "Status: %s\n", status)
+	if xStatus != "" {
+		fmt.Fprintf(mw.w, "X-Status: %s\n", xStatus)
+	}
+	mw.w.WriteString("\n")
+
+	for _, line := range strings.SplitAfter(string(body), "\n") {
+		if isFromLine(strings.TrimLeft(line, ">")) {
+			mw.w.WriteString(">")
+		}
+		mw.w.WriteString(line)
+	}
+	if len(body) > 0 && !bytes.HasSuffix(body, []byte("\n")) {
+		mw.w.WriteString("\n")
+	}
+	mw.w.WriteString("\n")
+
+	return mw.w.Flush()
+}
+
+// ReadMbox parses an mboxrd/mboxo stream and calls fn for every message found.
+// Line endings are converted to CRLF so the messages can be appended over IMAP.
+func ReadMbox(r io.Reader, fn func(msg Message) error) error {
+	br := bufio.NewReader(r)
+
+	var current *bytes.Buffer
+	var date time.Time
+
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		msg := finishMboxMessage(current.Bytes(), date)
+		current = nil
+		return fn(msg)
+	}
+
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			trimmed := strings.TrimRight(line, "\r\n")
+			if isFromLine(trimmed) {
+				if ferr := flush(); ferr != nil {
+					return ferr
+				}
+				current = new(bytes.Buffer)
+				date = parseFromLineDate(trimmed)
+			} else if current != nil {
+				if strings.HasPrefix(trimmed, ">") && isFromLine(strings.TrimLeft(trimmed, ">")) {
+					trimmed = trimmed[1:]
+				}
+				current.WriteString(trimmed)
+				current.WriteString("\r\n")
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read mbox: %w", err)
+		}
+	}
+
+	return flush()
+}
+
+// CountMbox returns the number of messages in an mbox stream
+func CountMbox(r io.Reader) (int, error) {
+	count := 0
+	err := ReadMbox(r, func(Message) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// finishMboxMessage strips the separator blank line and the Status headers
+// from a raw mbox entry and converts them back to IMAP flags
+func finishMboxMessage(raw []byte, date time.Time) Message {
+	raw = bytes.TrimSuffix(raw, []byte("\r\n"))
+	if !bytes.HasSuffix(raw, []byte("\r\n")) {
+		raw = append(raw, '\r', '\n')
+	}
+
+	header, body := splitHeader(raw)
+
+	var flags []string
+	if status := headerField(header, "Status"); status != "" || headerField(header, "X-Status") != "" {
+		flags = statusToFlags(status, headerField(header, "X-Status"))
+	}
+	header = removeHeaderFields(header, "Status", "X-Status")
+
+	if date.IsZero() {
+		if m, err := mail.ReadMessage(bytes.NewReader(header)); err == nil {
+			date, _ = m.Header.Date()
+		}
+	}
+
+	out := make([]byte, 0, len(header)+len(body)+2)
+	out = append(out, header...)
+	out = append(out, '\r', '\n')
+	out = append(out, body...)
+
+	return Message{Raw: out, Flags: flags, Date: date}
+}
+
+// isFromLine reports whether a line is an mbox message separator
+func isFromLine(line string) bool {
+	return strings.HasPrefix(line, "From ")
+}
+
+// parseFromLineDate extracts the date from a "From sender date" separator line
+func parseFromLineDate(line string) time.Time {
+	fields := strings.Fields(line)
+	if len(fields) < 7 {
+		return time.Time{}
+	}
+
+	date, err := time.Parse(mboxDateLayout, strings.Join(fields[len(fields)-5:], " "))
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+// envelopeSender returns the address used on the "From " separator line
+func envelopeSender(header []byte) string {
+	for _, field := range []string{"Return-Path", "From"} {
+		value := headerField(header, field)
+		if value == "" {
+			continue
+		}
+		if addr, err := mail.ParseAddress(value); err == nil && addr.Address != "" {
+			return addr.Address
+		}
+		if value = strings.Trim(value, "<> "); value != "" && !strings.ContainsAny(value, " \t") {
+			return value
+		}
+	}
+	return "MAILER-DAEMON"
+}
+
+// flagsToStatus converts IMAP flags to the mutt Status / X-Status header values
+func flagsToStatus(flags []string) (string, string) {
+	status := "O"
+	var xStatus string
+	for _, flag := range flags {
+		switch flag {
+		case imap.SeenFlag:
+			status = "RO"
+		case imap.AnsweredFlag:
+			xStatus += "A"
+		case imap.FlaggedFlag:
+			xStatus += "F"
+		case imap.DraftFlag:
+			xStatus += "T"
+		case imap.DeletedFlag:
+			xStatus += "D"
+		}
+	}
+	return status, xStatus
+}
+
+// statusToFlags converts mutt Status / X-Status header values to IMAP flags
+func statusToFlags(status, xStatus string) []string {
+	var flags []string
+	if strings.Contains(status, "R") {
+		flags = append(flags, imap.SeenFlag)
+	}
+	for _, r := range xStatus {
+		switch r {
+		case 'A':
+			flags = append(flags, imap.AnsweredFlag)
+		case 'F':
+			flags = append(flags, imap.FlaggedFlag)
+		case 'T':
+			flags = append(flags, imap.DraftFlag)
+		case 'D':
+			flags = append(flags, imap.DeletedFlag)
+		}
+	}
+	return flags
+}
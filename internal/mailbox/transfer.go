@@ -0,0 +1,311 @@
+package mailbox
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// Supported archive formats
+const (
+	FormatMbox    = "mbox"
+	FormatMaildir = "maildir"
+	FormatEML     = "eml"
+)
+
+// Source is an archive file on disk to import
+type Source struct {
+	Path     string
+	Filename string
+	Format   string
+}
+
+// DetectFormat guesses the archive format from a file name
+func DetectFormat(filename string) string {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".zip":
+		return FormatMaildir
+	case ".eml", ".msg":
+		return FormatEML
+	default:
+		return FormatMbox
+	}
+}
+
+// ExportFileInfo returns the content type and file name of an export.
+// A single folder in mbox format is a plain mbox file, anything else is zipped.
+func ExportFileInfo(format string, folders []string) (string, string) {
+	if format == FormatMbox && len(folders) == 1 {
+		return "application/mbox", maildirPath(folders[0]) + ".mbox"
+	}
+	return "application/zip", "mailbox-" + format + ".zip"
+}
+
+// Export writes the given folders of the IMAP account to w, tracking progress in job
+func Export(client *smtpclient.IMAPClient, folders []string, format string, w io.Writer, job *Job) error {
+	total := 0
+	for _, folder := range folders {
+		count, err := client.CountMessages(folder)
+		if err != nil {
+			return err
+		}
+		total += int(count)
+	}
+	job.SetTotal(total)
+
+	switch format {
+	case FormatMbox:
+		if len(folders) == 1 {
+			mw := NewMboxWriter(w)
+			return client.ExportFolder(folders[0], func(raw []byte, flags []string, date time.Time) error {
+				job.Advance(false)
+				return mw.Write(Message{Raw: raw, Flags: flags, Date: date})
+			})
+		}
+
+		zw := zip.NewWriter(w)
+		for _, folder := range folders {
+			fw, err := zw.CreateHeader(&zip.FileHeader{
+				Name:     maildirPath(folder) + ".mbox",
+				Method:   zip.Deflate,
+				Modified: time.Now(),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create archive entry: %w", err)
+			}
+
+			mw := NewMboxWriter(fw)
+			err = client.ExportFolder(folder, func(raw []byte, flags []string, date time.Time) error {
+				job.Advance(false)
+				return mw.Write(Message{Raw: raw, Flags: flags, Date: date})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+
+	case FormatMaildir:
+		mw := NewMaildirWriter(w)
+		for _, folder := range folders {
+			if err := mw.AddFolder(folder); err != nil {
+				return err
+			}
+
+			err := client.ExportFolder(folder, func(raw []byte, flags []string, date time.Time) error {
+				job.Advance(false)
+				return mw.Write(folder, Message{Raw: raw, Flags: flags, Date: date})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return mw.Close()
+
+	default:
+		return fmt.Errorf("unsupported export format: %s", format)
+	}
+}
+
+// Import appends every message of the sources to the IMAP account. Messages
+// that carry their own folder (Maildir directories, zipped mbox files) are
+// restored there; the others go to target. Individual failures are counted
+// on the job and do not abort the import.
+func Import(client *smtpclient.IMAPClient, sources []Source, target string, job *Job) error {
+	if target == "" {
+		target = imap.InboxName
+	}
+
+	total := 0
+	for _, src := range sources {
+		err := ReadSource(src, func(string, Message) error {
+			total++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	job.SetTotal(total)
+
+	ensured := make(map[string]bool)
+	var lastErr error
+
+	for _, src := range sources {
+		err := ReadSource(src, func(folder string, msg Message) error {
+			if folder == "" {
+				folder = target
+			}
+
+			if !ensured[folder] {
+				if err := client.EnsureFolder(folder); err != nil {
+					return err
+				}
+				ensured[folder] = true
+			}
+
+			date := msg.Date
+			if date.IsZero() {
+				date = time.Now()
+			}
+
+			if err := client.AppendMessage(folder, msg.Flags, date, normalizeCRLF(msg.Raw)); err != nil {
+				lastErr = err
+				job.Advance(true)
+				return nil
+			}
+
+			job.Advance(false)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if lastErr != nil && job.Status().Failed == total {
+		return fmt.Errorf("every message failed to import, last error: %w", lastErr)
+	}
+
+	return nil
+}
+
+// ReadSource calls fn for every message in an archive file, with the folder
+// the message belongs to or an empty string when the archive does not say
+func ReadSource(src Source, fn func(folder string, msg Message) error) error {
+	format := src.Format
+	if format == "" {
+		format = DetectFormat(src.Filename)
+	}
+
+	f, err := os.Open(src.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src.Filename, err)
+	}
+	defer f.Close()
+
+	switch format {
+	case FormatMbox:
+		return ReadMbox(f, func(msg Message) error {
+			return fn("", msg)
+		})
+
+	case FormatEML:
+		raw, err := io.ReadAll(f)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", src.Filename, err)
+		}
+		return fn("", emlMessage(raw, time.Time{}))
+
+	case FormatMaildir:
+		info, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", src.Filename, err)
+		}
+
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return fmt.Errorf("failed to open zip archive %s: %w", src.Filename, err)
+		}
+		return walkZip(zr, fn)
+
+	default:
+		return fmt.Errorf("unsupported import format: %s", format)
+	}
+}
+
+// walkZip reads Maildir directories, mbox files and .eml files from a zip archive
+func walkZip(zr *zip.Reader, fn func(folder string, msg Message) error) error {
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		name := f.Name
+		ext := strings.ToLower(path.Ext(name))
+
+		var err error
+		switch {
+		case ext == ".mbox" || ext == ".mbx":
+			folder := strings.TrimSuffix(name, path.Ext(name))
+			err = withZipFile(f, func(r io.Reader) error {
+				return ReadMbox(r, func(msg Message) error {
+					return fn(folder, msg)
+				})
+			})
+
+		case ext == ".eml":
+			err = withZipFile(f, func(r io.Reader) error {
+				raw, err := io.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				return fn("", emlMessage(raw, f.Modified))
+			})
+
+		default:
+			folder, sub, file, ok := parseMaildirEntry(name)
+			if !ok {
+				continue
+			}
+			err = withZipFile(f, func(r io.Reader) error {
+				raw, err := io.ReadAll(r)
+				if err != nil {
+					return err
+				}
+
+				flags := maildirToFlags(file)
+				if sub == "new" {
+					flags = removeFlag(flags, imap.SeenFlag)
+				}
+				return fn(folder, Message{Raw: raw, Flags: flags, Date: maildirDate(f, file)})
+			})
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// withZipFile opens a zip entry for the duration of fn
+func withZipFile(f *zip.File, fn func(r io.Reader) error) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return fn(rc)
+}
+
+// emlMessage builds a message from a single .eml file, dated from its Date header
+func emlMessage(raw []byte, fallback time.Time) Message {
+	date := fallback
+	if m, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if d, err := m.Header.Date(); err == nil {
+			date = d
+		}
+	}
+	return Message{Raw: raw, Date: date}
+}
+
+// removeFlag returns flags without the given flag
+func removeFlag(flags []string, flag string) []string {
+	var out []string
+	for _, f := range flags {
+		if f != flag {
+			out = append(out, f)
+		}
+	}
+	return out
+}
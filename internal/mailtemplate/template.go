@@ -0,0 +1,146 @@
+// Package mailtemplate renders stored email templates and parses the
+// recipient lists of mail-merge sends
+package mailtemplate
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/mail"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/lyneq/mailapi/db"
+)
+
+// Rendered is a template personalised with the variables of one recipient
+type Rendered struct {
+	Subject  string `json:"subject"`
+	HTMLBody string `json:"html_body,omitempty"`
+	TextBody string `json:"text_body,omitempty"`
+}
+
+// Check parses the subject and bodies of a template and reports the first syntax error
+func Check(t *db.Template) error {
+	if _, err := texttemplate.New("subject").Parse(t.Subject); err != nil {
+		return err
+	}
+	if _, err := htmltemplate.New("html_body").Parse(t.HTMLBody); err != nil {
+		return err
+	}
+	if _, err := texttemplate.New("text_body").Parse(t.TextBody); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Render executes a template with the given variables. Variables missing from
+// vars are reported as errors rather than rendered as "<no value>".
+func Render(t *db.Template, vars map[string]interface{}) (*Rendered, error) {
+	var rendered Rendered
+	var b strings.Builder
+
+	subject, err := texttemplate.New("subject").Option("missingkey=error").Parse(t.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if err := subject.Execute(&b, vars); err != nil {
+		return nil, err
+	}
+	// A header value must hold on a single line
+	rendered.Subject = strings.Join(strings.Fields(b.String()), " ")
+
+	if t.HTMLBody != "" {
+		body, err := htmltemplate.New("html_body").Option("missingkey=error").Parse(t.HTMLBody)
+		if err != nil {
+			return nil, err
+		}
+		b.Reset()
+		if err := body.Execute(&b, vars); err != nil {
+			return nil, err
+		}
+		rendered.HTMLBody = b.String()
+	}
+
+	if t.TextBody != "" {
+		body, err := texttemplate.New("text_body").Option("missingkey=error").Parse(t.TextBody)
+		if err != nil {
+			return nil, err
+		}
+		b.Reset()
+		if err := body.Execute(&b, vars); err != nil {
+			return nil, err
+		}
+		rendered.TextBody = b.String()
+	}
+
+	return &rendered, nil
+}
+
+// Recipient returns the address of a mail-merge recipient from its "email"
+// variable, with its "name" variable as display name when set
+func Recipient(vars map[string]interface{}) (string, error) {
+	email, _ := vars["email"].(string)
+	if strings.TrimSpace(email) == "" {
+		return "", errors.New("missing email")
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", fmt.Errorf("invalid email %q", email)
+	}
+	if name, ok := vars["name"].(string); ok && strings.TrimSpace(name) != "" {
+		addr.Name = strings.TrimSpace(name)
+	}
+	return addr.String(), nil
+}
+
+// ParseCSV reads mail-merge recipients from CSV. The first row names the
+// variables and must include an "email" column; each following row is a recipient.
+func ParseCSV(r io.Reader) ([]map[string]interface{}, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("empty CSV")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+
+	hasEmail := false
+	for i, name := range header {
+		// Spreadsheet exports often start with a byte order mark
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if name == "" {
+			return nil, fmt.Errorf("invalid CSV: column %d has no name", i+1)
+		}
+		header[i] = name
+		hasEmail = hasEmail || name == "email"
+	}
+	if !hasEmail {
+		return nil, errors.New("invalid CSV: missing email column")
+	}
+
+	var recipients []map[string]interface{}
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+
+		vars := make(map[string]interface{}, len(header))
+		for i, name := range header {
+			vars[name] = strings.TrimSpace(record[i])
+		}
+		recipients = append(recipients, vars)
+	}
+
+	return recipients, nil
+}
@@ -1,9 +1,15 @@
 package middleware // protectedRoute handles requests to protected endpoints by checking the user's authentication status via a session.
 
 import (
+	"fmt"
 	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/apitoken"
+	"github.com/lyneq/mailapi/internal/rbac"
 	"github.com/lyneq/mailapi/internal/session"
 	"net/http"
+	"strings"
 )
 
 // It returns unauthorized status if the user is not logged in, otherwise responds with the user's data.
@@ -17,15 +23,110 @@ func protectedRoute(c echo.Context) error {
 	return c.JSON(200, user)
 }
 
-// RequireAuth is a middleware that enforces authentication by verifying a valid user session before proceeding.
-func RequireAuth(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		_, err := session.GetUserID(c.Request().Context())
-		if err != nil {
-			return c.JSON(http.StatusUnauthorized, map[string]string{
-				"message": "Authentication required",
-			})
+// RequireAuth returns a middleware that enforces authentication, by a valid
+// user session or by an API token sent as "Authorization: Bearer <token>".
+// Tokens must grant the scope of the route; routes without scope are only
+// available to sessions.
+func RequireAuth(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if header := c.Request().Header.Get(echo.HeaderAuthorization); header != "" {
+				raw, ok := strings.CutPrefix(header, "Bearer ")
+				if !ok {
+					return c.JSON(http.StatusUnauthorized, map[string]string{
+						"message": "Unsupported authorization scheme, use Bearer",
+					})
+				}
+
+				token, err := apitoken.Authenticate(strings.TrimSpace(raw))
+				if err != nil {
+					return c.JSON(http.StatusUnauthorized, map[string]string{
+						"message": "Invalid or expired API token",
+					})
+				}
+				if scope == "" {
+					return c.JSON(http.StatusForbidden, map[string]string{
+						"message": "API tokens cannot access this endpoint, sign in instead",
+					})
+				}
+				if !apitoken.HasScope(token, scope) {
+					return c.JSON(http.StatusForbidden, map[string]string{
+						"message": fmt.Sprintf("The API token lacks the %s scope", scope),
+					})
+				}
+				var disabled int64
+				if err := db.DB.Model(&db.User{}).Where("id = ? AND disabled = ?", token.UserID, true).Count(&disabled).Error; err != nil || disabled > 0 {
+					return c.JSON(http.StatusForbidden, map[string]string{
+						"message": "This account is disabled",
+					})
+				}
+
+				c.SetRequest(c.Request().WithContext(session.WithTokenUser(c.Request().Context(), token.UserID)))
+				return next(c)
+			}
+
+			ctx := c.Request().Context()
+			user, err := session.GetCurrentUser(ctx)
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{
+					"message": "Authentication required",
+				})
+			}
+			// Disabling a user or forcing them out ends the sessions signed in before
+			if user.Disabled || session.Revoked(ctx, user) {
+				session.Manager.Destroy(ctx)
+				return c.JSON(http.StatusUnauthorized, map[string]string{
+					"message": "Your session has ended, please sign in again",
+				})
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequirePermission returns a middleware denying the route to users whose
+// role does not grant permission. It runs after RequireAuth.
+func RequirePermission(permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user, err := session.GetCurrentUser(c.Request().Context())
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{
+					"message": "Authentication required",
+				})
+			}
+			if !rbac.HasPermission(user.Role, permission) {
+				return c.JSON(http.StatusForbidden, map[string]string{
+					"message": "You are not allowed to access this endpoint",
+				})
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireVerified returns a middleware denying the route to users without a
+// verified email address, when require_verified is set in the [Users]
+// configuration. It runs after RequireAuth.
+func RequireVerified() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !config.GetUsersConfig().RequireVerified {
+				return next(c)
+			}
+
+			user, err := session.GetCurrentUser(c.Request().Context())
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{
+					"message": "Authentication required",
+				})
+			}
+			if !user.IsVerified {
+				return c.JSON(http.StatusForbidden, map[string]string{
+					"message": "Verify your email address to use this endpoint",
+				})
+			}
+			return next(c)
 		}
-		return next(c)
 	}
 }
@@ -0,0 +1,174 @@
+// Package oauth implements the OAuth 2.0 authorization-code flow with PKCE
+// and the refresh of access tokens, for mail accounts of providers that
+// disabled password logins
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lyneq/mailapi/config"
+)
+
+// ErrUnknownProvider is returned for a provider without [OAuth <name>] section
+var ErrUnknownProvider = errors.New("unknown OAuth provider")
+
+// HTTPClient sends the requests to token endpoints
+var HTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// Provider is an OAuth 2.0 authorization server of the configuration
+type Provider struct {
+	Name string
+	config.OAuthConfig
+}
+
+// Token is the result of a token request. RefreshToken is empty when the
+// provider keeps the previous one valid.
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+// TokenError is an error response of a token endpoint
+type TokenError struct {
+	Code        string
+	Description string
+}
+
+func (e *TokenError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("token request failed: %s (%s)", e.Code, e.Description)
+	}
+	return "token request failed: " + e.Code
+}
+
+// IsRevoked reports whether err means the refresh token is no longer valid
+// and the user must authorize the account again
+func IsRevoked(err error) bool {
+	var tokenErr *TokenError
+	return errors.As(err, &tokenErr) && (tokenErr.Code == "invalid_grant" || tokenErr.Code == "unauthorized_client")
+}
+
+// Get returns the configured provider of the given name
+func Get(name string) (*Provider, error) {
+	provider, ok := config.GetOAuthConfig(name)
+	if !ok || provider.TokenURL == "" {
+		return nil, fmt.Errorf("%w %q", ErrUnknownProvider, name)
+	}
+	return &Provider{Name: strings.ToLower(name), OAuthConfig: provider}, nil
+}
+
+// NewVerifier returns a random PKCE code verifier, also usable as state
+func NewVerifier() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Challenge returns the S256 PKCE challenge of a code verifier
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL sending the user to the consent page of the
+// provider. loginHint pre-fills the address of the account.
+func (p *Provider) AuthCodeURL(state, verifier, loginHint string) string {
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+		// Without offline access, Google issues no refresh token
+		"access_type": {"offline"},
+		"prompt":      {"consent"},
+	}
+	if loginHint != "" {
+		params.Set("login_hint", loginHint)
+	}
+
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + params.Encode()
+}
+
+// Exchange trades an authorization code for tokens
+func (p *Provider) Exchange(code, verifier string) (*Token, error) {
+	return p.request(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	})
+}
+
+// Refresh obtains a new access token with a refresh token
+func (p *Provider) Refresh(refreshToken string) (*Token, error) {
+	return p.request(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+}
+
+// request posts a token request and reads the response of RFC 6749 section 5
+func (p *Provider) request(params url.Values) (*Token, error) {
+	params.Set("client_id", p.ClientID)
+	if p.ClientSecret != "" {
+		params.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		RefreshToken     string `json:"refresh_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("token request failed: %s returned %s", p.TokenURL, resp.Status)
+	}
+	if body.Error != "" {
+		return nil, &TokenError{Code: body.Error, Description: body.ErrorDescription}
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return nil, fmt.Errorf("token request failed: %s returned %s without access token", p.TokenURL, resp.Status)
+	}
+
+	token := &Token{AccessToken: body.AccessToken, RefreshToken: body.RefreshToken}
+	if body.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
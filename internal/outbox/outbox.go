@@ -0,0 +1,763 @@
+// Package outbox delivers queued emails in the background. Messages are stored
+// in the database before the first attempt; temporary failures (network errors,
+// 4xx replies) are retried with exponential backoff while permanent ones (5xx
+// replies) fail the message immediately.
+package outbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/account"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+	"gorm.io/gorm"
+)
+
+// maxRetryDelay caps the exponential backoff between two attempts
+const maxRetryDelay = 6 * time.Hour
+
+// batchSize is the number of due messages handled per poll
+const batchSize = 20
+
+// sentWriteAttempts and sentWriteDelay bound the retries of the write marking
+// a delivered message as sent
+const (
+	sentWriteAttempts = 4
+	sentWriteDelay    = 250 * time.Millisecond
+)
+
+// sentMarkerSuffix names the file recording that a spooled message was sent
+// when the database could not be updated
+const sentMarkerSuffix = ".sent"
+
+var (
+	// ErrNotFound is returned when the message does not exist or belongs to another user
+	ErrNotFound = errors.New("outbox message not found")
+	// ErrInvalidState is returned when an action does not apply to the message status
+	ErrInvalidState = errors.New("action not allowed in the current message status")
+)
+
+// Sender submits composed messages over SMTP
+type Sender interface {
+	SendReader(from string, to []string, r io.Reader) error
+	// SignSpool signs a spooled message with the DKIM key of its sender, if
+	// any, and returns its size
+	SignSpool(from, path string) (int, error)
+}
+
+// SentSaver copies delivered messages to the Sent folder
+type SentSaver func(raw []byte) error
+
+var (
+	newSender = senderFor
+	saveSent  = appendToSent
+	wake      = make(chan struct{}, 1)
+)
+
+// SetSender replaces the SMTP client used to deliver messages, e.g. in tests.
+// nil restores the clients of the messages' mail accounts.
+func SetSender(sender Sender) {
+	if sender == nil {
+		newSender = senderFor
+		return
+	}
+	newSender = func(*db.OutboxMessage) (Sender, error) { return sender, nil }
+}
+
+// SetSentSaver replaces the function copying delivered messages to the Sent
+// folder. nil restores the copy to the messages' mail accounts.
+func SetSentSaver(saver SentSaver) {
+	if saver == nil {
+		saveSent = appendToSent
+		return
+	}
+	saveSent = func(msg *db.OutboxMessage) error {
+		raw, err := os.ReadFile(msg.SpoolPath)
+		if err != nil {
+			return err
+		}
+		return saver(raw)
+	}
+}
+
+// NewSpool creates the file a message is composed into before it is queued,
+// in the [Outbox] spool_dir or the spool directory next to the database
+func NewSpool() (*smtpclient.Spool, error) {
+	dir := config.GetOutboxConfig().SpoolDir
+	if dir == "" {
+		path := config.GetDatabasePath()
+		if path == "" {
+			path = "./db/default.db"
+		}
+		dir = filepath.Join(filepath.Dir(path), "spool")
+	}
+	return smtpclient.NewSpool(dir)
+}
+
+// Start requeues messages interrupted by a previous shutdown and starts the
+// background worker
+func Start() {
+	spoolStored()
+	Requeue()
+
+	go run()
+	fmt.Println("[App] Outbox worker started")
+}
+
+// Requeue makes the messages whose delivery was interrupted pending again.
+// Messages known to have been sent, whose sent status could not be stored,
+// are marked sent instead so that they are not delivered twice.
+func Requeue() {
+	var interrupted []db.OutboxMessage
+	if err := db.DB.Where("status = ?", db.OutboxSending).Find(&interrupted).Error; err != nil {
+		fmt.Printf("[Outbox] Failed to requeue interrupted messages: %v\n", err)
+		return
+	}
+
+	requeued := 0
+	for _, msg := range interrupted {
+		if sentAt, ok := sentMarker(&msg); ok {
+			msg.Attempts++
+			msg.SentAt = &sentAt
+			if err := markSent(&msg); err != nil {
+				continue
+			}
+			os.Remove(msg.SpoolPath + sentMarkerSuffix)
+			removeSpool(&msg)
+			fmt.Printf("[Outbox] Message %d was sent before the restart\n", msg.ID)
+			continue
+		}
+
+		result := db.DB.Model(&db.OutboxMessage{}).
+			Where("id = ? AND status = ?", msg.ID, db.OutboxSending).
+			Update("status", db.OutboxPending)
+		if result.Error != nil {
+			fmt.Printf("[Outbox] Failed to requeue message %d: %v\n", msg.ID, result.Error)
+		}
+		requeued += int(result.RowsAffected)
+	}
+	if requeued > 0 {
+		fmt.Printf("[Outbox] Requeued %d interrupted messages\n", requeued)
+	}
+}
+
+// Wake asks the worker to look for due messages without waiting for the next poll
+func Wake() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+func run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-wake:
+		}
+		ProcessDue()
+		timer.Reset(nextWait())
+	}
+}
+
+// nextWait returns the time until the next message is due, at most the poll
+// interval, so that short undo-send delays are honoured precisely
+func nextWait() time.Duration {
+	wait := config.GetOutboxConfig().PollInterval
+
+	var next db.OutboxMessage
+	err := db.DB.Select("next_attempt_at").
+		Where("status IN ?", []string{db.OutboxPending, db.OutboxScheduled}).
+		Order("next_attempt_at").
+		Take(&next).Error
+	if err == nil {
+		wait = min(wait, max(time.Until(next.NextAttemptAt), 10*time.Millisecond))
+	}
+	return wait
+}
+
+// ProcessDue releases scheduled messages whose time has come and delivers
+// every pending message whose next attempt is due
+func ProcessDue() {
+	err := db.DB.Model(&db.OutboxMessage{}).
+		Where("status = ? AND next_attempt_at <= ?", db.OutboxScheduled, time.Now()).
+		Update("status", db.OutboxPending).Error
+	if err != nil {
+		fmt.Printf("[Outbox] Failed to release scheduled messages: %v\n", err)
+	}
+
+	for {
+		var due []db.OutboxMessage
+		err := db.DB.Select("id", "merge_id").
+			Where("status = ? AND next_attempt_at <= ?", db.OutboxPending, time.Now()).
+			Order("next_attempt_at").
+			Limit(batchSize).
+			Find(&due).Error
+		if err != nil {
+			fmt.Printf("[Outbox] Failed to load due messages: %v\n", err)
+			return
+		}
+
+		for _, msg := range due {
+			if msg.MergeID != nil && !mergeSlot(&msg) {
+				continue
+			}
+			if _, err := Deliver(msg.ID); err != nil && !errors.Is(err, ErrInvalidState) {
+				fmt.Printf("[Outbox] Failed to deliver message %d: %v\n", msg.ID, err)
+			}
+		}
+
+		if len(due) < batchSize {
+			return
+		}
+	}
+}
+
+// Enqueue stores a message composed into its spool file for delivery as soon
+// as possible. The spool file is deleted when the message cannot be stored.
+func Enqueue(msg *db.OutboxMessage) error {
+	msg.Status = db.OutboxPending
+	if msg.NextAttemptAt.IsZero() {
+		msg.NextAttemptAt = time.Now()
+	}
+
+	if err := db.DB.Create(msg).Error; err != nil {
+		removeSpool(msg)
+		return fmt.Errorf("failed to queue message: %w", err)
+	}
+	return nil
+}
+
+// Schedule stores a composed message to be delivered at the given time.
+// timezone is only kept to present the schedule back to the user.
+func Schedule(msg *db.OutboxMessage, at time.Time, timezone string) error {
+	msg.Status = db.OutboxScheduled
+	msg.ScheduledAt = &at
+	msg.Timezone = timezone
+	msg.NextAttemptAt = at
+
+	if err := db.DB.Create(msg).Error; err != nil {
+		removeSpool(msg)
+		return fmt.Errorf("failed to queue message: %w", err)
+	}
+	return nil
+}
+
+// Hold stores a composed message for delivery once the undo-send delay is over,
+// giving it a token to cancel it in the meantime
+func Hold(msg *db.OutboxMessage, delay time.Duration) error {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return fmt.Errorf("failed to generate cancel token: %w", err)
+	}
+
+	msg.CancelToken = hex.EncodeToString(token)
+	msg.NextAttemptAt = time.Now().Add(delay)
+	if err := Enqueue(msg); err != nil {
+		return err
+	}
+
+	Wake()
+	return nil
+}
+
+// EnqueueMerge stores a mail-merge and its personalised messages in one
+// transaction. Messages are spaced out to send merge.Rate emails per minute;
+// ProcessDue holds the rate when they are picked up, e.g. after downtime.
+func EnqueueMerge(merge *db.Merge, msgs []*db.OutboxMessage) error {
+	interval := time.Minute / time.Duration(merge.Rate)
+	start := time.Now()
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		merge.Total = len(msgs)
+		merge.NextSendAt = start
+		if err := tx.Create(merge).Error; err != nil {
+			return err
+		}
+
+		for i, msg := range msgs {
+			msg.MergeID = &merge.ID
+			msg.Status = db.OutboxPending
+			msg.NextAttemptAt = start.Add(time.Duration(i) * interval)
+		}
+		return tx.CreateInBatches(msgs, batchSize).Error
+	})
+	if err != nil {
+		Discard(msgs...)
+		return fmt.Errorf("failed to queue mail-merge: %w", err)
+	}
+
+	Wake()
+	return nil
+}
+
+// Discard deletes the spool files of messages composed but not queued
+func Discard(msgs ...*db.OutboxMessage) {
+	for _, msg := range msgs {
+		removeSpool(msg)
+	}
+}
+
+// CancelMerge stops the delivery of the messages of a mail-merge not sent yet
+// and returns how many were cancelled
+func CancelMerge(userID, mergeID uint) (int64, error) {
+	var unsent []uint
+	err := db.DB.Model(&db.OutboxMessage{}).
+		Where("merge_id = ? AND user_id = ? AND status IN ?", mergeID, userID, []string{db.OutboxPending, db.OutboxScheduled}).
+		Pluck("id", &unsent).Error
+	if err != nil || len(unsent) == 0 {
+		return 0, err
+	}
+
+	result := db.DB.Model(&db.OutboxMessage{}).
+		Where("id IN ? AND status IN ?", unsent, []string{db.OutboxPending, db.OutboxScheduled}).
+		Update("status", db.OutboxCancelled)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	// Messages picked up for delivery meanwhile keep their spool file
+	var cancelled []*db.OutboxMessage
+	db.DB.Where("id IN ? AND status = ?", unsent, db.OutboxCancelled).Find(&cancelled)
+	for _, msg := range cancelled {
+		removeSpool(msg)
+	}
+	return result.RowsAffected, nil
+}
+
+// CancelHeld aborts a message held by Hold, as long as its delivery has not started
+func CancelHeld(userID uint, token string) (*db.OutboxMessage, error) {
+	var msg db.OutboxMessage
+	err := db.DB.Where("cancel_token = ? AND user_id = ?", token, userID).First(&msg).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := db.DB.Model(&db.OutboxMessage{}).
+		Where("id = ? AND status = ? AND attempts = 0", msg.ID, db.OutboxPending).
+		Update("status", db.OutboxCancelled)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidState
+	}
+
+	removeSpool(&msg)
+	return Get(userID, msg.ID)
+}
+
+// Deliver makes one delivery attempt of a pending message and returns it with
+// its new status. ErrInvalidState is returned when the message is not pending,
+// e.g. because the worker is already delivering it.
+func Deliver(id uint) (*db.OutboxMessage, error) {
+	claimed := db.DB.Model(&db.OutboxMessage{}).
+		Where("id = ? AND status = ?", id, db.OutboxPending).
+		Update("status", db.OutboxSending)
+	if claimed.Error != nil {
+		return nil, claimed.Error
+	}
+	if claimed.RowsAffected == 0 {
+		return nil, ErrInvalidState
+	}
+
+	var msg db.OutboxMessage
+	if err := db.DB.First(&msg, id).Error; err != nil {
+		return nil, err
+	}
+
+	if msg.ScheduledAt != nil && msg.Attempts == 0 {
+		// The message was composed long before, date it from its actual
+		// sending and sign the new date
+		size, err := smtpclient.RewriteSpoolHeader(msg.SpoolPath, "Date", time.Now().Format(time.RFC1123Z))
+		if err == nil {
+			size, err = signSpool(&msg)
+		}
+		if err != nil {
+			fmt.Printf("[Outbox] Failed to date and sign message %d: %v\n", msg.ID, err)
+		} else {
+			msg.Size = size
+		}
+	}
+
+	sendErr := send(&msg)
+	msg.Attempts++
+
+	if sendErr == nil {
+		now := time.Now()
+		msg.SentAt = &now
+		if err := markSent(&msg); err != nil {
+			return nil, err
+		}
+		if msg.SaveSent {
+			if err := saveSent(&msg); err != nil {
+				fmt.Printf("[Outbox] Failed to save message %d to the Sent folder: %v\n", msg.ID, err)
+				msg.Warning = "Email sent but could not be saved to the Sent folder"
+				db.DB.Model(&msg).Update("warning", msg.Warning)
+			}
+		}
+		removeSpool(&msg)
+		return &msg, nil
+	}
+
+	switch {
+	case smtpclient.IsPermanent(sendErr) || errors.Is(sendErr, account.ErrNotFound) || errors.Is(sendErr, fs.ErrNotExist) || msg.Attempts >= config.GetOutboxConfig().MaxAttempts:
+		msg.Status = db.OutboxFailed
+		msg.LastError = sendErr.Error()
+	default:
+		msg.Status = db.OutboxPending
+		msg.LastError = sendErr.Error()
+		msg.NextAttemptAt = time.Now().Add(Backoff(msg.Attempts))
+	}
+
+	if err := db.DB.Save(&msg).Error; err != nil {
+		return nil, fmt.Errorf("failed to update message status: %w", err)
+	}
+	return &msg, nil
+}
+
+// Backoff returns the delay before the attempt following the given number of
+// failed attempts: the configured retry delay, doubled after each attempt
+func Backoff(attempts int) time.Duration {
+	delay := config.GetOutboxConfig().RetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// Get returns a message of the user
+func Get(userID, id uint) (*db.OutboxMessage, error) {
+	var msg db.OutboxMessage
+	err := db.DB.Where("id = ? AND user_id = ?", id, userID).First(&msg).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Retry queues a failed or pending message for immediate delivery with a fresh attempt count
+func Retry(userID, id uint) (*db.OutboxMessage, error) {
+	msg, err := transition(userID, id, []string{db.OutboxFailed, db.OutboxPending}, map[string]interface{}{
+		"status":          db.OutboxPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	})
+	if err == nil {
+		Wake()
+	}
+	return msg, err
+}
+
+// Cancel stops the delivery of a pending or scheduled message
+func Cancel(userID, id uint) (*db.OutboxMessage, error) {
+	msg, err := transition(userID, id, []string{db.OutboxPending, db.OutboxScheduled}, map[string]interface{}{
+		"status": db.OutboxCancelled,
+	})
+	if err != nil {
+		return nil, err
+	}
+	removeSpool(msg)
+	return msg, nil
+}
+
+// Reschedule moves a scheduled message to another time
+func Reschedule(userID, id uint, at time.Time, timezone string) (*db.OutboxMessage, error) {
+	return transition(userID, id, []string{db.OutboxScheduled}, map[string]interface{}{
+		"scheduled_at":    at,
+		"timezone":        timezone,
+		"next_attempt_at": at,
+	})
+}
+
+// sendAtLayouts are the accepted local time formats when a timezone is given separately
+var sendAtLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"}
+
+// ParseSendAt parses the time a message should be sent at. sendAt is either an
+// RFC 3339 timestamp with its offset, or a local time in the IANA timezone,
+// e.g. "2024-03-04T09:00" in "Europe/Paris". The time must be after now.
+func ParseSendAt(sendAt, timezone string, now time.Time) (time.Time, error) {
+	var at time.Time
+	var err error
+
+	if timezone == "" {
+		at, err = time.Parse(time.RFC3339, sendAt)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("send_at must be an RFC 3339 timestamp with a timezone offset, or a local time with a timezone")
+		}
+	} else {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unknown timezone %q", timezone)
+		}
+		if at, err = time.Parse(time.RFC3339, sendAt); err == nil {
+			at = at.In(location)
+		} else {
+			for _, layout := range sendAtLayouts {
+				if at, err = time.ParseInLocation(layout, sendAt, location); err == nil {
+					break
+				}
+			}
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid send_at %q", sendAt)
+			}
+		}
+	}
+
+	if !at.After(now) {
+		return time.Time{}, fmt.Errorf("send_at must be in the future")
+	}
+	return at, nil
+}
+
+// transition updates a message of the user when its status is one of from
+func transition(userID, id uint, from []string, updates map[string]interface{}) (*db.OutboxMessage, error) {
+	if _, err := Get(userID, id); err != nil {
+		return nil, err
+	}
+
+	result := db.DB.Model(&db.OutboxMessage{}).
+		Where("id = ? AND user_id = ? AND status IN ?", id, userID, from).
+		Updates(updates)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidState
+	}
+
+	return Get(userID, id)
+}
+
+// messageAccount returns the mail account a message is sent with, nil for the shared account
+func messageAccount(msg *db.OutboxMessage) (*db.MailAccount, error) {
+	if msg.AccountID == nil {
+		return nil, nil
+	}
+	return account.Get(msg.UserID, *msg.AccountID)
+}
+
+// markSent stores that a message was delivered. The write only applies to a
+// message still being sent and is retried, since a message left in the
+// sending status would be delivered again after a restart; when it keeps
+// failing, a marker file next to the spool file tells Requeue the message
+// was sent.
+func markSent(msg *db.OutboxMessage) error {
+	msg.Status = db.OutboxSent
+	msg.LastError = ""
+
+	var err error
+	for i := 0; i < sentWriteAttempts; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * sentWriteDelay)
+		}
+		err = db.DB.Model(&db.OutboxMessage{}).
+			Where("id = ? AND status = ?", msg.ID, db.OutboxSending).
+			Updates(map[string]interface{}{
+				"status":     db.OutboxSent,
+				"sent_at":    msg.SentAt,
+				"attempts":   msg.Attempts,
+				"last_error": "",
+			}).Error
+		if err == nil {
+			return nil
+		}
+	}
+
+	fmt.Printf("[Outbox] ERROR: message %d was sent but its status could not be saved: %v\n", msg.ID, err)
+	markErr := errors.New("no spool file")
+	if msg.SpoolPath != "" {
+		markErr = os.WriteFile(msg.SpoolPath+sentMarkerSuffix, []byte(msg.SentAt.Format(time.RFC3339)), 0o600)
+	}
+	if markErr != nil {
+		fmt.Printf("[Outbox] ERROR: message %d may be sent again after a restart: %v\n", msg.ID, markErr)
+	}
+	return fmt.Errorf("failed to update message status: %w", err)
+}
+
+// sentMarker tells whether markSent left a marker for a message, and when it was sent
+func sentMarker(msg *db.OutboxMessage) (time.Time, bool) {
+	if msg.SpoolPath == "" {
+		return time.Time{}, false
+	}
+	content, err := os.ReadFile(msg.SpoolPath + sentMarkerSuffix)
+	if err != nil {
+		return time.Time{}, false
+	}
+	sentAt, err := time.Parse(time.RFC3339, string(content))
+	if err != nil {
+		sentAt = time.Now()
+	}
+	return sentAt, true
+}
+
+// mergeSlot takes the next sending slot of the merge of a due message and
+// reports whether the message may be sent now. The slots of a merge are
+// merge.Rate per minute and stored in the database, so that messages due
+// together, e.g. after downtime, are not sent in a burst. Without a free
+// slot, the message waits for the next one.
+func mergeSlot(msg *db.OutboxMessage) bool {
+	var merge db.Merge
+	if err := db.DB.First(&merge, *msg.MergeID).Error; err != nil || merge.Rate <= 0 {
+		// Deliver reports the message as it would without merge
+		return true
+	}
+
+	now := time.Now()
+	taken := db.DB.Model(&db.Merge{}).
+		Where("id = ? AND next_send_at <= ?", merge.ID, now).
+		Update("next_send_at", now.Add(time.Minute/time.Duration(merge.Rate)))
+	if taken.Error == nil && taken.RowsAffected > 0 {
+		return true
+	}
+
+	next := now.Add(time.Minute / time.Duration(merge.Rate))
+	if err := db.DB.Select("next_send_at").First(&merge, merge.ID).Error; err == nil && merge.NextSendAt.After(now) {
+		next = merge.NextSendAt
+	}
+	err := db.DB.Model(&db.OutboxMessage{}).
+		Where("id = ? AND status = ?", msg.ID, db.OutboxPending).
+		Update("next_attempt_at", next).Error
+	if err != nil {
+		fmt.Printf("[Outbox] Failed to postpone message %d: %v\n", msg.ID, err)
+	}
+	return false
+}
+
+// send submits a message streamed from its spool file
+func send(msg *db.OutboxMessage) error {
+	sender, err := newSender(msg)
+	if err != nil {
+		return err
+	}
+	spool, err := smtpclient.OpenSpool(msg.SpoolPath)
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+	return sender.SendReader(msg.From, msg.Recipients, spool.Reader())
+}
+
+// signSpool signs the spooled message with the client it is sent with
+func signSpool(msg *db.OutboxMessage) (int, error) {
+	sender, err := newSender(msg)
+	if err != nil {
+		return 0, err
+	}
+	return sender.SignSpool(msg.From, msg.SpoolPath)
+}
+
+// removeSpool deletes the spool file of a message sent or not to be sent
+func removeSpool(msg *db.OutboxMessage) {
+	if msg.SpoolPath == "" {
+		return
+	}
+	if err := os.Remove(msg.SpoolPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("[Outbox] Failed to delete the spool file of message %d: %v\n", msg.ID, err)
+	}
+	msg.SpoolPath = ""
+	if msg.ID != 0 {
+		db.DB.Model(msg).Update("spool_path", "")
+	}
+}
+
+// spoolStored moves the messages stored in the database by earlier versions
+// to spool files, signed as they were on submission, then drops their column
+func spoolStored() {
+	if !db.DB.Migrator().HasColumn(&db.OutboxMessage{}, "raw") {
+		return
+	}
+
+	var stored []struct {
+		ID        uint
+		AccountID *uint
+		From      string
+		Raw       []byte
+	}
+	err := db.DB.Table("outbox_messages").Select("id, account_id, `from`, raw").
+		Where("raw IS NOT NULL AND (spool_path IS NULL OR spool_path = '')").
+		Find(&stored).Error
+	if err != nil {
+		fmt.Printf("[Outbox] Failed to read stored messages: %v\n", err)
+		return
+	}
+	for _, row := range stored {
+		spool, err := NewSpool()
+		if err != nil {
+			fmt.Printf("[Outbox] Failed to spool message %d: %v\n", row.ID, err)
+			return
+		}
+		_, err = spool.Write(row.Raw)
+		if closeErr := spool.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			if _, signErr := signSpool(&db.OutboxMessage{AccountID: row.AccountID, From: row.From, SpoolPath: spool.Path()}); signErr != nil {
+				fmt.Printf("[Outbox] Failed to sign message %d: %v\n", row.ID, signErr)
+			}
+		}
+		if err == nil {
+			err = db.DB.Table("outbox_messages").Where("id = ?", row.ID).Update("spool_path", spool.Path()).Error
+		}
+		if err != nil {
+			os.Remove(spool.Path())
+			fmt.Printf("[Outbox] Failed to spool message %d: %v\n", row.ID, err)
+			return
+		}
+	}
+
+	if err := db.DB.Migrator().DropColumn(&db.OutboxMessage{}, "raw"); err != nil {
+		fmt.Printf("[Outbox] Failed to drop the raw column: %v\n", err)
+	}
+}
+
+// senderFor returns the SMTP client of the mail account a message is sent with
+func senderFor(msg *db.OutboxMessage) (Sender, error) {
+	found, err := messageAccount(msg)
+	if err != nil {
+		return nil, err
+	}
+	return account.SMTPClient(found)
+}
+
+// appendToSent copies a delivered message to the Sent folder of its IMAP account
+func appendToSent(msg *db.OutboxMessage) error {
+	found, err := messageAccount(msg)
+	if err != nil {
+		return err
+	}
+	imapClient, err := account.IMAPClient(found)
+	if err != nil {
+		return err
+	}
+
+	if err := imapClient.Connect(); err != nil {
+		return err
+	}
+	defer imapClient.Disconnect()
+
+	spool, err := smtpclient.OpenSpool(msg.SpoolPath)
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+	return imapClient.AppendToSent(spool.Reader())
+}
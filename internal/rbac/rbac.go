@@ -0,0 +1,43 @@
+// Package rbac maps the roles of users to the permissions routes require.
+package rbac
+
+import "slices"
+
+// Roles of users, stored in db.User.Role
+const (
+	RoleUser  = "User"
+	RoleAdmin = "Admin"
+)
+
+// Permissions required by routes
+const (
+	// PermissionUsersRead lists, searches and reads users
+	PermissionUsersRead = "users:read"
+	// PermissionUsersManage creates, disables, promotes and deletes users and ends their sessions
+	PermissionUsersManage = "users:manage"
+)
+
+// Roles lists the valid roles
+var Roles = []string{RoleUser, RoleAdmin}
+
+// permissions holds the permissions granted to each role
+var permissions = map[string][]string{
+	RoleUser:  {},
+	RoleAdmin: {PermissionUsersRead, PermissionUsersManage},
+}
+
+// ValidRole tells whether role exists
+func ValidRole(role string) bool {
+	_, ok := permissions[role]
+	return ok
+}
+
+// Permissions returns the permissions granted to role, none for an unknown role
+func Permissions(role string) []string {
+	return slices.Clone(permissions[role])
+}
+
+// HasPermission tells whether role grants permission
+func HasPermission(role, permission string) bool {
+	return slices.Contains(permissions[role], permission)
+}
@@ -10,8 +10,20 @@ import (
 	"time"
 )
 
+// tokenUserKey holds the user of a request authenticated with an API token
+type tokenUserKey struct{}
+
+// WithTokenUser returns a context authenticated as the owner of an API token
+func WithTokenUser(ctx context.Context, userID uint) context.Context {
+	return context.WithValue(ctx, tokenUserKey{}, userID)
+}
+
 // GetUserID extracts the user ID from the provided context and returns it. Returns an error if the user is unauthenticated.
 func GetUserID(ctx context.Context) (uint, error) {
+	if userID, ok := ctx.Value(tokenUserKey{}).(uint); ok {
+		return userID, nil
+	}
+
 	userID, ok := Manager.Get(ctx, "userID").(uint)
 	if !ok || userID == 0 {
 		return 0, errors.New("unauthenticated")
@@ -35,13 +47,110 @@ func GetCurrentUser(ctx context.Context) (*db.User, error) {
 	return &user, nil
 }
 
+// GetAccountID returns the mail account selected for the session, 0 when the default account is used
+func GetAccountID(ctx context.Context) uint {
+	accountID, _ := Manager.Get(ctx, "accountID").(uint)
+	return accountID
+}
+
+// SetAccountID selects the mail account used by the session
+func SetAccountID(ctx context.Context, accountID uint) {
+	Manager.Put(ctx, "accountID", accountID)
+}
+
+// SetOAuthFlow remembers the OAuth authorization started by the session for
+// a mail account, with its state and PKCE verifier
+func SetOAuthFlow(ctx context.Context, accountID uint, state, verifier string) {
+	Manager.Put(ctx, "oauthAccountID", accountID)
+	Manager.Put(ctx, "oauthState", state)
+	Manager.Put(ctx, "oauthVerifier", verifier)
+}
+
+// PopOAuthFlow returns and forgets the OAuth authorization started by the
+// session, so that its state is used once
+func PopOAuthFlow(ctx context.Context) (accountID uint, state, verifier string) {
+	accountID, _ = Manager.Pop(ctx, "oauthAccountID").(uint)
+	return accountID, Manager.PopString(ctx, "oauthState"), Manager.PopString(ctx, "oauthVerifier")
+}
+
+// PendingLifetime is the time left to users of two-factor authentication to
+// enter their code after their password
+const PendingLifetime = 5 * time.Minute
+
+// MaxPendingAttempts is the number of wrong codes after which the password
+// must be entered again
+const MaxPendingAttempts = 5
+
+// SetPendingUser starts a short-lived session for a user whose password was
+// checked, but who must still complete two-factor authentication. The session
+// does not authenticate requests.
+func SetPendingUser(c echo.Context, userID uint) {
+	ctx := c.Request().Context()
+	if err := Manager.RenewToken(ctx); err != nil {
+		fmt.Printf("Error renewing session token: %v\n", err)
+	}
+	Manager.Remove(ctx, "userID")
+	Manager.Put(ctx, "pendingUserID", userID)
+	Manager.Put(ctx, "pendingExpiry", time.Now().Add(PendingLifetime).Unix())
+	Manager.Put(ctx, "pendingAttempts", 0)
+
+	writeSessionCookie(c)
+}
+
+// GetPendingUser returns the user of an unexpired pending session
+func GetPendingUser(ctx context.Context) (uint, bool) {
+	userID, _ := Manager.Get(ctx, "pendingUserID").(uint)
+	if userID == 0 {
+		return 0, false
+	}
+	if time.Now().Unix() >= Manager.GetInt64(ctx, "pendingExpiry") {
+		ClearPendingUser(ctx)
+		return 0, false
+	}
+	return userID, true
+}
+
+// FailPendingAttempt records a wrong code and returns the attempts left. The
+// pending session ends when none are left.
+func FailPendingAttempt(ctx context.Context) int {
+	attempts := Manager.GetInt(ctx, "pendingAttempts") + 1
+	if attempts >= MaxPendingAttempts {
+		ClearPendingUser(ctx)
+		return 0
+	}
+	Manager.Put(ctx, "pendingAttempts", attempts)
+	return MaxPendingAttempts - attempts
+}
+
+// ClearPendingUser ends the pending session
+func ClearPendingUser(ctx context.Context) {
+	Manager.Remove(ctx, "pendingUserID")
+	Manager.Remove(ctx, "pendingExpiry")
+	Manager.Remove(ctx, "pendingAttempts")
+}
+
 // SetSessionCookie explicitly sets a session cookie for the given Echo context
 // This is a workaround for cases where the session middleware doesn't properly set the cookie
 func SetSessionCookie(c echo.Context, userID uint) {
 	fmt.Println("Setting session cookie for user:", userID)
 
 	Manager.Put(c.Request().Context(), "userID", userID)
+	Manager.Put(c.Request().Context(), "authTime", time.Now().UnixNano())
+
+	writeSessionCookie(c)
+}
+
+// Revoked tells whether the session of user was signed in before its
+// sessions were revoked
+func Revoked(ctx context.Context, user *db.User) bool {
+	if user.SessionsRevokedAt == nil {
+		return false
+	}
+	return Manager.GetInt64(ctx, "authTime") <= user.SessionsRevokedAt.UnixNano()
+}
 
+// writeSessionCookie commits the session and sets its cookie
+func writeSessionCookie(c echo.Context) {
 	token, expiry, err := Manager.Commit(c.Request().Context())
 	if err != nil {
 		fmt.Printf("Error committing session: %v\n", err)
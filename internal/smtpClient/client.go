@@ -1,12 +1,19 @@
 package smtpclient
 
 import (
-	"crypto/tls"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"sync"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/lyneq/mailapi/config"
 	"gopkg.in/gomail.v2"
 )
 
@@ -16,13 +23,23 @@ type SMTPConfig struct {
 	Port     int
 	Username string
 	Password string
+	// DKIM holds the signing keys by lower-cased sender domain. Messages from
+	// other domains are sent unsigned.
+	DKIM map[string]*DKIMKey
+	// IdleTimeout is how long the SMTP connection is kept open between messages
+	IdleTimeout time.Duration
+	TLS         config.TLSConfig
+	// TokenSource, when set, authenticates with OAUTHBEARER or XOAUTH2 instead of the password
+	TokenSource TokenSource
+	// AccountID is the mail account the connection belongs to, 0 for the
+	// account of the configuration
+	AccountID uint
 }
 
 // Client represents an SMTP client that can connect to a mail server
 type Client struct {
 	config SMTPConfig
-	dialer *gomail.Dialer
-	mu     sync.Mutex
+	conn   *connection
 }
 
 // Message represents an email message
@@ -36,6 +53,21 @@ type Message struct {
 	Attachments []Attachment
 	Flags       []string
 	Size        uint32 // Size of the message in bytes
+	Calendar    string // Inline text/calendar part, e.g. a meeting invitation
+	ReplyTo     string
+	Raw         []byte // Full RFC 822 content, only set by GetEmailByID
+
+	// The fields below are only set by GetEmailByID
+	Cc         []string
+	MessageID  string   // Without angle brackets
+	InReplyTo  string   // Without angle brackets
+	References []string // Without angle brackets
+	TextBody   string   // Inline text/plain part
+	HTMLBody   string   // Inline text/html part
+
+	// The fields below are only set by GetLatestInbox
+	UID      uint32
+	Received time.Time // Arrival date on the server
 }
 
 // Attachment represents an email attachment
@@ -43,69 +75,378 @@ type Attachment struct {
 	Filename string
 	Content  []byte
 	MimeType string
+	// ContentID identifies inline attachments referenced from the HTML body as cid:<ContentID>
+	ContentID string
+	Inline    bool
+	Size      int64
+	// Open streams the content instead of Content when set, so large files are not kept in memory
+	Open func() (io.ReadCloser, error)
 }
 
-// NewClient creates a new SMTP client with the given configuration
-func NewClient(config SMTPConfig) *Client {
-	dialer := gomail.NewDialer(config.Host, config.Port, config.Username, config.Password)
+// Message priorities
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
 
-	if config.Port == 1025 {
-		dialer.SSL = false
+// OutgoingMessage describes an email to compose and send. Addresses may
+// carry a display name, e.g. "Alice" <alice@example.com>.
+type OutgoingMessage struct {
+	From    string
+	To      []string
+	Cc      []string
+	Bcc     []string // Delivered to but never written in the headers
+	ReplyTo string
+	Subject string
+	// Body is the HTML body. A text/plain alternative is generated from it
+	// unless TextBody is set; without Body the message is plain text only.
+	Body     string
+	TextBody string
+	// Priority is PriorityHigh, PriorityNormal or PriorityLow
+	Priority string
+	// Headers are additional header fields, already checked against the allowed list
+	Headers map[string]string
+	// InReplyTo and References thread replies, message IDs are given without angle brackets
+	InReplyTo    string
+	References   []string
+	Alternatives []Alternative
+	Attachments  []Attachment
+}
 
-		dialer.TLSConfig = &tls.Config{
-			InsecureSkipVerify: true,
-		}
-	} else {
-		// Use system's certificate pool for proton-bridge certificates
-		dialer.TLSConfig = &tls.Config{
-			InsecureSkipVerify: true,
-		}
-	}
+// priorityHeaders lists the header fields understood by common clients for each priority
+var priorityHeaders = map[string]map[string]string{
+	PriorityHigh: {"X-Priority": "1 (Highest)", "Importance": "high", "Priority": "urgent"},
+	PriorityLow:  {"X-Priority": "5 (Lowest)", "Importance": "low", "Priority": "non-urgent"},
+}
 
+// Alternative is an additional representation of the body, such as a text/calendar part
+type Alternative struct {
+	ContentType string
+	Body        string
+}
+
+// NewClient creates a new SMTP client with the given configuration
+func NewClient(config SMTPConfig) *Client {
 	return &Client{
 		config: config,
-		dialer: dialer,
+		conn:   sharedConnection(config),
 	}
 }
 
-// Connect establishes a connection to the SMTP server
+// Connect establishes the connection to the SMTP server, kept open and
+// shared by the clients of the same mail account
 func (c *Client) Connect() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	_, err := c.dialer.Dial()
-	if err != nil {
+	if err := c.conn.connect(); err != nil {
 		return fmt.Errorf("failed to connect to SMTP server: %w", err)
 	}
 	return nil
 }
 
+// Close ends the connection to the SMTP server. It is re-established by the next send.
+func (c *Client) Close() {
+	c.conn.mu.Lock()
+	defer c.conn.mu.Unlock()
+	c.conn.close()
+}
+
 // SendMessage sends an email message
 func (c *Client) SendMessage(from string, to []string, subject, body string, attachments []Attachment) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	raw, err := c.ComposeMessage(from, to, subject, body, attachments)
+	if err != nil {
+		return err
+	}
+
+	return c.SendRaw(from, to, raw)
+}
+
+// Send composes an outgoing message and submits it to its recipients
+func (c *Client) Send(msg *OutgoingMessage) error {
+	raw, err := c.Compose(msg)
+	if err != nil {
+		return err
+	}
 
+	return c.SendRaw(msg.Sender(), msg.Recipients(), raw)
+}
+
+// ComposeMessage builds the MIME representation of an email message.
+// The returned bytes are exactly what SendRaw submits, so they can also be
+// stored in the Sent folder.
+func (c *Client) ComposeMessage(from string, to []string, subject, body string, attachments []Attachment) ([]byte, error) {
+	return c.Compose(&OutgoingMessage{
+		From:        from,
+		To:          to,
+		Subject:     subject,
+		Body:        body,
+		Attachments: attachments,
+	})
+}
+
+// Compose builds the MIME representation of an outgoing message in memory,
+// signed when the domain of its sender has a DKIM key
+func (c *Client) Compose(msg *OutgoingMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := c.ComposeTo(msg, &buf); err != nil {
+		return nil, err
+	}
+	if key := dkimKeyFor(c.config.DKIM, msg.Sender()); key != nil {
+		return key.Sign(buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+// SignSpool signs the message spooled at path when the domain of from has a
+// DKIM key, replacing an earlier signature, and returns the size of the
+// message. Spooled messages are signed once, so that the copy saved to the
+// Sent folder is the one delivered.
+func (c *Client) SignSpool(from, path string) (int, error) {
+	if key := dkimKeyFor(c.config.DKIM, from); key != nil {
+		return signSpool(path, key)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open spool file: %w", err)
+	}
+	return int(info.Size()), nil
+}
+
+// ComposeTo writes the MIME representation of an outgoing message to w,
+// streaming attachment contents. The message is not signed yet, see SignSpool.
+func (c *Client) ComposeTo(msg *OutgoingMessage, w io.Writer) error {
 	m := gomail.NewMessage()
-	m.SetHeader("From", from)
-	m.SetHeader("To", to...)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/html", body)
-
-	for _, attachment := range attachments {
-		m.Attach(attachment.Filename,
-			gomail.SetCopyFunc(func(w io.Writer) error {
-				_, err := w.Write(attachment.Content)
-				return err
-			}),
+
+	for _, field := range []struct {
+		name      string
+		addresses []string
+	}{
+		{"From", []string{msg.From}},
+		{"To", msg.To},
+		{"Cc", msg.Cc},
+		{"Reply-To", []string{msg.ReplyTo}},
+	} {
+		formatted, err := formatAddresses(m, field.addresses)
+		if err != nil {
+			return fmt.Errorf("invalid %s address: %w", field.name, err)
+		}
+		if len(formatted) > 0 {
+			m.SetHeader(field.name, formatted...)
+		}
+	}
+
+	m.SetHeader("Subject", msg.Subject)
+	m.SetHeader("Message-ID", generateMessageID(msg.From))
+	m.SetDateHeader("Date", time.Now())
+
+	if msg.InReplyTo != "" {
+		m.SetHeader("In-Reply-To", "<"+msg.InReplyTo+">")
+	}
+	if len(msg.References) > 0 {
+		m.SetHeader("References", "<"+strings.Join(msg.References, "> <")+">")
+	}
+
+	for name, value := range priorityHeaders[msg.Priority] {
+		m.SetHeader(name, value)
+	}
+	for name, value := range msg.Headers {
+		// Never let a value inject additional header fields
+		m.SetHeader(name, strings.NewReplacer("\r", "", "\n", "").Replace(value))
+	}
+
+	// Alternatives go from the simplest to the richest, as RFC 2046 requires
+	switch {
+	case msg.Body == "":
+		m.SetBody("text/plain", msg.TextBody)
+	case msg.TextBody != "":
+		m.SetBody("text/plain", msg.TextBody)
+		m.AddAlternative("text/html", msg.Body)
+	default:
+		m.SetBody("text/plain", HTMLToText(msg.Body))
+		m.AddAlternative("text/html", msg.Body)
+	}
+
+	for _, alternative := range msg.Alternatives {
+		m.AddAlternative(alternative.ContentType, alternative.Body)
+	}
+
+	for _, attachment := range msg.Attachments {
+		settings := []gomail.FileSetting{
+			gomail.SetCopyFunc(attachmentCopier(attachment)),
 			gomail.SetHeader(map[string][]string{
 				"Content-Type": {attachment.MimeType},
 			}),
-		)
+		}
+
+		if attachment.Inline {
+			contentID := attachment.ContentID
+			if contentID == "" {
+				contentID = attachment.Filename
+			}
+			settings = append(settings, gomail.SetHeader(map[string][]string{
+				"Content-ID": {"<" + strings.Trim(contentID, "<>") + ">"},
+			}))
+			m.Embed(attachment.Filename, settings...)
+		} else {
+			m.Attach(attachment.Filename, settings...)
+		}
 	}
 
-	if err := c.dialer.DialAndSend(m); err != nil {
-		return fmt.Errorf("failed to send message: %w", err)
+	if _, err := m.WriteTo(w); err != nil {
+		return fmt.Errorf("failed to compose message: %w", err)
+	}
+
+	return nil
+}
+
+// Sender returns the bare address used as SMTP envelope sender
+func (msg *OutgoingMessage) Sender() string {
+	if addr, err := mail.ParseAddress(msg.From); err == nil {
+		return addr.Address
+	}
+	return msg.From
+}
+
+// Recipients returns the bare, de-duplicated SMTP envelope recipients, Bcc included
+func (msg *OutgoingMessage) Recipients() []string {
+	var recipients []string
+	seen := make(map[string]bool)
+
+	for _, list := range [][]string{msg.To, msg.Cc, msg.Bcc} {
+		for _, value := range list {
+			address := value
+			if addr, err := mail.ParseAddress(value); err == nil {
+				address = addr.Address
+			}
+			if key := strings.ToLower(address); !seen[key] {
+				seen[key] = true
+				recipients = append(recipients, address)
+			}
+		}
+	}
+
+	return recipients
+}
+
+// formatAddresses encodes addresses with their display names for a header field
+func formatAddresses(m *gomail.Message, values []string) ([]string, error) {
+	var formatted []string
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		addr, err := mail.ParseAddress(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", value, err)
+		}
+		formatted = append(formatted, m.FormatAddress(addr.Address, addr.Name))
+	}
+	return formatted, nil
+}
+
+// attachmentCopier returns the function writing the content of an attachment
+func attachmentCopier(attachment Attachment) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		if attachment.Open == nil {
+			_, err := w.Write(attachment.Content)
+			return err
+		}
+
+		r, err := attachment.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open attachment %s: %w", attachment.Filename, err)
+		}
+		defer r.Close()
+
+		_, err = io.Copy(w, r)
+		return err
 	}
+}
+
+// SendRaw submits an already composed MIME message to the given recipients
+func (c *Client) SendRaw(from string, to []string, raw []byte) error {
+	return c.SendReader(from, to, bytes.NewReader(raw))
+}
 
+// SendReader submits a composed MIME message read from r, streamed as is
+func (c *Client) SendReader(from string, to []string, r io.Reader) error {
+	if err := c.conn.send(from, to, r); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
 	return nil
 }
+
+// ReplaceHeader returns raw with every top-level name header field replaced by
+// a single field with the given value, e.g. to refresh the Date of a message
+// composed ahead of its delivery
+func ReplaceHeader(raw []byte, name, value string) []byte {
+	return rewriteHeader(raw, name, name+": "+value)
+}
+
+// RemoveHeader returns raw without its top-level name header fields
+func RemoveHeader(raw []byte, name string) []byte {
+	return rewriteHeader(raw, name, "")
+}
+
+// rewriteHeader replaces the top-level name header fields of raw by field,
+// or removes them when field is empty
+func rewriteHeader(raw []byte, name, field string) []byte {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end < 0 {
+		return raw
+	}
+
+	var header []string
+	skipping, replaced := false, false
+	for _, line := range strings.Split(string(raw[:end]), "\r\n") {
+		if skipping && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			continue
+		}
+		skipping = false
+
+		if colon := strings.IndexByte(line, ':'); colon > 0 && strings.EqualFold(strings.TrimSpace(line[:colon]), name) {
+			skipping = true
+			if !replaced && field != "" {
+				header = append(header, field)
+			}
+			replaced = true
+			continue
+		}
+		header = append(header, line)
+	}
+	if !replaced && field != "" {
+		header = append(header, field)
+	}
+
+	result := []byte(strings.Join(header, "\r\n"))
+	return append(result, raw[end:]...)
+}
+
+// IsPermanent reports whether a submission error is a permanent SMTP failure
+// (5xx reply) that retrying will not fix. Network errors and 4xx replies are temporary.
+func IsPermanent(err error) bool {
+	var smtpErr *textproto.Error
+	return errors.As(err, &smtpErr) && smtpErr.Code >= 500
+}
+
+// readerWriterTo adapts an io.Reader to the io.WriterTo expected by gomail senders
+type readerWriterTo struct {
+	io.Reader
+}
+
+// WriteTo copies the whole reader to w
+func (r readerWriterTo) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, r.Reader)
+}
+
+// generateMessageID returns a unique Message-ID using the domain of the sender address
+func generateMessageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 && at < len(from)-1 {
+		domain = strings.TrimSuffix(from[at+1:], ">")
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
@@ -0,0 +1,206 @@
+package smtpclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// DefaultIdleTimeout is how long an unused SMTP connection is kept open
+const DefaultIdleTimeout = time.Minute
+
+// connection is a long-lived SMTP session shared by every client of a mail
+// account, so that consecutive messages skip the TLS and AUTH handshakes.
+// Messages are submitted one at a time; the session is re-dialled when it
+// breaks or after it stayed idle for longer than the idle timeout.
+type connection struct {
+	mu        sync.Mutex
+	accountID uint
+	// fingerprint identifies the server and credentials of config, so that a
+	// changed account gets a new connection
+	fingerprint string
+	config      SMTPConfig
+	idle        time.Duration
+	sender      gomail.SendCloser
+	lastUsed    time.Time
+	timer       *time.Timer
+}
+
+var (
+	connectionsMu sync.Mutex
+	// connections holds the connection of each mail account, 0 for the
+	// account of the configuration. Entries are removed once idle.
+	connections = make(map[uint]*connection)
+)
+
+// sharedConnection returns the connection of the account of config, creating
+// it on first use or when the server or credentials of the account changed.
+// Connections are never shared across accounts: with a token source, which
+// cannot be told apart from another, a client without account gets its own.
+func sharedConnection(config SMTPConfig) *connection {
+	idle := config.IdleTimeout
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+	fresh := &connection{accountID: config.AccountID, fingerprint: fingerprint(config), config: config, idle: idle}
+	if config.AccountID == 0 && config.TokenSource != nil {
+		return fresh
+	}
+
+	connectionsMu.Lock()
+	previous, ok := connections[config.AccountID]
+	if ok && previous.fingerprint == fresh.fingerprint {
+		connectionsMu.Unlock()
+		return previous
+	}
+	connections[config.AccountID] = fresh
+	connectionsMu.Unlock()
+
+	if ok {
+		previous.shutdown()
+	}
+	return fresh
+}
+
+// CloseAccount ends and forgets the connection of a mail account, e.g. once
+// the account is updated or deleted
+func CloseAccount(accountID uint) {
+	connectionsMu.Lock()
+	conn, ok := connections[accountID]
+	delete(connections, accountID)
+	connectionsMu.Unlock()
+
+	if ok {
+		conn.shutdown()
+	}
+}
+
+// fingerprint returns a hash of the server and credentials of config, so
+// that no password is kept outside the connection
+func fingerprint(config SMTPConfig) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d\x00%s\x00%s\x00%+v", config.Host, config.Port, config.Username, config.Password, config.TLS)))
+	return hex.EncodeToString(sum[:])
+}
+
+// forget removes the connection from the shared connections, unless another
+// connection replaced it
+func (c *connection) forget() {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	if connections[c.accountID] == c {
+		delete(connections, c.accountID)
+	}
+}
+
+// shutdown ends the session once the message being sent, if any, is submitted
+func (c *connection) shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.close()
+}
+
+// open dials the session unless it is already open and fresh. c.mu must be held.
+func (c *connection) open() (reused bool, err error) {
+	if c.sender != nil && time.Since(c.lastUsed) < c.idle {
+		return true, nil
+	}
+	c.close()
+
+	sender, err := dialSMTP(c.config)
+	if err != nil {
+		return false, err
+	}
+	c.sender = sender
+	c.touch()
+	return false, nil
+}
+
+// touch records a use of the session and schedules its closing once idle. c.mu must be held.
+func (c *connection) touch() {
+	c.lastUsed = time.Now()
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.idle, c.closeIdle)
+	} else {
+		c.timer.Reset(c.idle)
+	}
+}
+
+// closeIdle closes and forgets the session when it was not used for the idle timeout
+func (c *connection) closeIdle() {
+	c.mu.Lock()
+	idle := time.Since(c.lastUsed) >= c.idle
+	if idle {
+		c.close()
+	}
+	c.mu.Unlock()
+
+	if idle {
+		c.forget()
+	}
+}
+
+// close ends the session. c.mu must be held.
+func (c *connection) close() {
+	if c.sender != nil {
+		c.sender.Close()
+		c.sender = nil
+	}
+}
+
+// connect makes sure the session is open
+func (c *connection) connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.open()
+	return err
+}
+
+// send submits a message read from r. When a reused session turns out to be
+// broken before any of the message was transmitted, it is re-dialled and the
+// message sent again. Any failure ends the session, since the server may be
+// left in the middle of a transaction.
+func (c *connection) send(from string, to []string, r io.Reader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		reused, err := c.open()
+		if err != nil {
+			return err
+		}
+
+		counter := &countingReader{r: r}
+		err = c.sender.Send(from, to, readerWriterTo{counter})
+		if err == nil {
+			c.touch()
+			return nil
+		}
+		c.close()
+
+		var smtpErr *textproto.Error
+		if !reused || counter.n > 0 || errors.As(err, &smtpErr) {
+			return err
+		}
+		fmt.Printf("[SMTP] Connection to %s lost, reconnecting: %v\n", c.config.Host, err)
+	}
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
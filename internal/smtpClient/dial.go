@@ -0,0 +1,166 @@
+package smtpclient
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// dialTimeout bounds the TCP connection and the TLS and SMTP handshakes
+const dialTimeout = 30 * time.Second
+
+// dialSMTP opens an authenticated SMTP session according to the TLS mode of
+// config. Unlike gomail's dialer, STARTTLS is required rather than used
+// when offered, so that a stripped capability cannot downgrade the session.
+func dialSMTP(config SMTPConfig) (gomail.SendCloser, error) {
+	c, conn, err := openSMTP(config, &net.Dialer{Timeout: dialTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	if config.TokenSource != nil {
+		if err := authenticateSMTP(c, config); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	} else if config.Username != "" {
+		if ok, mechanisms := c.Extension("AUTH"); ok {
+			if err := c.Auth(smtpAuth(config, mechanisms)); err != nil {
+				c.Close()
+				return nil, fmt.Errorf("SMTP authentication failed: %w", err)
+			}
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &smtpSender{c}, nil
+}
+
+// openSMTP connects to the SMTP server of config and secures the session
+// according to its TLS mode. The connection keeps a deadline of the dialer
+// timeout until the caller clears it.
+func openSMTP(config SMTPConfig, dialer *net.Dialer) (*smtp.Client, net.Conn, error) {
+	mode, err := tlsMode(config.TLS, config.Port, 465)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tlsConfig *tls.Config
+	if mode != TLSNone {
+		if tlsConfig, err = NewTLSConfig(config.Host, config.TLS); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dialer.Timeout))
+
+	if mode == TLSImplicit {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, nil, tlsError(addr, err)
+		}
+		conn = tlsConn
+	}
+
+	c, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if mode == TLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, nil, fmt.Errorf("%s does not support STARTTLS (use tls_mode = implicit, or none to send in clear text)", addr)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, nil, tlsError(addr, err)
+		}
+	}
+
+	return c, conn, nil
+}
+
+// smtpAuth picks the authentication mechanism offered by the server
+func smtpAuth(config SMTPConfig, mechanisms string) smtp.Auth {
+	switch {
+	case strings.Contains(mechanisms, "CRAM-MD5"):
+		return smtp.CRAMMD5Auth(config.Username, config.Password)
+	case strings.Contains(mechanisms, "LOGIN") && !strings.Contains(mechanisms, "PLAIN"):
+		return &loginAuth{username: config.Username, password: config.Password}
+	default:
+		return smtp.PlainAuth("", config.Username, config.Password, config.Host)
+	}
+}
+
+// smtpSender submits messages over an open SMTP session
+type smtpSender struct {
+	*smtp.Client
+}
+
+func (s *smtpSender) Send(from string, to []string, msg io.WriterTo) error {
+	if err := s.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := s.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+
+	w, err := s.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *smtpSender) Close() error {
+	return s.Quit()
+}
+
+// loginAuth implements the LOGIN mechanism, offered alone by some servers
+type loginAuth struct {
+	username string
+	password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("refusing to send the password over an unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+	}
+}
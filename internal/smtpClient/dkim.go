@@ -0,0 +1,189 @@
+package smtpclient
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/lyneq/mailapi/config"
+)
+
+// DefaultDKIMHeaders are the header fields signed when a domain does not list
+// its own, as recommended by RFC 6376 section 5.4.1
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMKey signs the messages sent from a domain
+type DKIMKey struct {
+	Domain   string
+	Selector string
+	// Signer is an *rsa.PrivateKey or an ed25519.PrivateKey
+	Signer  crypto.Signer
+	Headers []string
+}
+
+// ParseDKIMKey parses a PEM encoded RSA (PKCS #1 or PKCS #8) or Ed25519 (PKCS #8) private key
+func ParseDKIMKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		default:
+			return nil, fmt.Errorf("unsupported private key type %T, use RSA or Ed25519", key)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+// Sign returns raw with a DKIM-Signature header field prepended
+func (k *DKIMKey) Sign(raw []byte) ([]byte, error) {
+	signature, err := k.Signature(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(signature), raw...), nil
+}
+
+// Signature returns the DKIM-Signature header field, with its final CRLF, of
+// the message read from r. Only the header is held in memory.
+func (k *DKIMKey) Signature(r io.Reader) (string, error) {
+	headers := k.Headers
+	if len(headers) == 0 {
+		headers = DefaultDKIMHeaders
+	}
+
+	signer, err := dkim.NewSigner(&dkim.SignOptions{
+		Domain:                 k.Domain,
+		Selector:               k.Selector,
+		Signer:                 k.Signer,
+		Hash:                   crypto.SHA256,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             headers,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign message with DKIM: %w", err)
+	}
+	if _, err := io.Copy(signer, r); err != nil {
+		signer.Close()
+		return "", fmt.Errorf("failed to read message: %w", err)
+	}
+	if err := signer.Close(); err != nil {
+		return "", fmt.Errorf("failed to sign message with DKIM: %w", err)
+	}
+	return signer.Signature(), nil
+}
+
+// DNSRecord returns the name and value of the TXT record publishing the public key
+func (k *DKIMKey) DNSRecord() (name, value string, err error) {
+	name = k.Selector + "._domainkey." + k.Domain
+
+	switch public := k.Signer.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(public)
+		if err != nil {
+			return "", "", err
+		}
+		value = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	case ed25519.PublicKey:
+		value = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public)
+	default:
+		return "", "", fmt.Errorf("unsupported public key type %T", public)
+	}
+	return name, value, nil
+}
+
+// dkimKeyFor returns the key of the domain of a sender address, if any
+func dkimKeyFor(keys map[string]*DKIMKey, from string) *DKIMKey {
+	at := strings.LastIndex(from, "@")
+	if at < 0 {
+		return nil
+	}
+	return keys[strings.ToLower(from[at+1:])]
+}
+
+var (
+	dkimMu   sync.RWMutex
+	dkimKeys map[string]*DKIMKey
+)
+
+// LoadDKIMKeys reads the private keys of the DKIM domains of the configuration.
+// Clients created by NewSMTPClientFromConfig sign with them afterwards.
+func LoadDKIMKeys() error {
+	keys := make(map[string]*DKIMKey)
+	for domain, cfg := range config.GetDKIMConfig() {
+		if cfg.Selector == "" || cfg.PrivateKey == "" {
+			return fmt.Errorf("DKIM %s: selector and private_key are required", domain)
+		}
+
+		data, err := os.ReadFile(cfg.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("DKIM %s: %w", domain, err)
+		}
+		signer, err := ParseDKIMKey(data)
+		if err != nil {
+			return fmt.Errorf("DKIM %s: %s: %w", domain, cfg.PrivateKey, err)
+		}
+
+		keys[domain] = &DKIMKey{
+			Domain:   domain,
+			Selector: cfg.Selector,
+			Signer:   signer,
+			Headers:  cfg.Headers,
+		}
+	}
+
+	dkimMu.Lock()
+	dkimKeys = keys
+	dkimMu.Unlock()
+	return nil
+}
+
+// DKIMKeys returns the loaded DKIM keys sorted by domain
+func DKIMKeys() []*DKIMKey {
+	dkimMu.RLock()
+	defer dkimMu.RUnlock()
+
+	keys := make([]*DKIMKey, 0, len(dkimKeys))
+	for _, key := range dkimKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Domain < keys[j].Domain })
+	return keys
+}
+
+// loadedDKIMKeys returns the loaded DKIM keys by domain
+func loadedDKIMKeys() map[string]*DKIMKey {
+	dkimMu.RLock()
+	defer dkimMu.RUnlock()
+	return dkimKeys
+}
@@ -2,6 +2,7 @@ package smtpclient
 
 import (
 	"strconv"
+	"strings"
 
 	"github.com/lyneq/mailapi/config"
 )
@@ -15,10 +16,13 @@ func NewSMTPClientFromConfig() *Client {
 	}
 
 	return NewClient(SMTPConfig{
-		Host:     smtpConfig.Host,
-		Port:     port,
-		Username: smtpConfig.Username,
-		Password: smtpConfig.Password,
+		Host:        smtpConfig.Host,
+		Port:        port,
+		Username:    smtpConfig.Username,
+		Password:    smtpConfig.Password,
+		DKIM:        loadedDKIMKeys(),
+		IdleTimeout: smtpConfig.IdleTimeout,
+		TLS:         smtpConfig.TLS,
 	})
 }
 
@@ -35,5 +39,19 @@ func NewIMAPClientFromConfig() *IMAPClient {
 		Port:     port,
 		Username: imapConfig.Username,
 		Password: imapConfig.Password,
+		TLS:      imapConfig.TLS,
 	})
 }
+
+// NewAccountSMTPClient creates an SMTP client for the server of a user's mail
+// account, with the idle timeout of the configuration. The DKIM keys of the
+// configuration only sign messages submitted to the configured SMTP server,
+// so that other servers cannot send mail signed for its domains.
+func NewAccountSMTPClient(server SMTPConfig) *Client {
+	smtpConfig := config.GetSMTPConfig()
+	server.IdleTimeout = smtpConfig.IdleTimeout
+	if smtpConfig.Host != "" && strings.EqualFold(server.Host, smtpConfig.Host) {
+		server.DKIM = loadedDKIMKeys()
+	}
+	return NewClient(server)
+}
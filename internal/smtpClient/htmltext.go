@@ -0,0 +1,224 @@
+package smtpclient
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// blockElements start on a new line in the plain-text rendering
+var blockElements = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true,
+	atom.Dd: true, atom.Div: true, atom.Dl: true, atom.Dt: true, atom.Fieldset: true,
+	atom.Figcaption: true, atom.Figure: true, atom.Footer: true, atom.Form: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Header: true, atom.Hr: true, atom.Li: true, atom.Main: true, atom.Nav: true,
+	atom.Ol: true, atom.P: true, atom.Pre: true, atom.Section: true, atom.Table: true,
+	atom.Tr: true, atom.Ul: true,
+}
+
+// paragraphElements are separated from their neighbours by a blank line
+var paragraphElements = map[atom.Atom]bool{
+	atom.P: true, atom.Blockquote: true, atom.Pre: true, atom.Table: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Ol: true, atom.Ul: true,
+}
+
+var (
+	spaces     = regexp.MustCompile(`[ \t\r\n\f]+`)
+	blankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// HTMLToText renders an HTML body as readable plain text, used as the
+// text/plain alternative of HTML emails. Links keep their target, list items
+// are bulleted and blockquotes are prefixed with "> ".
+func HTMLToText(body string) string {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return body
+	}
+
+	t := &textWriter{}
+	t.walk(doc)
+
+	lines := strings.Split(t.b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	return strings.Trim(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"), "\n") + "\n"
+}
+
+// textWriter accumulates the text rendering of an HTML tree
+type textWriter struct {
+	b         strings.Builder
+	quote     int  // Blockquote nesting depth
+	pre       int  // Pre nesting depth, whitespace is kept inside
+	lineStart bool // Nothing was written on the current line yet
+	started   bool
+	// pendingBlank delays blank lines until the next text, so that they get the
+	// quote prefix of the shallowest of the surrounding lines
+	pendingBlank bool
+	lastQuote    int
+}
+
+// newline ends the current line unless it is empty
+func (t *textWriter) newline() {
+	if t.started && !t.lineStart {
+		t.b.WriteString("\n")
+		t.lineStart = true
+	}
+}
+
+// blankLine makes sure the next text is preceded by an empty line
+func (t *textWriter) blankLine() {
+	if t.started {
+		t.pendingBlank = true
+	}
+}
+
+// prefix returns the quote marker of a line at the given depth
+func prefix(depth int) string {
+	return strings.Repeat("> ", depth)
+}
+
+// lineBreak ends the current line, even when it is empty
+func (t *textWriter) lineBreak() {
+	if t.started && t.lineStart {
+		t.b.WriteString(strings.TrimRight(prefix(t.quote), " "))
+	}
+	t.b.WriteString("\n")
+	t.lineStart = true
+}
+
+// write appends text, prefixing new lines with the quote marker
+func (t *textWriter) write(text string) {
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			t.lineBreak()
+		}
+		if t.lineStart || !t.started {
+			if t.pre == 0 {
+				line = strings.TrimLeft(line, " ")
+			}
+		}
+		if line == "" {
+			continue
+		}
+
+		if t.pendingBlank {
+			t.newline()
+			t.b.WriteString(strings.TrimRight(prefix(min(t.lastQuote, t.quote)), " ") + "\n")
+			t.pendingBlank = false
+		}
+		if t.lineStart || !t.started {
+			t.b.WriteString(prefix(t.quote))
+		}
+
+		t.b.WriteString(line)
+		t.lineStart = false
+		t.started = true
+		t.lastQuote = t.quote
+	}
+}
+
+func (t *textWriter) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		if t.pre > 0 {
+			t.write(n.Data)
+		} else {
+			t.write(spaces.ReplaceAllString(n.Data, " "))
+		}
+		return
+	case html.ElementNode:
+	default:
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			t.walk(child)
+		}
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Title:
+		return
+	case atom.Br:
+		t.lineBreak()
+		return
+	case atom.Hr:
+		t.newline()
+		t.write("----------")
+		t.newline()
+		return
+	case atom.Img:
+		if alt := attr(n, "alt"); alt != "" {
+			t.write("[" + alt + "]")
+		}
+		return
+	}
+
+	if paragraphElements[n.DataAtom] {
+		t.blankLine()
+	} else if blockElements[n.DataAtom] {
+		t.newline()
+	}
+
+	switch n.DataAtom {
+	case atom.Blockquote:
+		t.quote++
+		defer func() { t.quote-- }()
+	case atom.Pre:
+		t.pre++
+		defer func() { t.pre-- }()
+	case atom.Li:
+		t.write("* ")
+	case atom.Td, atom.Th:
+		if n.PrevSibling != nil {
+			t.write(" ")
+		}
+	}
+
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		t.walk(child)
+	}
+
+	if n.DataAtom == atom.A {
+		href := attr(n, "href")
+		if href != "" && !strings.HasPrefix(href, "#") && !strings.HasPrefix(href, "cid:") && textContent(n) != strings.TrimPrefix(href, "mailto:") {
+			t.write(" (" + href + ")")
+		}
+	}
+
+	if paragraphElements[n.DataAtom] {
+		t.blankLine()
+	} else if blockElements[n.DataAtom] {
+		t.newline()
+	}
+}
+
+// attr returns the value of an attribute of n
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// textContent returns the whitespace-normalised text of n
+func textContent(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+	return strings.TrimSpace(spaces.ReplaceAllString(b.String(), " "))
+}
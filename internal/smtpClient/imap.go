@@ -1,16 +1,23 @@
 package smtpclient
 
 import (
+	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
 	"github.com/emersion/go-message/mail"
+	"github.com/lyneq/mailapi/config"
 )
 
 // IMAPConfig holds the configuration for the IMAP client
@@ -19,6 +26,9 @@ type IMAPConfig struct {
 	Port     int
 	Username string
 	Password string
+	TLS      config.TLSConfig
+	// TokenSource, when set, authenticates with OAUTHBEARER or XOAUTH2 instead of the password
+	TokenSource TokenSource
 }
 
 // IMAPClient represents an IMAP client that can connect to a mail server
@@ -40,41 +50,78 @@ func (c *IMAPClient) Connect() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	var imapClient *client.Client
-	var err error
+	imapClient, err := dialIMAP(c.config, &net.Dialer{Timeout: dialTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to connect to IMAP server: %w", err)
+	}
 
-	if c.config.Port == 1143 {
+	if c.config.TokenSource != nil {
+		err = authenticateIMAP(imapClient, c.config)
+	} else {
+		err = imapClient.Login(c.config.Username, c.config.Password)
+	}
+	if err != nil {
+		imapClient.Logout()
+		return fmt.Errorf("failed to login to IMAP server: %w", err)
+	}
+	// Login cleared the dial deadline; later commands may take as long as
+	// the mailbox needs
+	imapClient.Timeout = 0
 
-		imapClient, err = client.Dial(fmt.Sprintf("%s:%d", c.config.Host, c.config.Port))
-		if err != nil {
-			return fmt.Errorf("failed to connect to IMAP server: %w", err)
-		}
+	c.client = imapClient
+	return nil
+}
 
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: true,
-		}
+// dialIMAP opens an IMAP session according to the TLS mode of config. The
+// dialer timeout also bounds the first command.
+func dialIMAP(config IMAPConfig, dialer *net.Dialer) (*client.Client, error) {
+	mode, err := tlsMode(config.TLS, config.Port, 993)
+	if err != nil {
+		return nil, err
+	}
 
-		if err := imapClient.StartTLS(tlsConfig); err != nil {
-			return fmt.Errorf("failed to start TLS: %w", err)
-		}
-	} else {
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: true,
+	var tlsConfig *tls.Config
+	if mode != TLSNone {
+		if tlsConfig, err = NewTLSConfig(config.Host, config.TLS); err != nil {
+			return nil, err
 		}
+	}
 
-		imapClient, err = client.DialTLS(fmt.Sprintf("%s:%d", c.config.Host, c.config.Port), tlsConfig)
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+
+	if mode == TLSImplicit {
+		imapClient, err := client.DialWithDialerTLS(dialer, addr, tlsConfig)
 		if err != nil {
-			return fmt.Errorf("failed to connect to IMAP server: %w", err)
+			var opErr *net.OpError
+			if errors.As(err, &opErr) && opErr.Op == "dial" {
+				return nil, err
+			}
+			return nil, tlsError(addr, err)
 		}
+		imapClient.Timeout = dialer.Timeout
+		return imapClient, nil
 	}
 
-	if err := imapClient.Login(c.config.Username, c.config.Password); err != nil {
-		imapClient.Logout()
-		return fmt.Errorf("failed to login to IMAP server: %w", err)
+	imapClient, err := client.DialWithDialer(dialer, addr)
+	if err != nil {
+		return nil, err
+	}
+	// The dialer leaves a deadline on the connection; a command timeout makes
+	// the client clear it once the next command completes
+	imapClient.Timeout = dialer.Timeout
+
+	if mode == TLSStartTLS {
+		if ok, err := imapClient.SupportStartTLS(); err != nil || !ok {
+			imapClient.Logout()
+			return nil, fmt.Errorf("%s does not support STARTTLS (use tls_mode = implicit, or none to connect in clear text)", addr)
+		}
+		if err := imapClient.StartTLS(tlsConfig); err != nil {
+			imapClient.Logout()
+			return nil, tlsError(addr, err)
+		}
 	}
 
-	c.client = imapClient
-	return nil
+	return imapClient, nil
 }
 
 // Disconnect closes the connection to the IMAP server
@@ -211,6 +258,114 @@ func (c *IMAPClient) GetInbox(page, pageSize int) (*GetInboxResult, error) {
 	}, nil
 }
 
+// GetLatestInbox returns up to limit INBOX messages for which keep returns
+// true, the latest received first: by received date, then by UID for
+// messages received at the same time. Messages carry their UID and received
+// date, which unlike sequence numbers stay the same while the mailbox
+// changes; keep only sees these two fields. The received dates of the whole
+// mailbox are read, as UIDs follow the order messages were added in, not the
+// order they were received in, e.g. for messages moved in from other folders.
+func (c *IMAPClient) GetLatestInbox(limit int, keep func(msg *Message) bool) ([]Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return nil, fmt.Errorf("not connected to IMAP server")
+	}
+
+	status, err := c.client.Select("INBOX", true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select inbox: %w", err)
+	}
+	if status.Messages == 0 {
+		return nil, nil
+	}
+
+	all := new(imap.SeqSet)
+	all.AddRange(1, 0)
+	dates := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.client.UidFetch(all, []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate}, dates)
+	}()
+	var candidates []Message
+	for msg := range dates {
+		candidates = append(candidates, Message{UID: msg.Uid, Received: msg.InternalDate})
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if !candidates[i].Received.Equal(candidates[j].Received) {
+			return candidates[i].Received.After(candidates[j].Received)
+		}
+		return candidates[i].UID > candidates[j].UID
+	})
+
+	var kept []Message
+	for i := range candidates {
+		if len(kept) == limit {
+			break
+		}
+		if keep(&candidates[i]) {
+			kept = append(kept, candidates[i])
+		}
+	}
+	if len(kept) == 0 {
+		return nil, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	order := make(map[uint32]int, len(kept))
+	for i, msg := range kept {
+		seqSet.AddNum(msg.UID)
+		order[msg.UID] = i
+	}
+
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags, imap.FetchUid, imap.FetchInternalDate}
+	messages := make(chan *imap.Message, 10)
+	go func() {
+		done <- c.client.UidFetch(seqSet, items, messages)
+	}()
+
+	result := make([]Message, len(kept))
+	found := make([]bool, len(kept))
+	for msg := range messages {
+		i, ok := order[msg.Uid]
+		if !ok {
+			continue
+		}
+		message := Message{
+			ID:       fmt.Sprintf("%d", msg.SeqNum),
+			UID:      msg.Uid,
+			Subject:  msg.Envelope.Subject,
+			Date:     msg.Envelope.Date,
+			Received: kept[i].Received,
+			Flags:    msg.Flags,
+		}
+		if len(msg.Envelope.From) > 0 {
+			message.From = msg.Envelope.From[0].Address()
+		}
+		for _, addr := range msg.Envelope.To {
+			message.To = append(message.To, addr.Address())
+		}
+		result[i] = message
+		found[i] = true
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to fetch messages: %w", err)
+	}
+
+	// Messages expunged meanwhile are left out
+	latest := result[:0]
+	for i := range result {
+		if found[i] {
+			latest = append(latest, result[i])
+		}
+	}
+	return latest, nil
+}
+
 // GetFolderResult represents the result of GetFolderMessages operation
 type GetFolderResult struct {
 	Messages   []Message
@@ -357,11 +512,30 @@ func (c *IMAPClient) GetEmailByID(id string, folder string) (*Message, error) {
 			message.To = append(message.To, addr.Address())
 		}
 
+		for _, addr := range msg.Envelope.Cc {
+			message.Cc = append(message.Cc, addr.Address())
+		}
+
+		if len(msg.Envelope.ReplyTo) > 0 {
+			message.ReplyTo = msg.Envelope.ReplyTo[0].Address()
+		}
+
+		message.MessageID = strings.Trim(msg.Envelope.MessageId, "<> ")
+		message.InReplyTo = strings.Trim(msg.Envelope.InReplyTo, "<> ")
+
 		for _, literal := range msg.Body {
-			mr, err := mail.CreateReader(literal)
+			raw, err := io.ReadAll(literal)
 			if err != nil {
 				continue
 			}
+			message.Raw = raw
+
+			mr, err := mail.CreateReader(bytes.NewReader(raw))
+			if err != nil {
+				continue
+			}
+
+			message.References, _ = mr.Header.MsgIDList("References")
 
 			for {
 				p, err := mr.NextPart()
@@ -375,6 +549,27 @@ func (c *IMAPClient) GetEmailByID(id string, folder string) (*Message, error) {
 				switch h := p.Header.(type) {
 				case *mail.InlineHeader:
 					b, _ := ioutil.ReadAll(p.Body)
+					contentType, _, _ := h.ContentType()
+					switch {
+					case contentType == "text/calendar":
+						// Keep invitations apart so they don't replace the readable body
+						message.Calendar = string(b)
+						continue
+					case contentType == "text/plain":
+						message.TextBody = string(b)
+					case contentType == "text/html":
+						message.HTMLBody = string(b)
+					case !strings.HasPrefix(contentType, "text/"):
+						// Inline images referenced from the HTML body
+						message.Attachments = append(message.Attachments, Attachment{
+							Filename:  inlineFilename(h, contentType),
+							Content:   b,
+							MimeType:  contentType,
+							ContentID: strings.Trim(h.Get("Content-ID"), "<> "),
+							Inline:    true,
+						})
+						continue
+					}
 					message.Body = string(b)
 				case *mail.AttachmentHeader:
 					filename, _ := h.Filename()
@@ -401,3 +596,266 @@ func (c *IMAPClient) GetEmailByID(id string, folder string) (*Message, error) {
 
 	return message, nil
 }
+
+// inlineFilename names an inline part, falling back to its Content-ID
+func inlineFilename(h *mail.InlineHeader, contentType string) string {
+	if _, params, err := h.ContentDisposition(); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if _, params, err := h.ContentType(); err == nil && params["name"] != "" {
+		return params["name"]
+	}
+	if contentID := strings.Trim(h.Get("Content-ID"), "<> "); contentID != "" {
+		return contentID
+	}
+	return "inline" + strings.Replace(contentType, "/", ".", 1)
+}
+
+// sentFolderFallbacks lists common Sent folder names used when the server
+// does not advertise the SPECIAL-USE \Sent attribute
+var sentFolderFallbacks = []string{"Sent", "Sent Items", "Sent Messages", "INBOX.Sent"}
+
+// findSentFolder returns the name of the mailbox used to store sent messages.
+// It must be called with the client mutex held.
+func (c *IMAPClient) findSentFolder() (string, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 50)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.client.List("", "*", mailboxes)
+	}()
+
+	var sent string
+	var names []string
+	for m := range mailboxes {
+		names = append(names, m.Name)
+		for _, attr := range m.Attributes {
+			if attr == imap.SentAttr && sent == "" {
+				sent = m.Name
+			}
+		}
+	}
+
+	if err := <-done; err != nil {
+		return "", fmt.Errorf("failed to list mailboxes: %w", err)
+	}
+
+	if sent != "" {
+		return sent, nil
+	}
+
+	for _, fallback := range sentFolderFallbacks {
+		for _, name := range names {
+			if strings.EqualFold(name, fallback) {
+				return name, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no Sent folder found on IMAP server")
+}
+
+// AppendToSent stores a copy of an already sent message in the Sent folder, marked as \Seen.
+// msg is typically a *bytes.Buffer.
+func (c *IMAPClient) AppendToSent(msg imap.Literal) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return fmt.Errorf("not connected to IMAP server")
+	}
+
+	folder, err := c.findSentFolder()
+	if err != nil {
+		return err
+	}
+
+	if err := c.client.Append(folder, []string{imap.SeenFlag}, time.Now(), msg); err != nil {
+		return fmt.Errorf("failed to append message to %s: %w", folder, err)
+	}
+
+	return nil
+}
+
+// GetSelectableFolders returns the mailboxes that can be selected, skipping \Noselect containers
+func (c *IMAPClient) GetSelectableFolders() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return nil, fmt.Errorf("not connected to IMAP server")
+	}
+
+	mailboxes := make(chan *imap.MailboxInfo, 50)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.client.List("", "*", mailboxes)
+	}()
+
+	var folderNames []string
+	for m := range mailboxes {
+		selectable := true
+		for _, attr := range m.Attributes {
+			if attr == imap.NoSelectAttr {
+				selectable = false
+			}
+		}
+		if selectable {
+			folderNames = append(folderNames, m.Name)
+		}
+	}
+
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to list mailboxes: %w", err)
+	}
+
+	return folderNames, nil
+}
+
+// CountMessages returns the number of messages in a folder without selecting it
+func (c *IMAPClient) CountMessages(folder string) (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return 0, fmt.Errorf("not connected to IMAP server")
+	}
+
+	status, err := c.client.Status(folder, []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get status of folder %s: %w", folder, err)
+	}
+
+	return status.Messages, nil
+}
+
+// exportBatchSize is the number of messages fetched per FETCH command during an export
+const exportBatchSize = 50
+
+// ExportFolder streams every message of a folder, oldest first, to fn with its
+// raw RFC 822 content, flags and internal date. Messages are fetched with
+// BODY.PEEK[] so exporting does not mark them as read.
+func (c *IMAPClient) ExportFolder(folder string, fn func(raw []byte, flags []string, date time.Time) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return fmt.Errorf("not connected to IMAP server")
+	}
+
+	mbox, err := c.client.Select(folder, true)
+	if err != nil {
+		return fmt.Errorf("failed to select folder %s: %w", folder, err)
+	}
+
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}
+
+	for start := uint32(1); start <= mbox.Messages; start += exportBatchSize {
+		end := start + exportBatchSize - 1
+		if end > mbox.Messages {
+			end = mbox.Messages
+		}
+
+		seqSet := new(imap.SeqSet)
+		seqSet.AddRange(start, end)
+
+		messages := make(chan *imap.Message, exportBatchSize)
+		done := make(chan error, 1)
+
+		go func() {
+			done <- c.client.Fetch(seqSet, items, messages)
+		}()
+
+		// Keep draining the channel after a callback error so the fetch can complete
+		var fnErr error
+		for msg := range messages {
+			if fnErr != nil {
+				continue
+			}
+
+			literal := msg.GetBody(section)
+			if literal == nil {
+				continue
+			}
+
+			raw, err := io.ReadAll(literal)
+			if err != nil {
+				fnErr = fmt.Errorf("failed to read message %d: %w", msg.SeqNum, err)
+				continue
+			}
+
+			fnErr = fn(raw, msg.Flags, msg.InternalDate)
+		}
+
+		if err := <-done; err != nil {
+			return fmt.Errorf("failed to fetch messages: %w", err)
+		}
+		if fnErr != nil {
+			return fnErr
+		}
+	}
+
+	return nil
+}
+
+// EnsureFolder creates the folder when it does not exist yet
+func (c *IMAPClient) EnsureFolder(folder string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return fmt.Errorf("not connected to IMAP server")
+	}
+
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.client.List("", folder, mailboxes)
+	}()
+
+	exists := false
+	for range mailboxes {
+		exists = true
+	}
+
+	if err := <-done; err != nil {
+		return fmt.Errorf("failed to list mailboxes: %w", err)
+	}
+
+	if exists {
+		return nil
+	}
+
+	if err := c.client.Create(folder); err != nil {
+		return fmt.Errorf("failed to create folder %s: %w", folder, err)
+	}
+
+	return nil
+}
+
+// AppendMessage stores a raw message in a folder with the given flags and internal date
+func (c *IMAPClient) AppendMessage(folder string, flags []string, date time.Time, raw []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return fmt.Errorf("not connected to IMAP server")
+	}
+
+	// \Recent is managed by the server and cannot be set by clients
+	var appendFlags []string
+	for _, flag := range flags {
+		if flag != imap.RecentFlag {
+			appendFlags = append(appendFlags, flag)
+		}
+	}
+
+	if err := c.client.Append(folder, appendFlags, date, bytes.NewBuffer(raw)); err != nil {
+		return fmt.Errorf("failed to append message to %s: %w", folder, err)
+	}
+
+	return nil
+}
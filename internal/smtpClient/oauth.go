@@ -0,0 +1,167 @@
+package smtpclient
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/client"
+)
+
+const (
+	// MechanismOAuthBearer is the standard OAuth 2.0 SASL mechanism of RFC 7628
+	MechanismOAuthBearer = "OAUTHBEARER"
+	// MechanismXOAuth2 is the older mechanism of Google and Microsoft
+	MechanismXOAuth2 = "XOAUTH2"
+)
+
+// TokenSource returns an access token valid for at least the next minute
+type TokenSource func() (string, error)
+
+// oauthAuth holds the state of an OAuth 2.0 SASL exchange
+type oauthAuth struct {
+	mechanism string
+	username  string
+	token     string
+	host      string
+	port      int
+	// rejection is the error challenge sent by the server before it fails the exchange
+	rejection []byte
+}
+
+// initialResponse returns the client message carrying the bearer token
+func (a *oauthAuth) initialResponse() []byte {
+	if a.mechanism == MechanismXOAuth2 {
+		return []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	}
+	return []byte("n,a=" + saslName(a.username) + ",\x01host=" + a.host + "\x01port=" + strconv.Itoa(a.port) +
+		"\x01auth=Bearer " + a.token + "\x01\x01")
+}
+
+// next answers the error challenge a server sends when it rejects the token
+// with the dummy response both mechanisms expect, upon which the server fails
+// the exchange
+func (a *oauthAuth) next(challenge []byte) []byte {
+	a.rejection = challenge
+	if a.mechanism == MechanismXOAuth2 {
+		return []byte{}
+	}
+	return []byte{0x01}
+}
+
+// wrap adds the reason of a rejected token to the failure of the exchange
+func (a *oauthAuth) wrap(err error) error {
+	if err != nil && a.rejection != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(a.rejection)))
+	}
+	return err
+}
+
+// saslName escapes the authorisation identity of a GS2 header
+func saslName(username string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(username)
+}
+
+// oauthMechanism picks the OAuth 2.0 mechanism supported by the server,
+// OAUTHBEARER when it offers both
+func oauthMechanism(supported func(mechanism string) bool, server string) (string, error) {
+	for _, mechanism := range []string{MechanismOAuthBearer, MechanismXOAuth2} {
+		if supported(mechanism) {
+			return mechanism, nil
+		}
+	}
+	return "", fmt.Errorf("%s supports neither OAUTHBEARER nor XOAUTH2", server)
+}
+
+// imapOAuth implements sasl.Client for IMAP AUTHENTICATE
+type imapOAuth struct {
+	oauthAuth
+}
+
+func (a *imapOAuth) Start() (string, []byte, error) {
+	return a.mechanism, a.initialResponse(), nil
+}
+
+func (a *imapOAuth) Next(challenge []byte) ([]byte, error) {
+	return a.next(challenge), nil
+}
+
+// smtpOAuth implements smtp.Auth. Like PLAIN, the token is only sent over TLS
+// or to localhost.
+type smtpOAuth struct {
+	oauthAuth
+}
+
+func (a *smtpOAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("refusing to send the access token over an unencrypted connection")
+	}
+	return a.mechanism, a.initialResponse(), nil
+}
+
+func (a *smtpOAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	return a.next(fromServer), nil
+}
+
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// authenticateIMAP logs in with the access token of config
+func authenticateIMAP(imapClient *client.Client, config IMAPConfig) error {
+	if !imapClient.IsTLS() && !isLocalhost(config.Host) {
+		return errors.New("refusing to send the access token over an unencrypted connection")
+	}
+
+	mechanism, err := oauthMechanism(func(mechanism string) bool {
+		ok, _ := imapClient.SupportAuth(mechanism)
+		return ok
+	}, config.Host)
+	if err != nil {
+		return err
+	}
+
+	token, err := config.TokenSource()
+	if err != nil {
+		return err
+	}
+	auth := &imapOAuth{oauthAuth{
+		mechanism: mechanism,
+		username:  config.Username,
+		token:     token,
+		host:      config.Host,
+		port:      config.Port,
+	}}
+	return auth.wrap(imapClient.Authenticate(auth))
+}
+
+// authenticateSMTP logs in with the access token of config
+func authenticateSMTP(c *smtp.Client, config SMTPConfig) error {
+	_, mechanisms := c.Extension("AUTH")
+	offered := strings.Fields(strings.ToUpper(mechanisms))
+	mechanism, err := oauthMechanism(func(mechanism string) bool {
+		return slices.Contains(offered, mechanism)
+	}, config.Host)
+	if err != nil {
+		return err
+	}
+
+	token, err := config.TokenSource()
+	if err != nil {
+		return err
+	}
+	auth := &smtpOAuth{oauthAuth{
+		mechanism: mechanism,
+		username:  config.Username,
+		token:     token,
+		host:      config.Host,
+		port:      config.Port,
+	}}
+	return auth.wrap(c.Auth(auth))
+}
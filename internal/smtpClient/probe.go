@@ -0,0 +1,48 @@
+package smtpclient
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// ProbeIMAP connects to an IMAP server without logging in, securing the
+// session according to the TLS mode of config, and returns the SASL
+// mechanisms it offers
+func ProbeIMAP(config IMAPConfig, dialer *net.Dialer) ([]string, error) {
+	imapClient, err := dialIMAP(config, dialer)
+	if err != nil {
+		return nil, err
+	}
+	defer imapClient.Logout()
+
+	capabilities, err := imapClient.Capability()
+	if err != nil {
+		return nil, err
+	}
+
+	var mechanisms []string
+	for capability := range capabilities {
+		if name, ok := strings.CutPrefix(strings.ToUpper(capability), "AUTH="); ok {
+			mechanisms = append(mechanisms, name)
+		}
+	}
+	sort.Strings(mechanisms)
+	return mechanisms, nil
+}
+
+// ProbeSMTP connects to an SMTP server without logging in, securing the
+// session according to the TLS mode of config, and returns the SASL
+// mechanisms it offers
+func ProbeSMTP(config SMTPConfig, dialer *net.Dialer) ([]string, error) {
+	c, _, err := openSMTP(config, dialer)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Quit()
+
+	_, offered := c.Extension("AUTH")
+	mechanisms := strings.Fields(strings.ToUpper(offered))
+	sort.Strings(mechanisms)
+	return mechanisms, nil
+}
@@ -0,0 +1,192 @@
+package smtpclient
+
+import (
+	"fmt"
+	"html"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// maxReferences bounds the References header of replies, keeping the first
+// message of the thread and the most recent ones as RFC 5322 suggests
+const maxReferences = 20
+
+var (
+	replyPrefix   = regexp.MustCompile(`(?i)^\s*(re|aw|sv)\s*:`)
+	forwardPrefix = regexp.MustCompile(`(?i)^\s*(fwd?|tr|wg)\s*:`)
+	bodyContent   = regexp.MustCompile(`(?is)<body[^>]*>(.*)</body>`)
+)
+
+// ReplySubject returns the subject of a reply to a message
+func ReplySubject(subject string) string {
+	if replyPrefix.MatchString(subject) {
+		return subject
+	}
+	return "Re: " + subject
+}
+
+// ForwardSubject returns the subject of a forwarded message
+func ForwardSubject(subject string) string {
+	if forwardPrefix.MatchString(subject) {
+		return subject
+	}
+	return "Fwd: " + subject
+}
+
+// ThreadReferences returns the References of a reply to original: its own
+// References followed by its Message-ID
+func ThreadReferences(original *Message) []string {
+	references := original.References
+	if len(references) == 0 && original.InReplyTo != "" {
+		references = []string{original.InReplyTo}
+	}
+	if original.MessageID != "" {
+		references = append(append([]string(nil), references...), original.MessageID)
+	}
+
+	if len(references) > maxReferences {
+		references = append(references[:1:1], references[len(references)-maxReferences+1:]...)
+	}
+	return references
+}
+
+// ReplyRecipients computes the recipients of a reply. The author (or its
+// Reply-To) is answered; with all set, the other To and Cc recipients are kept.
+// Addresses in own, the user's own addresses, are never included.
+func ReplyRecipients(original *Message, all bool, own []string) (to, cc []string) {
+	seen := make(map[string]bool)
+	for _, address := range own {
+		seen[normalizeAddress(address)] = true
+	}
+
+	add := func(list []string, addresses ...string) []string {
+		for _, address := range addresses {
+			key := normalizeAddress(address)
+			if key == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			list = append(list, address)
+		}
+		return list
+	}
+
+	author := original.ReplyTo
+	if author == "" {
+		author = original.From
+	}
+
+	if seen[normalizeAddress(author)] {
+		// Replying to one of our own messages goes back to its recipients
+		to = add(to, original.To...)
+	} else {
+		to = add(to, author)
+	}
+
+	if all {
+		to = add(to, original.To...)
+		cc = add(cc, original.Cc...)
+	}
+
+	return to, cc
+}
+
+// normalizeAddress returns the lower-cased bare address of value
+func normalizeAddress(value string) string {
+	if addr, err := mail.ParseAddress(value); err == nil {
+		value = addr.Address
+	}
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// QuoteHTML appends the original message to an HTML reply body as a cited blockquote
+func QuoteHTML(body string, original *Message) string {
+	attribution := fmt.Sprintf("On %s, %s wrote:",
+		original.Date.Format("Mon, 2 Jan 2006 at 15:04"), html.EscapeString(original.From))
+
+	return body +
+		"<br><div>" + attribution + "</div>" +
+		`<blockquote type="cite" style="margin:0 0 0 .8ex;border-left:1px solid #ccc;padding-left:1ex">` +
+		originalHTML(original) +
+		"</blockquote>"
+}
+
+// ForwardHTML appends the original message to an HTML body with the usual
+// "Forwarded message" summary of its headers
+func ForwardHTML(body string, original *Message) string {
+	var b strings.Builder
+	b.WriteString(body)
+	b.WriteString("<br><div>---------- Forwarded message ---------<br>")
+	fmt.Fprintf(&b, "From: %s<br>", html.EscapeString(original.From))
+	fmt.Fprintf(&b, "Date: %s<br>", original.Date.Format("Mon, 2 Jan 2006 at 15:04"))
+	fmt.Fprintf(&b, "Subject: %s<br>", html.EscapeString(original.Subject))
+	fmt.Fprintf(&b, "To: %s<br>", html.EscapeString(strings.Join(original.To, ", ")))
+	if len(original.Cc) > 0 {
+		fmt.Fprintf(&b, "Cc: %s<br>", html.EscapeString(strings.Join(original.Cc, ", ")))
+	}
+	b.WriteString("</div><br>")
+	b.WriteString(originalHTML(original))
+	return b.String()
+}
+
+// QuoteText appends the original message to a plain-text reply body, each line prefixed with "> "
+func QuoteText(body string, original *Message) string {
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(body, "\n"))
+	fmt.Fprintf(&b, "\n\nOn %s, %s wrote:\n", original.Date.Format("Mon, 2 Jan 2006 at 15:04"), original.From)
+
+	for _, line := range strings.Split(strings.TrimRight(originalText(original), "\n"), "\n") {
+		if line == "" || strings.HasPrefix(line, ">") {
+			b.WriteString(">" + line + "\n")
+		} else {
+			b.WriteString("> " + line + "\n")
+		}
+	}
+	return b.String()
+}
+
+// ForwardText appends the original message to a plain-text body with a summary of its headers
+func ForwardText(body string, original *Message) string {
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(body, "\n"))
+	b.WriteString("\n\n---------- Forwarded message ---------\n")
+	fmt.Fprintf(&b, "From: %s\n", original.From)
+	fmt.Fprintf(&b, "Date: %s\n", original.Date.Format("Mon, 2 Jan 2006 at 15:04"))
+	fmt.Fprintf(&b, "Subject: %s\n", original.Subject)
+	fmt.Fprintf(&b, "To: %s\n", strings.Join(original.To, ", "))
+	if len(original.Cc) > 0 {
+		fmt.Fprintf(&b, "Cc: %s\n", strings.Join(original.Cc, ", "))
+	}
+	b.WriteString("\n")
+	b.WriteString(originalText(original))
+	return b.String()
+}
+
+// originalText returns the body of a received message as plain text
+func originalText(original *Message) string {
+	switch {
+	case original.TextBody != "":
+		return original.TextBody
+	case original.HTMLBody != "":
+		return HTMLToText(original.HTMLBody)
+	default:
+		return original.Body
+	}
+}
+
+// originalHTML returns the body of a received message as an HTML fragment
+func originalHTML(original *Message) string {
+	if original.HTMLBody != "" {
+		if match := bodyContent.FindStringSubmatch(original.HTMLBody); match != nil {
+			return match[1]
+		}
+		return original.HTMLBody
+	}
+
+	text := original.TextBody
+	if text == "" {
+		text = original.Body
+	}
+	return strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+}
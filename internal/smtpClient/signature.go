@@ -0,0 +1,34 @@
+package smtpclient
+
+import (
+	"html"
+	"strings"
+)
+
+// signatureSeparator is the conventional "-- " line introducing a signature,
+// which lets mail clients recognise and strip it when quoting
+const signatureSeparator = "-- "
+
+// SignHTML appends a signature to an HTML body. The text signature is used,
+// escaped, when there is no HTML one.
+func SignHTML(body, htmlSignature, textSignature string) string {
+	if htmlSignature == "" {
+		if textSignature == "" {
+			return body
+		}
+		htmlSignature = strings.ReplaceAll(html.EscapeString(strings.TrimRight(textSignature, "\n")), "\n", "<br>")
+	}
+	return body + `<br><br><div class="signature">` + signatureSeparator + "<br>" + htmlSignature + "</div>"
+}
+
+// SignText appends a signature to a plain-text body. The HTML signature is
+// converted to text when there is no text one.
+func SignText(body, htmlSignature, textSignature string) string {
+	if textSignature == "" {
+		if htmlSignature == "" {
+			return body
+		}
+		textSignature = HTMLToText(htmlSignature)
+	}
+	return strings.TrimRight(body, "\n") + "\n\n" + signatureSeparator + "\n" + strings.TrimRight(textSignature, "\n") + "\n"
+}
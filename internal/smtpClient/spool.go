@@ -0,0 +1,165 @@
+package smtpclient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Spool is a file holding a composed message, so messages with large
+// attachments are streamed to the servers instead of kept in memory
+type Spool struct {
+	file *os.File
+	size int64
+}
+
+// SpoolReader reads a spooled message from the start. It satisfies the IMAP
+// literal interface so it can be appended to a mailbox directly.
+type SpoolReader struct {
+	*io.SectionReader
+}
+
+// NewSpool creates an empty spool file in dir
+func NewSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	file, err := os.CreateTemp(dir, "message-*.eml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	return &Spool{file: file}, nil
+}
+
+// OpenSpool opens a spooled message for reading
+func OpenSpool(path string) (*Spool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open spool file: %w", err)
+	}
+	return &Spool{file: file, size: info.Size()}, nil
+}
+
+// Write appends composed message data to the spool
+func (s *Spool) Write(p []byte) (int, error) {
+	n, err := s.file.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// Len returns the size of the spooled message in bytes
+func (s *Spool) Len() int {
+	return int(s.size)
+}
+
+// Path returns the path of the spool file
+func (s *Spool) Path() string {
+	return s.file.Name()
+}
+
+// Reader returns a new reader over the whole spooled message
+func (s *Spool) Reader() *SpoolReader {
+	return &SpoolReader{io.NewSectionReader(s.file, 0, s.size)}
+}
+
+// Close closes the spool file, which stays on disk
+func (s *Spool) Close() error {
+	return s.file.Close()
+}
+
+// Remove closes and deletes the spool file
+func (s *Spool) Remove() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// Len returns the size of the message, as announced in IMAP literals
+func (r *SpoolReader) Len() int {
+	return int(r.Size())
+}
+
+// RewriteSpoolHeader replaces the top-level name header field of the message
+// spooled at path, streaming the body, and returns the new size
+func RewriteSpoolHeader(path, name, value string) (int, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open spool file: %w", err)
+	}
+	defer in.Close()
+
+	r := bufio.NewReader(in)
+	header := readHeader(r)
+	return replaceSpool(path, bytes.NewReader(ReplaceHeader(header, name, value)), r)
+}
+
+// signSpool signs the message spooled at path with key, replacing the DKIM
+// signatures it already has, and returns its new size. The body is streamed
+// twice, once to hash it and once to write the signed message.
+func signSpool(path string, key *DKIMKey) (int, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open spool file: %w", err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open spool file: %w", err)
+	}
+
+	raw := readHeader(bufio.NewReader(in))
+	header := RemoveHeader(raw, "DKIM-Signature")
+	body := func() io.Reader {
+		return io.NewSectionReader(in, int64(len(raw)), info.Size()-int64(len(raw)))
+	}
+
+	signature, err := key.Signature(io.MultiReader(bytes.NewReader(header), body()))
+	if err != nil {
+		return 0, err
+	}
+	return replaceSpool(path, strings.NewReader(signature), bytes.NewReader(header), body())
+}
+
+// readHeader reads the header of a message, up to and including the first
+// empty line
+func readHeader(r *bufio.Reader) []byte {
+	var header bytes.Buffer
+	for {
+		line, err := r.ReadBytes('\n')
+		header.Write(line)
+		if err != nil || bytes.Equal(line, []byte("\r\n")) {
+			return header.Bytes()
+		}
+	}
+}
+
+// replaceSpool replaces the file at path with the concatenation of parts and
+// returns its size
+func replaceSpool(path string, parts ...io.Reader) (int, error) {
+	out, err := os.CreateTemp(filepath.Dir(path), "message-*.eml")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	n, err := io.Copy(out, io.MultiReader(parts...))
+	if err != nil {
+		return 0, fmt.Errorf("failed to write spool file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write spool file: %w", err)
+	}
+	if err := os.Rename(out.Name(), path); err != nil {
+		return 0, fmt.Errorf("failed to replace spool file: %w", err)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,168 @@
+package smtpclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lyneq/mailapi/config"
+)
+
+// TLS modes of a mail server connection
+const (
+	TLSImplicit = "implicit"
+	TLSStartTLS = "starttls"
+	TLSNone     = "none"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsMode returns the TLS mode of a connection: the configured one, else
+// implicit TLS on the well-known implicitPort and STARTTLS on any other port
+func tlsMode(settings config.TLSConfig, port, implicitPort int) (string, error) {
+	switch settings.Mode {
+	case TLSImplicit, TLSStartTLS, TLSNone:
+		return settings.Mode, nil
+	case "":
+		if port == implicitPort {
+			return TLSImplicit, nil
+		}
+		return TLSStartTLS, nil
+	default:
+		return "", fmt.Errorf("unknown tls_mode %q, expected implicit, starttls or none", settings.Mode)
+	}
+}
+
+// NewTLSConfig builds the TLS configuration of a connection to host.
+// Certificates are verified against the system roots and the CA bundle
+// unless a certificate is pinned, in which case only that one is accepted.
+func NewTLSConfig(host string, settings config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: settings.SkipVerify,
+	}
+
+	if settings.MinVersion != "" {
+		version, ok := tlsVersions[settings.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls_min_version %q, expected 1.0, 1.1, 1.2 or 1.3", settings.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if settings.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls_ca_file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in tls_ca_file %s", settings.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if settings.ClientCert != "" || settings.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(settings.ClientCert, settings.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if settings.PinnedCert != "" {
+		pins, err := pinnedFingerprints(settings.PinnedCert)
+		if err != nil {
+			return nil, err
+		}
+		// The pin replaces the chain and hostname verification, which
+		// self-signed certificates such as Proton Bridge's cannot pass
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) > 0 {
+				fingerprint := sha256.Sum256(rawCerts[0])
+				for _, pin := range pins {
+					if bytes.Equal(fingerprint[:], pin) {
+						return nil
+					}
+				}
+			}
+			return errPinMismatch
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+var errPinMismatch = errors.New("server certificate does not match tls_pinned_cert")
+
+// pinnedFingerprints parses tls_pinned_cert: a hex SHA-256 fingerprint
+// (colons allowed) or the path of a PEM file with the pinned certificates
+func pinnedFingerprints(value string) ([][]byte, error) {
+	if fingerprint, err := hex.DecodeString(strings.ReplaceAll(value, ":", "")); err == nil && len(fingerprint) == sha256.Size {
+		return [][]byte{fingerprint}, nil
+	}
+
+	data, err := os.ReadFile(value)
+	if err != nil {
+		return nil, fmt.Errorf("tls_pinned_cert is neither a SHA-256 fingerprint nor a readable file: %w", err)
+	}
+
+	var pins [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			fingerprint := sha256.Sum256(block.Bytes)
+			pins = append(pins, fingerprint[:])
+		}
+	}
+	if len(pins) == 0 {
+		return nil, fmt.Errorf("no certificate found in tls_pinned_cert %s", value)
+	}
+	return pins, nil
+}
+
+// tlsError explains a failed TLS handshake with server, with a hint on the
+// setting to change for the usual certificate problems
+func tlsError(server string, err error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+
+	hint := ""
+	switch {
+	case errors.Is(err, errPinMismatch):
+		hint = " (the server certificate changed, update tls_pinned_cert)"
+	case errors.As(err, &unknownAuthority):
+		hint = " (self-signed or private CA certificate: set tls_ca_file or tls_pinned_cert)"
+	case errors.As(err, &hostname):
+		hint = " (the certificate is issued for another host name)"
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		hint = " (the certificate has expired)"
+	case strings.Contains(err.Error(), "first record does not look like a TLS handshake"):
+		hint = " (the server does not speak TLS on this port: try tls_mode = starttls)"
+	case strings.Contains(err.Error(), "protocol version"):
+		hint = " (no common TLS version: check tls_min_version)"
+	}
+	return fmt.Errorf("TLS handshake with %s failed: %w%s", server, err, hint)
+}
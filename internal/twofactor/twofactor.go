@@ -0,0 +1,198 @@
+// Package twofactor adds a second sign-in step to accounts: a TOTP code of an
+// authenticator app (RFC 6238), or one of the recovery codes issued when the
+// app is set up. Only the hashes of recovery codes are stored.
+package twofactor
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lyneq/mailapi/db"
+	"gorm.io/gorm"
+)
+
+// RecoveryCodeCount is the number of recovery codes issued at once
+const RecoveryCodeCount = 10
+
+var (
+	// ErrNotEnabled is returned when the user has no confirmed app
+	ErrNotEnabled = errors.New("two-factor authentication is not enabled")
+	// ErrNoPendingSetup is returned when confirming an app that was not set up
+	ErrNoPendingSetup = errors.New("no authenticator app is being set up")
+	// ErrInvalidCode is returned for a wrong, expired or already used code
+	ErrInvalidCode = errors.New("invalid or expired code")
+)
+
+// Setup generates the secret of a new authenticator app and returns it with
+// its provisioning URI. The app replaces the current one, if any, once a code
+// confirms it with Enable.
+func Setup(user *db.User) (secret, uri string, err error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	secret = encoding.EncodeToString(key)
+
+	if err := db.DB.Model(user).Update("totp_pending_secret", secret).Error; err != nil {
+		return "", "", fmt.Errorf("failed to store secret: %w", err)
+	}
+	return secret, ProvisioningURI(user.Username, secret), nil
+}
+
+// Enable confirms the app being set up with one of its codes, enables
+// two-factor authentication and returns new recovery codes
+func Enable(user *db.User, code string) ([]string, error) {
+	if user.TOTPPendingSecret == "" {
+		return nil, ErrNoPendingSetup
+	}
+	s, ok := validate(user.TOTPPendingSecret, code, time.Now(), 0)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	var codes []string
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(user).Updates(map[string]interface{}{
+			"totp_enabled":        true,
+			"totp_secret":         user.TOTPPendingSecret,
+			"totp_pending_secret": "",
+			"totp_last_step":      s,
+		}).Error
+		if err != nil {
+			return err
+		}
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable two-factor authentication: %w", err)
+	}
+	return codes, nil
+}
+
+// Verify checks a code of the confirmed app. A code is accepted once.
+func Verify(user *db.User, code string) error {
+	if !user.TOTPEnabled {
+		return ErrNotEnabled
+	}
+	s, ok := validate(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	// The condition refuses the step when a concurrent request used it first
+	result := db.DB.Model(&db.User{}).
+		Where("id = ? AND totp_last_step < ?", user.ID, s).
+		Update("totp_last_step", s)
+	if result.Error != nil {
+		return fmt.Errorf("failed to verify code: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	user.TOTPLastStep = s
+	return nil
+}
+
+// Recover checks a recovery code of the user and uses it up
+func Recover(user *db.User, code string) error {
+	if !user.TOTPEnabled {
+		return ErrNotEnabled
+	}
+
+	result := db.DB.Model(&db.RecoveryCode{}).
+		Where("user_id = ? AND hash = ? AND used_at IS NULL", user.ID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return fmt.Errorf("failed to verify recovery code: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user
+func RegenerateRecoveryCodes(user *db.User) ([]string, error) {
+	if !user.TOTPEnabled {
+		return nil, ErrNotEnabled
+	}
+
+	var codes []string
+	err := db.DB.Transaction(func(tx *gorm.DB) (err error) {
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate recovery codes: %w", err)
+	}
+	return codes, nil
+}
+
+// RemainingRecoveryCodes counts the unused recovery codes of the user
+func RemainingRecoveryCodes(userID uint) (int64, error) {
+	var count int64
+	err := db.DB.Model(&db.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// Disable turns two-factor authentication off and deletes the secrets and
+// recovery codes of the user
+func Disable(user *db.User) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(user).Updates(map[string]interface{}{
+			"totp_enabled":        false,
+			"totp_secret":         "",
+			"totp_pending_secret": "",
+			"totp_last_step":      0,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", user.ID).Delete(&db.RecoveryCode{}).Error
+	})
+}
+
+// replaceRecoveryCodes deletes the recovery codes of the user and stores new ones
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&db.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	records := make([]db.RecoveryCode, RecoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		records[i] = db.RecoveryCode{UserID: userID, Hash: hashRecoveryCode(code)}
+	}
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// newRecoveryCode returns 80 random bits as four groups of base32 characters
+func newRecoveryCode() (string, error) {
+	data := make([]byte, 10)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("failed to generate recovery code: %w", err)
+	}
+	encoded := strings.ToLower(encoding.EncodeToString(data))
+	return encoded[0:4] + "-" + encoded[4:8] + "-" + encoded[8:12] + "-" + encoded[12:16], nil
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring case, spaces and dashes
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
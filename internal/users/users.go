@@ -0,0 +1,288 @@
+// Package users lets administrators manage the users of the instance. It
+// refuses the changes that would leave no enabled administrator.
+package users
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/outbox"
+	"github.com/lyneq/mailapi/internal/rbac"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+	"github.com/lyneq/mailapi/internal/verification"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrNotFound is returned when the user does not exist
+	ErrNotFound = errors.New("user not found")
+	// ErrUsernameTaken is returned when another user has the username
+	ErrUsernameTaken = errors.New("username unavailable")
+	// ErrEmailTaken is returned when another user has the email address
+	ErrEmailTaken = errors.New("email address unavailable")
+	// ErrInvalidRole is returned for an unknown role
+	ErrInvalidRole = errors.New("unknown role")
+	// ErrSelf is returned when administrators disable, demote or delete themselves
+	ErrSelf = errors.New("administrators cannot disable, demote or delete themselves")
+	// ErrLastAdmin is returned when the change would leave no enabled administrator
+	ErrLastAdmin = errors.New("the last enabled administrator cannot be disabled, demoted or deleted")
+)
+
+// Filter selects the users returned by Search
+type Filter struct {
+	// Query matches part of the username or email address
+	Query string
+	Role  string
+	// Disabled selects enabled or disabled users, both when nil
+	Disabled *bool
+}
+
+// Search returns a page of the users matching filter, by username, with their total count
+func Search(filter Filter, offset, limit int) ([]db.User, int64, error) {
+	query := db.DB.Model(&db.User{})
+	if q := strings.TrimSpace(filter.Query); q != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(q)) + "%"
+		query = query.Where(`LOWER(username) LIKE ? ESCAPE '\' OR email LIKE ? ESCAPE '\'`, pattern, pattern)
+	}
+	if filter.Role != "" {
+		query = query.Where("role = ?", filter.Role)
+	}
+	if filter.Disabled != nil {
+		query = query.Where("disabled = ?", *filter.Disabled)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count users: %w", err)
+	}
+
+	var users []db.User
+	if err := query.Order("username").Offset(offset).Limit(limit).Find(&users).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to list users: %w", err)
+	}
+	return users, total, nil
+}
+
+// Get returns a user
+func Get(id uint) (*db.User, error) {
+	var user db.User
+	err := db.DB.First(&user, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return &user, nil
+}
+
+// GetByUsername returns the user of a username
+func GetByUsername(username string) (*db.User, error) {
+	var user db.User
+	err := db.DB.Where("username = ?", username).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return &user, nil
+}
+
+// Create stores a new user. A verification link is mailed to its email
+// address, if any.
+func Create(username, password, email, role string) (*db.User, error) {
+	if role == "" {
+		role = rbac.RoleUser
+	}
+	if !rbac.ValidRole(role) {
+		return nil, ErrInvalidRole
+	}
+
+	var count int64
+	if err := db.DB.Unscoped().Model(&db.User{}).Where("username = ?", username).Count(&count).Error; err != nil {
+		return nil, fmt.Errorf("failed to check username: %w", err)
+	}
+	if count > 0 {
+		return nil, ErrUsernameTaken
+	}
+	email = verification.NormalizeEmail(email)
+	if email != "" {
+		taken, err := verification.EmailTaken(email, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check email: %w", err)
+		}
+		if taken {
+			return nil, ErrEmailTaken
+		}
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	user := &db.User{Username: username, Password: string(hashed), Email: email, Role: role}
+	if err := db.DB.Create(user).Error; err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	if email != "" {
+		if err := verification.SendVerification(user); err != nil {
+			_ = fmt.Errorf("verification email error: %v", err)
+		}
+	}
+	return user, nil
+}
+
+// SetDisabled disables or enables a user on behalf of the administrator
+// actorID. Disabling ends the sessions of the user.
+func SetDisabled(actorID, id uint, disabled bool) (*db.User, error) {
+	user, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if !disabled {
+		if err := db.DB.Model(user).Update("disabled", false).Error; err != nil {
+			return nil, fmt.Errorf("failed to enable user: %w", err)
+		}
+		return user, nil
+	}
+
+	if err := checkAdminChange(actorID, user); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	err = db.DB.Model(user).Updates(map[string]interface{}{"disabled": true, "sessions_revoked_at": now}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to disable user: %w", err)
+	}
+	return user, nil
+}
+
+// SetRole changes the role of a user on behalf of the administrator actorID,
+// 0 for the command line
+func SetRole(actorID, id uint, role string) (*db.User, error) {
+	if !rbac.ValidRole(role) {
+		return nil, ErrInvalidRole
+	}
+	user, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if user.Role == role {
+		return user, nil
+	}
+
+	if !rbac.HasPermission(role, rbac.PermissionUsersManage) {
+		if err := checkAdminChange(actorID, user); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.DB.Model(user).Update("role", role).Error; err != nil {
+		return nil, fmt.Errorf("failed to change role: %w", err)
+	}
+	return user, nil
+}
+
+// RevokeSessions ends the sessions of a user, who must sign in again, and
+// deletes their API tokens
+func RevokeSessions(id uint) (*db.User, error) {
+	user, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("sessions_revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&db.APIToken{}).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return user, nil
+}
+
+// Delete removes a user with their mail accounts, identities, templates,
+// outbox, tokens and codes, on behalf of the administrator actorID
+func Delete(actorID, id uint) error {
+	user, err := Get(id)
+	if err != nil {
+		return err
+	}
+	if err := checkAdminChange(actorID, user); err != nil {
+		return err
+	}
+
+	var accountIDs []uint
+	if err := db.DB.Model(&db.MailAccount{}).Where("user_id = ?", user.ID).Pluck("id", &accountIDs).Error; err != nil {
+		return fmt.Errorf("failed to list mail accounts: %w", err)
+	}
+	var queued []*db.OutboxMessage
+	if err := db.DB.Select("id", "spool_path").Where("user_id = ?", user.ID).Find(&queued).Error; err != nil {
+		return fmt.Errorf("failed to list outbox: %w", err)
+	}
+	defer func() {
+		for _, id := range accountIDs {
+			smtpclient.CloseAccount(id)
+		}
+		outbox.Discard(queued...)
+	}()
+
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		owned := []interface{}{
+			&db.MailAccount{}, &db.Identity{}, &db.Template{}, &db.Merge{}, &db.OutboxMessage{},
+			&db.APIToken{}, &db.RecoveryCode{}, &db.UserToken{},
+		}
+		for _, model := range owned {
+			if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return fmt.Errorf("failed to delete user data: %w", err)
+			}
+		}
+		// A new user of the same username does not inherit the lockout
+		if err := tx.Unscoped().Where("kind = ? AND value = ?", db.ThrottleUsername, user.Username).Delete(&db.SignInThrottle{}).Error; err != nil {
+			return fmt.Errorf("failed to delete user data: %w", err)
+		}
+		if err := tx.Unscoped().Delete(user).Error; err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+		return nil
+	})
+}
+
+// checkAdminChange refuses to disable, demote or delete the acting
+// administrator, or the last enabled administrator
+func checkAdminChange(actorID uint, user *db.User) error {
+	if actorID != 0 && actorID == user.ID {
+		return ErrSelf
+	}
+	if !rbac.HasPermission(user.Role, rbac.PermissionUsersManage) || user.Disabled {
+		return nil
+	}
+
+	var admins int64
+	err := db.DB.Model(&db.User{}).
+		Where("role IN ? AND disabled = ? AND id <> ?", managers(), false, user.ID).
+		Count(&admins).Error
+	if err != nil {
+		return fmt.Errorf("failed to count administrators: %w", err)
+	}
+	if admins == 0 {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// managers returns the roles granting the management of users
+func managers() []string {
+	var roles []string
+	for _, role := range rbac.Roles {
+		if rbac.HasPermission(role, rbac.PermissionUsersManage) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
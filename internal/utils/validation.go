@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/lyneq/mailapi/config"
+)
+
+// RegisterValidations adds the mail specific validation tags:
+//   - mailbox: an address with an optional display name, e.g. "Alice" <alice@example.com>
+//   - custom_header: an X- header field name listed in the SMTP allowed_headers setting
+func RegisterValidations(v *validator.Validate) error {
+	if err := v.RegisterValidation("mailbox", validateMailbox); err != nil {
+		return err
+	}
+	return v.RegisterValidation("custom_header", validateCustomHeader)
+}
+
+func validateMailbox(fl validator.FieldLevel) bool {
+	value := fl.Field().String()
+	if strings.ContainsAny(value, "\r\n") {
+		return false
+	}
+	_, err := mail.ParseAddress(value)
+	return err == nil
+}
+
+func validateCustomHeader(fl validator.FieldLevel) bool {
+	return HeaderAllowed(fl.Field().String())
+}
+
+// HeaderAllowed reports whether a custom header field may be set on sent emails
+func HeaderAllowed(name string) bool {
+	if len(name) < 3 || !strings.EqualFold(name[:2], "X-") {
+		return false
+	}
+	for _, r := range name {
+		// RFC 5322 field names are printable ASCII without the colon
+		if r <= ' ' || r > '~' || r == ':' {
+			return false
+		}
+	}
+	for _, allowed := range config.GetSMTPConfig().AllowedHeaders {
+		if strings.EqualFold(name, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// SenderAllowed reports whether emails may be sent from an address, i.e.
+// whether its domain is one of the SMTP sender_domains
+func SenderAllowed(address string) bool {
+	smtpConfig := config.GetSMTPConfig()
+
+	domains := smtpConfig.SenderDomains
+	if len(domains) == 0 {
+		if at := strings.LastIndex(smtpConfig.Username, "@"); at >= 0 {
+			domains = []string{smtpConfig.Username[at+1:]}
+		}
+	}
+
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return false
+	}
+	for _, domain := range domains {
+		if strings.EqualFold(address[at+1:], domain) {
+			return true
+		}
+	}
+	return false
+}
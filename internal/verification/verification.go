@@ -0,0 +1,305 @@
+// Package verification mails users the single-use tokens verifying their
+// email address, confirming their sender identities and resetting their
+// password. Only the SHA-256 hashes of the tokens are stored.
+package verification
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Purposes of tokens
+const (
+	PurposeVerifyEmail    = "verify_email"
+	PurposeVerifyIdentity = "verify_identity"
+	PurposeResetPassword  = "reset_password"
+)
+
+const (
+	// VerifyLifetime is the validity of email verification tokens
+	VerifyLifetime = 24 * time.Hour
+	// ResetLifetime is the validity of password reset tokens
+	ResetLifetime = time.Hour
+	// resendDelay is the time before another token of the same purpose is mailed to a user
+	resendDelay = time.Minute
+)
+
+var (
+	// ErrInvalidToken is returned for an unknown, used or expired token
+	ErrInvalidToken = errors.New("invalid or expired token")
+	// ErrNoEmail is returned when the user has no email address
+	ErrNoEmail = errors.New("no email address is set")
+	// ErrTooSoon is returned when a token was mailed less than a minute ago
+	ErrTooSoon = errors.New("an email was sent less than a minute ago")
+	// ErrNoSender is returned when neither [Users] from nor the [SMTP] username is configured
+	ErrNoSender = errors.New("no sender is configured for user emails")
+)
+
+// Sender submits the emails
+type Sender interface {
+	Send(msg *smtpclient.OutgoingMessage) error
+}
+
+var newSender = func() Sender { return smtpclient.NewSMTPClientFromConfig() }
+
+// SetSender replaces the SMTP client sending the emails, e.g. in tests. nil
+// restores the client of the [SMTP] configuration.
+func SetSender(sender Sender) {
+	if sender == nil {
+		newSender = func() Sender { return smtpclient.NewSMTPClientFromConfig() }
+		return
+	}
+	newSender = func() Sender { return sender }
+}
+
+// NormalizeEmail trims and lower-cases an address, so that it is compared and stored once
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// EmailTaken tells whether another user than userID has the address
+func EmailTaken(email string, userID uint) (bool, error) {
+	var count int64
+	err := db.DB.Model(&db.User{}).Where("email = ? AND id <> ?", NormalizeEmail(email), userID).Count(&count).Error
+	return count > 0, err
+}
+
+// SendVerification mails a token verifying the email address of the user
+func SendVerification(user *db.User) error {
+	if user.Email == "" {
+		return ErrNoEmail
+	}
+
+	token, err := issue(user, PurposeVerifyEmail, user.Email, VerifyLifetime)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hello %s,\n\n"+
+		"Confirm that %s is your email address by opening this link, valid for 24 hours:\n\n%s\n\n"+
+		"If you did not sign up, you can ignore this email.\n",
+		user.Username, user.Email, link(config.GetUsersConfig().VerifyURL, token))
+	return send(user.Email, "Verify your email address", body)
+}
+
+// VerifyEmail uses a verification token and marks the address it was sent
+// to as verified. The token is refused if the user changed address since.
+func VerifyEmail(plaintext string) (*db.User, error) {
+	token, err := consume(plaintext, PurposeVerifyEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	var user db.User
+	if err := db.DB.First(&user, token.UserID).Error; err != nil {
+		return nil, ErrInvalidToken
+	}
+	if user.Email != token.Email {
+		return nil, ErrInvalidToken
+	}
+	if err := db.DB.Model(&user).Update("is_verified", true).Error; err != nil {
+		return nil, fmt.Errorf("failed to verify email: %w", err)
+	}
+	return &user, nil
+}
+
+// SendIdentityVerification mails a token to an address the user wants to
+// send from, proving that they receive its emails
+func SendIdentityVerification(user *db.User, address string) error {
+	token, err := issue(user, PurposeVerifyIdentity, address, VerifyLifetime)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hello,\n\n"+
+		"%s wants to send emails from %s. Confirm that they may by opening this link, valid for 24 hours:\n\n%s\n\n"+
+		"If you do not know them, you can ignore this email; nobody can send from your address meanwhile.\n",
+		user.Username, address, link(config.GetUsersConfig().IdentityVerifyURL, token))
+	return send(address, "Confirm your sender address", body)
+}
+
+// VerifyIdentity uses an identity verification token and returns it, with
+// the user and the address it confirms
+func VerifyIdentity(plaintext string) (*db.UserToken, error) {
+	return consume(plaintext, PurposeVerifyIdentity)
+}
+
+// RequestPasswordReset mails a reset token to the user of a verified email
+// address. Unknown and unverified addresses are ignored without error, so
+// that the answer does not tell which addresses have an account.
+func RequestPasswordReset(email string) error {
+	var user db.User
+	err := db.DB.Where("email = ? AND is_verified = ?", NormalizeEmail(email), true).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to find user: %w", err)
+	}
+
+	token, err := issue(&user, PurposeResetPassword, user.Email, ResetLifetime)
+	if errors.Is(err, ErrTooSoon) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hello %s,\n\n"+
+		"Choose a new password by opening this link, valid for 1 hour:\n\n%s\n\n"+
+		"If you did not ask to reset your password, you can ignore this email; your password is unchanged.\n",
+		user.Username, link(config.GetUsersConfig().ResetURL, token))
+	return send(user.Email, "Reset your password", body)
+}
+
+// ResetPassword uses a reset token to set the password of its user, ending
+// their sessions and deleting their API tokens
+func ResetPassword(plaintext, password string) (*db.User, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	token, err := consume(plaintext, PurposeResetPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	var user db.User
+	if err := db.DB.First(&user, token.UserID).Error; err != nil {
+		return nil, ErrInvalidToken
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		// The sessions opened with the old password end
+		err := tx.Model(&user).Updates(map[string]interface{}{
+			"password":            string(hashed),
+			"sessions_revoked_at": time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		// So do the API tokens, which may have leaked with it
+		if err := tx.Where("user_id = ?", user.ID).Delete(&db.APIToken{}).Error; err != nil {
+			return err
+		}
+		// Other reset links sent before stop working with the old password
+		return tx.Where("user_id = ? AND purpose = ?", user.ID, PurposeResetPassword).Delete(&db.UserToken{}).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to reset password: %w", err)
+	}
+	return &user, nil
+}
+
+// issue stores a new token of purpose for the user, sent to email, and
+// returns it. Unused tokens of the same purpose and address stop working.
+func issue(user *db.User, purpose, email string, lifetime time.Duration) (string, error) {
+	var recent int64
+	err := db.DB.Model(&db.UserToken{}).
+		Where("user_id = ? AND purpose = ? AND email = ? AND created_at > ?", user.ID, purpose, email, time.Now().Add(-resendDelay)).
+		Count(&recent).Error
+	if err != nil {
+		return "", fmt.Errorf("failed to check tokens: %w", err)
+	}
+	if recent > 0 {
+		return "", ErrTooSoon
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	plaintext := base64.RawURLEncoding.EncodeToString(secret)
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND purpose = ? AND email = ? AND used_at IS NULL", user.ID, purpose, email).Delete(&db.UserToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&db.UserToken{
+			UserID:    user.ID,
+			Purpose:   purpose,
+			Email:     email,
+			Hash:      hash(plaintext),
+			ExpiresAt: time.Now().Add(lifetime),
+		}).Error
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+	return plaintext, nil
+}
+
+// consume marks an unused, unexpired token of purpose as used and returns it
+func consume(plaintext, purpose string) (*db.UserToken, error) {
+	if plaintext == "" {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now()
+	result := db.DB.Model(&db.UserToken{}).
+		Where("hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", hash(plaintext), purpose, now).
+		Update("used_at", now)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to check token: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	var token db.UserToken
+	if err := db.DB.Where("hash = ?", hash(plaintext)).First(&token).Error; err != nil {
+		return nil, fmt.Errorf("failed to read token: %w", err)
+	}
+	return &token, nil
+}
+
+// send mails a plain text message from the configured sender. It has no
+// HTML part, so the user names and addresses it quotes are never markup.
+func send(to, subject, body string) error {
+	from := config.GetUsersConfig().From
+	if from == "" {
+		from = config.GetSMTPConfig().Username
+	}
+	if from == "" {
+		return ErrNoSender
+	}
+
+	msg := &smtpclient.OutgoingMessage{From: from, To: []string{to}, Subject: subject, TextBody: body}
+	if err := newSender().Send(msg); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
+
+// link appends the token to the page of the client, or returns the token
+// alone when no page is configured
+func link(page, token string) string {
+	if page == "" {
+		return token
+	}
+	u, err := url.Parse(page)
+	if err != nil {
+		return token
+	}
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// hash returns the SHA-256 hash of a token, hex encoded
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -5,7 +5,11 @@ import (
 	"github.com/lyneq/mailapi/api"
 	"github.com/lyneq/mailapi/config"
 	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/account"
+	"github.com/lyneq/mailapi/internal/cli"
+	"github.com/lyneq/mailapi/internal/outbox"
 	"github.com/lyneq/mailapi/internal/session"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
 	"os"
 )
 
@@ -16,7 +20,27 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := account.LoadKey(); err != nil {
+		fmt.Printf("Error loading the mail account encryption key: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := smtpclient.LoadDKIMKeys(); err != nil {
+		fmt.Printf("Error loading DKIM keys: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Run a command line sub-command instead of the server when one is given
+	if len(os.Args) > 1 {
+		if err := cli.Run(os.Args[1:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	db.Init()
 	session.Init(db.DB, false)
+	outbox.Start()
 	api.Init()
 }
@@ -0,0 +1,237 @@
+package test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/account"
+	"github.com/lyneq/mailapi/internal/identity"
+	"github.com/lyneq/mailapi/internal/outbox"
+)
+
+// setupAccountKey configures a random credential encryption key
+func setupAccountKey(t *testing.T) {
+	t.Helper()
+	previous := config.AppConfig.Accounts
+	t.Cleanup(func() {
+		config.AppConfig.Accounts = previous
+		account.LoadKey()
+	})
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	config.AppConfig.Accounts = config.AccountsConfig{EncryptionKey: base64.StdEncoding.EncodeToString(key)}
+	if err := account.LoadKey(); err != nil {
+		t.Fatalf("LoadKey() error = %v", err)
+	}
+}
+
+func newAccount(userID uint, email string) *db.MailAccount {
+	return &db.MailAccount{
+		UserID:       userID,
+		Email:        email,
+		IMAPHost:     "imap.example.com",
+		IMAPPort:     993,
+		IMAPUsername: email,
+		SMTPHost:     "smtp.example.com",
+		SMTPPort:     587,
+		SMTPUsername: email,
+	}
+}
+
+func TestAccountCredentials(t *testing.T) {
+	setupDB(t)
+	setupAccountKey(t)
+
+	config.AppConfig.Accounts.EncryptionKey = "dG9vIHNob3J0"
+	if err := account.LoadKey(); err == nil {
+		t.Errorf("A key shorter than 32 bytes must be rejected")
+	}
+	config.AppConfig.Accounts.EncryptionKey = ""
+	account.LoadKey()
+	if err := account.Save(newAccount(1, "me@example.com"), account.Credentials{IMAPPassword: "secret"}); !errors.Is(err, account.ErrNoKey) {
+		t.Fatalf("Credentials must not be stored without a key, got %v", err)
+	}
+
+	setupAccountKey(t)
+	saved := newAccount(1, " Me@Example.com")
+	if err := account.Save(saved, account.Credentials{IMAPPassword: "imap secret", SMTPPassword: "smtp secret"}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	var stored db.MailAccount
+	db.DB.First(&stored, saved.ID)
+	if stored.Email != "me@example.com" || strings.Contains(stored.IMAPPassword, "secret") || stored.IMAPPassword == stored.SMTPPassword {
+		t.Errorf("Unexpected stored account %+v", stored)
+	}
+	if password, err := account.Decrypt(stored.SMTPPassword); err != nil || password != "smtp secret" {
+		t.Errorf("Decrypt() = %q, %v", password, err)
+	}
+	if data, _ := json.Marshal(stored); strings.Contains(string(data), stored.IMAPPassword) {
+		t.Errorf("Encrypted passwords must not be serialised: %s", data)
+	}
+
+	// Updating without passwords keeps the stored ones
+	stored.Name = "Work"
+	if err := account.Save(&stored, account.Credentials{}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if password, _ := account.Decrypt(stored.IMAPPassword); password != "imap secret" {
+		t.Errorf("The IMAP password was lost on update, got %q", password)
+	}
+
+	setupAccountKey(t)
+	if _, err := account.Decrypt(stored.IMAPPassword); err == nil {
+		t.Errorf("Credentials must not decrypt with another key")
+	}
+}
+
+func TestCurrentAccount(t *testing.T) {
+	setupDB(t)
+	setupAccountKey(t)
+
+	if _, err := account.Current(1, 0); !errors.Is(err, account.ErrNoAccount) {
+		t.Errorf("Users without account must not use the shared one by default, got %v", err)
+	}
+	config.AppConfig.Accounts.SharedAccount = true
+	if found, err := account.Current(1, 0); found != nil || err != nil {
+		t.Errorf("Expected the shared account, got %+v, %v", found, err)
+	}
+
+	work := newAccount(1, "me@work.example")
+	home := newAccount(1, "me@home.example")
+	other := newAccount(2, "them@example.net")
+	for _, a := range []*db.MailAccount{work, home, other} {
+		if err := account.Save(a, account.Credentials{IMAPPassword: "secret"}); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+	}
+	if !work.IsDefault || home.IsDefault {
+		t.Errorf("The first account should be the default one")
+	}
+
+	for _, tc := range []struct {
+		selected uint
+		want     uint
+	}{
+		{0, work.ID},
+		{home.ID, home.ID},
+		{other.ID, work.ID}, // accounts of other users are never used
+		{999, work.ID},
+	} {
+		if found, err := account.Current(1, tc.selected); err != nil || found.ID != tc.want {
+			t.Errorf("Current(1, %d) = %+v, %v, want account %d", tc.selected, found, err, tc.want)
+		}
+	}
+
+	if err := account.Delete(work); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if found, err := account.Current(1, 0); err != nil || found.ID != home.ID || !found.IsDefault {
+		t.Errorf("The remaining account should become the default one, got %+v, %v", found, err)
+	}
+
+	// Identities are limited to the verified domains of the user's accounts
+	if err := identity.Save(&db.Identity{UserID: 1, Address: "alias@home.example"}); !errors.Is(err, identity.ErrSenderNotAllowed) {
+		t.Errorf("Unverified account addresses must not allow identities, got %v", err)
+	}
+	db.DB.Model(home).Update("email_verified", true)
+	if err := identity.Save(&db.Identity{UserID: 1, Address: "alias@home.example"}); err != nil {
+		t.Errorf("Save() error = %v", err)
+	}
+	if err := identity.Save(&db.Identity{UserID: 1, Address: "alias@work.example"}); !errors.Is(err, identity.ErrSenderNotAllowed) {
+		t.Errorf("Identities outside the account domains must be rejected, got %v", err)
+	}
+}
+
+func TestAccountVerification(t *testing.T) {
+	setupDB(t)
+	setupAccountKey(t)
+	mailer := setupMailer(t)
+	createUser(t, "alice", "password1")
+
+	// The address is never taken as proven from the request
+	work := newAccount(1, "Me@Work.example")
+	work.EmailVerified = true
+	if err := account.Save(work, account.Credentials{IMAPPassword: "secret"}); err != nil || work.EmailVerified {
+		t.Fatalf("Save() = %+v, %v", work, err)
+	}
+
+	if err := account.RequestVerification(work); err != nil {
+		t.Fatalf("RequestVerification() error = %v", err)
+	}
+	if mailer.to[len(mailer.to)-1] != "me@work.example" {
+		t.Errorf("The link must be mailed to the address, got %v", mailer.to)
+	}
+	if address, err := identity.Verify(mailer.lastToken(t)); err != nil || address != "me@work.example" {
+		t.Fatalf("Verify() = %q, %v", address, err)
+	}
+	work, _ = account.Get(1, work.ID)
+	if !work.EmailVerified {
+		t.Fatalf("The account address should be verified")
+	}
+	if err := account.RequestVerification(work); !errors.Is(err, account.ErrVerified) {
+		t.Errorf("Verified addresses must not be mailed again, got %v", err)
+	}
+
+	// Settings changes keep it, a new address must be confirmed again
+	work.Name = "Work"
+	if err := account.Save(work, account.Credentials{}); err != nil || !work.EmailVerified {
+		t.Errorf("Save() = %+v, %v", work, err)
+	}
+	work.Email = "other@work.example"
+	if err := account.Save(work, account.Credentials{}); err != nil || work.EmailVerified {
+		t.Errorf("A changed address must be confirmed again, got %+v, %v", work, err)
+	}
+}
+
+func TestOutboxAccountDelivery(t *testing.T) {
+	setupOutbox(t)
+	setupAccountKey(t)
+	outbox.SetSender(nil)
+	defer outbox.SetSender(&fakeSender{})
+
+	server := startFakeSMTPServer(t)
+	mailbox := newAccount(1, "me@example.com")
+	mailbox.SMTPHost = "127.0.0.1"
+	mailbox.SMTPPort = server.listener.Addr().(*net.TCPAddr).Port
+	mailbox.SMTPTLSMode = "none"
+	if err := account.Save(mailbox, account.Credentials{IMAPPassword: "secret"}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	msg := enqueueFrom(t, mailbox)
+	if delivered, err := outbox.Deliver(msg.ID); err != nil || delivered.Status != db.OutboxSent {
+		t.Fatalf("Deliver() = %+v, %v", delivered, err)
+	}
+	if server.messages.Load() != 1 {
+		t.Errorf("Expected the message on the account's server, got %d", server.messages.Load())
+	}
+
+	account.Delete(mailbox)
+	msg = enqueueFrom(t, mailbox)
+	if delivered, err := outbox.Deliver(msg.ID); err != nil || delivered.Status != db.OutboxFailed {
+		t.Errorf("Messages of a removed account must fail without retries, got %+v, %v", delivered, err)
+	}
+}
+
+func enqueueFrom(t *testing.T, from *db.MailAccount) *db.OutboxMessage {
+	t.Helper()
+	msg := spooled(t, &db.OutboxMessage{
+		UserID:     from.UserID,
+		AccountID:  account.ID(from),
+		From:       from.Email,
+		Recipients: []string{"you@example.com"},
+	}, string(rawMessage))
+	if err := outbox.Enqueue(msg); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	return msg
+}
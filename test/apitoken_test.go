@@ -0,0 +1,110 @@
+package test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/apitoken"
+	"github.com/lyneq/mailapi/internal/middleware"
+	"github.com/lyneq/mailapi/internal/session"
+)
+
+func TestAPITokens(t *testing.T) {
+	setupDB(t)
+
+	plaintext, token, err := apitoken.Create(1, " Nightly   export ", []string{apitoken.ScopeMailRead}, time.Hour)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if !strings.HasPrefix(plaintext, "mapi_") || !strings.HasPrefix(plaintext, token.Hint) || token.Name != "Nightly export" {
+		t.Errorf("Unexpected token %q, %+v", plaintext, token)
+	}
+
+	var stored db.APIToken
+	db.DB.First(&stored, token.ID)
+	if stored.Hash == "" || strings.Contains(stored.Hash, plaintext[5:]) {
+		t.Errorf("Only a hash of the token must be stored, got %q", stored.Hash)
+	}
+
+	found, err := apitoken.Authenticate(plaintext)
+	if err != nil || found.ID != token.ID || found.LastUsedAt == nil {
+		t.Fatalf("Authenticate() = %+v, %v", found, err)
+	}
+	if !apitoken.HasScope(found, apitoken.ScopeMailRead) || apitoken.HasScope(found, apitoken.ScopeMailSend) {
+		t.Errorf("Unexpected scopes %v", found.Scopes)
+	}
+	for _, invalid := range []string{"", "mapi_unknown", plaintext[5:], plaintext + "x"} {
+		if _, err := apitoken.Authenticate(invalid); !errors.Is(err, apitoken.ErrInvalid) {
+			t.Errorf("Authenticate(%q) = %v", invalid, err)
+		}
+	}
+
+	expired, _, _ := apitoken.Create(1, "old", []string{apitoken.ScopeMailRead}, -time.Minute)
+	if _, err := apitoken.Authenticate(expired); !errors.Is(err, apitoken.ErrInvalid) {
+		t.Errorf("An expired token must be rejected, got %v", err)
+	}
+
+	if list, _ := apitoken.List(1); len(list) != 2 {
+		t.Errorf("List() = %d tokens", len(list))
+	}
+	if err := apitoken.Revoke(2, token.ID); !errors.Is(err, apitoken.ErrNotFound) {
+		t.Errorf("Tokens of other users must not be revoked, got %v", err)
+	}
+	if err := apitoken.Revoke(1, token.ID); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	if _, err := apitoken.Authenticate(plaintext); !errors.Is(err, apitoken.ErrInvalid) {
+		t.Errorf("A revoked token must be rejected, got %v", err)
+	}
+}
+
+func TestRequireAuthTokens(t *testing.T) {
+	setupDB(t)
+	reader, _, _ := apitoken.Create(7, "reader", []string{apitoken.ScopeMailRead}, time.Hour)
+
+	e := echo.New()
+	e.Use(session.Middleware())
+	handler := func(c echo.Context) error {
+		userID, err := session.GetUserID(c.Request().Context())
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]uint{"user_id": userID})
+	}
+	e.GET("/read", handler, middleware.RequireAuth(apitoken.ScopeMailRead))
+	e.GET("/send", handler, middleware.RequireAuth(apitoken.ScopeMailSend))
+	e.GET("/session", handler, middleware.RequireAuth(""))
+
+	for _, tc := range []struct {
+		path          string
+		authorization string
+		status        int
+	}{
+		{"/read", "", http.StatusUnauthorized},
+		{"/read", "Bearer " + reader, http.StatusOK},
+		{"/read", "Basic " + reader, http.StatusUnauthorized},
+		{"/read", "Bearer mapi_forged", http.StatusUnauthorized},
+		{"/send", "Bearer " + reader, http.StatusForbidden},
+		{"/session", "Bearer " + reader, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.authorization != "" {
+			req.Header.Set(echo.HeaderAuthorization, tc.authorization)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if rec.Code != tc.status {
+			t.Errorf("GET %s with %q = %d, want %d: %s", tc.path, tc.authorization, rec.Code, tc.status, rec.Body)
+		}
+		if rec.Code == http.StatusOK && !strings.Contains(rec.Body.String(), `"user_id":7`) {
+			t.Errorf("The handler must see the owner of the token, got %s", rec.Body)
+		}
+	}
+}
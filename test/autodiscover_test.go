@@ -0,0 +1,249 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lyneq/mailapi/internal/autodiscover"
+)
+
+// fakeDNS answers SRV lookups by "_service._proto.name" and MX lookups by name
+type fakeDNS struct {
+	srv map[string][]*net.SRV
+	mx  map[string][]*net.MX
+}
+
+func (r *fakeDNS) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	records, ok := r.srv[fmt.Sprintf("_%s._%s.%s", service, proto, name)]
+	if !ok {
+		return "", nil, errors.New("no such host")
+	}
+	return "", records, nil
+}
+
+func (r *fakeDNS) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	records, ok := r.mx[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return records, nil
+}
+
+// fakeWeb serves documents by URL, query string excluded, and records the request bodies
+type fakeWeb struct {
+	documents map[string]string
+	bodies    map[string]string
+}
+
+func (f *fakeWeb) Do(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.RawQuery = ""
+	if req.Body != nil {
+		body, _ := io.ReadAll(req.Body)
+		f.bodies[u.String()] = string(body)
+	}
+
+	document, ok := f.documents[u.String()]
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Body: io.NopCloser(strings.NewReader(document))}, nil
+}
+
+// fakeProber reports the servers of its list, by "host:port/mode", as working
+type fakeProber map[string][]string
+
+func (p fakeProber) Probe(_ context.Context, server autodiscover.Server) ([]string, error) {
+	mechanisms, ok := p[fmt.Sprintf("%s:%d/%s", server.Host, server.Port, server.TLSMode)]
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	return mechanisms, nil
+}
+
+func newFakeDiscoverer(documents map[string]string, resolver *fakeDNS, prober fakeProber) (*autodiscover.Discoverer, *fakeWeb) {
+	client := &fakeWeb{documents: documents, bodies: map[string]string{}}
+	if resolver == nil {
+		resolver = &fakeDNS{}
+	}
+	return &autodiscover.Discoverer{
+		Resolver: resolver,
+		HTTP:     client,
+		Prober:   prober,
+		Timeout:  5 * time.Second,
+		ISPDB:    "https://ispdb.test/v1.1/",
+	}, client
+}
+
+func describe(results []autodiscover.Result) []string {
+	var out []string
+	for _, r := range results {
+		out = append(out, fmt.Sprintf("%s %s:%d/%s %v", r.Source, r.Host, r.Port, r.TLSMode, r.OK))
+	}
+	return out
+}
+
+const autoconfigDocument = `<?xml version="1.0"?>
+<clientConfig version="1.1">
+  <emailProvider id="example.com">
+    <incomingServer type="imap">
+      <hostname>imap.%EMAILDOMAIN%</hostname>
+      <port>993</port>
+      <socketType>SSL</socketType>
+      <username>%EMAILLOCALPART%</username>
+    </incomingServer>
+    <incomingServer type="pop3">
+      <hostname>pop.example.com</hostname>
+      <port>995</port>
+      <socketType>SSL</socketType>
+    </incomingServer>
+    <outgoingServer type="smtp">
+      <hostname>out.example.com</hostname>
+      <port>25</port>
+      <socketType>plain</socketType>
+      <username>%EMAILADDRESS%</username>
+    </outgoingServer>
+    <outgoingServer type="smtp">
+      <hostname>out.example.com</hostname>
+      <port>587</port>
+      <socketType>STARTTLS</socketType>
+      <username>%EMAILADDRESS%</username>
+    </outgoingServer>
+  </emailProvider>
+</clientConfig>`
+
+func TestAutodiscoverRanking(t *testing.T) {
+	resolver := &fakeDNS{srv: map[string][]*net.SRV{
+		"_imaps._tcp.example.com":      {{Target: "mx.example.net.", Port: 993}},
+		"_submission._tcp.example.com": {{Target: "mx.example.net.", Port: 587}},
+		// A target of "." means the service is not provided
+		"_imap._tcp.example.com": {{Target: ".", Port: 0}},
+	}}
+	discoverer, _ := newFakeDiscoverer(map[string]string{
+		"https://autoconfig.example.com/mail/config-v1.1.xml": autoconfigDocument,
+	}, resolver, fakeProber{
+		"imap.example.com:993/implicit": {"PLAIN"},
+		"mx.example.net:993/implicit":   {"PLAIN", "XOAUTH2"},
+		"out.example.com:25/none":       nil,
+		"out.example.com:587/starttls":  {"LOGIN", "PLAIN"},
+		"smtp.example.com:465/implicit": {"PLAIN"},
+	})
+
+	report, err := discoverer.Discover(context.Background(), "Jane.Doe@Example.com")
+	if err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+	if report.Email != "jane.doe@example.com" {
+		t.Errorf("Email = %q", report.Email)
+	}
+
+	imap := describe(report.IMAP)
+	wantIMAP := []string{
+		"autoconfig imap.example.com:993/implicit true",
+		"srv mx.example.net:993/implicit true",
+	}
+	if len(imap) != 5 || strings.Join(imap[:2], ",") != strings.Join(wantIMAP, ",") {
+		t.Errorf("IMAP = %v, want %v then the failed guesses", imap, wantIMAP)
+	}
+	if report.IMAP[0].Username != "jane.doe" || report.IMAP[1].Username != "jane.doe@example.com" {
+		t.Errorf("Unexpected usernames %q, %q", report.IMAP[0].Username, report.IMAP[1].Username)
+	}
+	if strings.Join(report.IMAP[1].Mechanisms, " ") != "PLAIN XOAUTH2" {
+		t.Errorf("Mechanisms = %v", report.IMAP[1].Mechanisms)
+	}
+
+	smtp := describe(report.SMTP)
+	wantSMTP := []string{
+		"autoconfig out.example.com:587/starttls true",
+		"guess smtp.example.com:465/implicit true",
+		"autoconfig out.example.com:25/none true",
+		"srv mx.example.net:587/starttls false",
+	}
+	if len(smtp) < 4 || strings.Join(smtp[:4], ",") != strings.Join(wantSMTP, ",") {
+		t.Errorf("SMTP = %v, want %v first", smtp, wantSMTP)
+	}
+	for _, result := range report.SMTP[3:] {
+		if result.OK || result.Error == "" {
+			t.Errorf("Failed servers must come last with their error, got %+v", result)
+		}
+	}
+
+	if _, err := discoverer.Discover(context.Background(), "not an address"); !errors.Is(err, autodiscover.ErrInvalidAddress) {
+		t.Errorf("Discover() of an invalid address = %v", err)
+	}
+}
+
+func TestAutodiscoverSources(t *testing.T) {
+	const exchange = `<?xml version="1.0" encoding="utf-8"?>
+<Autodiscover xmlns="http://schemas.microsoft.com/exchange/autodiscover/responseschema/2006">
+  <Response xmlns="http://schemas.microsoft.com/exchange/autodiscover/outlook/responseschema/2006a">
+    <Account>
+      <AccountType>email</AccountType>
+      <Action>settings</Action>
+      <Protocol><Type>EXCH</Type><Server>ex.corp.test</Server></Protocol>
+      <Protocol><Type>IMAP</Type><Server>imap.corp.test</Server><Port>993</Port><SSL>on</SSL><LoginName>CORP\me</LoginName></Protocol>
+      <Protocol><Type>SMTP</Type><Server>smtp.corp.test</Server><Port>587</Port><SSL>on</SSL><Encryption>TLS</Encryption></Protocol>
+    </Account>
+  </Response>
+</Autodiscover>`
+
+	discoverer, client := newFakeDiscoverer(map[string]string{
+		"https://autodiscover.corp.test/autodiscover/autodiscover.xml": exchange,
+		// Hosted domains are found in the database by the domain of their MX
+		"https://ispdb.test/v1.1/hosting.test": strings.ReplaceAll(autoconfigDocument, "%EMAILDOMAIN%", "hosting.test"),
+	}, &fakeDNS{mx: map[string][]*net.MX{
+		"corp.test": {{Host: "mx1.eu.hosting.test.", Pref: 10}},
+	}}, fakeProber{
+		"imap.corp.test:993/implicit":    nil,
+		"smtp.corp.test:587/starttls":    nil,
+		"imap.hosting.test:993/implicit": nil,
+	})
+
+	report, err := discoverer.Discover(context.Background(), "me@corp.test")
+	if err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+	if !strings.Contains(client.bodies["https://autodiscover.corp.test/autodiscover/autodiscover.xml"], "<EMailAddress>me@corp.test</EMailAddress>") {
+		t.Errorf("The autodiscover request must name the address")
+	}
+
+	imap := describe(report.IMAP)
+	if len(imap) < 2 || imap[0] != "autoconfig imap.hosting.test:993/implicit true" || imap[1] != "autodiscover imap.corp.test:993/implicit true" {
+		t.Errorf("IMAP = %v", imap)
+	}
+	if report.IMAP[1].Username != `CORP\me` {
+		t.Errorf("The login name of autodiscover must be kept, got %q", report.IMAP[1].Username)
+	}
+	if smtp := describe(report.SMTP); len(smtp) == 0 || smtp[0] != "autodiscover smtp.corp.test:587/starttls true" {
+		t.Errorf("SMTP = %v", smtp)
+	}
+}
+
+func TestAutodiscoverProbe(t *testing.T) {
+	server := startFakeSMTPServer(t)
+	server.bearer = "token"
+	server.mechanisms = "PLAIN XOAUTH2"
+	port := server.listener.Addr().(*net.TCPAddr).Port
+
+	prober := &autodiscover.NetProber{Dialer: &net.Dialer{Timeout: 5 * time.Second}}
+	mechanisms, err := prober.Probe(context.Background(), autodiscover.Server{Protocol: "smtp", Host: "127.0.0.1", Port: port, TLSMode: "none"})
+	if err != nil || strings.Join(mechanisms, " ") != "PLAIN XOAUTH2" {
+		t.Errorf("Probe() = %v, %v", mechanisms, err)
+	}
+	if _, err := prober.Probe(context.Background(), autodiscover.Server{Protocol: "smtp", Host: "127.0.0.1", Port: port, TLSMode: "starttls"}); err == nil {
+		t.Errorf("A server without STARTTLS must fail the starttls probe")
+	}
+
+	// The network discoverer stays off the local network
+	_, err = autodiscover.New().Prober.Probe(context.Background(), autodiscover.Server{Protocol: "smtp", Host: "127.0.0.1", Port: port, TLSMode: "none"})
+	if err == nil || !strings.Contains(err.Error(), "non-public") {
+		t.Errorf("Probing a loopback address must be refused, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lyneq/mailapi/internal/calendar"
+)
+
+const sampleInvitation = "BEGIN:VCALENDAR\r\n" +
+	"PRODID:-//Example//EN\r\n" +
+	"VERSION:2.0\r\n" +
+	"METHOD:REQUEST\r\n" +
+	"BEGIN:VTIMEZONE\r\n" +
+	"TZID:Europe/Paris\r\n" +
+	"END:VTIMEZONE\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:meeting-42@example.com\r\n" +
+	"SEQUENCE:2\r\n" +
+	"DTSTART;TZID=Europe/Paris:20240315T100000\r\n" +
+	"DURATION:PT1H30M\r\n" +
+	"SUMMARY:Quarterly review\\, Q1\r\n" +
+	"DESCRIPTION:Agenda:\\n- numbers\\n- plans with a very long line that has to be f\r\n" +
+	" olded by the sender\r\n" +
+	"ORGANIZER;CN=\"Boss, The\":mailto:boss@example.com\r\n" +
+	"ATTENDEE;CN=Alice;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:alice@example.com\r\n" +
+	"ATTENDEE;PARTSTAT=ACCEPTED:MAILTO:bob@example.com\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseInvitation(t *testing.T) {
+	inv, err := calendar.ParseInvitation(sampleInvitation)
+	if err != nil {
+		t.Fatalf("ParseInvitation() error = %v", err)
+	}
+
+	if inv.Method != "REQUEST" || inv.UID != "meeting-42@example.com" || inv.Sequence != 2 {
+		t.Errorf("Unexpected identification: method=%s uid=%s sequence=%d", inv.Method, inv.UID, inv.Sequence)
+	}
+	if inv.Summary != "Quarterly review, Q1" {
+		t.Errorf("Unexpected summary: %q", inv.Summary)
+	}
+	if !strings.HasSuffix(inv.Description, "has to be folded by the sender") {
+		t.Errorf("Description was not unfolded: %q", inv.Description)
+	}
+
+	paris, _ := time.LoadLocation("Europe/Paris")
+	start := time.Date(2024, 3, 15, 10, 0, 0, 0, paris)
+	if inv.Start == nil || !inv.Start.Equal(start) {
+		t.Errorf("Expected start %v, got %v", start, inv.Start)
+	}
+	if inv.End == nil || !inv.End.Equal(start.Add(90*time.Minute)) {
+		t.Errorf("Expected end 90 minutes after start, got %v", inv.End)
+	}
+
+	if inv.Organizer == nil || inv.Organizer.Email != "boss@example.com" || inv.Organizer.Name != "Boss, The" {
+		t.Errorf("Unexpected organizer: %+v", inv.Organizer)
+	}
+	if len(inv.Attendees) != 2 {
+		t.Fatalf("Expected 2 attendees, got %d", len(inv.Attendees))
+	}
+	if alice := inv.FindAttendee("ALICE@example.com"); alice == nil || !alice.RSVP || alice.Status != "NEEDS-ACTION" {
+		t.Errorf("Unexpected attendee: %+v", alice)
+	}
+}
+
+func TestInvitationReply(t *testing.T) {
+	inv, err := calendar.ParseInvitation(sampleInvitation)
+	if err != nil {
+		t.Fatalf("ParseInvitation() error = %v", err)
+	}
+
+	reply := inv.Reply("alice@example.com", "Alice", calendar.PartStatAccepted, "See you there; bring snacks", time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+
+	for _, line := range strings.Split(strings.TrimSuffix(reply, "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("Line longer than 75 octets: %q", line)
+		}
+	}
+
+	parsed, err := calendar.ParseInvitation(reply)
+	if err != nil {
+		t.Fatalf("Reply is not valid iCalendar: %v\n%s", err, reply)
+	}
+
+	if parsed.Method != "REPLY" || parsed.UID != inv.UID || parsed.Sequence != inv.Sequence {
+		t.Errorf("Reply does not identify the event: %+v", parsed)
+	}
+	if len(parsed.Attendees) != 1 || parsed.Attendees[0].Email != "alice@example.com" || parsed.Attendees[0].Status != calendar.PartStatAccepted {
+		t.Errorf("Unexpected attendees in reply: %+v", parsed.Attendees)
+	}
+	if !strings.Contains(reply, "COMMENT:See you there\\; bring snacks\r\n") {
+		t.Errorf("Comment was not escaped:\n%s", reply)
+	}
+	if !strings.Contains(reply, "DTSTART;TZID=Europe/Paris:20240315T100000\r\n") {
+		t.Errorf("DTSTART was not copied verbatim:\n%s", reply)
+	}
+}
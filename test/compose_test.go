@@ -0,0 +1,239 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// composedParts composes msg and returns its parts keyed by content type
+func composedParts(t *testing.T, msg *smtpclient.OutgoingMessage) (*mail.Reader, map[string][]*mail.Part) {
+	t.Helper()
+
+	client := smtpclient.NewClient(smtpclient.SMTPConfig{Host: "localhost", Port: 25})
+	raw, err := client.Compose(msg)
+	if err != nil {
+		t.Fatalf("Compose() error = %v", err)
+	}
+
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Composed message cannot be parsed: %v", err)
+	}
+
+	parts := make(map[string][]*mail.Part)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read part: %v", err)
+		}
+		contentType, _, _ := p.Header.(interface {
+			ContentType() (string, map[string]string, error)
+		}).ContentType()
+		body, _ := io.ReadAll(p.Body)
+		p.Body = bytes.NewReader(body)
+		parts[contentType] = append(parts[contentType], p)
+	}
+
+	return mr, parts
+}
+
+func TestComposeAttachments(t *testing.T) {
+	large := strings.Repeat("0123456789", 100000)
+
+	_, parts := composedParts(t, &smtpclient.OutgoingMessage{
+		From:    "me@example.com",
+		To:      []string{"you@example.com"},
+		Subject: "Report",
+		Body:    `<p>See the chart: <img src="cid:chart.png"></p>`,
+		Attachments: []smtpclient.Attachment{
+			{Filename: "chart.png", MimeType: "image/png", Inline: true, ContentID: "chart.png", Content: []byte("\x89PNG fake")},
+			{Filename: "data.csv", MimeType: "text/csv", Size: int64(len(large)), Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader(large)), nil
+			}},
+		},
+	})
+
+	inline := parts["image/png"]
+	if len(inline) != 1 {
+		t.Fatalf("Expected one inline image, got %d", len(inline))
+	}
+	if cid := inline[0].Header.Get("Content-ID"); cid != "<chart.png>" {
+		t.Errorf("Expected Content-ID <chart.png>, got %q", cid)
+	}
+	if !strings.HasPrefix(inline[0].Header.Get("Content-Disposition"), "inline") {
+		t.Errorf("Expected inline disposition, got %q", inline[0].Header.Get("Content-Disposition"))
+	}
+
+	csv := parts["text/csv"]
+	if len(csv) != 1 {
+		t.Fatalf("Expected one CSV attachment, got %d", len(csv))
+	}
+	content, _ := io.ReadAll(csv[0].Body)
+	if string(content) != large {
+		t.Errorf("Streamed attachment content differs (%d bytes, want %d)", len(content), len(large))
+	}
+}
+
+func TestComposeRecipientsAndHeaders(t *testing.T) {
+	msg := &smtpclient.OutgoingMessage{
+		From:     `"Me Myself" <me@example.com>`,
+		To:       []string{`"Alice Dupont" <alice@example.com>`, "bob@example.com"},
+		Cc:       []string{"Carol <carol@example.com>", "ALICE@example.com"},
+		Bcc:      []string{"secret@example.com"},
+		ReplyTo:  `"Support" <support@example.com>`,
+		Subject:  "Hello",
+		Body:     "<p>Hi</p>",
+		Priority: smtpclient.PriorityHigh,
+		Headers:  map[string]string{"X-Ticket-Id": "42\r\nBcc: injected@example.com"},
+	}
+
+	mr, _ := composedParts(t, msg)
+
+	to, err := mr.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[0].Name != "Alice Dupont" || to[0].Address != "alice@example.com" {
+		t.Errorf("Unexpected To header: %v (%v)", to, err)
+	}
+	if cc, _ := mr.Header.AddressList("Cc"); len(cc) != 2 || cc[0].Name != "Carol" {
+		t.Errorf("Unexpected Cc header: %v", cc)
+	}
+	if replyTo, _ := mr.Header.AddressList("Reply-To"); len(replyTo) != 1 || replyTo[0].Address != "support@example.com" {
+		t.Errorf("Unexpected Reply-To header: %v", replyTo)
+	}
+	if mr.Header.Has("Bcc") {
+		t.Errorf("Bcc must not be written in the headers, got %q", mr.Header.Get("Bcc"))
+	}
+	if got := mr.Header.Get("X-Priority"); got != "1 (Highest)" {
+		t.Errorf("Expected X-Priority 1 (Highest), got %q", got)
+	}
+	if got := mr.Header.Get("X-Ticket-Id"); !strings.HasPrefix(got, "42") {
+		t.Errorf("Unexpected custom header: %q", got)
+	}
+
+	if sender := msg.Sender(); sender != "me@example.com" {
+		t.Errorf("Expected envelope sender me@example.com, got %q", sender)
+	}
+	want := []string{"alice@example.com", "bob@example.com", "carol@example.com", "secret@example.com"}
+	if got := msg.Recipients(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected envelope recipients %v, got %v", want, got)
+	}
+}
+
+func TestComposeBodies(t *testing.T) {
+	mr, parts := composedParts(t, &smtpclient.OutgoingMessage{
+		From:     "me@example.com",
+		To:       []string{"you@example.com"},
+		Subject:  "Plain",
+		TextBody: "Just text <b>not bold</b>",
+	})
+	if contentType, _, _ := mr.Header.ContentType(); contentType != "text/plain" {
+		t.Errorf("Expected a text/plain message, got %s", contentType)
+	}
+	if len(parts["text/html"]) != 0 {
+		t.Errorf("Plain text message should not have an HTML part")
+	}
+
+	mr, parts = composedParts(t, &smtpclient.OutgoingMessage{
+		From:    "me@example.com",
+		To:      []string{"you@example.com"},
+		Subject: "Rich",
+		Body:    `<p>Hello <a href="https://example.com">there</a></p>`,
+	})
+	if contentType, _, _ := mr.Header.ContentType(); contentType != "multipart/alternative" {
+		t.Errorf("Expected a multipart/alternative message, got %s", contentType)
+	}
+	if len(parts["text/plain"]) != 1 || len(parts["text/html"]) != 1 {
+		t.Fatalf("Expected a text and an HTML part, got %v", parts)
+	}
+	text, _ := io.ReadAll(parts["text/plain"][0].Body)
+	if got := strings.TrimSpace(string(text)); got != "Hello there (https://example.com)" {
+		t.Errorf("Unexpected generated text alternative: %q", got)
+	}
+}
+
+func TestHTMLToText(t *testing.T) {
+	got := smtpclient.HTMLToText(`<html><head><style>p { color: red }</style></head><body>` +
+		`<h1>News</h1><p>Hello   <b>world</b>,<br>visit <a href="https://example.com">our site</a>.</p>` +
+		`<ul><li>one</li><li>two</li></ul>` +
+		`<div>On Monday, alice wrote:</div><blockquote><p>first</p><p>second<br>line</p><blockquote>deeper</blockquote></blockquote>` +
+		`<p>Bye <img alt="logo" src="cid:logo.png"></p></body></html>`)
+
+	want := "News\n\n" +
+		"Hello world,\nvisit our site (https://example.com).\n\n" +
+		"* one\n* two\n\n" +
+		"On Monday, alice wrote:\n\n" +
+		"> first\n>\n> second\n> line\n>\n> > deeper\n\n" +
+		"Bye [logo]\n"
+	if got != want {
+		t.Errorf("HTMLToText() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSendFormHeaders(t *testing.T) {
+	sender, _ := setupOutbox(t)
+	previous, previousAccounts := config.AppConfig.SMTP, config.AppConfig.Accounts
+	defer func() { config.AppConfig.SMTP, config.AppConfig.Accounts = previous, previousAccounts }()
+	config.AppConfig.SMTP.Username = "account@example.com"
+	config.AppConfig.SMTP.AllowedHeaders = []string{"X-Campaign", "X-Ticket"}
+	config.AppConfig.Accounts.SharedAccount = true
+	createUser(t, "alice", "password1")
+	client := newAPIClient(t, newAuthServer(t))
+	client.signIn("alice", "password1")
+
+	send := func(fields map[string]string) (int, string) {
+		t.Helper()
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("to", "bob@example.com")
+		form.WriteField("subject", "Hello")
+		form.WriteField("body", "Hi")
+		for name, value := range fields {
+			form.WriteField(name, value)
+		}
+		form.Close()
+
+		req, _ := http.NewRequest(http.MethodPost, client.url+"/api/email/send", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		resp, err := client.client.Do(req)
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	if status, body := send(map[string]string{"headers": `{"x-campaign":"spring"}`, "headers[X-Ticket]": "42"}); status != http.StatusOK {
+		t.Fatalf("Send = %d %s", status, body)
+	}
+	if len(sender.sent) != 1 {
+		t.Fatalf("Expected one sent message, got %d", len(sender.sent))
+	}
+	raw := string(sender.sent[0])
+	if !strings.Contains(raw, "X-Campaign: spring\r\n") || !strings.Contains(raw, "X-Ticket: 42\r\n") {
+		t.Errorf("Form headers missing from the sent message:\n%s", raw)
+	}
+
+	for _, fields := range []map[string]string{
+		{"headers": `{"X-Mailer":"spoofed"}`},
+		{"headers[Bcc]": "eve@example.com"},
+		{"headers": "X-Campaign: spring"},
+	} {
+		if status, body := send(fields); status != http.StatusBadRequest {
+			t.Errorf("Send with %v = %d %s, want 400", fields, status, body)
+		}
+	}
+	if len(sender.sent) != 1 {
+		t.Errorf("Rejected requests must not be sent, got %d messages", len(sender.sent))
+	}
+}
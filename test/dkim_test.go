@@ -0,0 +1,198 @@
+package test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/outbox"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// writeKey stores a PEM encoded private key in a temporary file
+func writeKey(t *testing.T, block *pem.Block) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dkim.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDKIMSigning(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.AppConfig.DKIM = map[string]config.DKIMConfig{
+		"example.com": {Selector: "mail", PrivateKey: writeKey(t, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})},
+		"example.org": {Selector: "ed", PrivateKey: writeKey(t, &pem.Block{Type: "PRIVATE KEY", Bytes: edDER})},
+	}
+	defer func() { config.AppConfig.DKIM = nil }()
+
+	if err := smtpclient.LoadDKIMKeys(); err != nil {
+		t.Fatalf("LoadDKIMKeys() error = %v", err)
+	}
+	defer smtpclient.LoadDKIMKeys()
+
+	keys := smtpclient.DKIMKeys()
+	if len(keys) != 2 || keys[0].Domain != "example.com" {
+		t.Fatalf("Unexpected keys %+v", keys)
+	}
+
+	for _, key := range keys {
+		name, value, err := key.DNSRecord()
+		if err != nil {
+			t.Fatalf("DNSRecord() error = %v", err)
+		}
+		if name != key.Selector+"._domainkey."+key.Domain || !strings.HasPrefix(value, "v=DKIM1; k=") {
+			t.Errorf("Unexpected record %s %s", name, value)
+		}
+
+		raw, err := smtpclient.NewClient(smtpclient.SMTPConfig{}).Compose(&smtpclient.OutgoingMessage{
+			From:     "me@" + key.Domain,
+			To:       []string{"you@example.net"},
+			Subject:  "Signed",
+			TextBody: "Hello\n",
+		})
+		if err != nil {
+			t.Fatalf("Compose() error = %v", err)
+		}
+
+		signed, err := key.Sign(raw)
+		if err != nil {
+			t.Fatalf("Sign() error = %v", err)
+		}
+		if !bytes.HasPrefix(signed, []byte("DKIM-Signature:")) || !bytes.HasSuffix(signed, raw[bytes.Index(raw, []byte("\r\n\r\n")):]) {
+			t.Fatalf("Signature must be prepended to the unchanged message:\n%s", signed)
+		}
+
+		verifications, err := dkim.VerifyWithOptions(bytes.NewReader(signed), &dkim.VerifyOptions{
+			LookupTXT: func(domain string) ([]string, error) {
+				if domain != name {
+					t.Errorf("Unexpected lookup of %s", domain)
+				}
+				return []string{value}, nil
+			},
+		})
+		if err != nil || len(verifications) != 1 || verifications[0].Err != nil || verifications[0].Domain != key.Domain {
+			t.Errorf("%s: signature does not verify: %+v, %v", key.Domain, verifications, err)
+		}
+	}
+
+	config.AppConfig.DKIM["example.net"] = config.DKIMConfig{Selector: "broken", PrivateKey: writeKey(t, &pem.Block{Type: "PUBLIC KEY", Bytes: []byte("x")})}
+	if err := smtpclient.LoadDKIMKeys(); err == nil {
+		t.Errorf("Invalid keys should be reported")
+	}
+}
+
+func TestSpoolSigning(t *testing.T) {
+	sender, saved := setupOutbox(t)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &smtpclient.DKIMKey{Domain: "example.com", Selector: "mail", Signer: edKey}
+	name, value, err := key.DNSRecord()
+	if err != nil {
+		t.Fatalf("DNSRecord() error = %v", err)
+	}
+	client := smtpclient.NewClient(smtpclient.SMTPConfig{DKIM: map[string]*smtpclient.DKIMKey{"example.com": key}})
+	sender.signer = client
+
+	verify := func(raw []byte) {
+		t.Helper()
+		if n := bytes.Count(raw, []byte("DKIM-Signature:")); n != 1 {
+			t.Fatalf("Expected one signature, got %d", n)
+		}
+		verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{
+			LookupTXT: func(domain string) ([]string, error) {
+				if domain != name {
+					t.Errorf("Unexpected lookup of %s", domain)
+				}
+				return []string{value}, nil
+			},
+		})
+		if err != nil || len(verifications) != 1 || verifications[0].Err != nil {
+			t.Errorf("Signature does not verify: %+v, %v", verifications, err)
+		}
+	}
+
+	// The message is signed once spooled, its attachment streamed
+	msg := &smtpclient.OutgoingMessage{
+		From:     "me@example.com",
+		To:       []string{"you@example.net"},
+		Subject:  "Later",
+		TextBody: "Hello\n",
+		Attachments: []smtpclient.Attachment{{
+			Filename: "data.bin",
+			MimeType: "application/octet-stream",
+			Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(bytes.Repeat([]byte("x"), 1<<20))), nil
+			},
+		}},
+	}
+	spool, err := outbox.NewSpool()
+	if err != nil {
+		t.Fatalf("NewSpool() error = %v", err)
+	}
+	if err := client.ComposeTo(msg, spool); err != nil {
+		t.Fatalf("ComposeTo() error = %v", err)
+	}
+	spool.Close()
+	if _, err := smtpclient.RewriteSpoolHeader(spool.Path(), "Date", "Mon, 01 Jan 2024 00:00:00 +0000"); err != nil {
+		t.Fatalf("RewriteSpoolHeader() error = %v", err)
+	}
+	size, err := client.SignSpool(msg.Sender(), spool.Path())
+	if err != nil {
+		t.Fatalf("SignSpool() error = %v", err)
+	}
+	signed, _ := os.ReadFile(spool.Path())
+	if len(signed) != size {
+		t.Errorf("SignSpool() = %d, the file has %d bytes", size, len(signed))
+	}
+	verify(signed)
+
+	// A scheduled message is signed again with its new date, and the Sent
+	// copy is the message delivered
+	queued := &db.OutboxMessage{UserID: 1, From: msg.Sender(), Recipients: msg.Recipients(), Subject: msg.Subject, SpoolPath: spool.Path(), Size: size, SaveSent: true}
+	if err := outbox.Schedule(queued, time.Now().Add(time.Hour), ""); err != nil {
+		t.Fatalf("Schedule() error = %v", err)
+	}
+	if _, err := outbox.Reschedule(1, queued.ID, time.Now().Add(-time.Second), ""); err != nil {
+		t.Fatalf("Reschedule() error = %v", err)
+	}
+	outbox.ProcessDue()
+
+	if len(sender.sent) != 1 || len(*saved) != 1 {
+		t.Fatalf("Expected one sent and saved message, got %d and %d", len(sender.sent), len(*saved))
+	}
+	if !bytes.Equal(sender.sent[0], (*saved)[0]) {
+		t.Errorf("The Sent copy differs from the delivered message")
+	}
+	if bytes.Contains(sender.sent[0], []byte("Mon, 01 Jan 2024")) {
+		t.Errorf("The scheduled message was not dated again")
+	}
+	verify(sender.sent[0])
+}
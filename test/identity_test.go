@@ -0,0 +1,204 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/identity"
+	"github.com/lyneq/mailapi/internal/rbac"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+func TestIdentities(t *testing.T) {
+	setupDB(t)
+	previous, previousAccounts := config.AppConfig.SMTP, config.AppConfig.Accounts
+	defer func() { config.AppConfig.SMTP, config.AppConfig.Accounts = previous, previousAccounts }()
+	config.AppConfig.SMTP.Username = "account@example.com"
+	config.AppConfig.SMTP.SenderDomains = nil
+	config.AppConfig.Accounts.SharedAccount = true
+	mailer := setupMailer(t)
+	createUser(t, "alice", "password1")
+
+	if found, err := identity.Resolve(1, 0); err != nil || found != nil {
+		t.Fatalf("Users without identities send from the account address, got %+v, %v", found, err)
+	}
+
+	if err := identity.Save(&db.Identity{UserID: 1, Address: "ceo@elsewhere.com"}); !errors.Is(err, identity.ErrSenderNotAllowed) {
+		t.Errorf("Addresses outside the sender domains must be rejected, got %v", err)
+	}
+
+	support := &db.Identity{UserID: 1, Address: " Support@Example.com", Name: "Support\r\nBcc: x@example.com", TextSignature: "The support team"}
+	if err := identity.Save(support); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if !support.IsDefault || support.Address != "support@example.com" || support.Name != "Support Bcc: x@example.com" {
+		t.Errorf("Unexpected first identity %+v", support)
+	}
+
+	sales := &db.Identity{UserID: 1, Address: "sales@example.com", Name: "Sales"}
+	if err := identity.Save(sales); err != nil || sales.IsDefault {
+		t.Fatalf("Save() = %+v, %v", sales, err)
+	}
+	if err := identity.Save(&db.Identity{UserID: 1, Address: "sales@example.com"}); !errors.Is(err, identity.ErrDuplicate) {
+		t.Errorf("Duplicate addresses must be rejected, got %v", err)
+	}
+
+	// Identities are used once their address is confirmed
+	if _, err := identity.Resolve(1, support.ID); !errors.Is(err, identity.ErrUnverified) {
+		t.Fatalf("Unverified identities must not be used, got %v", err)
+	}
+	for _, unverified := range []*db.Identity{support, sales} {
+		if err := identity.RequestVerification(unverified); err != nil {
+			t.Fatalf("RequestVerification() error = %v", err)
+		}
+		if _, err := identity.Verify(mailer.lastToken(t)); err != nil {
+			t.Fatalf("Verify() error = %v", err)
+		}
+	}
+
+	sales.IsDefault = true
+	sales.Verified = true
+	if err := identity.Save(sales); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if found, err := identity.Resolve(1, 0); err != nil || found.ID != sales.ID {
+		t.Errorf("The new default identity should be used, got %+v, %v", found, err)
+	}
+	if found, _ := identity.Get(1, support.ID); found.IsDefault {
+		t.Errorf("The previous default identity was not unset")
+	}
+
+	if _, err := identity.Resolve(2, support.ID); !errors.Is(err, identity.ErrNotFound) {
+		t.Errorf("Identities of other users must not be usable, got %v", err)
+	}
+	if found, err := identity.Match(1, []string{"Someone <someone@example.net>", "SUPPORT@example.com"}); err != nil || found == nil || found.ID != support.ID {
+		t.Errorf("Match() = %+v, %v", found, err)
+	}
+	if got := identity.From(sales); got != `"Sales" <sales@example.com>` {
+		t.Errorf("From() = %q", got)
+	}
+
+	config.AppConfig.SMTP.SenderDomains = []string{"example.org"}
+	if _, err := identity.Resolve(1, support.ID); !errors.Is(err, identity.ErrSenderNotAllowed) {
+		t.Errorf("Identities outside the current sender domains must be refused, got %v", err)
+	}
+}
+
+func TestIdentityOwnership(t *testing.T) {
+	setupDB(t)
+	previous := config.AppConfig.Accounts
+	defer func() { config.AppConfig.Accounts = previous }()
+	config.AppConfig.Accounts.SharedAccount = false
+	mailer := setupMailer(t)
+	server := newAuthServer(t)
+
+	admin := createUser(t, "admin", "password1")
+	db.DB.Model(admin).Update("role", rbac.RoleAdmin)
+	alice := createUser(t, "alice", "password1")
+	mallory := createUser(t, "mallory", "password1")
+	for _, a := range []*db.MailAccount{newAccount(alice.ID, "alice@example.com"), newAccount(mallory.ID, "mallory@example.com")} {
+		a.EmailVerified = true
+		db.DB.Create(a)
+	}
+
+	// The verified address of the user's own account needs no confirmation
+	own := &db.Identity{UserID: alice.ID, Address: "Alice@example.com"}
+	if err := identity.Save(own); err != nil || !own.Verified {
+		t.Fatalf("Save() = %+v, %v", own, err)
+	}
+
+	// Unverified account addresses prove nothing and block nobody
+	db.DB.Create(newAccount(mallory.ID, "ceo@example.com"))
+	db.DB.Create(newAccount(mallory.ID, "bob@example.com"))
+	spoof := &db.Identity{UserID: mallory.ID, Address: "ceo@example.com"}
+	if err := identity.Save(spoof); err != nil || spoof.Verified {
+		t.Fatalf("Save() = %+v, %v", spoof, err)
+	}
+	if _, err := identity.Resolve(mallory.ID, spoof.ID); !errors.Is(err, identity.ErrUnverified) {
+		t.Errorf("An unverified account address must not prove an identity, got %v", err)
+	}
+	db.DB.Delete(spoof)
+	bob := createUser(t, "bob", "password1")
+	bobAccount := newAccount(bob.ID, "bob@example.com")
+	bobAccount.EmailVerified = true
+	db.DB.Create(bobAccount)
+	bobIdentity := &db.Identity{UserID: bob.ID, Address: "bob@example.com"}
+	if err := identity.Save(bobIdentity); err != nil || !bobIdentity.Verified {
+		t.Fatalf("The account address of another user must not block its owner, got %+v, %v", bobIdentity, err)
+	}
+	if _, err := identity.Resolve(bob.ID, bobIdentity.ID); err != nil {
+		t.Errorf("Resolve() error = %v", err)
+	}
+
+	// Addresses of other users are refused, even within the same domain
+	if err := identity.Save(&db.Identity{UserID: mallory.ID, Address: "alice@example.com"}); !errors.Is(err, identity.ErrAddressTaken) {
+		t.Errorf("The account address of another user must be refused, got %v", err)
+	}
+
+	ceo := &db.Identity{UserID: mallory.ID, Address: "ceo@example.com"}
+	if err := identity.Save(ceo); err != nil || ceo.Verified {
+		t.Fatalf("Save() = %+v, %v", ceo, err)
+	}
+	if _, err := identity.Resolve(mallory.ID, ceo.ID); !errors.Is(err, identity.ErrUnverified) {
+		t.Errorf("An unconfirmed address must not be used, got %v", err)
+	}
+	if err := identity.RequestVerification(ceo); err != nil {
+		t.Fatalf("RequestVerification() error = %v", err)
+	}
+	if mailer.to[len(mailer.to)-1] != "ceo@example.com" {
+		t.Errorf("The verification link must be mailed to the address, got %v", mailer.to)
+	}
+	stale := mailer.lastToken(t)
+
+	// An administrator assigns the address to its actual owner
+	adminClient := newAPIClient(t, server)
+	adminClient.signIn("admin", "password1")
+	status, body := adminClient.do(http.MethodPost, fmt.Sprintf("/api/admin/users/%d/identities", alice.ID), map[string]string{"address": "ceo@example.com", "name": "CEO"})
+	if status != http.StatusCreated || body["verified"] != true {
+		t.Fatalf("Assign = %d %v", status, body)
+	}
+	if status, _ := adminClient.do(http.MethodPost, fmt.Sprintf("/api/admin/users/%d/identities", alice.ID), map[string]string{"address": "mallory@example.com"}); status != http.StatusConflict {
+		t.Errorf("Assigning the address of another user = %d", status)
+	}
+
+	// The confirmation of the other user now fails, and their identity is refused
+	client := newAPIClient(t, server)
+	if status, _ := client.do(http.MethodPost, "/api/verify-identity", map[string]string{"token": stale}); status != http.StatusConflict {
+		t.Errorf("Confirming the address of another user = %d", status)
+	}
+	if _, err := identity.Resolve(mallory.ID, ceo.ID); !errors.Is(err, identity.ErrAddressTaken) {
+		t.Errorf("The address of another user must not be used, got %v", err)
+	}
+
+	// Changing the address of a verified identity requires a new confirmation
+	sales := &db.Identity{UserID: alice.ID, Address: "sales@example.com"}
+	identity.Save(sales)
+	identity.RequestVerification(sales)
+	if status, body := client.do(http.MethodPost, "/api/verify-identity", map[string]string{"token": mailer.lastToken(t)}); status != http.StatusOK || body["address"] != "sales@example.com" {
+		t.Fatalf("Verify identity = %d %v", status, body)
+	}
+	sales, _ = identity.Get(alice.ID, sales.ID)
+	sales.Address = "board@example.com"
+	if err := identity.Save(sales); err != nil || sales.Verified {
+		t.Errorf("A changed address must be confirmed again, got %+v, %v", sales, err)
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	if got := smtpclient.SignText("Hello\n\n", "", "Alice\nExample Inc.\n"); got != "Hello\n\n-- \nAlice\nExample Inc.\n" {
+		t.Errorf("SignText() = %q", got)
+	}
+	if got := smtpclient.SignText("Hello", "<p><b>Alice</b></p>", ""); got != "Hello\n\n-- \nAlice\n" {
+		t.Errorf("SignText() with an HTML signature = %q", got)
+	}
+	if got := smtpclient.SignHTML("<p>Hello</p>", "", "Alice & Bob\nExample"); got != `<p>Hello</p><br><br><div class="signature">-- <br>Alice &amp; Bob<br>Example</div>` {
+		t.Errorf("SignHTML() with a text signature = %q", got)
+	}
+	if got := smtpclient.SignHTML("<p>Hello</p>", "", ""); got != "<p>Hello</p>" {
+		t.Errorf("Bodies without signature must be unchanged, got %q", got)
+	}
+}
@@ -0,0 +1,158 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/lockout"
+	"github.com/lyneq/mailapi/internal/rbac"
+)
+
+// setupLockout sets small sign-in limits for the test
+func setupLockout(t *testing.T, limits config.SignInConfig) {
+	t.Helper()
+	previous := config.AppConfig.SignIn
+	config.AppConfig.SignIn = limits
+	t.Cleanup(func() { config.AppConfig.SignIn = previous })
+}
+
+func TestSignInDelays(t *testing.T) {
+	setupDB(t)
+	setupLockout(t, config.SignInConfig{MaxAttempts: 4, IPMaxAttempts: 3, Delay: 10 * time.Second, Lockout: time.Minute})
+
+	// The first failure is free, the next ones wait longer each time
+	lockout.Fail("bob", "10.0.0.1")
+	if wait, err := lockout.Check("bob", "10.0.0.9"); err != nil || wait != 0 {
+		t.Fatalf("Wait after one failure = %v %v", wait, err)
+	}
+	lockout.Fail("bob", "10.0.0.2")
+	if wait, _ := lockout.Check("bob", "10.0.0.9"); wait <= 0 || wait > 10*time.Second {
+		t.Errorf("Wait after two failures = %v", wait)
+	}
+	lockout.Fail("bob", "10.0.0.3")
+	if wait, _ := lockout.Check("bob", "10.0.0.9"); wait <= 10*time.Second || wait > 20*time.Second {
+		t.Errorf("Wait after three failures = %v", wait)
+	}
+	lockout.Fail("bob", "10.0.0.4")
+	if wait, _ := lockout.Check("bob", "10.0.0.9"); wait <= 50*time.Second {
+		t.Errorf("Wait after the lockout = %v", wait)
+	}
+	lockout.Reset("bob")
+	if wait, _ := lockout.Check("bob", "10.0.0.9"); wait != 0 {
+		t.Errorf("Wait after a reset = %v", wait)
+	}
+
+	// An IP address is locked out for every username
+	for i := 0; i < 3; i++ {
+		lockout.Fail(fmt.Sprintf("user%d", i), "10.0.1.1")
+	}
+	if wait, _ := lockout.Check("carol", "10.0.1.1"); wait <= 0 {
+		t.Error("The IP address must be locked out")
+	}
+	if wait, _ := lockout.Check("carol", "10.0.1.2"); wait != 0 {
+		t.Errorf("Other IP addresses must not wait, got %v", wait)
+	}
+
+	// Stale failures are forgotten
+	db.DB.Model(&db.SignInThrottle{}).Where("value = ?", "10.0.1.1").
+		Updates(map[string]interface{}{"locked_until": time.Now().Add(-time.Second), "last_failure_at": time.Now().Add(-2 * time.Minute)})
+	if wait, _ := lockout.Check("carol", "10.0.1.1"); wait != 0 {
+		t.Errorf("An expired lockout must not wait, got %v", wait)
+	}
+	lockout.Fail("user0", "10.0.1.1")
+	var throttle db.SignInThrottle
+	db.DB.Where("kind = ? AND value = ?", db.ThrottleIP, "10.0.1.1").First(&throttle)
+	if throttle.Failures != 1 || throttle.LockedUntil != nil {
+		t.Errorf("Failures after an expired lockout = %d, locked until %v", throttle.Failures, throttle.LockedUntil)
+	}
+}
+
+func TestSignInLockout(t *testing.T) {
+	setupDB(t)
+	setupLockout(t, config.SignInConfig{MaxAttempts: 3, IPMaxAttempts: 100, Lockout: time.Minute})
+	server := newAuthServer(t)
+	admin := createUser(t, "admin", "password1")
+	db.DB.Model(admin).Update("role", rbac.RoleAdmin)
+	alice := createUser(t, "alice", "password1")
+
+	client := newAPIClient(t, server)
+	for i := 0; i < 3; i++ {
+		if status, _ := client.do(http.MethodPost, "/api/signin", map[string]string{"username": "alice", "password": "wrong"}); status != http.StatusUnauthorized {
+			t.Fatalf("Wrong password %d = %d", i, status)
+		}
+	}
+	status, body := client.do(http.MethodPost, "/api/signin", map[string]string{"username": "alice", "password": "password1"})
+	if status != http.StatusTooManyRequests || body["retry_after"] == nil {
+		t.Fatalf("A locked out user must wait, got %d %v", status, body)
+	}
+
+	// Unknown usernames are locked out alike
+	for i := 0; i < 3; i++ {
+		client.do(http.MethodPost, "/api/signin", map[string]string{"username": "ghost", "password": "wrong"})
+	}
+	if status, _ := client.do(http.MethodPost, "/api/signin", map[string]string{"username": "ghost", "password": "wrong"}); status != http.StatusTooManyRequests {
+		t.Errorf("An unknown username must be locked out, got %d", status)
+	}
+
+	adminClient := newAPIClient(t, server)
+	adminClient.signIn("admin", "password1")
+	status, body = adminClient.do(http.MethodGet, "/api/admin/lockouts", nil)
+	if list, _ := body["lockouts"].([]interface{}); status != http.StatusOK || len(list) != 3 {
+		t.Fatalf("Lockouts = %d %v", status, body)
+	}
+
+	if status, body := adminClient.do(http.MethodPost, fmt.Sprintf("/api/admin/users/%d/unlock", alice.ID), nil); status != http.StatusOK {
+		t.Fatalf("Unlock = %d %v", status, body)
+	}
+	client.signIn("alice", "password1")
+
+	var ghost db.SignInThrottle
+	db.DB.Where("kind = ? AND value = ?", db.ThrottleUsername, "ghost").First(&ghost)
+	if status, _ := adminClient.do(http.MethodDelete, fmt.Sprintf("/api/admin/lockouts/%d", ghost.ID), nil); status != http.StatusOK {
+		t.Errorf("Delete lockout = %d", status)
+	}
+	if status, _ := adminClient.do(http.MethodDelete, fmt.Sprintf("/api/admin/lockouts/%d", ghost.ID), nil); status != http.StatusNotFound {
+		t.Errorf("Deleting a missing lockout = %d", status)
+	}
+	if status, _ := client.do(http.MethodPost, "/api/signin", map[string]string{"username": "ghost", "password": "wrong"}); status != http.StatusUnauthorized {
+		t.Errorf("An unlocked username must sign in again, got %d", status)
+	}
+}
+
+func TestParallelSignIns(t *testing.T) {
+	setupDB(t)
+	setupLockout(t, config.SignInConfig{MaxAttempts: 3, IPMaxAttempts: 100, Lockout: time.Minute})
+	server := newAuthServer(t)
+	createUser(t, "alice", "password1")
+
+	// Attempts sent at once are checked one after the other
+	statuses := make(chan int, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(statuses); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, _ := newAPIClient(t, server).do(http.MethodPost, "/api/signin", map[string]string{"username": "alice", "password": "wrong"})
+			statuses <- status
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	guesses := 0
+	for status := range statuses {
+		if status == http.StatusUnauthorized {
+			guesses++
+		} else if status != http.StatusTooManyRequests {
+			t.Errorf("Unexpected status %d", status)
+		}
+	}
+	if guesses != 3 {
+		t.Errorf("Expected the limit of 3 password checks, got %d", guesses)
+	}
+}
@@ -0,0 +1,202 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/lyneq/mailapi/internal/mailauth"
+)
+
+// fakeResolver serves TXT records from memory so DKIM and DMARC can be checked offline
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(name string) ([]string, error) {
+	if records, ok := r[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+const unsignedMessage = "From: Bank <support@bank.example>\r\n" +
+	"To: user@example.com\r\n" +
+	"Subject: Your account\r\n" +
+	"Date: Mon, 4 Mar 2024 10:00:00 +0000\r\n" +
+	"\r\n" +
+	"Please confirm your details.\r\n"
+
+func signedMessage(t *testing.T) ([]byte, fakeResolver) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	var signed bytes.Buffer
+	err = dkim.Sign(&signed, strings.NewReader(unsignedMessage), &dkim.SignOptions{
+		Domain:   "bank.example",
+		Selector: "mail",
+		Signer:   key,
+	})
+	if err != nil {
+		t.Fatalf("Failed to sign message: %v", err)
+	}
+
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	resolver := fakeResolver{
+		"mail._domainkey.bank.example": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)},
+		"_dmarc.bank.example":          {"v=DMARC1; p=reject"},
+	}
+
+	return signed.Bytes(), resolver
+}
+
+func TestAnalyzeValidDKIM(t *testing.T) {
+	raw, resolver := signedMessage(t)
+
+	report := mailauth.Analyze(raw, resolver)
+
+	if report.DKIM.Result != mailauth.ResultPass || report.DKIM.Source != mailauth.SourceLocal || report.DKIM.Domain != "bank.example" {
+		t.Errorf("Unexpected DKIM verdict: %+v", report.DKIM)
+	}
+	if report.DMARC.Result != mailauth.ResultPass {
+		t.Errorf("Expected aligned DKIM to pass DMARC, got %+v", report.DMARC)
+	}
+	if len(report.Warnings) != 0 {
+		t.Errorf("Expected no warnings, got %v", report.Warnings)
+	}
+}
+
+func TestAnalyzeTamperedMessage(t *testing.T) {
+	raw, resolver := signedMessage(t)
+	raw = bytes.Replace(raw, []byte("confirm your details"), []byte("send us your password"), 1)
+
+	report := mailauth.Analyze(raw, resolver)
+
+	if report.DKIM.Result != mailauth.ResultFail {
+		t.Errorf("Expected DKIM fail, got %+v", report.DKIM)
+	}
+	if report.DMARC.Result != mailauth.ResultFail || report.DMARC.Reason != "policy=reject" {
+		t.Errorf("Expected DMARC fail with reject policy, got %+v", report.DMARC)
+	}
+	if len(report.Warnings) != 2 {
+		t.Errorf("Expected DKIM and DMARC warnings, got %v", report.Warnings)
+	}
+}
+
+func TestAnalyzeHeadersAndReplyTo(t *testing.T) {
+	raw := "Authentication-Results: mx.example.com; spf=softfail smtp.mailfrom=attacker.example; dkim=none; dmarc=fail header.from=bank.example\r\n" +
+		"Authentication-Results: mx.example.com; spf=pass; dkim=pass; dmarc=pass\r\n" +
+		"Received-SPF: pass (forged) envelope-from=\"support@bank.example\";\r\n" +
+		"Reply-To: support@attacker.example\r\n" +
+		unsignedMessage
+
+	report := mailauth.Analyze([]byte(raw), fakeResolver{})
+
+	if report.SPF.Result != mailauth.ResultSoftFail || report.SPF.Domain != "attacker.example" || report.SPF.Source != mailauth.SourceHeader {
+		t.Errorf("Expected the topmost SPF verdict, got %+v", report.SPF)
+	}
+	if report.DMARC.Result != mailauth.ResultFail || report.DMARC.Source != mailauth.SourceHeader {
+		t.Errorf("Unexpected DMARC verdict: %+v", report.DMARC)
+	}
+	if report.ReplyToDomain != "attacker.example" || report.FromDomain != "bank.example" {
+		t.Errorf("Unexpected domains: from=%s reply-to=%s", report.FromDomain, report.ReplyToDomain)
+	}
+
+	found := false
+	for _, warning := range report.Warnings {
+		if strings.Contains(warning, "attacker.example") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected a Reply-To warning, got %v", report.Warnings)
+	}
+}
+
+func TestAnalyzeReceivedSPF(t *testing.T) {
+	raw := "Received-SPF: Pass (mx.example.com: domain designates 192.0.2.1 as permitted sender) envelope-from=\"support@bank.example\"; client-ip=192.0.2.1;\r\n" + unsignedMessage
+
+	report := mailauth.Analyze([]byte(raw), fakeResolver{"_dmarc.bank.example": {"v=DMARC1; p=none"}})
+
+	if report.SPF.Result != mailauth.ResultPass || report.SPF.Domain != "bank.example" {
+		t.Errorf("Unexpected SPF verdict: %+v", report.SPF)
+	}
+	if report.DMARC.Result != mailauth.ResultPass {
+		t.Errorf("Expected aligned SPF to pass DMARC, got %+v", report.DMARC)
+	}
+	if report.DKIM.Result != mailauth.ResultNone {
+		t.Errorf("Expected no DKIM result, got %+v", report.DKIM)
+	}
+}
+
+// hangingResolver answers like fakeResolver once released, and counts its lookups
+type hangingResolver struct {
+	fakeResolver
+	release chan struct{}
+	lookups int
+}
+
+func (r *hangingResolver) LookupTXT(name string) ([]string, error) {
+	return r.LookupTXTContext(context.Background(), name)
+}
+
+func (r *hangingResolver) LookupTXTContext(ctx context.Context, name string) ([]string, error) {
+	r.lookups++
+	select {
+	case <-r.release:
+		return r.fakeResolver.LookupTXT(name)
+	case <-ctx.Done():
+		return nil, &net.DNSError{Err: ctx.Err().Error(), Name: name, IsTimeout: true, IsTemporary: true}
+	}
+}
+
+func TestAnalyzeTimeout(t *testing.T) {
+	raw, records := signedMessage(t)
+	resolver := &hangingResolver{fakeResolver: records, release: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	report := mailauth.AnalyzeContext(ctx, raw, resolver)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Analysis must end with its context, took %v", elapsed)
+	}
+	if report.DKIM.Result != mailauth.ResultTempError || report.DMARC.Result != mailauth.ResultTempError {
+		t.Errorf("Unfinished lookups must be temporary errors, got DKIM %+v DMARC %+v", report.DKIM, report.DMARC)
+	}
+}
+
+func TestAnalyzeCached(t *testing.T) {
+	raw, records := signedMessage(t)
+	resolver := &hangingResolver{fakeResolver: records, release: make(chan struct{})}
+	previous := mailauth.DefaultResolver
+	mailauth.DefaultResolver = resolver
+	defer func() { mailauth.DefaultResolver = previous }()
+
+	// Temporary errors are not kept
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if report := mailauth.AnalyzeCached(ctx, raw); report.DKIM.Result != mailauth.ResultTempError {
+		t.Fatalf("Expected a temporary error, got %+v", report.DKIM)
+	}
+
+	close(resolver.release)
+	first := mailauth.AnalyzeCached(context.Background(), raw)
+	if first.DKIM.Result != mailauth.ResultPass {
+		t.Fatalf("Expected DKIM to pass once DNS answers, got %+v", first.DKIM)
+	}
+	lookups := resolver.lookups
+	if again := mailauth.AnalyzeCached(context.Background(), raw); again.DKIM.Result != mailauth.ResultPass || resolver.lookups != lookups {
+		t.Errorf("The report of an analyzed message must be reused, %d more lookups", resolver.lookups-lookups)
+	}
+}
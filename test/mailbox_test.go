@@ -0,0 +1,117 @@
+package test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lyneq/mailapi/internal/mailbox"
+)
+
+const sampleMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"First line\r\n" +
+	"From the body, not a separator\r\n" +
+	">From an already quoted line\r\n"
+
+func TestMboxRoundTrip(t *testing.T) {
+	date := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	mw := mailbox.NewMboxWriter(&buf)
+	if err := mw.Write(mailbox.Message{Raw: []byte(sampleMessage), Flags: []string{`\Seen`, `\Flagged`}, Date: date}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := mw.Write(mailbox.Message{Raw: []byte(sampleMessage), Date: date}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	if !strings.HasPrefix(buf.String(), "From alice@example.com Fri Mar  1 10:30:00 2024\n") {
+		t.Errorf("Unexpected separator line: %q", strings.SplitN(buf.String(), "\n", 2)[0])
+	}
+	if !strings.Contains(buf.String(), "\n>From the body") || !strings.Contains(buf.String(), "\n>>From an already") {
+		t.Errorf("Body From lines were not quoted:\n%s", buf.String())
+	}
+
+	var messages []mailbox.Message
+	err := mailbox.ReadMbox(&buf, func(msg mailbox.Message) error {
+		messages = append(messages, msg)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadMbox() error = %v", err)
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+
+	for _, msg := range messages {
+		if string(msg.Raw) != sampleMessage {
+			t.Errorf("Message content changed:\n%q\nwant\n%q", msg.Raw, sampleMessage)
+		}
+		if !msg.Date.Equal(date) {
+			t.Errorf("Expected date %v, got %v", date, msg.Date)
+		}
+	}
+
+	if len(messages[0].Flags) != 2 || messages[0].Flags[0] != `\Seen` || messages[0].Flags[1] != `\Flagged` {
+		t.Errorf("Unexpected flags on first message: %v", messages[0].Flags)
+	}
+	if len(messages[1].Flags) != 0 {
+		t.Errorf("Expected no flags on second message, got %v", messages[1].Flags)
+	}
+}
+
+func TestMaildirRoundTrip(t *testing.T) {
+	date := time.Date(2023, 12, 24, 18, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	mw := mailbox.NewMaildirWriter(&buf)
+	if err := mw.Write("Archive/2023", mailbox.Message{Raw: []byte(sampleMessage), Flags: []string{`\Seen`, `\Answered`}, Date: date}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := mw.AddFolder("Empty"); err != nil {
+		t.Fatalf("AddFolder() error = %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.zip")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+
+	var folders []string
+	var messages []mailbox.Message
+	err := mailbox.ReadSource(mailbox.Source{Path: path, Filename: "backup.zip"}, func(folder string, msg mailbox.Message) error {
+		folders = append(folders, folder)
+		messages = append(messages, msg)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadSource() error = %v", err)
+	}
+
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(messages))
+	}
+	if folders[0] != "Archive/2023" {
+		t.Errorf("Expected folder Archive/2023, got %s", folders[0])
+	}
+	if !messages[0].Date.Equal(date) {
+		t.Errorf("Expected date %v, got %v", date, messages[0].Date)
+	}
+	if len(messages[0].Flags) != 2 || messages[0].Flags[0] != `\Answered` || messages[0].Flags[1] != `\Seen` {
+		t.Errorf("Unexpected flags: %v", messages[0].Flags)
+	}
+	if strings.ReplaceAll(string(messages[0].Raw), "\n", "\r\n") != sampleMessage {
+		t.Errorf("Message content changed: %q", messages[0].Raw)
+	}
+}
@@ -0,0 +1,329 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/account"
+	"github.com/lyneq/mailapi/internal/oauth"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// standInProvider is a local OAuth 2.0 token endpoint. It grants the code
+// "granted" to the PKCE challenge it was told about, and rotates refresh
+// tokens on every refresh.
+type standInProvider struct {
+	server    *httptest.Server
+	challenge string
+	expiresIn int
+	refreshes atomic.Int32
+	revoked   atomic.Bool
+}
+
+func startStandInProvider(t *testing.T) *standInProvider {
+	t.Helper()
+	provider := &standInProvider{expiresIn: 3600}
+	provider.server = httptest.NewServer(http.HandlerFunc(provider.token))
+	t.Cleanup(provider.server.Close)
+
+	previous := config.AppConfig.OAuth
+	t.Cleanup(func() { config.AppConfig.OAuth = previous })
+	config.AppConfig.OAuth = map[string]config.OAuthConfig{
+		"standin": {
+			ClientID:    "client",
+			AuthURL:     provider.server.URL + "/authorize",
+			TokenURL:    provider.server.URL + "/token",
+			RedirectURL: "http://localhost/api/oauth/callback",
+			Scopes:      []string{"mail"},
+		},
+	}
+	return provider
+}
+
+func (p *standInProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	if r.PostForm.Get("client_id") != "client" {
+		fail("invalid_client")
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		if r.PostForm.Get("code") != "granted" || oauth.Challenge(r.PostForm.Get("code_verifier")) != p.challenge {
+			fail("invalid_grant")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access-0", "refresh_token": "refresh-0", "expires_in": p.expiresIn,
+		})
+	case "refresh_token":
+		if p.revoked.Load() || !strings.HasPrefix(r.PostForm.Get("refresh_token"), "refresh-") {
+			fail("invalid_grant")
+			return
+		}
+		// Slow enough for concurrent callers to pile up
+		time.Sleep(10 * time.Millisecond)
+		n := p.refreshes.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access-" + string(rune('0'+n)), "refresh_token": "refresh-" + string(rune('0'+n)), "expires_in": p.expiresIn,
+		})
+	default:
+		fail("unsupported_grant_type")
+	}
+}
+
+func TestOAuthAuthorizationCode(t *testing.T) {
+	standIn := startStandInProvider(t)
+
+	if _, err := oauth.Get("unknown"); !errors.Is(err, oauth.ErrUnknownProvider) {
+		t.Errorf("Get() of an unconfigured provider = %v", err)
+	}
+	provider, err := oauth.Get("StandIn")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	verifier := oauth.NewVerifier()
+	authURL, err := url.Parse(provider.AuthCodeURL("some-state", verifier, "me@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authURL.Query()
+	if query.Get("state") != "some-state" || query.Get("code_challenge_method") != "S256" ||
+		query.Get("redirect_uri") != "http://localhost/api/oauth/callback" || query.Get("login_hint") != "me@example.com" {
+		t.Errorf("Unexpected authorization URL %s", authURL)
+	}
+	standIn.challenge = query.Get("code_challenge")
+
+	if _, err := provider.Exchange("granted", oauth.NewVerifier()); !oauth.IsRevoked(err) {
+		t.Errorf("A code must not be exchanged with another verifier, got %v", err)
+	}
+	token, err := provider.Exchange("granted", verifier)
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if token.AccessToken != "access-0" || token.RefreshToken != "refresh-0" || time.Until(token.Expiry) < 59*time.Minute {
+		t.Errorf("Unexpected token %+v", token)
+	}
+}
+
+func TestOAuthRefresh(t *testing.T) {
+	setupDB(t)
+	setupAccountKey(t)
+	standIn := startStandInProvider(t)
+
+	mailbox := newAccount(1, "me@example.com")
+	mailbox.AuthMethod = account.AuthOAuth2
+	mailbox.OAuthProvider = "standin"
+	if err := account.Save(mailbox, account.Credentials{}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if _, err := account.AccessToken(mailbox.ID); !errors.Is(err, account.ErrNotAuthorized) {
+		t.Errorf("AccessToken() before authorization = %v", err)
+	}
+
+	// An access token about to expire is refreshed once by concurrent callers
+	err := account.SaveTokens(mailbox, &oauth.Token{AccessToken: "access-0", RefreshToken: "refresh-0", Expiry: time.Now().Add(30 * time.Second)})
+	if err != nil {
+		t.Fatalf("SaveTokens() error = %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := account.AccessToken(mailbox.ID); err != nil || token != "access-1" {
+				t.Errorf("AccessToken() = %q, %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if standIn.refreshes.Load() != 1 {
+		t.Errorf("Expected a single refresh, got %d", standIn.refreshes.Load())
+	}
+
+	var stored db.MailAccount
+	db.DB.First(&stored, mailbox.ID)
+	if refresh, _ := account.Decrypt(stored.OAuthRefreshToken); refresh != "refresh-1" || strings.Contains(stored.OAuthAccessToken, "access") {
+		t.Errorf("The rotated tokens must be stored encrypted, got %+v", stored)
+	}
+
+	// A revoked grant requires a new authorization
+	db.DB.Model(&stored).Update("oauth_expiry", time.Now())
+	standIn.revoked.Store(true)
+	if _, err := account.AccessToken(mailbox.ID); !errors.Is(err, account.ErrNotAuthorized) {
+		t.Errorf("AccessToken() after revocation = %v", err)
+	}
+	var cleared db.MailAccount
+	db.DB.First(&cleared, mailbox.ID)
+	if cleared.OAuthRefreshToken != "" || cleared.OAuthAuthorizedAt != nil {
+		t.Errorf("A revoked refresh token must be forgotten")
+	}
+}
+
+func TestSMTPOAuth(t *testing.T) {
+	for _, mechanisms := range []string{"XOAUTH2", "PLAIN XOAUTH2 OAUTHBEARER"} {
+		server := startFakeSMTPServer(t)
+		server.bearer = "secret-token"
+		server.mechanisms = mechanisms
+
+		// Clients without account never share a connection authenticated by a token
+		send := func(username, token string) error {
+			client := smtpclient.NewClient(smtpclient.SMTPConfig{
+				Host:     "127.0.0.1",
+				Port:     server.listener.Addr().(*net.TCPAddr).Port,
+				Username: username,
+				TLS:      config.TLSConfig{Mode: smtpclient.TLSNone},
+				TokenSource: func() (string, error) {
+					return token, nil
+				},
+			})
+			defer client.Close()
+			return client.SendRaw("me@example.com", []string{"you@example.com"}, rawMessage)
+		}
+
+		if err := send("wrong@example.com", "wrong-token"); err == nil {
+			t.Errorf("%s: a rejected token must fail", mechanisms)
+		}
+		if err := send("me@example.com", "secret-token"); err != nil {
+			t.Fatalf("%s: SendRaw() error = %v", mechanisms, err)
+		}
+		want := "XOAUTH2"
+		if strings.Contains(mechanisms, "OAUTHBEARER") {
+			want = "OAUTHBEARER"
+		}
+		if got, _ := server.authenticated.Load().(string); got != want || server.messages.Load() != 1 {
+			t.Errorf("%s: authenticated with %q, %d messages", mechanisms, got, server.messages.Load())
+		}
+	}
+}
+
+func TestSMTPOAuthAccounts(t *testing.T) {
+	server := startFakeSMTPServer(t)
+	server.bearer = "victim-token"
+	server.mechanisms = "XOAUTH2"
+
+	// Two accounts with the same username but different tokens
+	client := func(accountID uint, token string) *smtpclient.Client {
+		return smtpclient.NewClient(smtpclient.SMTPConfig{
+			Host:      "127.0.0.1",
+			Port:      server.listener.Addr().(*net.TCPAddr).Port,
+			Username:  "shared@example.com",
+			TLS:       config.TLSConfig{Mode: smtpclient.TLSNone},
+			AccountID: accountID,
+			TokenSource: func() (string, error) {
+				return token, nil
+			},
+		})
+	}
+	send := func(c *smtpclient.Client) error {
+		return c.SendRaw("me@example.com", []string{"you@example.com"}, rawMessage)
+	}
+	defer smtpclient.CloseAccount(201)
+	defer smtpclient.CloseAccount(202)
+
+	if err := send(client(201, "victim-token")); err != nil {
+		t.Fatalf("The owner of the token must send, got %v", err)
+	}
+	attacker := client(202, "attacker-token")
+	if err := send(attacker); err == nil {
+		t.Error("A client with an invalid token must not send over the session of another account")
+	}
+	attacker.Close()
+	if err := send(attacker); err == nil {
+		t.Error("A client with an invalid token must not reconnect with the token of another account")
+	}
+	if err := send(client(201, "victim-token")); err != nil {
+		t.Errorf("The owner must keep sending with their token, got %v", err)
+	}
+	if server.messages.Load() != 2 {
+		t.Errorf("Expected the 2 messages of the owner, got %d", server.messages.Load())
+	}
+
+	// Without accounts, clients with tokens get their own connections
+	for _, token := range []string{"victim-token", "attacker-token"} {
+		c := smtpclient.NewClient(smtpclient.SMTPConfig{
+			Host:        "127.0.0.1",
+			Port:        server.listener.Addr().(*net.TCPAddr).Port,
+			Username:    "shared@example.com",
+			TLS:         config.TLSConfig{Mode: smtpclient.TLSNone},
+			TokenSource: func() (string, error) { return token, nil },
+		})
+		err := send(c)
+		c.Close()
+		if (err == nil) != (token == "victim-token") {
+			t.Errorf("Token %s: SendRaw() error = %v", token, err)
+		}
+	}
+}
+
+func TestIMAPOAuth(t *testing.T) {
+	backend := memory.New()
+	imapServer := server.New(backend)
+	imapServer.AllowInsecureAuth = true
+	imapServer.EnableAuth(sasl.OAuthBearer, func(conn server.Conn) sasl.Server {
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			if opts.Token != "secret-token" || opts.Username != "username" {
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			user, err := backend.Login(conn.Info(), "username", "password")
+			if err != nil {
+				return &sasl.OAuthBearerError{Status: "invalid_request"}
+			}
+			conn.Context().State = imap.AuthenticatedState
+			conn.Context().User = user
+			return nil
+		})
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go imapServer.Serve(listener)
+	t.Cleanup(func() { imapServer.Close() })
+
+	connect := func(token string) error {
+		client := smtpclient.NewIMAPClient(smtpclient.IMAPConfig{
+			Host:     "127.0.0.1",
+			Port:     listener.Addr().(*net.TCPAddr).Port,
+			Username: "username",
+			TLS:      config.TLSConfig{Mode: smtpclient.TLSNone},
+			TokenSource: func() (string, error) {
+				return token, nil
+			},
+		})
+		if err := client.Connect(); err != nil {
+			return err
+		}
+		defer client.Disconnect()
+		_, err := client.GetFolders()
+		return err
+	}
+
+	if err := connect("wrong-token"); err == nil {
+		t.Errorf("A rejected token must fail")
+	}
+	if err := connect("secret-token"); err != nil {
+		t.Errorf("Connect() error = %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+package test
+
+import (
+	"errors"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/outbox"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+	"gorm.io/gorm"
+)
+
+// setupDB points the db package at a fresh SQLite database
+func setupDB(t *testing.T) {
+	t.Helper()
+	config.AppConfig.Database.Path = filepath.Join(t.TempDir(), "test.db")
+	db.Init()
+}
+
+// fakeSender records submitted messages and fails with the queued errors
+type fakeSender struct {
+	errs []error
+	sent [][]byte
+	// onSend runs after each successful submission
+	onSend func()
+	// signer signs spooled messages when set
+	signer *smtpclient.Client
+}
+
+func (s *fakeSender) SignSpool(from, path string) (int, error) {
+	if s.signer != nil {
+		return s.signer.SignSpool(from, path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return int(info.Size()), nil
+}
+
+func (s *fakeSender) SendReader(from string, to []string, r io.Reader) error {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	s.sent = append(s.sent, raw)
+	if s.onSend != nil {
+		s.onSend()
+	}
+	return nil
+}
+
+func setupOutbox(t *testing.T, errs ...error) (*fakeSender, *[][]byte) {
+	t.Helper()
+	setupDB(t)
+	config.AppConfig.Outbox = config.OutboxConfig{MaxAttempts: 3, RetryDelay: time.Minute, PollInterval: time.Second}
+
+	sender := &fakeSender{errs: errs}
+	outbox.SetSender(sender)
+
+	var saved [][]byte
+	outbox.SetSentSaver(func(raw []byte) error {
+		saved = append(saved, raw)
+		return nil
+	})
+
+	return sender, &saved
+}
+
+// spooled writes raw to a spool file and attaches it to msg
+func spooled(t *testing.T, msg *db.OutboxMessage, raw string) *db.OutboxMessage {
+	t.Helper()
+	spool, err := outbox.NewSpool()
+	if err != nil {
+		t.Fatalf("NewSpool() error = %v", err)
+	}
+	if _, err := spool.Write([]byte(raw)); err != nil {
+		t.Fatalf("Spool Write() error = %v", err)
+	}
+	spool.Close()
+	msg.SpoolPath, msg.Size = spool.Path(), spool.Len()
+	return msg
+}
+
+func enqueue(t *testing.T, userID uint) *db.OutboxMessage {
+	t.Helper()
+	msg := spooled(t, &db.OutboxMessage{
+		UserID:     userID,
+		From:       "me@example.com",
+		Recipients: []string{"you@example.com", "other@example.com"},
+		Subject:    "Hello",
+		SaveSent:   true,
+	}, "Subject: Hello\r\n\r\nHi\r\n")
+	if err := outbox.Enqueue(msg); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	return msg
+}
+
+func TestOutboxDelivery(t *testing.T) {
+	sender, saved := setupOutbox(t)
+	msg := enqueue(t, 1)
+
+	delivered, err := outbox.Deliver(msg.ID)
+	if err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	if delivered.Status != db.OutboxSent || delivered.SentAt == nil || delivered.Attempts != 1 {
+		t.Errorf("Unexpected delivered message: %+v", delivered)
+	}
+	if len(sender.sent) != 1 || len(*saved) != 1 {
+		t.Errorf("Expected one submission and one Sent copy, got %d and %d", len(sender.sent), len(*saved))
+	}
+
+	stored, err := outbox.Get(1, msg.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if stored.SpoolPath != "" || len(stored.Recipients) != 2 {
+		t.Errorf("Expected recipients kept and content dropped once sent: %+v", stored)
+	}
+	if _, err := os.Stat(msg.SpoolPath); !os.IsNotExist(err) {
+		t.Errorf("The spool file must be deleted once sent, got %v", err)
+	}
+
+	if _, err := outbox.Deliver(msg.ID); !errors.Is(err, outbox.ErrInvalidState) {
+		t.Errorf("A sent message must not be delivered twice, got %v", err)
+	}
+	if _, err := outbox.Get(2, msg.ID); !errors.Is(err, outbox.ErrNotFound) {
+		t.Errorf("Messages of other users must not be visible, got %v", err)
+	}
+}
+
+func TestOutboxSentWriteFailure(t *testing.T) {
+	sender, _ := setupOutbox(t)
+	msg := enqueue(t, 1)
+
+	// The database fails right after the SMTP server accepted the message
+	sender.onSend = func() {
+		db.DB.Callback().Update().Before("gorm:update").Register("test:fail", func(tx *gorm.DB) {
+			tx.AddError(errors.New("database is locked"))
+		})
+	}
+	if _, err := outbox.Deliver(msg.ID); err == nil {
+		t.Fatal("Deliver() must report the failed status update")
+	}
+	db.DB.Callback().Update().Remove("test:fail")
+	sender.onSend = nil
+
+	interrupted := enqueue(t, 1)
+	db.DB.Model(interrupted).Update("status", db.OutboxSending)
+
+	outbox.Requeue()
+	stored, _ := outbox.Get(1, msg.ID)
+	if stored.Status != db.OutboxSent || stored.SentAt == nil || stored.SpoolPath != "" {
+		t.Errorf("A sent message must not be requeued after a restart: %+v", stored)
+	}
+	if _, err := os.Stat(msg.SpoolPath + ".sent"); !os.IsNotExist(err) {
+		t.Errorf("The sent marker must be deleted, got %v", err)
+	}
+	if stored, _ := outbox.Get(1, interrupted.ID); stored.Status != db.OutboxPending {
+		t.Errorf("An interrupted message must be requeued, got %s", stored.Status)
+	}
+
+	outbox.ProcessDue()
+	if len(sender.sent) != 2 {
+		t.Errorf("Expected the sent message once and the interrupted one, got %d submissions", len(sender.sent))
+	}
+}
+
+func TestOutboxRetries(t *testing.T) {
+	temporary := &textproto.Error{Code: 451, Msg: "Try again later"}
+	sender, _ := setupOutbox(t, temporary, errors.New("connection refused"), temporary)
+	msg := enqueue(t, 1)
+
+	before := time.Now()
+	retried, err := outbox.Deliver(msg.ID)
+	if err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	if retried.Status != db.OutboxPending || retried.Attempts != 1 || retried.LastError == "" {
+		t.Errorf("Temporary failure should keep the message pending: %+v", retried)
+	}
+	if wait := retried.NextAttemptAt.Sub(before); wait < time.Minute || wait > time.Minute+time.Second {
+		t.Errorf("Expected the next attempt in a minute, got %v", wait)
+	}
+
+	// Not due yet
+	outbox.ProcessDue()
+	if len(sender.errs) != 2 {
+		t.Fatalf("Message was retried before its next attempt")
+	}
+
+	outbox.Deliver(msg.ID)
+	failed, _ := outbox.Deliver(msg.ID)
+	if failed.Status != db.OutboxFailed || failed.Attempts != 3 {
+		t.Errorf("Message should fail after max_attempts: %+v", failed)
+	}
+
+	retried, err = outbox.Retry(1, msg.ID)
+	if err != nil || retried.Status != db.OutboxPending || retried.Attempts != 0 {
+		t.Fatalf("Retry() = %+v, %v", retried, err)
+	}
+	outbox.ProcessDue()
+	if len(sender.sent) != 1 {
+		t.Errorf("Retried message was not delivered")
+	}
+}
+
+func TestOutboxPermanentFailureAndCancel(t *testing.T) {
+	setupOutbox(t, &textproto.Error{Code: 550, Msg: "No such user"})
+
+	msg := enqueue(t, 1)
+	failed, err := outbox.Deliver(msg.ID)
+	if err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	if failed.Status != db.OutboxFailed || failed.Attempts != 1 {
+		t.Errorf("5xx replies should fail the message immediately: %+v", failed)
+	}
+	if _, err := outbox.Cancel(1, msg.ID); !errors.Is(err, outbox.ErrInvalidState) {
+		t.Errorf("Failed messages cannot be cancelled, got %v", err)
+	}
+
+	pending := enqueue(t, 1)
+	cancelled, err := outbox.Cancel(1, pending.ID)
+	if err != nil || cancelled.Status != db.OutboxCancelled {
+		t.Fatalf("Cancel() = %+v, %v", cancelled, err)
+	}
+	if _, err := outbox.Deliver(pending.ID); !errors.Is(err, outbox.ErrInvalidState) {
+		t.Errorf("Cancelled messages must not be delivered, got %v", err)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	config.AppConfig.Outbox.RetryDelay = time.Minute
+
+	for attempts, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 20: 6 * time.Hour} {
+		if got := outbox.Backoff(attempts); got != want {
+			t.Errorf("Backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestParseSendAt(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	paris, _ := time.LoadLocation("Europe/Paris")
+
+	at, err := outbox.ParseSendAt("2024-03-04T09:00", "Europe/Paris", now)
+	if err != nil || !at.Equal(time.Date(2024, 3, 4, 9, 0, 0, 0, paris)) {
+		t.Errorf("Local time in a timezone: got %v, %v", at, err)
+	}
+
+	at, err = outbox.ParseSendAt("2024-03-04T09:00:00-05:00", "", now)
+	if err != nil || !at.Equal(time.Date(2024, 3, 4, 14, 0, 0, 0, time.UTC)) {
+		t.Errorf("RFC 3339 timestamp: got %v, %v", at, err)
+	}
+
+	for _, invalid := range [][2]string{
+		{"2024-03-04T09:00", ""},
+		{"2024-03-04T09:00", "Mars/Olympus"},
+		{"2024-02-28T09:00:00Z", ""},
+		{"next monday", "Europe/Paris"},
+	} {
+		if _, err := outbox.ParseSendAt(invalid[0], invalid[1], now); err == nil {
+			t.Errorf("ParseSendAt(%q, %q) should fail", invalid[0], invalid[1])
+		}
+	}
+}
+
+func TestOutboxScheduling(t *testing.T) {
+	sender, _ := setupOutbox(t)
+
+	msg := spooled(t, &db.OutboxMessage{
+		UserID:     1,
+		From:       "me@example.com",
+		Recipients: []string{"you@example.com"},
+	}, "Date: Mon, 01 Jan 2024 00:00:00 +0000\r\nSubject: Later\r\n\r\nHi\r\n")
+	if err := outbox.Schedule(msg, time.Now().Add(time.Hour), "Europe/Paris"); err != nil {
+		t.Fatalf("Schedule() error = %v", err)
+	}
+
+	outbox.ProcessDue()
+	if len(sender.sent) != 0 {
+		t.Fatalf("Scheduled message was sent before its time")
+	}
+
+	rescheduled, err := outbox.Reschedule(1, msg.ID, time.Now().Add(-time.Second), "UTC")
+	if err != nil || rescheduled.Status != db.OutboxScheduled || rescheduled.Timezone != "UTC" {
+		t.Fatalf("Reschedule() = %+v, %v", rescheduled, err)
+	}
+
+	outbox.ProcessDue()
+	if len(sender.sent) != 1 {
+		t.Fatalf("Scheduled message was not sent once due")
+	}
+	if strings.Contains(string(sender.sent[0]), "Mon, 01 Jan 2024") || !strings.Contains(string(sender.sent[0]), "Subject: Later") {
+		t.Errorf("Date header was not refreshed at sending time:\n%s", sender.sent[0])
+	}
+	if _, err := outbox.Reschedule(1, msg.ID, time.Now().Add(time.Hour), ""); !errors.Is(err, outbox.ErrInvalidState) {
+		t.Errorf("Sent messages cannot be rescheduled, got %v", err)
+	}
+}
+
+func TestOutboxUndoSend(t *testing.T) {
+	sender, _ := setupOutbox(t)
+
+	held := spooled(t, &db.OutboxMessage{UserID: 1, From: "me@example.com", Recipients: []string{"you@example.com"}}, "Subject: Oops\r\n\r\n")
+	if err := outbox.Hold(held, 10*time.Second); err != nil {
+		t.Fatalf("Hold() error = %v", err)
+	}
+	if len(held.CancelToken) != 32 {
+		t.Fatalf("Expected a cancel token, got %q", held.CancelToken)
+	}
+
+	outbox.ProcessDue()
+	if len(sender.sent) != 0 {
+		t.Fatalf("Held message was sent during the undo delay")
+	}
+
+	if _, err := outbox.CancelHeld(2, held.CancelToken); !errors.Is(err, outbox.ErrNotFound) {
+		t.Errorf("Other users must not cancel the message, got %v", err)
+	}
+	cancelled, err := outbox.CancelHeld(1, held.CancelToken)
+	if err != nil || cancelled.Status != db.OutboxCancelled {
+		t.Fatalf("CancelHeld() = %+v, %v", cancelled, err)
+	}
+	if _, err := os.Stat(held.SpoolPath); !os.IsNotExist(err) {
+		t.Errorf("The spool file must be deleted once cancelled, got %v", err)
+	}
+
+	late := spooled(t, &db.OutboxMessage{UserID: 1, From: "me@example.com", Recipients: []string{"you@example.com"}}, "Subject: Fine\r\n\r\n")
+	if err := outbox.Hold(late, 0); err != nil {
+		t.Fatalf("Hold() error = %v", err)
+	}
+	outbox.ProcessDue()
+	if len(sender.sent) != 1 {
+		t.Fatalf("Message was not sent after the undo delay")
+	}
+	if _, err := outbox.CancelHeld(1, late.CancelToken); !errors.Is(err, outbox.ErrInvalidState) {
+		t.Errorf("Sent messages cannot be cancelled, got %v", err)
+	}
+}
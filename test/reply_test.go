@@ -0,0 +1,128 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+func TestReplySubject(t *testing.T) {
+	cases := map[string]string{
+		"Hello":         "Re: Hello",
+		"Re: Hello":     "Re: Hello",
+		"RE:Hello":      "RE:Hello",
+		"AW: Hallo":     "AW: Hallo",
+		"Fwd: Document": "Re: Fwd: Document",
+	}
+	for subject, want := range cases {
+		if got := smtpclient.ReplySubject(subject); got != want {
+			t.Errorf("ReplySubject(%q) = %q, want %q", subject, got, want)
+		}
+	}
+
+	if got := smtpclient.ForwardSubject("FW: Hello"); got != "FW: Hello" {
+		t.Errorf("ForwardSubject() added a second prefix: %q", got)
+	}
+	if got := smtpclient.ForwardSubject("Re: Hello"); got != "Fwd: Re: Hello" {
+		t.Errorf("ForwardSubject() = %q", got)
+	}
+}
+
+func TestReplyRecipients(t *testing.T) {
+	original := &smtpclient.Message{
+		From:    "alice@example.com",
+		ReplyTo: "list@example.com",
+		To:      []string{"Me@Example.com", "bob@example.com"},
+		Cc:      []string{"carol@example.com", "bob@example.com"},
+	}
+	own := []string{"me@example.com"}
+
+	to, cc := smtpclient.ReplyRecipients(original, false, own)
+	if strings.Join(to, ",") != "list@example.com" || len(cc) != 0 {
+		t.Errorf("Reply should go to Reply-To only, got to=%v cc=%v", to, cc)
+	}
+
+	to, cc = smtpclient.ReplyRecipients(original, true, own)
+	if strings.Join(to, ",") != "list@example.com,bob@example.com" {
+		t.Errorf("Unexpected reply-all To: %v", to)
+	}
+	if strings.Join(cc, ",") != "carol@example.com" {
+		t.Errorf("Unexpected reply-all Cc: %v", cc)
+	}
+
+	sent := &smtpclient.Message{From: "me@example.com", To: []string{"dave@example.com"}}
+	if to, _ := smtpclient.ReplyRecipients(sent, false, own); strings.Join(to, ",") != "dave@example.com" {
+		t.Errorf("Replying to an own message should address its recipients, got %v", to)
+	}
+}
+
+func TestThreadReferences(t *testing.T) {
+	original := &smtpclient.Message{
+		MessageID:  "c@example.com",
+		InReplyTo:  "b@example.com",
+		References: []string{"a@example.com", "b@example.com"},
+	}
+	got := smtpclient.ThreadReferences(original)
+	if strings.Join(got, " ") != "a@example.com b@example.com c@example.com" {
+		t.Errorf("Unexpected references: %v", got)
+	}
+	if len(original.References) != 2 {
+		t.Errorf("ThreadReferences() modified the original references: %v", original.References)
+	}
+
+	var long []string
+	for i := 0; i < 30; i++ {
+		long = append(long, fmt.Sprintf("%d@example.com", i))
+	}
+	got = smtpclient.ThreadReferences(&smtpclient.Message{MessageID: "last@example.com", References: long})
+	if len(got) != 20 || got[0] != "0@example.com" || got[19] != "last@example.com" {
+		t.Errorf("References were not trimmed around the thread root: %v", got)
+	}
+}
+
+func TestReplyThreadingHeaders(t *testing.T) {
+	original := &smtpclient.Message{
+		From:       "alice@example.com",
+		Subject:    "Plans",
+		Date:       time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC),
+		MessageID:  "b@example.com",
+		References: []string{"a@example.com"},
+		HTMLBody:   "<html><body><p>Shall we <b>meet</b>?</p></body></html>",
+	}
+
+	mr, parts := composedParts(t, &smtpclient.OutgoingMessage{
+		From:       "me@example.com",
+		To:         []string{original.From},
+		Subject:    smtpclient.ReplySubject(original.Subject),
+		Body:       smtpclient.QuoteHTML("<p>Yes</p>", original),
+		InReplyTo:  original.MessageID,
+		References: smtpclient.ThreadReferences(original),
+	})
+
+	if got := mr.Header.Get("In-Reply-To"); got != "<b@example.com>" {
+		t.Errorf("Unexpected In-Reply-To: %q", got)
+	}
+	if got, _ := mr.Header.MsgIDList("References"); strings.Join(got, " ") != "a@example.com b@example.com" {
+		t.Errorf("Unexpected References: %v", got)
+	}
+
+	htmlParts := parts["text/html"]
+	if len(htmlParts) != 1 {
+		t.Fatalf("Expected one HTML part, got %d", len(htmlParts))
+	}
+	raw, _ := io.ReadAll(htmlParts[0].Body)
+	content := string(raw)
+	if !strings.Contains(content, `<blockquote type="cite"`) || !strings.Contains(content, "<p>Shall we <b>meet</b>?</p>") {
+		t.Errorf("Original was not quoted:\n%s", content)
+	}
+	if strings.Contains(content, "<body>") {
+		t.Errorf("Quoted HTML should not contain the original document wrapper:\n%s", content)
+	}
+	if !strings.Contains(content, "On Fri, 1 Mar 2024 at 09:30, alice@example.com wrote:") {
+		t.Errorf("Missing attribution line:\n%s", content)
+	}
+}
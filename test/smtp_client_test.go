@@ -19,6 +19,10 @@ func TestSMTPAndIMAPClient(t *testing.T) {
 	}
 
 	// Load configuration
+	if _, err := os.Stat("../config/config.ini"); err != nil {
+		t.Skip("Skipping SMTP/IMAP test: config/config.ini not found")
+	}
+
 	if err := config.LoadConfig(); err != nil {
 		t.Fatalf("Failed to load configuration: %v", err)
 	}
@@ -68,14 +72,14 @@ func TestSMTPAndIMAPClient(t *testing.T) {
 	defer imapClient.Disconnect()
 
 	// Get inbox messages (last 10)
-	messages, err := imapClient.GetInbox(10)
+	result, err := imapClient.GetInbox(1, 10)
 	if err != nil {
 		t.Errorf("Failed to get inbox: %v", err)
 	} else {
-		t.Logf("Successfully retrieved %d messages from inbox", len(messages))
+		t.Logf("Successfully retrieved %d messages from inbox", len(result.Messages))
 
 		// Log message details
-		for i, msg := range messages {
+		for i, msg := range result.Messages {
 			t.Logf("Message %d:", i+1)
 			t.Logf("  ID: %s", msg.ID)
 			t.Logf("  To: %s", msg.To)
@@ -0,0 +1,255 @@
+package test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lyneq/mailapi/config"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// fakeSMTPServer accepts SMTP sessions, counting connections and messages.
+// Recipients starting with "reject" are refused; with dropAfterMessage set,
+// the server hangs up after each message. With a TLS configuration, the
+// server offers STARTTLS, or speaks TLS from the start when implicit is set.
+// With a bearer token, the server offers the given OAuth 2.0 mechanisms and
+// accepts that token only.
+type fakeSMTPServer struct {
+	listener         net.Listener
+	tlsConfig        *tls.Config
+	implicit         bool
+	bearer           string
+	mechanisms       string
+	authenticated    atomic.Value
+	connections      atomic.Int32
+	messages         atomic.Int32
+	dropAfterMessage atomic.Bool
+}
+
+func startFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	return startFakeTLSServer(t, nil, false)
+}
+
+func startFakeTLSServer(t *testing.T, tlsConfig *tls.Config, implicit bool) *fakeSMTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeSMTPServer{listener: listener, tlsConfig: tlsConfig, implicit: implicit}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.connections.Add(1)
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	secure := false
+	if s.implicit {
+		conn = tls.Server(conn, s.tlsConfig)
+		secure = true
+	}
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			extensions := []string{"fake"}
+			if s.tlsConfig != nil && !secure {
+				extensions = append(extensions, "STARTTLS")
+			}
+			if s.bearer != "" {
+				extensions = append(extensions, "AUTH "+s.mechanisms)
+			}
+			for i, extension := range extensions {
+				if i < len(extensions)-1 {
+					reply("250-" + extension)
+				} else {
+					reply("250 " + extension)
+				}
+			}
+		case strings.HasPrefix(command, "AUTH ") && s.bearer != "":
+			fields := strings.Fields(strings.TrimSpace(line))
+			response, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			if strings.Contains(string(response), "auth=Bearer "+s.bearer+"\x01") {
+				s.authenticated.Store(fields[1])
+				reply("235 Accepted")
+				continue
+			}
+			reply("334 " + base64.StdEncoding.EncodeToString([]byte(`{"status":"401"}`)))
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			reply("535 5.7.8 Invalid credentials")
+		case command == "STARTTLS" && s.tlsConfig != nil && !secure:
+			reply("220 Ready to start TLS")
+			conn = tls.Server(conn, s.tlsConfig)
+			r = bufio.NewReader(conn)
+			secure = true
+		case strings.HasPrefix(command, "RCPT TO:<REJECT"):
+			reply("550 5.1.1 No such user")
+		case strings.HasPrefix(command, "DATA"):
+			reply("354 Go ahead")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+			}
+			s.messages.Add(1)
+			reply("250 Queued")
+			if s.dropAfterMessage.Load() {
+				return
+			}
+		case strings.HasPrefix(command, "QUIT"):
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) client(idle time.Duration) *smtpclient.Client {
+	return s.tlsClient(idle, config.TLSConfig{Mode: smtpclient.TLSNone})
+}
+
+func (s *fakeSMTPServer) tlsClient(idle time.Duration, settings config.TLSConfig) *smtpclient.Client {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return smtpclient.NewClient(smtpclient.SMTPConfig{Host: "127.0.0.1", Port: addr.Port, IdleTimeout: idle, TLS: settings})
+}
+
+var rawMessage = []byte("From: me@example.com\r\nTo: you@example.com\r\nSubject: Hi\r\n\r\nHello\r\n")
+
+func TestSMTPConnectionReuse(t *testing.T) {
+	server := startFakeSMTPServer(t)
+
+	for i := 0; i < 3; i++ {
+		// Clients of the same account share the connection
+		if err := server.client(time.Minute).SendRaw("me@example.com", []string{"you@example.com"}, rawMessage); err != nil {
+			t.Fatalf("SendRaw() error = %v", err)
+		}
+	}
+
+	client := server.client(time.Minute)
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- client.SendRaw("me@example.com", []string{"you@example.com"}, rawMessage)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Concurrent SendRaw() error = %v", err)
+		}
+	}
+
+	if server.messages.Load() != 13 || server.connections.Load() != 1 {
+		t.Errorf("Expected 13 messages over 1 connection, got %d over %d", server.messages.Load(), server.connections.Load())
+	}
+
+	err := client.SendRaw("me@example.com", []string{"reject@example.com"}, rawMessage)
+	if !smtpclient.IsPermanent(err) {
+		t.Errorf("Expected a permanent failure, got %v", err)
+	}
+	if err := client.SendRaw("me@example.com", []string{"you@example.com"}, rawMessage); err != nil {
+		t.Errorf("Sending after a rejected message failed: %v", err)
+	}
+	client.Close()
+}
+
+func TestSMTPReconnection(t *testing.T) {
+	server := startFakeSMTPServer(t)
+	server.dropAfterMessage.Store(true)
+	client := server.client(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if err := client.SendRaw("me@example.com", []string{"you@example.com"}, rawMessage); err != nil {
+			t.Fatalf("Message %d was not sent after the server hung up: %v", i+1, err)
+		}
+	}
+	if server.messages.Load() != 3 || server.connections.Load() != 3 {
+		t.Errorf("Expected 3 messages over 3 connections, got %d over %d", server.messages.Load(), server.connections.Load())
+	}
+
+	idle := startFakeSMTPServer(t)
+	client = idle.client(50 * time.Millisecond)
+	client.SendRaw("me@example.com", []string{"you@example.com"}, rawMessage)
+	time.Sleep(150 * time.Millisecond)
+	if err := client.SendRaw("me@example.com", []string{"you@example.com"}, rawMessage); err != nil {
+		t.Fatalf("SendRaw() after idle timeout error = %v", err)
+	}
+	if idle.connections.Load() != 2 {
+		t.Errorf("Expected the idle connection to be closed and re-dialled, got %d connections", idle.connections.Load())
+	}
+	client.Close()
+}
+
+func TestSMTPAccountConnections(t *testing.T) {
+	server := startFakeSMTPServer(t)
+	port := server.listener.Addr().(*net.TCPAddr).Port
+	client := func(accountID uint, password string) *smtpclient.Client {
+		return smtpclient.NewClient(smtpclient.SMTPConfig{
+			Host: "127.0.0.1", Port: port, Username: "me@example.com", Password: password,
+			TLS: config.TLSConfig{Mode: smtpclient.TLSNone}, IdleTimeout: time.Minute, AccountID: accountID,
+		})
+	}
+	send := func(c *smtpclient.Client) {
+		t.Helper()
+		if err := c.SendRaw("me@example.com", []string{"you@example.com"}, rawMessage); err != nil {
+			t.Fatalf("SendRaw() error = %v", err)
+		}
+	}
+
+	// Accounts with the same credentials do not share a connection
+	send(client(101, "secret"))
+	send(client(102, "secret"))
+	send(client(101, "secret"))
+	if server.connections.Load() != 2 {
+		t.Errorf("Expected one connection per account, got %d", server.connections.Load())
+	}
+
+	// Changed credentials and closed accounts get a new connection
+	send(client(101, "changed"))
+	smtpclient.CloseAccount(102)
+	send(client(102, "secret"))
+	if server.connections.Load() != 4 {
+		t.Errorf("Expected new connections after the changes, got %d", server.connections.Load())
+	}
+	smtpclient.CloseAccount(101)
+	smtpclient.CloseAccount(102)
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/mailtemplate"
+	"github.com/lyneq/mailapi/internal/outbox"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	tpl := &db.Template{
+		Subject:  "Order {{.order}}\r\nBcc: victim@example.com",
+		HTMLBody: "<p>Hello {{.name}}</p>",
+		TextBody: "Hello {{.name}}, your order {{.order}} has shipped.",
+	}
+	if err := mailtemplate.Check(tpl); err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+
+	rendered, err := mailtemplate.Render(tpl, map[string]interface{}{"name": "<Bob>", "order": 42})
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	if rendered.Subject != "Order 42 Bcc: victim@example.com" {
+		t.Errorf("Subject must be a single line, got %q", rendered.Subject)
+	}
+	if rendered.HTMLBody != "<p>Hello &lt;Bob&gt;</p>" {
+		t.Errorf("Variables must be escaped in the HTML body, got %q", rendered.HTMLBody)
+	}
+	if rendered.TextBody != "Hello <Bob>, your order 42 has shipped." {
+		t.Errorf("Unexpected text body %q", rendered.TextBody)
+	}
+
+	if _, err := mailtemplate.Render(tpl, map[string]interface{}{"name": "Bob"}); err == nil {
+		t.Errorf("Missing variables should fail the rendering")
+	}
+	if err := mailtemplate.Check(&db.Template{Subject: "{{.name"}); err == nil {
+		t.Errorf("Syntax errors should be reported")
+	}
+}
+
+func TestMergeRecipients(t *testing.T) {
+	csv := "\ufeffEmail, Name,Order\nbob@example.com,Bob,42\n\"alice@example.com\",\"Smith, Alice\",43\n"
+	recipients, err := mailtemplate.ParseCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("ParseCSV() error = %v", err)
+	}
+	if len(recipients) != 2 || recipients[1]["order"] != "43" {
+		t.Fatalf("Unexpected recipients %v", recipients)
+	}
+
+	if to, err := mailtemplate.Recipient(recipients[1]); err != nil || to != `"Smith, Alice" <alice@example.com>` {
+		t.Errorf("Recipient() = %q, %v", to, err)
+	}
+	if _, err := mailtemplate.Recipient(map[string]interface{}{"email": "not an address"}); err == nil {
+		t.Errorf("Invalid addresses should be rejected")
+	}
+
+	for _, invalid := range []string{"", "name,order\nBob,42\n", "email,name\nbob@example.com\n"} {
+		if _, err := mailtemplate.ParseCSV(strings.NewReader(invalid)); err == nil {
+			t.Errorf("ParseCSV(%q) should fail", invalid)
+		}
+	}
+}
+
+func TestMergeThrottling(t *testing.T) {
+	sender, _ := setupOutbox(t)
+
+	var messages []*db.OutboxMessage
+	for _, to := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		messages = append(messages, spooled(t, &db.OutboxMessage{UserID: 1, From: "me@example.com", Recipients: []string{to}}, "Subject: Hi\r\n\r\n"))
+	}
+
+	merge := &db.Merge{UserID: 1, TemplateID: 1, Rate: 2}
+	if err := outbox.EnqueueMerge(merge, messages); err != nil {
+		t.Fatalf("EnqueueMerge() error = %v", err)
+	}
+	if merge.Total != 3 || messages[2].MergeID == nil || *messages[2].MergeID != merge.ID {
+		t.Fatalf("Messages were not attached to the merge: %+v", merge)
+	}
+	if gap := messages[1].NextAttemptAt.Sub(messages[0].NextAttemptAt); gap != 30*time.Second {
+		t.Errorf("Expected messages 30s apart at 2 per minute, got %v", gap)
+	}
+
+	outbox.ProcessDue()
+	if len(sender.sent) != 1 {
+		t.Fatalf("Expected only the first email to be sent right away, got %d", len(sender.sent))
+	}
+
+	// Emails all due at once, e.g. after downtime, still go at the merge rate
+	db.DB.Model(&db.OutboxMessage{}).Where("merge_id = ? AND status = ?", merge.ID, db.OutboxPending).
+		Update("next_attempt_at", time.Now().Add(-time.Hour))
+	outbox.ProcessDue()
+	if len(sender.sent) != 1 {
+		t.Fatalf("Due emails must wait for the next slot of the merge, got %d sent", len(sender.sent))
+	}
+	var postponed db.OutboxMessage
+	db.DB.First(&postponed, messages[1].ID)
+	if wait := time.Until(postponed.NextAttemptAt); wait < 20*time.Second || wait > 30*time.Second {
+		t.Errorf("Expected the email postponed to the next slot, in %v", wait)
+	}
+
+	db.DB.Model(merge).Update("next_send_at", time.Now().Add(-time.Second))
+	db.DB.Model(&db.OutboxMessage{}).Where("merge_id = ? AND status = ?", merge.ID, db.OutboxPending).
+		Update("next_attempt_at", time.Now().Add(-time.Hour))
+	outbox.ProcessDue()
+	if len(sender.sent) != 2 {
+		t.Fatalf("Expected one email per slot, got %d sent", len(sender.sent))
+	}
+
+	cancelled, err := outbox.CancelMerge(1, merge.ID)
+	if err != nil || cancelled != 1 {
+		t.Errorf("CancelMerge() = %d, %v", cancelled, err)
+	}
+	if cancelled, _ := outbox.CancelMerge(2, merge.ID); cancelled != 0 {
+		t.Errorf("Other users must not cancel the merge")
+	}
+}
@@ -0,0 +1,100 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lyneq/mailapi/config"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// selfSignedCert creates a certificate for 127.0.0.1, like Proton Bridge's,
+// and writes it to a PEM file
+func selfSignedCert(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, path
+}
+
+func TestSMTPTLSModes(t *testing.T) {
+	cert, certFile := selfSignedCert(t)
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12}
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+
+	starttls := startFakeTLSServer(t, serverTLS, false)
+	implicit := startFakeTLSServer(t, serverTLS, true)
+	plain := startFakeSMTPServer(t)
+
+	send := func(server *fakeSMTPServer, settings config.TLSConfig) error {
+		client := server.tlsClient(time.Minute, settings)
+		defer client.Close()
+		return client.SendRaw("me@example.com", []string{"you@example.com"}, rawMessage)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		server   *fakeSMTPServer
+		settings config.TLSConfig
+		wantErr  string
+	}{
+		{"unknown certificate", starttls, config.TLSConfig{}, "set tls_ca_file or tls_pinned_cert"},
+		{"CA bundle", starttls, config.TLSConfig{CAFile: certFile}, ""},
+		{"pinned fingerprint", starttls, config.TLSConfig{PinnedCert: strings.ToUpper(hex.EncodeToString(fingerprint[:]))}, ""},
+		{"pinned file", implicit, config.TLSConfig{Mode: smtpclient.TLSImplicit, PinnedCert: certFile}, ""},
+		{"wrong pin", starttls, config.TLSConfig{PinnedCert: strings.Repeat("ab:", 31) + "ab"}, "update tls_pinned_cert"},
+		{"skip verification", implicit, config.TLSConfig{Mode: smtpclient.TLSImplicit, SkipVerify: true}, ""},
+		{"minimum version", starttls, config.TLSConfig{CAFile: certFile, MinVersion: "1.3"}, "check tls_min_version"},
+		{"STARTTLS required", plain, config.TLSConfig{Mode: smtpclient.TLSStartTLS}, "does not support STARTTLS"},
+		{"implicit on a plain port", plain, config.TLSConfig{Mode: smtpclient.TLSImplicit, SkipVerify: true}, "try tls_mode = starttls"},
+		{"unknown mode", plain, config.TLSConfig{Mode: "ssl"}, "unknown tls_mode"},
+	} {
+		err := send(tc.server, tc.settings)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.wantErr, err)
+		}
+	}
+
+	if starttls.messages.Load() != 2 || implicit.messages.Load() != 2 {
+		t.Errorf("Expected 2 messages over each TLS mode, got %d and %d", starttls.messages.Load(), implicit.messages.Load())
+	}
+}
@@ -0,0 +1,296 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/api/auth"
+	"github.com/lyneq/mailapi/api/email"
+	"github.com/lyneq/mailapi/api/users"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/lockout"
+	"github.com/lyneq/mailapi/internal/middleware"
+	"github.com/lyneq/mailapi/internal/session"
+	"github.com/lyneq/mailapi/internal/twofactor"
+	"github.com/lyneq/mailapi/internal/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type testValidator struct {
+	validator *validator.Validate
+}
+
+func (v *testValidator) Validate(i interface{}) error {
+	return v.validator.Struct(i)
+}
+
+// newAuthServer serves the routes of the auth and users controllers
+func newAuthServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	e := echo.New()
+	v := validator.New()
+	if err := utils.RegisterValidations(v); err != nil {
+		t.Fatalf("RegisterValidations() error = %v", err)
+	}
+	e.Validator = &testValidator{validator: v}
+	e.Use(session.Middleware())
+	add := func(method, path string, handler echo.HandlerFunc, requiredAuth bool, scope, permission string) {
+		var middlewares []echo.MiddlewareFunc
+		if requiredAuth {
+			middlewares = append(middlewares, middleware.RequireAuth(scope))
+		}
+		if permission != "" {
+			middlewares = append(middlewares, middleware.RequirePermission(permission))
+		}
+		e.Add(method, path, handler, middlewares...)
+	}
+	for _, route := range auth.GetAuthController() {
+		add(route.Method, route.Route, route.Handler, route.RequiredAuth, route.Scope, route.Permission)
+	}
+	for _, route := range users.GetUsersController() {
+		add(route.Method, route.Route, route.Handler, route.RequiredAuth, route.Scope, route.Permission)
+	}
+	for _, route := range email.GetEmailController() {
+		add(route.Method, route.Route, route.Handler, route.RequiredAuth, route.Scope, route.Permission)
+	}
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// createUser stores a user signing in with password
+func createUser(t *testing.T, username, password string) *db.User {
+	t.Helper()
+	hashed, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	user := &db.User{Username: username, Password: string(hashed)}
+	if err := db.DB.Create(user).Error; err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	return user
+}
+
+// apiClient sends JSON requests to a test server, keeping its cookies
+type apiClient struct {
+	t      *testing.T
+	url    string
+	client *http.Client
+}
+
+func newAPIClient(t *testing.T, server *httptest.Server) *apiClient {
+	jar, _ := cookiejar.New(nil)
+	return &apiClient{t: t, url: server.URL, client: &http.Client{Jar: jar}}
+}
+
+func (a *apiClient) do(method, path string, body interface{}) (int, map[string]interface{}) {
+	a.t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, _ := http.NewRequest(method, a.url+path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		a.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	var decoded map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&decoded)
+	return resp.StatusCode, decoded
+}
+
+func (a *apiClient) signIn(username, password string) map[string]interface{} {
+	a.t.Helper()
+	status, body := a.do(http.MethodPost, "/api/signin", map[string]string{"username": username, "password": password})
+	if status != http.StatusOK {
+		a.t.Fatalf("Sign in = %d %v", status, body)
+	}
+	return body
+}
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors of RFC 6238, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		if got, err := twofactor.Code(secret, time.Unix(unix, 0)); err != nil || got != want {
+			t.Errorf("Code(%d) = %q, %v, want %q", unix, got, err, want)
+		}
+	}
+
+	uri := twofactor.ProvisioningURI("alice", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/MailAPI:alice?") || !strings.Contains(uri, "secret="+secret) || !strings.Contains(uri, "issuer=MailAPI") {
+		t.Errorf("Unexpected provisioning URI %q", uri)
+	}
+}
+
+func TestTwoFactorSignIn(t *testing.T) {
+	setupDB(t)
+	server := newAuthServer(t)
+	createUser(t, "alice", "password1")
+
+	owner := newAPIClient(t, server)
+	owner.signIn("alice", "password1")
+	status, setup := owner.do(http.MethodPost, "/api/me/2fa/setup", nil)
+	secret, _ := setup["secret"].(string)
+	if status != http.StatusOK || secret == "" || !strings.HasPrefix(setup["uri"].(string), "otpauth://") {
+		t.Fatalf("Setup = %d %v", status, setup)
+	}
+	if status, body := owner.do(http.MethodPost, "/api/me/2fa/enable", map[string]string{"code": "000000"}); status != http.StatusBadRequest {
+		t.Errorf("A wrong code must not enable 2FA, got %d %v", status, body)
+	}
+	enableCode, _ := twofactor.Code(secret, time.Now())
+	status, enabled := owner.do(http.MethodPost, "/api/me/2fa/enable", map[string]string{"code": enableCode})
+	codes, _ := enabled["recovery_codes"].([]interface{})
+	if status != http.StatusOK || len(codes) != twofactor.RecoveryCodeCount {
+		t.Fatalf("Enable = %d %v", status, enabled)
+	}
+	if status, body := owner.do(http.MethodPost, "/api/me/2fa/setup", nil); status != http.StatusConflict {
+		t.Errorf("Setup while enabled = %d %v", status, body)
+	}
+
+	var stored db.RecoveryCode
+	db.DB.First(&stored)
+	if strings.Contains(stored.Hash, strings.ReplaceAll(codes[0].(string), "-", "")) {
+		t.Error("Recovery codes must be stored hashed")
+	}
+
+	// The password only opens a pending session
+	client := newAPIClient(t, server)
+	if body := client.signIn("alice", "password1"); body["two_factor_required"] != true {
+		t.Fatalf("Sign in must require a code, got %v", body)
+	}
+	if status, _ := client.do(http.MethodGet, "/api/me", nil); status != http.StatusUnauthorized {
+		t.Errorf("A pending session must not authenticate, got %d", status)
+	}
+	status, body := client.do(http.MethodPost, "/api/signin/2fa", map[string]string{"code": enableCode})
+	if status != http.StatusUnauthorized || body["attempts_left"] != float64(session.MaxPendingAttempts-1) {
+		t.Errorf("A used code must be refused, got %d %v", status, body)
+	}
+	code, _ := twofactor.Code(secret, time.Now().Add(twofactor.Period))
+	if status, body := client.do(http.MethodPost, "/api/signin/2fa", map[string]string{"code": code}); status != http.StatusOK {
+		t.Fatalf("Second step = %d %v", status, body)
+	}
+	if status, _ := client.do(http.MethodGet, "/api/me", nil); status != http.StatusOK {
+		t.Errorf("The session must be authenticated after the second step, got %d", status)
+	}
+
+	// Recovery codes are used once
+	recovery := codes[0].(string)
+	client = newAPIClient(t, server)
+	client.signIn("alice", "password1")
+	status, body = client.do(http.MethodPost, "/api/signin/2fa", map[string]string{"recovery_code": strings.ToUpper(recovery)})
+	if status != http.StatusOK || body["recovery_codes_remaining"] != float64(twofactor.RecoveryCodeCount-1) {
+		t.Fatalf("Recovery code = %d %v", status, body)
+	}
+	client = newAPIClient(t, server)
+	client.signIn("alice", "password1")
+	if status, _ := client.do(http.MethodPost, "/api/signin/2fa", map[string]string{"recovery_code": recovery}); status != http.StatusUnauthorized {
+		t.Errorf("A used recovery code must be refused, got %d", status)
+	}
+
+	// Too many wrong codes end the pending session
+	client = newAPIClient(t, server)
+	client.signIn("alice", "password1")
+	for range session.MaxPendingAttempts {
+		client.do(http.MethodPost, "/api/signin/2fa", map[string]string{"code": "000000"})
+	}
+	if status, body := client.do(http.MethodPost, "/api/signin/2fa", map[string]string{"recovery_code": codes[1].(string)}); status != http.StatusUnauthorized {
+		t.Errorf("The pending session must end after too many attempts, got %d %v", status, body)
+	}
+	// Wrong codes also count as failed sign-ins of the username
+	if status, _ := client.do(http.MethodPost, "/api/signin", map[string]string{"username": "alice", "password": "password1"}); status != http.StatusTooManyRequests {
+		t.Errorf("Too many wrong codes must lock the username out, got %d", status)
+	}
+	lockout.Reset("alice")
+
+	// Disabling requires the password
+	if status, _ := owner.do(http.MethodPost, "/api/me/2fa/disable", map[string]string{"password": "wrong"}); status != http.StatusUnauthorized {
+		t.Errorf("Disable with a wrong password = %d", status)
+	}
+	if status, body := owner.do(http.MethodPost, "/api/me/2fa/disable", map[string]string{"password": "password1"}); status != http.StatusOK {
+		t.Fatalf("Disable = %d %v", status, body)
+	}
+	client = newAPIClient(t, server)
+	if body := client.signIn("alice", "password1"); body["two_factor_required"] == true {
+		t.Error("Sign in must not require a code once 2FA is disabled")
+	}
+}
+
+func TestTwoFactorReset(t *testing.T) {
+	setupDB(t)
+	server := newAuthServer(t)
+	user := createUser(t, "bob", "password1")
+
+	_, secret := enableTwoFactor(t, user)
+
+	owner := newAPIClient(t, server)
+	owner.signIn("bob", "password1")
+	code, _ := twofactor.Code(secret, time.Now().Add(twofactor.Period))
+	owner.do(http.MethodPost, "/api/signin/2fa", map[string]string{"code": code})
+
+	if status, _ := owner.do(http.MethodPost, "/api/me/2fa/reset", map[string]string{"password": "wrong"}); status != http.StatusUnauthorized {
+		t.Errorf("Reset with a wrong password = %d", status)
+	}
+	status, reset := owner.do(http.MethodPost, "/api/me/2fa/reset", map[string]string{"password": "password1"})
+	newSecret, _ := reset["secret"].(string)
+	if status != http.StatusOK || newSecret == "" || newSecret == secret {
+		t.Fatalf("Reset = %d %v", status, reset)
+	}
+
+	// The previous app works until the new one is confirmed
+	var fresh db.User
+	db.DB.First(&fresh, user.ID)
+	if !fresh.TOTPEnabled || fresh.TOTPSecret != secret {
+		t.Error("Reset must keep the current app until the new one is confirmed")
+	}
+	newCode, _ := twofactor.Code(newSecret, time.Now())
+	if status, body := owner.do(http.MethodPost, "/api/me/2fa/enable", map[string]string{"code": newCode}); status != http.StatusOK {
+		t.Fatalf("Enable = %d %v", status, body)
+	}
+	fresh = db.User{}
+	db.DB.First(&fresh, user.ID)
+	if fresh.TOTPSecret != newSecret || fresh.TOTPPendingSecret != "" {
+		t.Error("Enable must replace the secret")
+	}
+
+	status, regenerated := owner.do(http.MethodPost, "/api/me/2fa/recovery-codes", map[string]string{"password": "password1"})
+	if codes, _ := regenerated["recovery_codes"].([]interface{}); status != http.StatusOK || len(codes) != twofactor.RecoveryCodeCount {
+		t.Errorf("Recovery codes = %d %v", status, regenerated)
+	}
+	if remaining, _ := twofactor.RemainingRecoveryCodes(user.ID); remaining != twofactor.RecoveryCodeCount {
+		t.Errorf("Regenerating must replace the recovery codes, %d left", remaining)
+	}
+}
+
+// enableTwoFactor turns two-factor authentication on for user and returns its recovery codes and secret
+func enableTwoFactor(t *testing.T, user *db.User) ([]string, string) {
+	t.Helper()
+	secret, _, err := twofactor.Setup(user)
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	user.TOTPPendingSecret = secret
+	code, _ := twofactor.Code(secret, time.Now())
+	codes, err := twofactor.Enable(user, code)
+	if err != nil {
+		t.Fatalf("Enable() error = %v", err)
+	}
+	return codes, secret
+}
@@ -0,0 +1,229 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/internal/account"
+	"github.com/lyneq/mailapi/internal/pagination"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+)
+
+// fakeInbox is an INBOX read by a unified inbox source, the latest received first
+type fakeInbox struct {
+	accountID uint
+	messages  []smtpclient.Message
+	err       error
+}
+
+func (f *fakeInbox) receive(uid uint32, received time.Time) {
+	f.messages = append(f.messages, smtpclient.Message{
+		UID:      uid,
+		Subject:  fmt.Sprintf("%d/%d", f.accountID, uid),
+		Received: received,
+	})
+}
+
+func (f *fakeInbox) source() account.InboxSource {
+	return account.InboxSource{
+		AccountID: f.accountID,
+		Address:   fmt.Sprintf("account%d@example.com", f.accountID),
+		Fetch: func(limit int, keep func(msg *smtpclient.Message) bool) ([]smtpclient.Message, error) {
+			if f.err != nil {
+				return nil, f.err
+			}
+			sorted := append([]smtpclient.Message(nil), f.messages...)
+			sort.Slice(sorted, func(i, j int) bool {
+				if !sorted[i].Received.Equal(sorted[j].Received) {
+					return sorted[i].Received.After(sorted[j].Received)
+				}
+				return sorted[i].UID > sorted[j].UID
+			})
+
+			var kept []smtpclient.Message
+			for i := range sorted {
+				if len(kept) < limit && keep(&sorted[i]) {
+					kept = append(kept, sorted[i])
+				}
+			}
+			return kept, nil
+		},
+	}
+}
+
+func TestUnifiedInboxOrder(t *testing.T) {
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	work := &fakeInbox{accountID: 1}
+	home := &fakeInbox{accountID: 2}
+	work.receive(10, base)
+	work.receive(11, base.Add(2*time.Minute))
+	home.receive(5, base.Add(time.Minute))
+	home.receive(6, base) // same arrival as work 10, listed after it
+
+	messages, failed := account.UnifiedInbox([]account.InboxSource{work.source(), home.source()}, nil, 10)
+	if len(failed) != 0 {
+		t.Fatalf("Unexpected failures %v", failed)
+	}
+
+	var got []string
+	for _, msg := range messages {
+		got = append(got, msg.Subject)
+		if msg.Account != fmt.Sprintf("account%d@example.com", msg.AccountID) {
+			t.Errorf("Message %s is tagged with account %q", msg.Subject, msg.Account)
+		}
+	}
+	want := []string{"1/11", "2/5", "1/10", "2/6"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("UnifiedInbox() = %v, want %v", got, want)
+	}
+}
+
+func TestUnifiedInboxPagination(t *testing.T) {
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	inboxes := []*fakeInbox{{accountID: 1}, {accountID: 2}, {accountID: 3}}
+	for i := 0; i < 7; i++ {
+		for j, inbox := range inboxes {
+			inbox.receive(uint32(100+i), base.Add(time.Duration(i*3+j)*time.Minute))
+		}
+	}
+	// Two messages arriving at the same time in one account
+	inboxes[0].receive(200, base)
+
+	var sources []account.InboxSource
+	for _, inbox := range inboxes {
+		sources = append(sources, inbox.source())
+	}
+
+	seen := map[string]bool{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatalf("Pagination does not end")
+		}
+
+		var after *account.Cursor
+		if cursor != "" {
+			after = new(account.Cursor)
+			if err := pagination.DecodeCursor(cursor, after); err != nil {
+				t.Fatalf("DecodeCursor() error = %v", err)
+			}
+		}
+		messages, _ := account.UnifiedInbox(sources, after, 4)
+		for _, msg := range messages {
+			if seen[msg.Subject] {
+				t.Errorf("Message %s listed twice", msg.Subject)
+			}
+			seen[msg.Subject] = true
+		}
+		if pages == 0 {
+			// Arrivals after the first page must not shift the following ones
+			inboxes[1].receive(300, base.Add(time.Hour))
+		}
+		if len(messages) < 4 {
+			break
+		}
+		cursor = pagination.EncodeCursor(account.NextCursor(after, messages))
+	}
+
+	if len(seen) != 22 {
+		t.Errorf("Expected the 22 messages present on the first page, got %d", len(seen))
+	}
+	if seen["2/300"] {
+		t.Errorf("A message newer than the cursor must not be listed on later pages")
+	}
+
+	var position account.Cursor
+	if err := pagination.DecodeCursor("not a cursor", &position); err == nil {
+		t.Errorf("An invalid cursor must be rejected")
+	}
+}
+
+func TestUnifiedInboxDateOrder(t *testing.T) {
+	backend := memory.New()
+	imapServer := server.New(backend)
+	imapServer.AllowInsecureAuth = true
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go imapServer.Serve(listener)
+	t.Cleanup(func() { imapServer.Close() })
+
+	user, _ := backend.Login(nil, "username", "password")
+	mailbox, _ := user.GetMailbox("INBOX")
+	mailbox.(*memory.Mailbox).Messages = nil
+
+	// UIDs follow the order messages were added in: the old messages were
+	// moved in after the new ones, so UID order and date order disagree
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, minutes := range []int{50, 40, 30, 5, 4, 3, 2, 1, 45} {
+		body := fmt.Sprintf("Subject: 1/%d\r\n\r\nHi\r\n", i+1)
+		mailbox.CreateMessage(nil, base.Add(time.Duration(minutes)*time.Minute), bytes.NewBufferString(body))
+	}
+	other := &fakeInbox{accountID: 2}
+	other.receive(1, base.Add(35*time.Minute))
+	other.receive(2, base.Add(10*time.Minute))
+
+	imap := account.InboxSource{
+		AccountID: 1,
+		Fetch: func(limit int, keep func(msg *smtpclient.Message) bool) ([]smtpclient.Message, error) {
+			client := smtpclient.NewIMAPClient(smtpclient.IMAPConfig{
+				Host:     "127.0.0.1",
+				Port:     listener.Addr().(*net.TCPAddr).Port,
+				Username: "username",
+				Password: "password",
+				TLS:      config.TLSConfig{Mode: smtpclient.TLSNone},
+			})
+			if err := client.Connect(); err != nil {
+				return nil, err
+			}
+			defer client.Disconnect()
+			return client.GetLatestInbox(limit, keep)
+		},
+	}
+	sources := []account.InboxSource{imap, other.source()}
+
+	var got []string
+	var after *account.Cursor
+	for pages := 0; pages < 10; pages++ {
+		messages, failed := account.UnifiedInbox(sources, after, 3)
+		if len(failed) != 0 {
+			t.Fatalf("Unexpected failures %v", failed)
+		}
+		for _, msg := range messages {
+			got = append(got, msg.Subject)
+		}
+		if len(messages) < 3 {
+			break
+		}
+		cursor := account.NextCursor(after, messages)
+		after = &cursor
+	}
+
+	want := []string{"1/1", "1/9", "1/2", "2/1", "1/3", "2/2", "1/4", "1/5", "1/6", "1/7", "1/8"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Unified inbox pages = %v, want %v", got, want)
+	}
+}
+
+func TestUnifiedInboxFailures(t *testing.T) {
+	ok := &fakeInbox{accountID: 1}
+	ok.receive(1, time.Now())
+	broken := &fakeInbox{accountID: 2, err: errors.New("connection refused")}
+
+	messages, failed := account.UnifiedInbox([]account.InboxSource{ok.source(), broken.source()}, nil, 10)
+	if len(messages) != 1 || messages[0].AccountID != 1 {
+		t.Errorf("The readable account must still be listed, got %+v", messages)
+	}
+	if err := failed[2]; err == nil || err.Error() != "connection refused" || len(failed) != 1 {
+		t.Errorf("Unexpected failures %v", failed)
+	}
+}
@@ -0,0 +1,131 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/apitoken"
+	"github.com/lyneq/mailapi/internal/rbac"
+	"github.com/lyneq/mailapi/internal/users"
+)
+
+func TestRolePermissions(t *testing.T) {
+	if !rbac.HasPermission(rbac.RoleAdmin, rbac.PermissionUsersManage) || !rbac.HasPermission(rbac.RoleAdmin, rbac.PermissionUsersRead) {
+		t.Error("Admins must manage users")
+	}
+	if rbac.HasPermission(rbac.RoleUser, rbac.PermissionUsersRead) || rbac.HasPermission("root", rbac.PermissionUsersRead) {
+		t.Error("Users and unknown roles must not read users")
+	}
+	if rbac.ValidRole("root") || !rbac.ValidRole(rbac.RoleUser) {
+		t.Error("Unexpected role validity")
+	}
+}
+
+func TestAdminUsers(t *testing.T) {
+	setupDB(t)
+	server := newAuthServer(t)
+	admin := createUser(t, "admin", "password1")
+	db.DB.Model(admin).Update("role", rbac.RoleAdmin)
+	bob := createUser(t, "bob", "password1")
+
+	adminClient := newAPIClient(t, server)
+	adminClient.signIn("admin", "password1")
+	bobClient := newAPIClient(t, server)
+	bobClient.signIn("bob", "password1")
+
+	if status, _ := bobClient.do(http.MethodGet, "/api/admin/users", nil); status != http.StatusForbidden {
+		t.Errorf("Users must not list users, got %d", status)
+	}
+
+	status, body := adminClient.do(http.MethodGet, "/api/admin/users?q=BO", nil)
+	if list, _ := body["users"].([]interface{}); status != http.StatusOK || len(list) != 1 || list[0].(map[string]interface{})["username"] != "bob" {
+		t.Errorf("Search = %d %v", status, body)
+	}
+	status, body = adminClient.do(http.MethodGet, "/api/admin/users?role=Admin", nil)
+	if list, _ := body["users"].([]interface{}); status != http.StatusOK || len(list) != 1 {
+		t.Errorf("Filter by role = %d %v", status, body)
+	}
+
+	status, body = adminClient.do(http.MethodPost, "/api/admin/users", map[string]string{"username": "carol", "password": "password1"})
+	if status != http.StatusCreated || body["role"] != rbac.RoleUser {
+		t.Fatalf("Create = %d %v", status, body)
+	}
+	carolID := uint(body["ID"].(float64))
+	if status, _ := adminClient.do(http.MethodPost, "/api/admin/users", map[string]string{"username": "carol", "password": "password1"}); status != http.StatusBadRequest {
+		t.Errorf("A taken username must be refused, got %d", status)
+	}
+
+	// Promotion grants the permissions to the current sessions
+	if status, body := adminClient.do(http.MethodPut, fmt.Sprintf("/api/admin/users/%d/role", bob.ID), map[string]string{"role": "Admin"}); status != http.StatusOK {
+		t.Fatalf("Promote = %d %v", status, body)
+	}
+	if status, _ := bobClient.do(http.MethodGet, "/api/admin/users", nil); status != http.StatusOK {
+		t.Errorf("A promoted user must list users, got %d", status)
+	}
+	if status, _ := adminClient.do(http.MethodPut, fmt.Sprintf("/api/admin/users/%d/role", admin.ID), map[string]string{"role": "User"}); status != http.StatusConflict {
+		t.Errorf("Admins must not demote themselves, got %d", status)
+	}
+	if status, _ := adminClient.do(http.MethodDelete, fmt.Sprintf("/api/admin/users/%d", admin.ID), nil); status != http.StatusConflict {
+		t.Errorf("Admins must not delete themselves, got %d", status)
+	}
+	adminClient.do(http.MethodPut, fmt.Sprintf("/api/admin/users/%d/role", bob.ID), map[string]string{"role": "User"})
+
+	// Disabling ends the sessions and API tokens of the user
+	token, _, _ := apitoken.Create(bob.ID, "script", []string{apitoken.ScopeMailRead}, time.Hour)
+	if status, body := adminClient.do(http.MethodPost, fmt.Sprintf("/api/admin/users/%d/disable", bob.ID), nil); status != http.StatusOK || body["disabled"] != true {
+		t.Fatalf("Disable = %d %v", status, body)
+	}
+	if status, _ := bobClient.do(http.MethodGet, "/api/me", nil); status != http.StatusUnauthorized {
+		t.Errorf("The session of a disabled user must end, got %d", status)
+	}
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/me", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("The API tokens of a disabled user must be refused, got %v %v", resp.StatusCode, err)
+	}
+	if status, _ := bobClient.do(http.MethodPost, "/api/signin", map[string]string{"username": "bob", "password": "password1"}); status != http.StatusForbidden {
+		t.Errorf("A disabled user must not sign in, got %d", status)
+	}
+	adminClient.do(http.MethodPost, fmt.Sprintf("/api/admin/users/%d/enable", bob.ID), nil)
+	bobClient.signIn("bob", "password1")
+
+	// Force logout
+	time.Sleep(time.Millisecond)
+	if status, body := adminClient.do(http.MethodPost, fmt.Sprintf("/api/admin/users/%d/logout", bob.ID), nil); status != http.StatusOK {
+		t.Fatalf("Logout = %d %v", status, body)
+	}
+	if status, _ := bobClient.do(http.MethodGet, "/api/me", nil); status != http.StatusUnauthorized {
+		t.Errorf("Force logout must end the session, got %d", status)
+	}
+	if _, err := apitoken.Authenticate(token); !errors.Is(err, apitoken.ErrInvalid) {
+		t.Errorf("Force logout must revoke the API tokens, got %v", err)
+	}
+	bobClient.signIn("bob", "password1")
+	if status, _ := bobClient.do(http.MethodGet, "/api/me", nil); status != http.StatusOK {
+		t.Errorf("A new session must work after a force logout, got %d", status)
+	}
+
+	// Deletion removes the data of the user
+	apitoken.Create(carolID, "script", []string{apitoken.ScopeMailRead}, time.Hour)
+	if status, body := adminClient.do(http.MethodDelete, fmt.Sprintf("/api/admin/users/%d", carolID), nil); status != http.StatusOK {
+		t.Fatalf("Delete = %d %v", status, body)
+	}
+	if status, _ := adminClient.do(http.MethodGet, fmt.Sprintf("/api/admin/users/%d", carolID), nil); status != http.StatusNotFound {
+		t.Errorf("A deleted user must not be found, got %d", status)
+	}
+	if list, _ := apitoken.List(carolID); len(list) != 0 {
+		t.Errorf("The tokens of a deleted user must be deleted, %d left", len(list))
+	}
+
+	// The last administrator stays
+	if _, err := users.SetRole(0, admin.ID, rbac.RoleUser); !errors.Is(err, users.ErrLastAdmin) {
+		t.Errorf("Demoting the last administrator = %v", err)
+	}
+	if _, err := users.SetDisabled(0, admin.ID, true); !errors.Is(err, users.ErrLastAdmin) {
+		t.Errorf("Disabling the last administrator = %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/labstack/echo/v4"
+	"github.com/lyneq/mailapi/config"
+	"github.com/lyneq/mailapi/db"
+	"github.com/lyneq/mailapi/internal/apitoken"
+	"github.com/lyneq/mailapi/internal/middleware"
+	"github.com/lyneq/mailapi/internal/session"
+	smtpclient "github.com/lyneq/mailapi/internal/smtpClient"
+	"github.com/lyneq/mailapi/internal/verification"
+)
+
+// fakeMailer records the user emails
+type fakeMailer struct {
+	to    []string
+	body  []string
+	froms []string
+	raw   [][]byte
+}
+
+func (m *fakeMailer) Send(msg *smtpclient.OutgoingMessage) error {
+	raw, err := smtpclient.NewClient(smtpclient.SMTPConfig{Host: "localhost", Port: 25}).Compose(msg)
+	if err != nil {
+		return err
+	}
+	m.froms = append(m.froms, msg.Sender())
+	m.to = append(m.to, msg.Recipients()...)
+	m.body = append(m.body, msg.TextBody)
+	m.raw = append(m.raw, raw)
+	return nil
+}
+
+var tokenPattern = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+// lastToken returns the token of the last email
+func (m *fakeMailer) lastToken(t *testing.T) string {
+	t.Helper()
+	if len(m.body) == 0 {
+		t.Fatal("No email was sent")
+	}
+	match := tokenPattern.FindStringSubmatch(m.body[len(m.body)-1])
+	if match == nil {
+		t.Fatalf("No token in %q", m.body[len(m.body)-1])
+	}
+	return match[1]
+}
+
+func setupMailer(t *testing.T) *fakeMailer {
+	t.Helper()
+	previous := config.AppConfig.Users
+	config.AppConfig.Users = config.UsersConfig{
+		From:              "noreply@example.com",
+		VerifyURL:         "https://app.example.com/verify",
+		ResetURL:          "https://app.example.com/reset?lang=en",
+		IdentityVerifyURL: "https://app.example.com/identity",
+	}
+	mailer := &fakeMailer{}
+	verification.SetSender(mailer)
+	t.Cleanup(func() {
+		verification.SetSender(nil)
+		config.AppConfig.Users = previous
+	})
+	return mailer
+}
+
+func TestEmailVerification(t *testing.T) {
+	setupDB(t)
+	mailer := setupMailer(t)
+	server := newAuthServer(t)
+	client := newAPIClient(t, server)
+
+	status, body := client.do(http.MethodPost, "/api/signup", map[string]string{"username": "alice", "password": "password1", "email": " Alice@Example.com"})
+	if status != http.StatusCreated || body["email"] != "alice@example.com" || body["is_verified"] != false {
+		t.Fatalf("Sign up = %d %v", status, body)
+	}
+	if len(mailer.to) != 1 || mailer.to[0] != "alice@example.com" || mailer.froms[0] != "noreply@example.com" {
+		t.Fatalf("Unexpected verification email to %v from %v", mailer.to, mailer.froms)
+	}
+	token := mailer.lastToken(t)
+	if !strings.Contains(mailer.body[0], "https://app.example.com/verify?token="+token) {
+		t.Errorf("The email must link the verification page, got %q", mailer.body[0])
+	}
+
+	var stored db.UserToken
+	db.DB.First(&stored)
+	if stored.Hash == "" || stored.Hash == token || stored.Purpose != verification.PurposeVerifyEmail {
+		t.Errorf("Only a hash of the token must be stored, got %+v", stored)
+	}
+
+	if status, _ := client.do(http.MethodPost, "/api/signup", map[string]string{"username": "mallory", "password": "password1", "email": "ALICE@example.com"}); status != http.StatusBadRequest {
+		t.Errorf("An address of another user must be refused, got %d", status)
+	}
+
+	if status, body := client.do(http.MethodPost, "/api/verify-email", map[string]string{"token": token}); status != http.StatusOK {
+		t.Fatalf("Verify = %d %v", status, body)
+	}
+	var user db.User
+	db.DB.Where("username = ?", "alice").First(&user)
+	if !user.IsVerified {
+		t.Error("The user must be verified")
+	}
+	if status, _ := client.do(http.MethodPost, "/api/verify-email", map[string]string{"token": token}); status != http.StatusBadRequest {
+		t.Errorf("A token must be used once, got %d", status)
+	}
+
+	// Changing the address requires the password and a new verification
+	client.signIn("alice", "password1")
+	if status, _ := client.do(http.MethodPut, "/api/me/email", map[string]string{"email": "new@example.com", "password": "wrong"}); status != http.StatusUnauthorized {
+		t.Errorf("Change with a wrong password = %d", status)
+	}
+	// The previous email was sent less than a minute ago
+	db.DB.Model(&db.UserToken{}).Where("1 = 1").Update("created_at", time.Now().Add(-time.Hour))
+	if status, body := client.do(http.MethodPut, "/api/me/email", map[string]string{"email": "new@example.com", "password": "password1"}); status != http.StatusAccepted {
+		t.Fatalf("Change = %d %v", status, body)
+	}
+	user = db.User{}
+	db.DB.Where("username = ?", "alice").First(&user)
+	if user.Email != "new@example.com" || user.IsVerified || mailer.to[len(mailer.to)-1] != "new@example.com" {
+		t.Errorf("The new address must be unverified until verified, got %+v, emails to %v", user, mailer.to)
+	}
+	if status, _ := client.do(http.MethodPost, "/api/me/email/verify", nil); status != http.StatusTooManyRequests {
+		t.Errorf("Emails must not be sent again within a minute, got %d", status)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	setupDB(t)
+	mailer := setupMailer(t)
+	server := newAuthServer(t)
+	user := createUser(t, "bob", "password1")
+	db.DB.Model(user).Updates(map[string]interface{}{"email": "bob@example.com", "is_verified": true})
+	unverified := createUser(t, "carol", "password1")
+	db.DB.Model(unverified).Update("email", "carol@example.com")
+
+	client := newAPIClient(t, server)
+	for _, email := range []string{"nobody@example.com", "carol@example.com"} {
+		if status, _ := client.do(http.MethodPost, "/api/password/forgot", map[string]string{"email": email}); status != http.StatusAccepted {
+			t.Errorf("Forgot(%s) = %d", email, status)
+		}
+	}
+	if len(mailer.to) != 0 {
+		t.Fatalf("Unknown and unverified addresses must not get emails, sent to %v", mailer.to)
+	}
+
+	client.do(http.MethodPost, "/api/password/forgot", map[string]string{"email": "BOB@example.com"})
+	client.do(http.MethodPost, "/api/password/forgot", map[string]string{"email": "bob@example.com"})
+	if len(mailer.to) != 1 || mailer.to[0] != "bob@example.com" {
+		t.Fatalf("Expected one reset email, sent to %v", mailer.to)
+	}
+	token := mailer.lastToken(t)
+	apiToken, _, err := apitoken.Create(user.ID, "cli", []string{apitoken.ScopeMailSend}, time.Hour)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if !strings.Contains(mailer.body[0], "https://app.example.com/reset?lang=en&token=") {
+		t.Errorf("The email must link the reset page, got %q", mailer.body[0])
+	}
+
+	if status, _ := client.do(http.MethodPost, "/api/password/reset", map[string]string{"token": "unknown", "password": "password2"}); status != http.StatusBadRequest {
+		t.Errorf("Reset with an unknown token = %d", status)
+	}
+	if status, body := client.do(http.MethodPost, "/api/password/reset", map[string]string{"token": token, "password": "password2"}); status != http.StatusOK {
+		t.Fatalf("Reset = %d %v", status, body)
+	}
+	if status, _ := client.do(http.MethodPost, "/api/password/reset", map[string]string{"token": token, "password": "password3"}); status != http.StatusBadRequest {
+		t.Errorf("A reset token must be used once, got %d", status)
+	}
+	if status, _ := client.do(http.MethodPost, "/api/signin", map[string]string{"username": "bob", "password": "password1"}); status != http.StatusUnauthorized {
+		t.Errorf("The old password must be refused, got %d", status)
+	}
+	client.signIn("bob", "password2")
+	if _, err := apitoken.Authenticate(apiToken); !errors.Is(err, apitoken.ErrInvalid) {
+		t.Errorf("API tokens must be revoked by a password reset, got %v", err)
+	}
+
+	// Expired tokens are refused
+	db.DB.Unscoped().Where("1 = 1").Delete(&db.UserToken{})
+	if err := verification.RequestPasswordReset("bob@example.com"); err != nil {
+		t.Fatalf("RequestPasswordReset() error = %v", err)
+	}
+	expired := mailer.lastToken(t)
+	db.DB.Model(&db.UserToken{}).Where("1 = 1").Update("expires_at", time.Now().Add(-time.Minute))
+	if _, err := verification.ResetPassword(expired, "password3"); err != verification.ErrInvalidToken {
+		t.Errorf("An expired token must be refused, got %v", err)
+	}
+}
+
+func TestVerificationEmailFormat(t *testing.T) {
+	setupDB(t)
+	mailer := setupMailer(t)
+	user := createUser(t, `<a href="https://evil.example">bob</a>`, "password1")
+	user.Email = "bob@example.com"
+	db.DB.Save(user)
+
+	if err := verification.SendVerification(user); err != nil {
+		t.Fatalf("SendVerification() error = %v", err)
+	}
+	if err := verification.SendIdentityVerification(user, "sales@example.com"); err != nil {
+		t.Fatalf("SendIdentityVerification() error = %v", err)
+	}
+
+	for _, raw := range mailer.raw {
+		mr, err := mail.CreateReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("The email cannot be parsed: %v", err)
+		}
+		if mediaType, _, _ := mime.ParseMediaType(mr.Header.Get("Content-Type")); mediaType != "text/plain" {
+			t.Errorf("User emails must be plain text only, got %q", mr.Header.Get("Content-Type"))
+		}
+		if bytes.Contains(raw, []byte("text/html")) {
+			t.Errorf("User emails must have no HTML part:\n%s", raw)
+		}
+
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("NextPart() error = %v", err)
+		}
+		body, _ := io.ReadAll(part.Body)
+		// The user name is quoted as text and the lines are kept
+		if !strings.Contains(string(body), user.Username) || !strings.Contains(string(body), "\r\n\r\n") {
+			t.Errorf("Unexpected body %q", body)
+		}
+	}
+}
+
+func TestRequireVerified(t *testing.T) {
+	setupDB(t)
+	previous := config.AppConfig.Users
+	t.Cleanup(func() { config.AppConfig.Users = previous })
+	user := createUser(t, "dave", "password1")
+
+	e := echo.New()
+	e.Use(session.Middleware())
+	e.POST("/signin", func(c echo.Context) error {
+		session.SetSessionCookie(c, user.ID)
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/mail", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, middleware.RequireAuth(""), middleware.RequireVerified())
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	client := newAPIClient(t, server)
+	client.do(http.MethodPost, "/signin", nil)
+
+	config.AppConfig.Users.RequireVerified = false
+	if status, _ := client.do(http.MethodGet, "/mail", nil); status != http.StatusOK {
+		t.Errorf("Unverified users must be allowed by default, got %d", status)
+	}
+	config.AppConfig.Users.RequireVerified = true
+	if status, _ := client.do(http.MethodGet, "/mail", nil); status != http.StatusForbidden {
+		t.Errorf("Unverified users must be denied, got %d", status)
+	}
+	db.DB.Model(user).Update("is_verified", true)
+	if status, _ := client.do(http.MethodGet, "/mail", nil); status != http.StatusOK {
+		t.Errorf("Verified users must be allowed, got %d", status)
+	}
+}